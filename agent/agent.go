@@ -0,0 +1,227 @@
+package agent
+
+import (
+	"cni-demo/consts"
+	"cni-demo/tools/logger"
+	"cni-demo/tools/metrics"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// 健康检查的路由, CNI 插件和 DaemonSet 的探针都用它
+	HEALTH_PATH = consts.DEFAULT_TEST_CNI_API + "/agent/health"
+	// prometheus 拉取指标的路由, 和健康检查在同一个端口上
+	METRICS_PATH = "/metrics"
+	// 默认监听的地址, 和以前的守护进程用的是同一个端口
+	// 上面没有鉴权, 只监听本机, 探针和 CNI 插件都是从本机访问的, 要让 prometheus 从外面拉的话用 -health-addr 改
+	DEFAULT_HEALTH_ADDR = "127.0.0.1:" + consts.DEFAULT_TMP_PORT
+	// 组件退出之后隔多久重新拉起来
+	DEFAULT_RETRY_INTERVAL = 5 * time.Second
+	// 收到退出信号之后最多等多久
+	shutdownTimeout = 10 * time.Second
+	// CNI 插件检查 agent 的时候最多等多久
+	checkTimeout = 2 * time.Second
+)
+
+// running 表示当前进程就是 agent, 这时候 CNI 插件是在 agent 里执行的, 不用再检查自己
+var running int32
+
+// Component 是 agent 里的一个常驻任务, 比如同步 ebpf map, 管理 BIRD, 同步路由
+// Run 要一直阻塞到 stop 被关掉, 中途返回了的话 agent 会隔一会儿重新拉起来
+type Component struct {
+	Name string
+	Run  func(stop <-chan struct{}) error
+	// 组件要在调试端口上提供的接口, key 是路由, 比如流量事件
+	// 这些接口会暴露 pod 的流量, 只有设置了 Agent.DebugAddr 才会提供
+	Handlers map[string]http.Handler
+}
+
+// Agent 是每个节点上常驻的 cni-demo-agent, 以前散落在 CNI ADD 里 fork 出来的守护进程都放到这里
+// 每个节点只管自己, 不需要选主
+type Agent struct {
+	components    []Component
+	addr          string
+	RetryInterval time.Duration
+	// DebugAddr 是提供组件的 Handlers 的地址, 空的话不提供
+	DebugAddr string
+
+	lock   sync.Mutex
+	status map[string]error
+}
+
+func NewAgent(addr string, components ...Component) *Agent {
+	if addr == "" {
+		addr = DEFAULT_HEALTH_ADDR
+	}
+	return &Agent{
+		components:    components,
+		addr:          addr,
+		RetryInterval: DEFAULT_RETRY_INTERVAL,
+		status:        map[string]error{},
+	}
+}
+
+func (a *Agent) setStatus(name string, err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.status[name] = err
+}
+
+// Health 返回不健康的组件以及原因, 都健康的话返回 nil
+func (a *Agent) Health() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	var msgs []string
+	for name, err := range a.status {
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("%s: %s", name, err.Error()))
+		}
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	sort.Strings(msgs)
+	return errors.New(strings.Join(msgs, "; "))
+}
+
+func (a *Agent) healthHandler(w http.ResponseWriter, r *http.Request) {
+	if err := a.Health(); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+// runComponent 运行一个组件, 退出了就隔一会儿重新拉起来, 直到 stop 被关掉
+func (a *Agent) runComponent(c Component, stop <-chan struct{}) {
+	for {
+		a.setStatus(c.Name, nil)
+		err := c.Run(stop)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if err == nil {
+			err = errors.New("意外退出了")
+		}
+		logger.Warn("组件退出了, 准备重新启动", "component", c.Name, "err", err)
+		a.setStatus(c.Name, err)
+		select {
+		case <-time.After(a.RetryInterval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+// healthMux 返回健康检查端口上的路由, 只有健康检查和指标
+func (a *Agent) healthMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc(HEALTH_PATH, a.healthHandler)
+	mux.Handle(METRICS_PATH, metrics.Handler())
+	return mux
+}
+
+// debugMux 返回调试端口上的路由, 没有组件提供接口的话返回 nil
+func (a *Agent) debugMux() *http.ServeMux {
+	var mux *http.ServeMux
+	for _, c := range a.components {
+		for path, handler := range c.Handlers {
+			if mux == nil {
+				mux = http.NewServeMux()
+			}
+			mux.Handle(path, handler)
+		}
+	}
+	return mux
+}
+
+// Run 启动健康检查的服务(配置了 DebugAddr 的话还有调试接口的服务)和所有的组件, 直到 stop 被关掉
+// 关掉之后先停掉健康检查, 让 CNI 插件不再认为 agent 还活着, 再等所有的组件退出
+func (a *Agent) Run(stop <-chan struct{}) error {
+	atomic.StoreInt32(&running, 1)
+	defer atomic.StoreInt32(&running, 0)
+
+	servers := []*http.Server{{Addr: a.addr, Handler: a.healthMux()}}
+	if mux := a.debugMux(); mux != nil {
+		if a.DebugAddr != "" {
+			servers = append(servers, &http.Server{Addr: a.DebugAddr, Handler: mux})
+		} else {
+			logger.Info("没有配置调试接口的地址, 组件提供的接口不会开放")
+		}
+	}
+	serverErr := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) {
+			serverErr <- server.ListenAndServe()
+		}(server)
+	}
+
+	wg := sync.WaitGroup{}
+	for _, c := range a.components {
+		wg.Add(1)
+		go func(c Component) {
+			defer wg.Done()
+			a.runComponent(c, stop)
+		}(c)
+	}
+
+	var err error
+	select {
+	case <-stop:
+	case err = <-serverErr:
+		logger.Error("http 服务退出了", "err", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		server.Shutdown(ctx)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logger.Warn("等待组件退出超时了")
+	}
+	return err
+}
+
+// CheckAlive 由 CNI 插件调用, 确认本机上的 agent 在运行
+// 有组件不健康的时候只记日志, 不影响 pod 的创建, agent 自己会把它拉起来
+func CheckAlive() error {
+	if atomic.LoadInt32(&running) == 1 {
+		return nil
+	}
+	return checkAlive("http://127.0.0.1:" + consts.DEFAULT_TMP_PORT + HEALTH_PATH)
+}
+
+func checkAlive(url string) error {
+	c := &http.Client{Timeout: checkTimeout}
+	resp, err := c.Get(url)
+	if err != nil {
+		return fmt.Errorf("本机上的 cni-demo-agent 没有在运行, 请先部署它: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		logger.Warn("cni-demo-agent 有组件不健康", "status", string(body))
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package agent
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAgent(t *testing.T) {
+	test := assert.New(t)
+
+	var runs int32
+	stopped := make(chan struct{})
+	a := NewAgent("127.0.0.1:0",
+		Component{
+			Name: "flaky",
+			Run: func(stop <-chan struct{}) error {
+				// 第一次直接失败, 第二次开始一直跑到 stop
+				if atomic.AddInt32(&runs, 1) == 1 {
+					return errors.New("boom")
+				}
+				<-stop
+				return nil
+			},
+		},
+		Component{
+			Name: "steady",
+			Run: func(stop <-chan struct{}) error {
+				<-stop
+				close(stopped)
+				return nil
+			},
+		},
+	)
+	a.RetryInterval = 200 * time.Millisecond
+
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- a.Run(stop)
+	}()
+
+	// 失败之后健康检查要报出来
+	time.Sleep(100 * time.Millisecond)
+	test.EqualError(a.Health(), "flaky: boom")
+	rec := httptest.NewRecorder()
+	a.healthHandler(rec, httptest.NewRequest(http.MethodGet, HEALTH_PATH, nil))
+	test.Equal(http.StatusServiceUnavailable, rec.Code)
+
+	// 重新拉起来之后就好了
+	time.Sleep(300 * time.Millisecond)
+	test.Equal(int32(2), atomic.LoadInt32(&runs))
+	test.Nil(a.Health())
+	rec = httptest.NewRecorder()
+	a.healthHandler(rec, httptest.NewRequest(http.MethodGet, HEALTH_PATH, nil))
+	test.Equal(http.StatusOK, rec.Code)
+
+	// 关掉 stop 之后所有的组件都要退出
+	close(stop)
+	select {
+	case err := <-done:
+		test.Nil(err)
+	case <-time.After(time.Second):
+		t.Fatal("agent 没有退出")
+	}
+	select {
+	case <-stopped:
+	default:
+		t.Fatal("组件没有收到 stop")
+	}
+}
+
+func TestCheckAlive(t *testing.T) {
+	test := assert.New(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	// 有组件不健康的时候不影响 CNI
+	test.Nil(checkAlive(srv.URL + HEALTH_PATH))
+	srv.Close()
+	// agent 没在运行的话要报错
+	test.NotNil(checkAlive(srv.URL + HEALTH_PATH))
+}
+
+// 组件提供的接口只在调试端口上, 不能从健康检查的端口访问到
+func TestDebugMux(t *testing.T) {
+	test := assert.New(t)
+
+	a := NewAgent("")
+	test.Equal(DEFAULT_HEALTH_ADDR, a.addr)
+	test.Nil(a.debugMux())
+
+	a = NewAgent("", Component{
+		Name: "flows",
+		Handlers: map[string]http.Handler{"/flows": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("flows"))
+		})},
+	})
+	rec := httptest.NewRecorder()
+	a.healthMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/flows", nil))
+	test.Equal(http.StatusNotFound, rec.Code)
+	rec = httptest.NewRecorder()
+	a.debugMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/flows", nil))
+	test.Equal("flows", rec.Body.String())
+}
@@ -0,0 +1,223 @@
+package agent
+
+import (
+	"bytes"
+	"cni-demo/tools/skel"
+	"cni-demo/tools/utils"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// CNI 插件和 agent 之间通信用的 unix socket
+	CNI_SOCKET_PATH = "/run/cni-demo/cni.sock"
+	CNI_ADD_PATH    = "/cni/add"
+	CNI_DEL_PATH    = "/cni/del"
+	CNI_CHECK_PATH  = "/cni/check"
+	// 一次 ADD 最多等多久, kubelet 那边自己也有超时
+	cniRequestTimeout = 2 * time.Minute
+	// 探测 agent 在不在的时候连 socket 最多等多久
+	cniProbeTimeout = time.Second
+)
+
+// CNIResponse 是 agent 返回给 CNI 插件的结果, Error 不为空表示执行失败了
+type CNIResponse struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// CNIServer 在 unix socket 上接收 CNI 插件转过来的 ADD, DEL 和 CHECK
+// agent 里的 etcd, k8s 客户端和 ipam 的缓存都是常驻的, 不用每次都重新建一遍
+// 同一时间只执行一个请求, 节点上的分配都是串行的, 也不会被 cni manager 里共享的状态坑到
+type CNIServer struct {
+	SocketPath string
+	Add        func(args *skel.CmdArgs) ([]byte, error)
+	Del        func(args *skel.CmdArgs) error
+	Check      func(args *skel.CmdArgs) error
+
+	lock sync.Mutex
+}
+
+func NewCNIServer(socketPath string, add func(args *skel.CmdArgs) ([]byte, error), del, check func(args *skel.CmdArgs) error) *CNIServer {
+	if socketPath == "" {
+		socketPath = CNI_SOCKET_PATH
+	}
+	return &CNIServer{
+		SocketPath: socketPath,
+		Add:        add,
+		Del:        del,
+		Check:      check,
+	}
+}
+
+// handle 把请求里的 CmdArgs 解出来交给 fn 执行, 执行的时候持有锁
+func (s *CNIServer) handle(fn func(args *skel.CmdArgs) ([]byte, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reply := func(code int, resp *CNIResponse) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(code)
+			json.NewEncoder(w).Encode(resp)
+		}
+		if r.Method != http.MethodPost {
+			reply(http.StatusMethodNotAllowed, &CNIResponse{Error: "只支持 POST"})
+			return
+		}
+		args := &skel.CmdArgs{}
+		err := json.NewDecoder(r.Body).Decode(args)
+		if err != nil {
+			reply(http.StatusBadRequest, &CNIResponse{Error: "解析请求失败: " + err.Error()})
+			return
+		}
+
+		s.lock.Lock()
+		result, err := fn(args)
+		s.lock.Unlock()
+		if err != nil {
+			reply(http.StatusInternalServerError, &CNIResponse{Error: err.Error()})
+			return
+		}
+		reply(http.StatusOK, &CNIResponse{Result: result})
+	}
+}
+
+// listen 监听 unix socket, 上次没清理掉的 socket 文件先删掉
+func (s *CNIServer) listen() (net.Listener, error) {
+	err := os.MkdirAll(filepath.Dir(s.SocketPath), 0700)
+	if err != nil {
+		return nil, err
+	}
+	if utils.PathExists(s.SocketPath) {
+		err = os.Remove(s.SocketPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", s.SocketPath)
+	if err != nil {
+		return nil, err
+	}
+	// 只有 root 也就是 kubelet 拉起来的 CNI 插件能连
+	err = os.Chmod(s.SocketPath, 0600)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Run 在 unix socket 上提供服务, 一直阻塞到 stop 被关掉, 可以作为 agent 的一个组件
+// 退出的时候把 socket 文件删掉, CNI 插件发现没有 socket 的时候会自己执行
+func (s *CNIServer) Run(stop <-chan struct{}) error {
+	l, err := s.listen()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(s.SocketPath)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(CNI_ADD_PATH, s.handle(s.Add))
+	mux.HandleFunc(CNI_DEL_PATH, s.handle(func(args *skel.CmdArgs) ([]byte, error) {
+		return nil, s.Del(args)
+	}))
+	mux.HandleFunc(CNI_CHECK_PATH, s.handle(func(args *skel.CmdArgs) ([]byte, error) {
+		return nil, s.Check(args)
+	}))
+	server := &http.Server{Handler: mux}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.Serve(l)
+	}()
+
+	select {
+	case err = <-serverErr:
+		return err
+	case <-stop:
+	}
+	// 正在执行的请求让它做完, 不然 pod 的网络可能只配了一半
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	server.Shutdown(ctx)
+	return nil
+}
+
+// CNIClient 是 CNI 插件这边用来把请求转给 agent 的客户端
+type CNIClient struct {
+	socketPath string
+	client     *http.Client
+}
+
+func NewCNIClient(socketPath string) *CNIClient {
+	if socketPath == "" {
+		socketPath = CNI_SOCKET_PATH
+	}
+	return &CNIClient{
+		socketPath: socketPath,
+		client: &http.Client{
+			Timeout: cniRequestTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+}
+
+// Available 看 agent 有没有在提供 CNI 的服务, 没有的话 CNI 插件自己执行
+// 只看 socket 文件在不在是不够的, agent 崩溃之后文件会留下来, 连上去是 ECONNREFUSED, 所以这里真的连一次
+func (c *CNIClient) Available() bool {
+	conn, err := net.DialTimeout("unix", c.socketPath, cniProbeTimeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func (c *CNIClient) do(path string, args *skel.CmdArgs) ([]byte, error) {
+	body, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+	// host 随便填, 真正连的是 unix socket
+	resp, err := c.client.Post("http://cni-demo-agent"+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("连接 cni-demo-agent 失败: %v", err)
+	}
+	defer resp.Body.Close()
+	res := &CNIResponse{}
+	err = json.NewDecoder(resp.Body).Decode(res)
+	if err != nil {
+		return nil, fmt.Errorf("解析 cni-demo-agent 的返回失败, status: %d, err: %v", resp.StatusCode, err)
+	}
+	if res.Error != "" {
+		return nil, errors.New(res.Error)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("cni-demo-agent 返回了 %d", resp.StatusCode)
+	}
+	return res.Result, nil
+}
+
+// Add 把 ADD 转给 agent, 返回的是可以直接打印到标准输出的结果
+func (c *CNIClient) Add(args *skel.CmdArgs) ([]byte, error) {
+	return c.do(CNI_ADD_PATH, args)
+}
+
+func (c *CNIClient) Del(args *skel.CmdArgs) error {
+	_, err := c.do(CNI_DEL_PATH, args)
+	return err
+}
+
+func (c *CNIClient) Check(args *skel.CmdArgs) error {
+	_, err := c.do(CNI_CHECK_PATH, args)
+	return err
+}
@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"cni-demo/tools/skel"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCNIServer(t *testing.T) {
+	test := assert.New(t)
+	socketPath := filepath.Join(t.TempDir(), "cni.sock")
+
+	var inflight, maxInflight int32
+	add := func(args *skel.CmdArgs) ([]byte, error) {
+		// 同一时间只能有一个请求在执行
+		n := atomic.AddInt32(&inflight, 1)
+		if n > atomic.LoadInt32(&maxInflight) {
+			atomic.StoreInt32(&maxInflight, n)
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&inflight, -1)
+		return []byte(`{"cniVersion":"0.3.0","ips":[{"address":"10.244.1.2/32"}]}`), nil
+	}
+	del := func(args *skel.CmdArgs) error {
+		if args.ContainerID == "missing" {
+			return errors.New("容器不存在")
+		}
+		return nil
+	}
+	check := func(args *skel.CmdArgs) error {
+		return nil
+	}
+
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- NewCNIServer(socketPath, add, del, check).Run(stop)
+	}()
+
+	client := NewCNIClient(socketPath)
+	for i := 0; i < 50 && !client.Available(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.True(client.Available())
+
+	args := &skel.CmdArgs{ContainerID: "abc", Netns: "/var/run/netns/abc", IfName: "eth0", StdinData: []byte(`{"mode":"vxlan"}`)}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := client.Add(args)
+			test.Nil(err)
+			test.JSONEq(`{"cniVersion":"0.3.0","ips":[{"address":"10.244.1.2/32"}]}`, string(result))
+		}()
+	}
+	wg.Wait()
+	test.Equal(int32(1), atomic.LoadInt32(&maxInflight))
+
+	test.Nil(client.Del(args))
+	test.EqualError(client.Del(&skel.CmdArgs{ContainerID: "missing"}), "容器不存在")
+	test.Nil(client.Check(args))
+
+	// 退出之后 socket 文件要删掉, CNI 插件才会自己执行
+	close(stop)
+	select {
+	case err := <-done:
+		test.Nil(err)
+	case <-time.After(time.Second):
+		t.Fatal("cni server 没有退出")
+	}
+	test.False(client.Available())
+}
+
+func TestCNIClientStaleSocket(t *testing.T) {
+	test := assert.New(t)
+	socketPath := filepath.Join(t.TempDir(), "cni.sock")
+
+	client := NewCNIClient(socketPath)
+	test.False(client.Available())
+
+	// agent 崩溃之后 socket 文件还在, 但是已经没人 listen 了
+	listener, err := net.Listen("unix", socketPath)
+	test.Nil(err)
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	_, err = os.Stat(socketPath)
+	test.Nil(err)
+	test.False(client.Available())
+}
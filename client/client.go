@@ -2,14 +2,12 @@ package client
 
 import (
 	"cni-demo/consts"
-	"crypto/tls"
-	"crypto/x509"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	v1 "k8s.io/api/core/v1"
 	"net/http"
+	"strings"
 )
 
 type Get struct {
@@ -17,8 +15,15 @@ type Get struct {
 	client      *LightK8sClient // 自定义 K8s 客户端
 }
 
+// Set 负责往 apiserver 写数据, 目前只有自定义资源会用到
+type Set struct {
+	httpsClient *http.Client    // https 客户端
+	client      *LightK8sClient // 自定义 K8s 客户端
+}
+
 type operators struct {
 	Get *Get // Get 操作
+	Set *Set // Set 操作
 }
 
 type operator struct {
@@ -27,12 +32,11 @@ type operator struct {
 
 // LightK8sClient 是一个自定义的 Kubernetes 客户端，用于与 K8s API Server 进行交互
 type LightK8sClient struct {
-	caCertPath, certFile, keyFile string         // 证书文件路径
-	pool                          *x509.CertPool // 证书池
-	client                        *http.Client   // http 客户端
-	masterEndpoint                string         // Kubernetes API Server 地址
-	kubeApi                       string         // Kubernetes API
-	*operator                                    // operator 结构体指针
+	config         *Config      // 连接 apiserver 的配置
+	client         *http.Client // http 客户端
+	masterEndpoint string       // Kubernetes API Server 地址
+	kubeApi        string       // Kubernetes API
+	*operator                   // operator 结构体指针
 }
 
 // getGet 函数返回一个 Get 类型的单例
@@ -52,16 +56,51 @@ var getGet = func() func() *Get {
 	}
 }()
 
+// getSet 函数返回一个 Set 类型的单例
+var getSet = func() func() *Set {
+	var _set *Set
+	return func() *Set {
+		if _set != nil {
+			return _set
+		}
+		_set = &Set{}
+		client, _ := GetLightK8sClient()
+		if client != nil {
+			_set.httpsClient = client.client
+		}
+		_set.client = client
+		return _set
+	}
+}()
+
 // getRoute 函数用于生成 API 请求的 URL
 func (get *Get) getRoute(api string) string {
 	return get.client.masterEndpoint + get.client.kubeApi + api
 }
 
+// getGroupRoute 函数用于生成非 core 组的 API 请求的 URL, 比如 networking.k8s.io/v1
+func (get *Get) getGroupRoute(groupVersion, api string) string {
+	return get.client.masterEndpoint + consts.KUBE_APIS + "/" + groupVersion + api
+}
+
+// getNamespacedApi 生成带 namespace 的路径, namespace 为空的话表示所有的 namespace
+func getNamespacedApi(namespace, resource string) string {
+	if namespace == "" {
+		return "/" + resource
+	}
+	return fmt.Sprintf("/namespaces/%s/%s", namespace, resource)
+}
+
 // Get 方法返回一个 Get 结构体
 func (o *operator) Get() *Get {
 	return getGet()
 }
 
+// Set 方法返回一个 Set 结构体
+func (o *operator) Set() *Set {
+	return getSet()
+}
+
 // getBody 函数用于从 http.Response 中读取响应体并返回
 func (get *Get) getBody(resp *http.Response) ([]byte, error) {
 	defer resp.Body.Close()
@@ -73,93 +112,71 @@ func (get *Get) getBody(resp *http.Response) ([]byte, error) {
 	return body, nil
 }
 
-// Nodes 方法用于获取集群中所有节点的信息
-func (get *Get) Nodes() (*v1.NodeList, error) {
-	url := get.getRoute("/nodes?limit=500")
-	resp, err := get.httpsClient.Get(url)
-	if err != nil {
-		return nil, err
-	}
-	body, err := get.getBody(resp)
-	if err != nil {
-		return nil, err
-	}
-	var nodes *v1.NodeList
-	err = json.Unmarshal(body, &nodes)
-	if err != nil {
-		return nil, err
-	}
-	return nodes, nil
-}
-
 // Node 方法用于获取指定节点的信息
 func (get *Get) Node(name string) (*v1.Node, error) {
-	url := get.getRoute(fmt.Sprintf("/nodes/%s", name))
-	resp, err := get.httpsClient.Get(url)
+	var node *v1.Node
+	err := get.getObject(get.getRoute(fmt.Sprintf("/nodes/%s", name)), &node)
 	if err != nil {
 		return nil, err
 	}
-	body, err := get.getBody(resp)
+	return node, nil
+}
+
+// Endpoints 方法用于获取指定 namespace 下的 Endpoints
+func (get *Get) Endpoints(namespace, name string) (*v1.Endpoints, error) {
+	var endpoints *v1.Endpoints
+	err := get.getObject(get.getRoute(getNamespacedApi(namespace, "endpoints")+"/"+name), &endpoints)
 	if err != nil {
 		return nil, err
 	}
-	var node *v1.Node
-	err = json.Unmarshal(body, &node)
+	return endpoints, nil
+}
+
+var __GetLightK8sClient func() (*LightK8sClient, error)
+
+// newLightK8sClient 函数根据 Config 创建 LightK8sClient
+func newLightK8sClient(config *Config) (*LightK8sClient, error) {
+	_client, err := config.httpClient()
 	if err != nil {
 		return nil, err
 	}
-	return node, nil
+	return &LightK8sClient{
+		config:         config,
+		client:         _client,
+		kubeApi:        consts.KUBE_API,
+		masterEndpoint: strings.TrimSuffix(config.Host, "/"),
+	}, nil
 }
 
-var __GetLightK8sClient func() (*LightK8sClient, error)
-
 // _GetLightK8sClient 函数用于初始化 LightK8sClient
 func _GetLightK8sClient(caCertPath, certFile, keyFile string) func() (*LightK8sClient, error) {
 	return func() (*LightK8sClient, error) {
-		var client *LightK8sClient
-		if client != nil {
-			return client, nil
-		} else {
-			// 读取 k8s 的证书
-			caCrt, err := ioutil.ReadFile(caCertPath)
-			if err != nil {
-				return nil, err
-			}
-			// new 个 pool
-			pool := x509.NewCertPool()
-			// 解析一系列PEM编码的证书, 从 base64 中解析证书到池子中
-			pool.AppendCertsFromPEM(caCrt)
-			// 加载客户端的证书和私钥
-			cliCrt, err := tls.LoadX509KeyPair(certFile, keyFile)
-			if err != nil {
-				return nil, err
-			}
-			// 创建一个 https 客户端
-			_client := &http.Client{
-				Transport: &http.Transport{
-					TLSClientConfig: &tls.Config{
-						RootCAs:      pool,
-						Certificates: []tls.Certificate{cliCrt},
-					},
-				},
-			}
-
-			masterEndpoint, err := GetMasterEndpoint()
-			if err != nil {
-				return nil, err
-			}
-			client = &LightK8sClient{
-				caCertPath:     caCertPath,
-				certFile:       certFile,
-				keyFile:        keyFile,
-				pool:           pool,
-				client:         _client,
-				kubeApi:        consts.KUBE_API,
-				masterEndpoint: masterEndpoint,
-			}
+		masterEndpoint, err := GetMasterEndpoint()
+		if err != nil {
+			return nil, err
+		}
+		return newLightK8sClient(&Config{
+			Host:     masterEndpoint,
+			CAFile:   caCertPath,
+			CertFile: certFile,
+			KeyFile:  keyFile,
+		})
+	}
+}
 
+// _GetLightK8sClientWithConfig 函数用于根据 Config 初始化 LightK8sClient, 只会创建一次
+func _GetLightK8sClientWithConfig(config *Config) func() (*LightK8sClient, error) {
+	var client *LightK8sClient
+	return func() (*LightK8sClient, error) {
+		if client != nil {
 			return client, nil
 		}
+		_client, err := newLightK8sClient(config)
+		if err != nil {
+			return nil, err
+		}
+		client = _client
+		return client, nil
 	}
 }
 
@@ -176,9 +193,30 @@ func GetLightK8sClient() (*LightK8sClient, error) {
 	return lightK8sClient, nil
 }
 
-// Init 函数用于初始化 LightK8sClient
+// Init 函数用于用本机上的证书文件初始化 LightK8sClient, apiserver 的地址从 kubeconfig 里拿
 func Init(caCertPath, certFile, keyFile string) {
 	if __GetLightK8sClient == nil {
 		__GetLightK8sClient = _GetLightK8sClient(caCertPath, certFile, keyFile)
 	}
 }
+
+// InitWithConfig 函数用于用 Config 初始化 LightK8sClient
+func InitWithConfig(config *Config) {
+	if __GetLightK8sClient == nil {
+		__GetLightK8sClient = _GetLightK8sClientWithConfig(config)
+	}
+}
+
+// InitDefault 函数用 DefaultConfig 找到的配置初始化 LightK8sClient
+// 在集群里以 pod 的形式跑的时候用 service account, 否则用本机的 kubeconfig
+func InitDefault() error {
+	if __GetLightK8sClient != nil {
+		return nil
+	}
+	config, err := DefaultConfig()
+	if err != nil {
+		return err
+	}
+	InitWithConfig(config)
+	return nil
+}
@@ -2,17 +2,20 @@ package client
 
 import (
 	"cni-demo/consts"
+	"cni-demo/tools/logger"
 	utils2 "cni-demo/tools/utils"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"github.com/dlclark/regexp2"
 	"io/ioutil"
+	"net/url"
 )
 
 // GetClientConfigPath 函数尝试按以下顺序查找配置文件路径：
 // 1. admin.conf
 // 2. kubelet.conf
-// 3. ~/.kube/conf
+// 3. ~/.kube/config
 // 如果都找不到，则返回默认的 consts.KUBE_LOCAL_DEFAULT_PATH
 func GetClientConfigPath() string {
 	clusterConfPath := consts.KUBE_LOCAL_DEFAULT_PATH
@@ -26,32 +29,72 @@ func GetClientConfigPath() string {
 
 // GetMasterEndpoint 函数尝试从上述的配置文件路径中读取 master endpoint。
 func GetMasterEndpoint() (string, error) {
-	// 先尝试去捞 admin.conf, 没有的话就用 kubelet.conf, 再没有的话就用 ~/.kube/conf
+	// 先尝试去捞 admin.conf, 没有的话就用 kubelet.conf, 再没有的话就用 ~/.kube/config
 	clusterConfPath := GetClientConfigPath()
-	confByte, err := ioutil.ReadFile(clusterConfPath)
+	config, err := LoadKubeconfig(clusterConfPath, "")
 	if err != nil {
-		utils2.WriteLog("读取 path: ", clusterConfPath, " 失败: ", err.Error())
+		logger.Error("读取文件失败", "path", clusterConfPath, "err", err)
 		return "", err
 	}
-	masterEndpoint, err := GetLineFromYaml(string(confByte), "server")
+	return config.Host, nil
+}
+
+// GetAPIServerHost 返回 apiserver 所在机器的地址(不带端口)
+// 在 pod 里的时候 service account 的配置里只有 kubernetes 这个 service 的 clusterIP, 真实的地址要从 default/kubernetes 的 endpoints 里拿
+// 不在集群里的话和以前一样从本机的 kubeconfig 里拿
+func GetAPIServerHost() (string, error) {
+	config, err := InClusterConfig()
+	if err == ErrNotInCluster {
+		master, err := GetMasterEndpoint()
+		if err != nil {
+			return "", err
+		}
+		u, err := url.Parse(master)
+		if err != nil {
+			return "", err
+		}
+		if u.Hostname() == "" {
+			return "", errors.New("从 apiserver 的地址 " + master + " 中获取不到主机名")
+		}
+		return u.Hostname(), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	c, err := newLightK8sClient(config)
 	if err != nil {
-		utils2.WriteLog("读取 path: ", clusterConfPath, " 失败: ", err.Error())
 		return "", err
 	}
-	return masterEndpoint, nil
+	return apiServerHost(&Get{httpsClient: c.client, client: c})
+}
+
+// apiServerHost 从 default/kubernetes 的 endpoints 里拿第一个 apiserver 的地址
+func apiServerHost(get *Get) (string, error) {
+	endpoints, err := get.Endpoints(consts.KUBE_DEFAULT_NAMESPACE, consts.KUBE_API_SERVICE_NAME)
+	if err != nil {
+		return "", err
+	}
+	for _, subset := range endpoints.Subsets {
+		for _, addr := range subset.Addresses {
+			if addr.IP != "" {
+				return addr.IP, nil
+			}
+		}
+	}
+	return "", errors.New("default/kubernetes 的 endpoints 里没有 apiserver 的地址")
 }
 
 // GetLineFromYaml 函数从给定的 yaml 字符串中根据键值提取对应的内容。
 func GetLineFromYaml(yaml string, key string) (string, error) {
 	r, err := regexp2.Compile(fmt.Sprintf(`(?<=%s: )(.*)`, key), 0)
 	if err != nil {
-		utils2.WriteLog("初始化正则表达式失败, err: ", err.Error())
+		logger.Error("初始化正则表达式失败", "err", err)
 		return "", err
 	}
 
 	res, err := r.FindStringMatch(yaml)
 	if err != nil {
-		utils2.WriteLog("正则匹配 ip 失败, err: ", err.Error())
+		logger.Error("正则匹配 ip 失败", "err", err)
 		return "", err
 	}
 	return res.String(), nil
@@ -65,6 +108,7 @@ type AuthenticationInfoPath struct {
 }
 
 // GetHostAuthenticationInfoPath 函数获取主机上的认证信息文件的路径。
+// 它会把 kubeconfig 里的证书解出来放到 /opt/cni-demo 下, 只有用 Init 的时候才需要, 新代码用 InitDefault 就行。
 func GetHostAuthenticationInfoPath() (*AuthenticationInfoPath, error) {
 	paths := &AuthenticationInfoPath{}
 	if !utils2.PathExists(consts.KUBE_TEST_CNI_DEFAULT_PATH) {
@@ -98,9 +142,9 @@ func GetHostAuthenticationInfoPath() (*AuthenticationInfoPath, error) {
 	}
 	clusterConfPath := GetClientConfigPath()
 
-	confByte, err := ioutil.ReadFile(clusterConfPath)
+	confByte, err := ioutil.ReadFile(expandHome(clusterConfPath))
 	if err != nil {
-		utils2.WriteLog("读取 path: ", clusterConfPath, " 失败: ", err.Error())
+		logger.Error("读取文件失败", "path", clusterConfPath, "err", err)
 		return nil, err
 	}
 
@@ -0,0 +1,174 @@
+package client
+
+import (
+	"cni-demo/consts"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotInCluster 表示当前不是跑在 k8s 的 pod 里
+var ErrNotInCluster = errors.New("没有 KUBERNETES_SERVICE_HOST 和 KUBERNETES_SERVICE_PORT, 不是在集群中运行")
+
+// token 文件多久重新读一次, service account 的 token 会被 kubelet 定期轮换
+const tokenRefreshInterval = time.Minute
+
+// Config 是连接 apiserver 需要的全部信息
+// 证书和 token 既可以直接给内容也可以给文件路径, 都给了的话用内容
+type Config struct {
+	Host string
+
+	CAData   []byte
+	CAFile   string
+	CertData []byte
+	CertFile string
+	KeyData  []byte
+	KeyFile  string
+
+	BearerToken string
+	// BearerTokenFile 不为空的话会定期重新读, 读到的 token 优先于 BearerToken
+	BearerTokenFile string
+
+	Insecure bool
+}
+
+// InClusterConfig 生成在 pod 里访问 apiserver 的配置, 用的是 pod 的 service account
+func InClusterConfig() (*Config, error) {
+	host := os.Getenv(consts.KUBE_SERVICE_HOST_ENV)
+	port := os.Getenv(consts.KUBE_SERVICE_PORT_ENV)
+	if host == "" || port == "" {
+		return nil, ErrNotInCluster
+	}
+	token, err := ioutil.ReadFile(consts.KUBE_SERVICE_ACCOUNT_TOKEN_PATH)
+	if err != nil {
+		return nil, err
+	}
+	return &Config{
+		Host:            "https://" + net.JoinHostPort(host, port),
+		CAFile:          consts.KUBE_SERVICE_ACCOUNT_CA_PATH,
+		BearerToken:     strings.TrimSpace(string(token)),
+		BearerTokenFile: consts.KUBE_SERVICE_ACCOUNT_TOKEN_PATH,
+	}, nil
+}
+
+// DefaultConfig 按以下顺序找一个能用的配置:
+// 1. 在 pod 里的话用 service account
+// 2. KUBECONFIG 环境变量指定的 kubeconfig
+// 3. admin.conf, kubelet.conf, ~/.kube/config 中第一个存在的
+func DefaultConfig() (*Config, error) {
+	config, err := InClusterConfig()
+	if err == nil {
+		return config, nil
+	}
+	if err != ErrNotInCluster {
+		return nil, err
+	}
+	if env := os.Getenv(consts.KUBECONFIG_ENV); env != "" {
+		// 和 kubectl 不一样, 这里不做合并, 只用第一个
+		return LoadKubeconfig(strings.Split(env, string(os.PathListSeparator))[0], "")
+	}
+	return LoadKubeconfig(GetClientConfigPath(), "")
+}
+
+// tlsConfig 根据证书生成 tls 的配置
+func (c *Config) tlsConfig() (*tls.Config, error) {
+	conf := &tls.Config{InsecureSkipVerify: c.Insecure}
+
+	ca := c.CAData
+	if len(ca) == 0 && c.CAFile != "" {
+		var err error
+		ca, err = ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(ca) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("解析 apiserver 的 ca 证书失败")
+		}
+		conf.RootCAs = pool
+	}
+
+	var cert tls.Certificate
+	var err error
+	switch {
+	case len(c.CertData) > 0 && len(c.KeyData) > 0:
+		cert, err = tls.X509KeyPair(c.CertData, c.KeyData)
+	case c.CertFile != "" && c.KeyFile != "":
+		cert, err = tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	default:
+		return conf, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	conf.Certificates = []tls.Certificate{cert}
+	return conf, nil
+}
+
+// httpClient 根据配置生成访问 apiserver 的 http 客户端
+func (c *Config) httpClient() (*http.Client, error) {
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	var transport http.RoundTripper = &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+	}
+	if c.BearerToken != "" || c.BearerTokenFile != "" {
+		transport = &bearerAuthRoundTripper{
+			token:     c.BearerToken,
+			tokenFile: c.BearerTokenFile,
+			rt:        transport,
+		}
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// bearerAuthRoundTripper 给每个请求加上 Authorization: Bearer 的头
+type bearerAuthRoundTripper struct {
+	token     string
+	tokenFile string
+	rt        http.RoundTripper
+
+	lock    sync.Mutex
+	expires time.Time
+}
+
+// getToken 返回当前的 token, 有 tokenFile 的话隔一段时间重新读一次, 读失败了就继续用上一次的
+func (b *bearerAuthRoundTripper) getToken() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.tokenFile == "" || time.Now().Before(b.expires) {
+		return b.token
+	}
+	token, err := ioutil.ReadFile(b.tokenFile)
+	if err == nil {
+		b.token = strings.TrimSpace(string(token))
+		b.expires = time.Now().Add(tokenRefreshInterval)
+	}
+	return b.token
+}
+
+func (b *bearerAuthRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Authorization") != "" {
+		return b.rt.RoundTrip(req)
+	}
+	token := b.getToken()
+	if token == "" {
+		return b.rt.RoundTrip(req)
+	}
+	// RoundTripper 不能改传进来的请求, 要复制一份
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return b.rt.RoundTrip(req)
+}
@@ -0,0 +1,127 @@
+package client
+
+import (
+	"cni-demo/consts"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testKubeconfig = `
+apiVersion: v1
+kind: Config
+current-context: admin@test
+clusters:
+- name: test
+  cluster:
+    server: https://192.168.98.143:6443
+    certificate-authority-data: %s
+- name: other
+  cluster:
+    server: https://10.0.0.1:6443
+    certificate-authority: pki/ca.crt
+contexts:
+- name: admin@test
+  context:
+    cluster: test
+    user: admin
+- name: reader@other
+  context:
+    cluster: other
+    user: reader
+- name: exec@other
+  context:
+    cluster: other
+    user: exec
+users:
+- name: admin
+  user:
+    client-certificate-data: %s
+    client-key-data: %s
+- name: reader
+  user:
+    token: abc
+    tokenFile: /var/run/token
+- name: exec
+  user:
+    exec:
+      command: aws
+`
+
+func encode(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func TestParseKubeconfig(t *testing.T) {
+	test := assert.New(t)
+	data := []byte(fmt.Sprintf(testKubeconfig, encode("ca"), encode("cert"), encode("key")))
+
+	config, err := ParseKubeconfig(data, "/etc/kubernetes", "")
+	test.Nil(err)
+	test.Equal(&Config{
+		Host:     "https://192.168.98.143:6443",
+		CAData:   []byte("ca"),
+		CertData: []byte("cert"),
+		KeyData:  []byte("key"),
+	}, config)
+
+	// 相对路径是相对于 kubeconfig 所在目录的
+	config, err = ParseKubeconfig(data, "/etc/kubernetes", "reader@other")
+	test.Nil(err)
+	test.Equal(&Config{
+		Host:            "https://10.0.0.1:6443",
+		CAFile:          "/etc/kubernetes/pki/ca.crt",
+		BearerToken:     "abc",
+		BearerTokenFile: "/var/run/token",
+	}, config)
+
+	_, err = ParseKubeconfig(data, "/etc/kubernetes", "exec@other")
+	test.NotNil(err)
+	_, err = ParseKubeconfig(data, "/etc/kubernetes", "nope")
+	test.NotNil(err)
+}
+
+func TestInClusterConfig(t *testing.T) {
+	test := assert.New(t)
+	os.Unsetenv(consts.KUBE_SERVICE_HOST_ENV)
+	_, err := InClusterConfig()
+	test.Equal(ErrNotInCluster, err)
+}
+
+func TestBearerAuth(t *testing.T) {
+	test := assert.New(t)
+
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		w.Write([]byte(`{"metadata":{"name":"node1"}}`))
+	}))
+	defer srv.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	test.Nil(ioutil.WriteFile(tokenFile, []byte("from-file\n"), 0600))
+
+	for _, c := range []struct {
+		config *Config
+		want   string
+	}{
+		{&Config{Host: srv.URL}, ""},
+		{&Config{Host: srv.URL, BearerToken: "static"}, "Bearer static"},
+		{&Config{Host: srv.URL + "/", BearerToken: "static", BearerTokenFile: tokenFile}, "Bearer from-file"},
+	} {
+		k8s, err := newLightK8sClient(c.config)
+		test.Nil(err)
+		get := &Get{httpsClient: k8s.client, client: k8s}
+		node, err := get.Node("node1")
+		test.Nil(err)
+		test.Equal("node1", node.Name)
+		test.Equal(c.want, auth)
+	}
+}
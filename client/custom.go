@@ -0,0 +1,167 @@
+package client
+
+import (
+	"bytes"
+	"cni-demo/consts"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CustomResource 描述一种集群级别的自定义资源
+type CustomResource struct {
+	Group   string
+	Version string
+	Plural  string
+}
+
+func (res CustomResource) GroupVersion() string {
+	return res.Group + "/" + res.Version
+}
+
+// IsConflict 判断是不是 409, 更新的时候 resourceVersion 对不上或者创建的时候已经存在了都是 409
+func IsConflict(err error) bool {
+	var statusErr *StatusError
+	return errors.As(err, &statusErr) && statusErr.Code == http.StatusConflict
+}
+
+// getCustomRoute 生成自定义资源的 url, name 为空的话是整个集合
+func (get *Get) getCustomRoute(res CustomResource, name string) string {
+	api := "/" + res.Plural
+	if name != "" {
+		api += "/" + name
+	}
+	return get.getGroupRoute(res.GroupVersion(), api)
+}
+
+// Custom 方法用于获取一个自定义资源, 不存在的话返回的错误可以用 IsNotFound 判断
+func (get *Get) Custom(res CustomResource, name string, out interface{}) error {
+	return get.getObject(get.getCustomRoute(res, name), out)
+}
+
+// ListCustom 方法分页获取某种自定义资源的全部对象, 每个对象都是原始的 json, 由调用方自己解析
+// 返回的 resourceVersion 可以直接拿去 watch
+func (get *Get) ListCustom(res CustomResource, opts *ListOptions) ([]json.RawMessage, string, error) {
+	var items []json.RawMessage
+	meta, err := get.listAll(get.getCustomRoute(res, ""), opts, func() { items = nil }, func(body []byte) (*metav1.ListMeta, error) {
+		page := &struct {
+			Metadata metav1.ListMeta   `json:"metadata"`
+			Items    []json.RawMessage `json:"items"`
+		}{}
+		if err := json.Unmarshal(body, page); err != nil {
+			return nil, err
+		}
+		items = append(items, page.Items...)
+		return &page.Metadata, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return items, meta.ResourceVersion, nil
+}
+
+// WatchCustom 方法用于 watch 某种自定义资源, opts 里只有 LabelSelector 和 FieldSelector 会生效
+func (get *Get) WatchCustom(res CustomResource, opts *ListOptions, resourceVersion string, handler WatchHandler) (func(), <-chan struct{}, error) {
+	route := get.getCustomRoute(res, "")
+	if opts != nil {
+		values := url.Values{}
+		if opts.LabelSelector != "" {
+			values.Set("labelSelector", opts.LabelSelector)
+		}
+		if opts.FieldSelector != "" {
+			values.Set("fieldSelector", opts.FieldSelector)
+		}
+		if len(values) > 0 {
+			route += "?" + values.Encode()
+		}
+	}
+	return get.watch(route, resourceVersion, handler)
+}
+
+// CustomListWatch 返回某种自定义资源的 ListWatch, 每次 list 完都会调用 onList
+func (get *Get) CustomListWatch(res CustomResource, opts *ListOptions, onList func(items []json.RawMessage)) *ListWatch {
+	return &ListWatch{
+		List: func() (string, error) {
+			items, rv, err := get.ListCustom(res, opts)
+			if err != nil {
+				return "", err
+			}
+			onList(items)
+			return rv, nil
+		},
+		Watch: func(resourceVersion string, handler WatchHandler) (func(), <-chan struct{}, error) {
+			return get.WatchCustom(res, opts, resourceVersion, handler)
+		},
+	}
+}
+
+// do 发一个带 json body 的请求, 非 2xx 的时候返回 StatusError
+func (set *Set) do(method, url string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		body, err = json.Marshal(in)
+		if err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := set.httpsClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody := &bytes.Buffer{}
+	_, err = respBody.ReadFrom(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &StatusError{URL: url, Code: resp.StatusCode, Body: respBody.String()}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(respBody.Bytes(), out)
+}
+
+func (set *Set) getCustomRoute(res CustomResource, name string) string {
+	return (&Get{client: set.client}).getCustomRoute(res, name)
+}
+
+// CreateCustom 方法用于创建一个自定义资源, 已经存在的话返回的错误可以用 IsConflict 判断
+func (set *Set) CreateCustom(res CustomResource, obj, out interface{}) error {
+	return set.do(http.MethodPost, set.getCustomRoute(res, ""), obj, out)
+}
+
+// UpdateCustom 方法用于更新一个自定义资源, obj 里要带上读出来时的 resourceVersion
+// 期间被别人改过的话 apiserver 会返回 409, 可以用 IsConflict 判断之后重新读一遍再改
+func (set *Set) UpdateCustom(res CustomResource, name string, obj, out interface{}) error {
+	return set.do(http.MethodPut, set.getCustomRoute(res, name), obj, out)
+}
+
+// DeleteCustom 方法用于删除一个自定义资源, 不存在的话不算错
+func (set *Set) DeleteCustom(res CustomResource, name string) error {
+	err := set.do(http.MethodDelete, set.getCustomRoute(res, name), nil, nil)
+	if IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// CreateCustomResourceDefinition 方法用于创建 CRD, 已经存在的话什么也不做
+func (set *Set) CreateCustomResourceDefinition(crd interface{}) error {
+	url := set.client.masterEndpoint + consts.KUBE_APIS + "/" + consts.KUBE_APIEXTENSIONS_GROUP_VERSION + "/customresourcedefinitions"
+	err := set.do(http.MethodPost, url, crd, nil)
+	if IsConflict(err) {
+		return nil
+	}
+	return err
+}
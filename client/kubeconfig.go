@@ -0,0 +1,168 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// 下面这些结构体只包含了 kubeconfig 中用得到的字段
+// []byte 类型的字段在 json 里是 base64 编码的字符串, 正好对应 xxx-data 的格式
+
+type kubeconfigCluster struct {
+	Server                   string `json:"server"`
+	CertificateAuthority     string `json:"certificate-authority"`
+	CertificateAuthorityData []byte `json:"certificate-authority-data"`
+	InsecureSkipTLSVerify    bool   `json:"insecure-skip-tls-verify"`
+}
+
+type kubeconfigUser struct {
+	ClientCertificate     string          `json:"client-certificate"`
+	ClientCertificateData []byte          `json:"client-certificate-data"`
+	ClientKey             string          `json:"client-key"`
+	ClientKeyData         []byte          `json:"client-key-data"`
+	Token                 string          `json:"token"`
+	TokenFile             string          `json:"tokenFile"`
+	Exec                  json.RawMessage `json:"exec"`
+	AuthProvider          json.RawMessage `json:"auth-provider"`
+}
+
+type kubeconfigContext struct {
+	Cluster string `json:"cluster"`
+	User    string `json:"user"`
+}
+
+type kubeconfig struct {
+	CurrentContext string `json:"current-context"`
+	Clusters       []struct {
+		Name    string            `json:"name"`
+		Cluster kubeconfigCluster `json:"cluster"`
+	} `json:"clusters"`
+	Users []struct {
+		Name string         `json:"name"`
+		User kubeconfigUser `json:"user"`
+	} `json:"users"`
+	Contexts []struct {
+		Name    string            `json:"name"`
+		Context kubeconfigContext `json:"context"`
+	} `json:"contexts"`
+}
+
+// expandHome 把路径开头的 ~ 换成用户的 home 目录
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
+
+// resolvePath kubeconfig 里的相对路径是相对于 kubeconfig 所在目录的
+func resolvePath(dir, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// findContext 找到要用的 context, 没有指定并且也没有 current-context 的时候, 只有一个 context 的话就用它
+func (k *kubeconfig) findContext(name string) (*kubeconfigContext, error) {
+	if name == "" {
+		name = k.CurrentContext
+	}
+	if name == "" && len(k.Contexts) == 1 {
+		return &k.Contexts[0].Context, nil
+	}
+	for i := range k.Contexts {
+		if k.Contexts[i].Name == name {
+			return &k.Contexts[i].Context, nil
+		}
+	}
+	return nil, fmt.Errorf("kubeconfig 中没有找到 context: %q", name)
+}
+
+func (k *kubeconfig) findCluster(name string) (*kubeconfigCluster, error) {
+	for i := range k.Clusters {
+		if k.Clusters[i].Name == name {
+			return &k.Clusters[i].Cluster, nil
+		}
+	}
+	return nil, fmt.Errorf("kubeconfig 中没有找到 cluster: %q", name)
+}
+
+func (k *kubeconfig) findUser(name string) (*kubeconfigUser, error) {
+	for i := range k.Users {
+		if k.Users[i].Name == name {
+			return &k.Users[i].User, nil
+		}
+	}
+	return nil, fmt.Errorf("kubeconfig 中没有找到 user: %q", name)
+}
+
+// ParseKubeconfig 解析 kubeconfig 的内容, contextName 为空的话用 current-context
+// dir 是 kubeconfig 所在的目录, 用来解析里面的相对路径
+// exec 和 auth-provider 类型的用户需要调外部的程序拿凭证, 这里不支持
+func ParseKubeconfig(data []byte, dir, contextName string) (*Config, error) {
+	k := &kubeconfig{}
+	err := yaml.Unmarshal(data, k)
+	if err != nil {
+		return nil, err
+	}
+	context, err := k.findContext(contextName)
+	if err != nil {
+		return nil, err
+	}
+	cluster, err := k.findCluster(context.Cluster)
+	if err != nil {
+		return nil, err
+	}
+	if cluster.Server == "" {
+		return nil, fmt.Errorf("kubeconfig 中的 cluster %q 没有 server", context.Cluster)
+	}
+	config := &Config{
+		Host:     cluster.Server,
+		CAData:   cluster.CertificateAuthorityData,
+		CAFile:   resolvePath(dir, cluster.CertificateAuthority),
+		Insecure: cluster.InsecureSkipTLSVerify,
+	}
+
+	// 有的 kubeconfig 只配了集群没有配用户, 比如走匿名访问的
+	if context.User == "" {
+		return config, nil
+	}
+	user, err := k.findUser(context.User)
+	if err != nil {
+		return nil, err
+	}
+	if len(user.Exec) > 0 && string(user.Exec) != "null" {
+		return nil, fmt.Errorf("kubeconfig 中的 user %q 是 exec 类型的, 暂不支持", context.User)
+	}
+	if len(user.AuthProvider) > 0 && string(user.AuthProvider) != "null" {
+		return nil, fmt.Errorf("kubeconfig 中的 user %q 是 auth-provider 类型的, 暂不支持", context.User)
+	}
+	config.CertData = user.ClientCertificateData
+	config.CertFile = resolvePath(dir, user.ClientCertificate)
+	config.KeyData = user.ClientKeyData
+	config.KeyFile = resolvePath(dir, user.ClientKey)
+	config.BearerToken = user.Token
+	config.BearerTokenFile = resolvePath(dir, user.TokenFile)
+	return config, nil
+}
+
+// LoadKubeconfig 读取并解析 path 指向的 kubeconfig, path 可以以 ~ 开头
+func LoadKubeconfig(path, contextName string) (*Config, error) {
+	path = expandHome(path)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKubeconfig(data, filepath.Dir(path), contextName)
+}
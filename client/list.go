@@ -0,0 +1,252 @@
+package client
+
+import (
+	"cni-demo/consts"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1beta1 "k8s.io/api/discovery/v1beta1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// DEFAULT_LIST_LIMIT 是每页默认拉多少条
+	DEFAULT_LIST_LIMIT = 500
+	// continue 的 token 过期(410)之后最多从头重新 list 几次
+	maxListRestarts = 3
+)
+
+// StatusError 是 apiserver 返回的非 200 的响应
+type StatusError struct {
+	URL  string
+	Code int
+	Body string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("请求 %s 失败, status: %d, body: %s", e.URL, e.Code, e.Body)
+}
+
+// IsGone 判断是不是 410, 说明 resourceVersion 或者 continue 太旧了, 需要重新 list
+func IsGone(err error) bool {
+	var statusErr *StatusError
+	return errors.As(err, &statusErr) && statusErr.Code == http.StatusGone
+}
+
+// IsNotFound 判断是不是 404
+func IsNotFound(err error) bool {
+	var statusErr *StatusError
+	return errors.As(err, &statusErr) && statusErr.Code == http.StatusNotFound
+}
+
+// ListOptions 是 list 的时候可以带的参数
+// Limit 为 0 的时候用 DEFAULT_LIST_LIMIT, ResourceVersion 只会带在第一页上, 后面的页由 continue 决定
+type ListOptions struct {
+	LabelSelector   string
+	FieldSelector   string
+	ResourceVersion string
+	Limit           int64
+}
+
+// query 生成某一页的请求参数
+func (opts *ListOptions) query(_continue string) string {
+	values := url.Values{}
+	limit := int64(DEFAULT_LIST_LIMIT)
+	if opts != nil {
+		if opts.LabelSelector != "" {
+			values.Set("labelSelector", opts.LabelSelector)
+		}
+		if opts.FieldSelector != "" {
+			values.Set("fieldSelector", opts.FieldSelector)
+		}
+		if opts.ResourceVersion != "" && _continue == "" {
+			values.Set("resourceVersion", opts.ResourceVersion)
+		}
+		if opts.Limit > 0 {
+			limit = opts.Limit
+		}
+	}
+	values.Set("limit", strconv.FormatInt(limit, 10))
+	if _continue != "" {
+		values.Set("continue", _continue)
+	}
+	return values.Encode()
+}
+
+// getObject 请求 url 并把结果解析到 out 里, 非 200 的时候返回 StatusError
+func (get *Get) getObject(url string, out interface{}) error {
+	resp, err := get.httpsClient.Get(url)
+	if err != nil {
+		return err
+	}
+	body, err := get.getBody(resp)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &StatusError{URL: url, Code: resp.StatusCode, Body: string(body)}
+	}
+	return json.Unmarshal(body, out)
+}
+
+// listAll 按 continue 一页一页地把列表拉完
+// reset 在每次从头开始的时候调用, 让调用方清掉已经拿到的数据; page 负责解析一页并返回这一页的 ListMeta
+// 中途 continue 过期的话 apiserver 会返回 410, 这时候从第一页重新开始
+// 返回的是最后一页的 ListMeta, 其中的 resourceVersion 可以直接拿去 watch
+func (get *Get) listAll(url string, opts *ListOptions, reset func(), page func(body []byte) (*metav1.ListMeta, error)) (*metav1.ListMeta, error) {
+	for restarts := 0; ; restarts++ {
+		reset()
+		meta, err := get.listPages(url, opts, page)
+		if err == nil {
+			return meta, nil
+		}
+		if !IsGone(err) || restarts >= maxListRestarts {
+			return nil, err
+		}
+	}
+}
+
+func (get *Get) listPages(url string, opts *ListOptions, page func(body []byte) (*metav1.ListMeta, error)) (*metav1.ListMeta, error) {
+	_continue := ""
+	for {
+		var raw json.RawMessage
+		err := get.getObject(url+"?"+opts.query(_continue), &raw)
+		if err != nil {
+			return nil, err
+		}
+		meta, err := page(raw)
+		if err != nil {
+			return nil, err
+		}
+		if meta.Continue == "" {
+			return meta, nil
+		}
+		_continue = meta.Continue
+	}
+}
+
+// listInto 用 listAll 把列表拉完, 每一页的 Items 都拼到 list 里, 最后一页的 ListMeta 写回 list
+// list 是指向 k8s 的 XxxList 结构体的指针, 这些结构体都是 TypeMeta、ListMeta 加上 Items 三个字段,
+// 各个 List 方法只是类型不一样, 所以这里用反射来拼, 不然每种资源都要写一遍一样的 page 回调
+func (get *Get) listInto(url string, opts *ListOptions, list interface{}) error {
+	res := reflect.ValueOf(list).Elem()
+	items := res.FieldByName("Items")
+	reset := func() {
+		items.Set(reflect.Zero(items.Type()))
+	}
+	meta, err := get.listAll(url, opts, reset, func(body []byte) (*metav1.ListMeta, error) {
+		page := reflect.New(res.Type())
+		if err := json.Unmarshal(body, page.Interface()); err != nil {
+			return nil, err
+		}
+		page = page.Elem()
+		res.FieldByName("TypeMeta").Set(page.FieldByName("TypeMeta"))
+		items.Set(reflect.AppendSlice(items, page.FieldByName("Items")))
+		meta := page.FieldByName("ListMeta").Interface().(metav1.ListMeta)
+		return &meta, nil
+	})
+	if err != nil {
+		return err
+	}
+	res.FieldByName("ListMeta").Set(reflect.ValueOf(*meta))
+	return nil
+}
+
+// ListNodes 方法分页获取集群中所有的节点
+func (get *Get) ListNodes(opts *ListOptions) (*v1.NodeList, error) {
+	res := &v1.NodeList{}
+	err := get.listInto(get.getRoute("/nodes"), opts, res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ListPods 方法分页获取某个 namespace 下所有的 pod, namespace 为空的话获取所有 namespace 的
+func (get *Get) ListPods(namespace string, opts *ListOptions) (*v1.PodList, error) {
+	res := &v1.PodList{}
+	err := get.listInto(get.getRoute(getNamespacedApi(namespace, "pods")), opts, res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ListNamespaces 方法分页获取集群中所有的 namespace
+func (get *Get) ListNamespaces(opts *ListOptions) (*v1.NamespaceList, error) {
+	res := &v1.NamespaceList{}
+	err := get.listInto(get.getRoute("/namespaces"), opts, res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ListNetworkPolicies 方法分页获取某个 namespace 下所有的 NetworkPolicy, namespace 为空的话获取所有 namespace 的
+func (get *Get) ListNetworkPolicies(namespace string, opts *ListOptions) (*networkingv1.NetworkPolicyList, error) {
+	res := &networkingv1.NetworkPolicyList{}
+	err := get.listInto(get.getGroupRoute(consts.KUBE_NETWORKING_GROUP_VERSION, getNamespacedApi(namespace, "networkpolicies")), opts, res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ListServices 方法分页获取某个 namespace 下所有的 Service, namespace 为空的话获取所有 namespace 的
+func (get *Get) ListServices(namespace string, opts *ListOptions) (*v1.ServiceList, error) {
+	res := &v1.ServiceList{}
+	err := get.listInto(get.getRoute(getNamespacedApi(namespace, "services")), opts, res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ListEndpointSlices 方法分页获取某个 namespace 下所有的 EndpointSlice, namespace 为空的话获取所有 namespace 的
+// 请求的是 discovery.k8s.io/v1, 依赖的 k8s.io/api 版本里还只有 v1beta1 的结构体,
+// 用到的 addresses, conditions 和 ports 两个版本是一样的, 所以直接解到 v1beta1 里
+func (get *Get) ListEndpointSlices(namespace string, opts *ListOptions) (*discoveryv1beta1.EndpointSliceList, error) {
+	res := &discoveryv1beta1.EndpointSliceList{}
+	err := get.listInto(get.getGroupRoute(consts.KUBE_DISCOVERY_GROUP_VERSION, getNamespacedApi(namespace, "endpointslices")), opts, res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Nodes 方法用于获取集群中所有节点的信息
+func (get *Get) Nodes() (*v1.NodeList, error) {
+	return get.ListNodes(nil)
+}
+
+// Pods 方法用于获取某个 namespace 下所有的 pod, namespace 为空的话获取所有 namespace 的
+func (get *Get) Pods(namespace string) (*v1.PodList, error) {
+	return get.ListPods(namespace, nil)
+}
+
+// Namespaces 方法用于获取集群中所有的 namespace
+func (get *Get) Namespaces() (*v1.NamespaceList, error) {
+	return get.ListNamespaces(nil)
+}
+
+// NetworkPolicies 方法用于获取某个 namespace 下所有的 NetworkPolicy, namespace 为空的话获取所有 namespace 的
+func (get *Get) NetworkPolicies(namespace string) (*networkingv1.NetworkPolicyList, error) {
+	return get.ListNetworkPolicies(namespace, nil)
+}
+
+// Services 方法用于获取某个 namespace 下所有的 Service, namespace 为空的话获取所有 namespace 的
+func (get *Get) Services(namespace string) (*v1.ServiceList, error) {
+	return get.ListServices(namespace, nil)
+}
+
+// EndpointSlices 方法用于获取某个 namespace 下所有的 EndpointSlice, namespace 为空的话获取所有 namespace 的
+func (get *Get) EndpointSlices(namespace string) (*discoveryv1beta1.EndpointSliceList, error) {
+	return get.ListEndpointSlices(namespace, nil)
+}
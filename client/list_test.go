@@ -0,0 +1,183 @@
+package client
+
+import (
+	"cni-demo/consts"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+)
+
+func newTestGet(srv *httptest.Server) *Get {
+	return &Get{
+		httpsClient: srv.Client(),
+		client:      &LightK8sClient{masterEndpoint: srv.URL, kubeApi: consts.KUBE_API},
+	}
+}
+
+func TestListNodesPagination(t *testing.T) {
+	test := assert.New(t)
+
+	var lock sync.Mutex
+	var queries []string
+	gone := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		queries = append(queries, r.URL.RawQuery)
+		q := r.URL.Query()
+		switch q.Get("continue") {
+		case "":
+			fmt.Fprint(w, `{"metadata":{"resourceVersion":"10","continue":"c1"},"items":[{"metadata":{"name":"node1"}}]}`)
+		case "c1":
+			// 第一次拿第二页的时候 continue 过期了
+			if gone {
+				gone = false
+				w.WriteHeader(http.StatusGone)
+				fmt.Fprint(w, `{"kind":"Status","code":410}`)
+				return
+			}
+			fmt.Fprint(w, `{"metadata":{"resourceVersion":"10"},"items":[{"metadata":{"name":"node2"}}]}`)
+		}
+	}))
+	defer srv.Close()
+
+	nodes, err := newTestGet(srv).ListNodes(&ListOptions{ResourceVersion: "0", Limit: 1})
+	test.Nil(err)
+	test.Len(nodes.Items, 2)
+	test.Equal("node1", nodes.Items[0].Name)
+	test.Equal("node2", nodes.Items[1].Name)
+	test.Equal("10", nodes.ResourceVersion)
+	test.Equal("", nodes.Continue)
+
+	// 重新 list 的时候从第一页开始, 并且 resourceVersion 只带在第一页上
+	test.Equal([]string{
+		"limit=1&resourceVersion=0",
+		"continue=c1&limit=1",
+		"limit=1&resourceVersion=0",
+		"continue=c1&limit=1",
+	}, queries)
+}
+
+func TestListNotFound(t *testing.T) {
+	test := assert.New(t)
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	_, err := newTestGet(srv).Node("node1")
+	test.True(IsNotFound(err))
+	test.False(IsGone(err))
+}
+
+// EndpointSlice 走的是 discovery.k8s.io/v1, 解到 v1beta1 的结构体里
+func TestListEndpointSlices(t *testing.T) {
+	test := assert.New(t)
+	var path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		fmt.Fprint(w, `{"metadata":{"resourceVersion":"7"},"items":[{"metadata":{"name":"web-abcde"},"addressType":"IPv4",`+
+			`"endpoints":[{"addresses":["10.244.1.5"],"conditions":{"ready":true},"nodeName":"node1"}],"ports":[{"name":"","protocol":"TCP","port":8080}]}]}`)
+	}))
+	defer srv.Close()
+
+	slices, err := newTestGet(srv).EndpointSlices("default")
+	test.Nil(err)
+	test.Equal("/apis/discovery.k8s.io/v1/namespaces/default/endpointslices", path)
+	test.Len(slices.Items, 1)
+	test.Equal([]string{"10.244.1.5"}, slices.Items[0].Endpoints[0].Addresses)
+	test.True(*slices.Items[0].Endpoints[0].Conditions.Ready)
+	test.Equal(int32(8080), *slices.Items[0].Ports[0].Port)
+}
+
+func TestReflector(t *testing.T) {
+	test := assert.New(t)
+
+	var lock sync.Mutex
+	lists := 0
+	var watches []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		lock.Lock()
+		if q.Get("watch") != "true" {
+			lists++
+			rv := "10"
+			if lists > 1 {
+				rv = "20"
+			}
+			lock.Unlock()
+			fmt.Fprintf(w, `{"metadata":{"resourceVersion":"%s"},"items":[]}`, rv)
+			return
+		}
+		rv := q.Get("resourceVersion")
+		watches = append(watches, rv)
+		lock.Unlock()
+
+		flusher := w.(http.Flusher)
+		switch rv {
+		case "10":
+			fmt.Fprintln(w, `{"type":"ADDED","object":{"metadata":{"name":"node1","resourceVersion":"11"}}}`)
+			fmt.Fprintln(w, `{"type":"BOOKMARK","object":{"metadata":{"resourceVersion":"15"}}}`)
+		case "15":
+			fmt.Fprintln(w, `{"type":"ERROR","object":{"kind":"Status","code":410}}`)
+		case "20":
+			fmt.Fprintln(w, `{"type":"DELETED","object":{"metadata":{"name":"node1","resourceVersion":"21"}}}`)
+			flusher.Flush()
+			<-r.Context().Done()
+		}
+	}))
+	defer srv.Close()
+
+	events := make(chan string, 10)
+	get := newTestGet(srv)
+	reflector := NewReflector("nodes", get.NodeListWatch(func(nodes *v1.NodeList) {}), func(event *WatchEvent) {
+		events <- event.Type
+	})
+	reflector.RetryInterval = 10 * time.Millisecond
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		reflector.Run(stop)
+		close(done)
+	}()
+
+	test.Equal(WATCH_ADDED, <-events)
+	test.Equal(WATCH_DELETED, <-events)
+	close(stop)
+	<-done
+
+	lock.Lock()
+	defer lock.Unlock()
+	test.Equal(2, lists)
+	// BOOKMARK 之后从 15 接着 watch, 410 之后重新 list 从 20 开始
+	test.Equal([]string{"10", "15", "20"}, watches)
+	test.Equal("21", reflector.resourceVersion)
+}
+
+// 在 pod 里的时候 apiserver 的真实地址从 default/kubernetes 的 endpoints 里拿
+func TestAPIServerHost(t *testing.T) {
+	test := assert.New(t)
+	var path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		fmt.Fprint(w, `{"metadata":{"name":"kubernetes"},"subsets":[{"addresses":[{"ip":"192.168.1.10"}],"ports":[{"name":"https","port":6443}]}]}`)
+	}))
+	defer srv.Close()
+
+	host, err := apiServerHost(newTestGet(srv))
+	test.Nil(err)
+	test.Equal("/api/v1/namespaces/default/endpoints/kubernetes", path)
+	test.Equal("192.168.1.10", host)
+
+	empty := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"metadata":{"name":"kubernetes"}}`)
+	}))
+	defer empty.Close()
+	_, err = apiServerHost(newTestGet(empty))
+	test.NotNil(err)
+}
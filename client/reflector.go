@@ -0,0 +1,220 @@
+package client
+
+import (
+	"cni-demo/tools/logger"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1beta1 "k8s.io/api/discovery/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// list 或者 watch 失败之后隔多久重试
+	DEFAULT_RETRY_INTERVAL = 5 * time.Second
+)
+
+// ListWatch 描述一种资源怎么 list 和 watch
+// List 拉一遍全量, 自己处理拿到的结果, 然后返回列表的 resourceVersion
+type ListWatch struct {
+	List  func() (string, error)
+	Watch func(resourceVersion string, handler WatchHandler) (func(), <-chan struct{}, error)
+}
+
+// Reflector 先 list 一遍再从 list 的 resourceVersion 开始 watch
+//  1. watch 正常断开的时候从最后一次看到的 resourceVersion 接着 watch, 不用重新 list
+//  2. BOOKMARK 只用来更新 resourceVersion, 不会交给 handler
+//  3. resourceVersion 太旧的时候 apiserver 会返回 410 或者一个 code 是 410 的 ERROR 事件, 这时候重新 list
+type Reflector struct {
+	name            string
+	lw              *ListWatch
+	handler         WatchHandler
+	resourceVersion string
+	RetryInterval   time.Duration
+}
+
+func NewReflector(name string, lw *ListWatch, handler WatchHandler) *Reflector {
+	return &Reflector{
+		name:          name,
+		lw:            lw,
+		handler:       handler,
+		RetryInterval: DEFAULT_RETRY_INTERVAL,
+	}
+}
+
+// getEventResourceVersion 从事件的 object 里拿出 resourceVersion
+func getEventResourceVersion(event *WatchEvent) string {
+	var obj struct {
+		Metadata metav1.ObjectMeta `json:"metadata"`
+	}
+	if err := json.Unmarshal(event.Object, &obj); err != nil {
+		return ""
+	}
+	return obj.Metadata.ResourceVersion
+}
+
+// getEventStatus 把 ERROR 事件里的 object 解析成 Status
+func getEventStatus(event *WatchEvent) *metav1.Status {
+	status := &metav1.Status{}
+	if err := json.Unmarshal(event.Object, status); err != nil {
+		return nil
+	}
+	return status
+}
+
+// wait 等一个重试的间隔, stop 被关掉的话返回 false
+func (r *Reflector) wait(stop <-chan struct{}) bool {
+	select {
+	case <-time.After(r.RetryInterval):
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// watchOnce 从当前的 resourceVersion 开始 watch 一次, 直到连接断开
+// 返回 true 表示需要重新 list
+func (r *Reflector) watchOnce(stop <-chan struct{}) (relist bool, ok bool) {
+	gone := false
+	cancel, done, err := r.lw.Watch(r.resourceVersion, func(event *WatchEvent) {
+		switch event.Type {
+		case WATCH_BOOKMARK:
+			if rv := getEventResourceVersion(event); rv != "" {
+				r.resourceVersion = rv
+			}
+		case WATCH_ERROR:
+			status := getEventStatus(event)
+			if status != nil && status.Code == http.StatusGone {
+				gone = true
+				return
+			}
+			logger.Error("watch 收到了错误事件", "resource", r.name, "event", string(event.Object))
+		default:
+			if rv := getEventResourceVersion(event); rv != "" {
+				r.resourceVersion = rv
+			}
+			r.handler(event)
+		}
+	})
+	if err != nil {
+		logger.Error("watch 失败", "resource", r.name, "err", err)
+		if IsGone(err) {
+			return true, true
+		}
+		return false, r.wait(stop)
+	}
+	select {
+	case <-done:
+	case <-stop:
+		cancel()
+		return false, false
+	}
+	// 出现 410 之后 apiserver 会自己把连接关掉, 走到这里的时候 done 已经关了, 读 gone 是安全的
+	return gone, true
+}
+
+// Run 一直 list + watch, 直到 stop 被关掉
+func (r *Reflector) Run(stop <-chan struct{}) {
+	relist := true
+	for {
+		if relist {
+			rv, err := r.lw.List()
+			if err != nil {
+				logger.Error("list 失败", "resource", r.name, "err", err)
+				if !r.wait(stop) {
+					return
+				}
+				continue
+			}
+			r.resourceVersion = rv
+		}
+		var ok bool
+		relist, ok = r.watchOnce(stop)
+		if !ok {
+			return
+		}
+	}
+}
+
+// NodeListWatch 返回节点的 ListWatch, 每次 list 完都会调用 onList
+func (get *Get) NodeListWatch(onList func(nodes *v1.NodeList)) *ListWatch {
+	return &ListWatch{
+		List: func() (string, error) {
+			nodes, err := get.ListNodes(nil)
+			if err != nil {
+				return "", err
+			}
+			onList(nodes)
+			return nodes.ResourceVersion, nil
+		},
+		Watch: get.WatchNodes,
+	}
+}
+
+// PodListWatch 返回某个 namespace 下 pod 的 ListWatch, namespace 为空的话是所有 namespace 的
+func (get *Get) PodListWatch(namespace string, onList func(pods *v1.PodList)) *ListWatch {
+	return &ListWatch{
+		List: func() (string, error) {
+			pods, err := get.ListPods(namespace, nil)
+			if err != nil {
+				return "", err
+			}
+			onList(pods)
+			return pods.ResourceVersion, nil
+		},
+		Watch: func(resourceVersion string, handler WatchHandler) (func(), <-chan struct{}, error) {
+			return get.WatchPods(namespace, resourceVersion, handler)
+		},
+	}
+}
+
+// NamespaceListWatch 返回 namespace 的 ListWatch
+func (get *Get) NamespaceListWatch(onList func(namespaces *v1.NamespaceList)) *ListWatch {
+	return &ListWatch{
+		List: func() (string, error) {
+			namespaces, err := get.ListNamespaces(nil)
+			if err != nil {
+				return "", err
+			}
+			onList(namespaces)
+			return namespaces.ResourceVersion, nil
+		},
+		Watch: get.WatchNamespaces,
+	}
+}
+
+// ServiceListWatch 返回某个 namespace 下 Service 的 ListWatch, namespace 为空的话是所有 namespace 的
+func (get *Get) ServiceListWatch(namespace string, onList func(services *v1.ServiceList)) *ListWatch {
+	return &ListWatch{
+		List: func() (string, error) {
+			services, err := get.ListServices(namespace, nil)
+			if err != nil {
+				return "", err
+			}
+			onList(services)
+			return services.ResourceVersion, nil
+		},
+		Watch: func(resourceVersion string, handler WatchHandler) (func(), <-chan struct{}, error) {
+			return get.WatchServices(namespace, resourceVersion, handler)
+		},
+	}
+}
+
+// EndpointSliceListWatch 返回某个 namespace 下 EndpointSlice 的 ListWatch, namespace 为空的话是所有 namespace 的
+func (get *Get) EndpointSliceListWatch(namespace string, onList func(slices *discoveryv1beta1.EndpointSliceList)) *ListWatch {
+	return &ListWatch{
+		List: func() (string, error) {
+			slices, err := get.ListEndpointSlices(namespace, nil)
+			if err != nil {
+				return "", err
+			}
+			onList(slices)
+			return slices.ResourceVersion, nil
+		},
+		Watch: func(resourceVersion string, handler WatchHandler) (func(), <-chan struct{}, error) {
+			return get.WatchEndpointSlices(namespace, resourceVersion, handler)
+		},
+	}
+}
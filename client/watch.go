@@ -0,0 +1,101 @@
+package client
+
+import (
+	"cni-demo/consts"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+const (
+	WATCH_ADDED    = "ADDED"
+	WATCH_MODIFIED = "MODIFIED"
+	WATCH_DELETED  = "DELETED"
+	WATCH_ERROR    = "ERROR"
+	// WATCH_BOOKMARK 只带了一个最新的 resourceVersion, 没有真正的变化, 用来在重连的时候少走一次 410
+	WATCH_BOOKMARK = "BOOKMARK"
+)
+
+// WatchEvent 是 apiserver 在 watch=true 的时候一行一行吐出来的事件
+// Object 没有直接解析, 由调用方根据自己 watch 的资源类型去解析
+type WatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// WatchHandler 是收到 watch 事件时的回调
+type WatchHandler func(event *WatchEvent)
+
+// watch 方法对 url 发起一个 watch 请求, 每收到一个事件就调用一次 handler
+// 返回的函数用来取消 watch, 连接断开之后 done 会被关掉, 调用方可以据此重新 list + watch
+// 请求里带了 allowWatchBookmarks, 所以 handler 可能会收到 WATCH_BOOKMARK, 不关心的话直接忽略就行
+func (get *Get) watch(url, resourceVersion string, handler WatchHandler) (cancel func(), done <-chan struct{}, err error) {
+	sep := "?"
+	if strings.Contains(url, "?") {
+		sep = "&"
+	}
+	url = url + sep + "watch=true&allowWatchBookmarks=true"
+	if resourceVersion != "" {
+		url = url + "&resourceVersion=" + resourceVersion
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := get.httpsClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := get.getBody(resp)
+		return nil, nil, &StatusError{URL: url, Code: resp.StatusCode, Body: string(body)}
+	}
+
+	_done := make(chan struct{})
+	go func() {
+		defer close(_done)
+		defer resp.Body.Close()
+		decoder := json.NewDecoder(resp.Body)
+		for {
+			event := &WatchEvent{}
+			if err := decoder.Decode(event); err != nil {
+				return
+			}
+			handler(event)
+		}
+	}()
+	return func() { resp.Body.Close() }, _done, nil
+}
+
+// WatchNodes 方法用于 watch 节点的变化
+func (get *Get) WatchNodes(resourceVersion string, handler WatchHandler) (func(), <-chan struct{}, error) {
+	return get.watch(get.getRoute("/nodes"), resourceVersion, handler)
+}
+
+// WatchPods 方法用于 watch 某个 namespace 下 pod 的变化, namespace 为空的话 watch 所有 namespace 的
+func (get *Get) WatchPods(namespace, resourceVersion string, handler WatchHandler) (func(), <-chan struct{}, error) {
+	return get.watch(get.getRoute(getNamespacedApi(namespace, "pods")), resourceVersion, handler)
+}
+
+// WatchNamespaces 方法用于 watch namespace 的变化
+func (get *Get) WatchNamespaces(resourceVersion string, handler WatchHandler) (func(), <-chan struct{}, error) {
+	return get.watch(get.getRoute("/namespaces"), resourceVersion, handler)
+}
+
+// WatchNetworkPolicies 方法用于 watch 某个 namespace 下 NetworkPolicy 的变化, namespace 为空的话 watch 所有 namespace 的
+func (get *Get) WatchNetworkPolicies(namespace, resourceVersion string, handler WatchHandler) (func(), <-chan struct{}, error) {
+	url := get.getGroupRoute(consts.KUBE_NETWORKING_GROUP_VERSION, getNamespacedApi(namespace, "networkpolicies"))
+	return get.watch(url, resourceVersion, handler)
+}
+
+// WatchServices 方法用于 watch 某个 namespace 下 Service 的变化, namespace 为空的话 watch 所有 namespace 的
+func (get *Get) WatchServices(namespace, resourceVersion string, handler WatchHandler) (func(), <-chan struct{}, error) {
+	return get.watch(get.getRoute(getNamespacedApi(namespace, "services")), resourceVersion, handler)
+}
+
+// WatchEndpointSlices 方法用于 watch 某个 namespace 下 EndpointSlice 的变化, namespace 为空的话 watch 所有 namespace 的
+func (get *Get) WatchEndpointSlices(namespace, resourceVersion string, handler WatchHandler) (func(), <-chan struct{}, error) {
+	url := get.getGroupRoute(consts.KUBE_DISCOVERY_GROUP_VERSION, getNamespacedApi(namespace, "endpointslices"))
+	return get.watch(url, resourceVersion, handler)
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"cni-demo/agent"
+	"cni-demo/cni"
+	"cni-demo/consts"
+	"cni-demo/datastore"
+	"cni-demo/etcd"
+	"cni-demo/ipam"
+	"cni-demo/plugins/ipip/bird"
+	"cni-demo/plugins/vxlan/flows"
+	bpf_map "cni-demo/plugins/vxlan/map"
+	"cni-demo/plugins/vxlan/service"
+	"cni-demo/plugins/vxlan/tc"
+	"cni-demo/plugins/vxlan/watcher"
+	"cni-demo/policy"
+	"cni-demo/tools/helper"
+	"cni-demo/tools/metrics"
+	"cni-demo/tools/nettools"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	_ "cni-demo/plugins/hostgw"
+	_ "cni-demo/plugins/ipip"
+	_ "cni-demo/plugins/vxlan/vxlan"
+	_ "cni-demo/plugins/xvlan/ipvlan"
+	_ "cni-demo/plugins/xvlan/macvlan"
+	"cni-demo/tools/logger"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	DEFAULT_CNI_CONF_DIR = "/etc/cni/net.d"
+	// host-gw 模式和 kernel 数据面的 vxlan 模式下多久全量对一次路由, 节点变化的时候会立刻对一次
+	routeResyncInterval = 30 * time.Second
+)
+
+// loadConfig 读 CNI 的配置文件, 没指定的话用配置目录里按文件名排序的第一个 .conf, 和 kubelet 的选法一样
+func loadConfig(confPath, confDir string) (*cni.PluginConf, error) {
+	if confPath == "" {
+		files, err := filepath.Glob(filepath.Join(confDir, "*.conf"))
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("%s 下没有找到 cni 配置文件", confDir)
+		}
+		sort.Strings(files)
+		confPath = files[0]
+	}
+	data, err := ioutil.ReadFile(confPath)
+	if err != nil {
+		return nil, err
+	}
+	conf := &cni.PluginConf{}
+	err = json.Unmarshal(data, conf)
+	if err != nil {
+		return nil, fmt.Errorf("解析 cni 配置文件 %s 失败: %v", confPath, err)
+	}
+	return conf, nil
+}
+
+// initIpam 按照和 CNI 插件一样的参数初始化 ipam, 不然算出来的网段对不上
+func initIpam(mode, subnet string) (*ipam.IpamService, error) {
+	var options *ipam.IPAMOptions
+	if mode == consts.MODE_VXLAN {
+		options = &ipam.IPAMOptions{
+			MaskSegment:      "16",
+			PodIpMaskSegment: "32",
+		}
+	}
+	ipam.Init(subnet, options)
+	return ipam.GetIpamService()
+}
+
+// reconcileRoutes 把 host-gw 模式下去往其他节点的路由对一遍
+func reconcileRoutes(is *ipam.IpamService) error {
+	networks, err := is.Get().AllHostNetwork()
+	if err != nil {
+		return err
+	}
+	currentNetwork, err := is.Get().HostNetwork()
+	if err != nil {
+		return err
+	}
+	clusterCIDR, err := is.Get().CurrentSubnet()
+	if err != nil {
+		return err
+	}
+	return nettools.ReconcileHostRoutes(networks, currentNetwork, clusterCIDR)
+}
+
+// reconcileVxlanPeers 把 kernel 数据面的 vxlan 设备上去往其他节点的 fdb、邻居和路由对一遍
+func reconcileVxlanPeers(is *ipam.IpamService, device string) error {
+	networks, err := is.Get().AllHostNetwork()
+	if err != nil {
+		return err
+	}
+	return nettools.ReconcileVxlanPeers(networks, device)
+}
+
+// runRoutes 定时以及在节点变化的时候调用 reconcile 同步路由, 一直阻塞到 stop 被关掉
+func runRoutes(is *ipam.IpamService, reconcile func(is *ipam.IpamService) error, stop <-chan struct{}) error {
+	err := reconcile(is)
+	if err != nil {
+		return err
+	}
+	trigger := make(chan struct{}, 1)
+	onChange := func(node *v1.Node) {
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+	}
+	go is.WatchNodes(&ipam.NodeHandler{OnAdd: onChange, OnDelete: onChange}, stop)
+
+	ticker := time.NewTicker(routeResyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-trigger:
+		case <-stop:
+			return nil
+		}
+		err := reconcile(is)
+		if err != nil {
+			logger.Error("同步路由失败", "err", err)
+		}
+	}
+}
+
+// flowOptions 是导出流量事件的参数, 只有 vxlan 模式下有用
+type flowOptions struct {
+	// 平均多少个包导出一个, 0 表示不导出
+	sampleRate uint
+	// 每个事件写一行 json 的文件, 空的话只能通过 -debug-addr 上的 flows.FLOWS_PATH 看
+	logPath string
+}
+
+// flowComponent 返回从 vxlan 的 tc 程序读流量事件的组件, 用 ipam 里的记录补上 pod 和节点的名字
+func flowComponent(is *ipam.IpamService, opts *flowOptions) (agent.Component, error) {
+	var out io.Writer
+	if opts.logPath != "" {
+		file, err := logger.NewRotateFile(opts.logPath, logger.DEFAULT_MAX_SIZE*1024*1024, logger.DEFAULT_MAX_BACKUPS)
+		if err != nil {
+			return agent.Component{}, fmt.Errorf("打开流量事件的日志文件失败: %v", err)
+		}
+		out = file
+	}
+	observer := flows.NewObserver(uint32(opts.sampleRate), out, is.Get().Owners, is.Get().AllOtherHostIP)
+	return agent.Component{
+		Name:     "flows",
+		Run:      observer.Run,
+		Handlers: map[string]http.Handler{flows.FLOWS_PATH: observer},
+	}, nil
+}
+
+// components 返回当前模式下 agent 需要运行的组件
+func components(mode string, conf *cni.PluginConf, socketPath string, flowOpts *flowOptions) ([]agent.Component, error) {
+	// 所有模式下都在 unix socket 上接收 CNI 插件转过来的请求
+	cniServer := agent.NewCNIServer(socketPath, helper.CmdAdd, helper.CmdDel, helper.CmdCheck)
+	cs := []agent.Component{{
+		Name: "cni-api",
+		Run:  cniServer.Run,
+	}}
+	// ipvlan 和 macvlan 用的是配置里的地址范围, 不需要集群的 ipam
+	var is *ipam.IpamService
+	switch mode {
+	case consts.MODE_VXLAN, consts.MODE_IPIP, consts.MODE_HOST_GW:
+		var err error
+		is, err = initIpam(mode, conf.Subnet)
+		if err != nil {
+			return nil, fmt.Errorf("初始化 ipam 失败: %v", err)
+		}
+		metrics.RegisterCollector(is.CollectMetrics)
+	}
+
+	switch mode {
+	case consts.MODE_VXLAN:
+		// 配置不对的话 CNI 插件也起不来 pod, agent 直接不启动
+		vxlanConf := conf.GetVxlanConf()
+		err := vxlanConf.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("vxlan 的配置不对: %v", err)
+		}
+		if vxlanConf.Datapath == consts.VXLAN_DATAPATH_KERNEL {
+			// kernel 数据面没有 tc 程序, 只要把其他节点的 fdb 和路由写到 vxlan 设备上
+			if conf.ServiceLB {
+				return nil, fmt.Errorf("vxlan.datapath 是 %s 的时候不支持 serviceLB, 用 kube-proxy 吧", consts.VXLAN_DATAPATH_KERNEL)
+			}
+			if flowOpts.sampleRate > 0 {
+				logger.Warn("kernel 数据面没有流量事件, 忽略 -flow-sample-rate")
+			}
+			cs = append(cs, agent.Component{
+				Name: "vxlan-peers",
+				Run: func(stop <-chan struct{}) error {
+					return runRoutes(is, func(is *ipam.IpamService) error {
+						return reconcileVxlanPeers(is, vxlanConf.Device)
+					}, stop)
+				},
+			})
+			break
+		}
+		store, err := datastore.GetDatastore()
+		if err != nil {
+			return nil, fmt.Errorf("初始化 datastore 失败: %v", err)
+		}
+		mm, err := bpf_map.GetMapsManager()
+		if err != nil {
+			return nil, fmt.Errorf("初始化 ebpf map 失败: %v", err)
+		}
+		metrics.RegisterCollector(mm.CollectMetrics)
+		cs = append(cs, agent.Component{
+			Name: "pod-cidr-sync",
+			Run: func(stop <-chan struct{}) error {
+				return watcher.RunMapWatcher(is, store, stop)
+			},
+		})
+		cs = append(cs, agent.Component{
+			Name: "host-addr-sync",
+			Run:  watcher.RunHostAddrWatcher,
+		})
+		cs = append(cs, agent.Component{
+			Name: "map-cleanup",
+			Run: func(stop <-chan struct{}) error {
+				return watcher.RunMapCleaner(is, stop)
+			},
+		})
+		if conf.ServiceLB {
+			cs = append(cs, agent.Component{
+				Name: "service-lb",
+				Run:  service.RunController,
+			})
+		}
+		if flowOpts.sampleRate > 0 {
+			c, err := flowComponent(is, flowOpts)
+			if err != nil {
+				return nil, err
+			}
+			cs = append(cs, c)
+		}
+	case consts.MODE_IPIP:
+		cs = append(cs, agent.Component{
+			Name: "bird",
+			Run: func(stop <-chan struct{}) error {
+				return bird.Run(is, stop)
+			},
+		})
+	case consts.MODE_HOST_GW:
+		cs = append(cs, agent.Component{
+			Name: "routes",
+			Run: func(stop <-chan struct{}) error {
+				return runRoutes(is, reconcileRoutes, stop)
+			},
+		})
+	}
+	if conf.NetworkPolicy {
+		cs = append(cs, agent.Component{
+			Name: "network-policy",
+			Run: func(stop <-chan struct{}) error {
+				return policy.RunController(mode, conf.GetVxlanConf().Datapath, stop)
+			},
+		})
+	}
+	return cs, nil
+}
+
+// printCounters 把 vxlan 模式下数据面的计数器按 endpoint 和原因打印出来, 排查 pod 不通的时候用
+func printCounters(out io.Writer) error {
+	mm, err := bpf_map.GetMapsManager()
+	if err != nil {
+		return err
+	}
+	counters, err := mm.DatapathCounters()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ENDPOINT\tREASON\tPACKETS\tBYTES")
+	for _, c := range counters {
+		endpoint := c.Endpoint
+		if endpoint == "" {
+			endpoint = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", endpoint, c.Reason, c.Packets, c.Bytes)
+	}
+	return w.Flush()
+}
+
+func main() {
+	confPath := flag.String("cni-conf", "", "cni 配置文件的路径, 不填的话从 -cni-conf-dir 里找")
+	confDir := flag.String("cni-conf-dir", DEFAULT_CNI_CONF_DIR, "cni 配置文件所在的目录")
+	healthAddr := flag.String("health-addr", agent.DEFAULT_HEALTH_ADDR, "健康检查和指标监听的地址")
+	debugAddr := flag.String("debug-addr", "", "流量事件等调试接口监听的地址, 没有鉴权, 空的话不开")
+	socketPath := flag.String("cni-socket", agent.CNI_SOCKET_PATH, "接收 CNI 插件请求的 unix socket")
+	dumpCounters := flag.Bool("dump-counters", false, "打印 vxlan 模式下数据面的计数器之后退出")
+	flowOpts := &flowOptions{}
+	flag.UintVar(&flowOpts.sampleRate, "flow-sample-rate", 0, "vxlan 模式下平均多少个包导出一个流量事件, 0 表示不导出, 丢掉的包不抽样")
+	flag.StringVar(&flowOpts.logPath, "flow-log", "", "把流量事件按每行一个 json 写到这个文件里")
+	flag.Parse()
+
+	if *dumpCounters {
+		err := printCounters(os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	conf, err := loadConfig(*confPath, *confDir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	// 不在处理 CNI 请求的时候, 日志里的 command 都是 agent
+	logger.SetCommand("agent")
+	err = logger.Init(conf.Log)
+	if err != nil {
+		logger.Error("初始化日志失败", "err", err)
+	}
+	mode, _ := helper.GetBaseInfo(conf)
+	etcd.InitWithConfig(conf.Etcd)
+	datastore.InitDatastore(conf.Datastore)
+	nettools.InitFirewall(conf.Firewall)
+	bpf_map.InitMapSizes(conf.BPFMapSizes)
+	tc.InitTunnelID(conf.GetVxlanConf().VNI)
+
+	cs, err := components(mode, conf, *socketPath, flowOpts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logger.Info("cni-demo-agent 收到了信号, 准备退出", "signal", sig)
+		close(stop)
+	}()
+
+	logger.Info("cni-demo-agent 启动了", "mode", mode)
+	a := agent.NewAgent(*healthAddr, cs...)
+	a.DebugAddr = *debugAddr
+	err = a.Run(stop)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
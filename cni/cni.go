@@ -1,10 +1,15 @@
 package cni
 
 import (
+	"cni-demo/consts"
+	"cni-demo/etcd"
+	bpf_map "cni-demo/plugins/vxlan/map"
+	"cni-demo/tools/logger"
 	"cni-demo/tools/skel"
-	"cni-demo/tools/utils"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
 
 	cniTypes "github.com/containernetworking/cni/pkg/types"
 	types "github.com/containernetworking/cni/pkg/types/100"
@@ -44,6 +49,104 @@ type PluginConf struct {
 	Bridge string `json:"bridge"`
 	Subnet string `json:"subnet"`
 	Mode   string `json:"mode" default:"host-gw"`
+
+	// 是否给 pod 访问集群外部的流量做 snat, 不开的话 pod 是访问不了外网的
+	IPMasq bool `json:"ipMasq"`
+	// 除了集群自己的网段以外, 额外不需要做 snat 的目标网段, 比如机房的内网
+	NonMasqueradeCIDRs []string `json:"nonMasqueradeCIDRs"`
+	// 防火墙规则用 iptables 还是 nftables 来下发, 不填的话会自己探测
+	Firewall string `json:"firewall"`
+	// 是否执行 k8s 的 NetworkPolicy, 目前只有 host-gw, ipip 和 vxlan 模式支持
+	NetworkPolicy bool `json:"networkPolicy"`
+	// vxlan 模式下是否在 tc 程序里做 service 的 ClusterIP 负载均衡, 开了之后 pod 访问 ClusterIP 不再经过 kube-proxy
+	ServiceLB bool `json:"serviceLB"`
+	// ipam 用的 etcd 的连接配置, 不填的话用 APIV1_ETCD_* 环境变量, 都没有的话连 apiserver 所在机器上的 etcd
+	Etcd *etcd.EtcdConfig `json:"etcd"`
+	// ipam 的数据存在哪里, etcd 或者 kubernetes, 不填的话用 etcd
+	// 用 kubernetes 的话数据会存成 apiserver 上的自定义资源, 节点上不需要能访问 etcd
+	Datastore string `json:"datastore"`
+	// 日志的级别、文件、切割和是否打到标准错误, 不填的话用 CNI_DEMO_LOG_* 环境变量, 见 tools/logger
+	Log *logger.Config `json:"log"`
+	// vxlan 模式下各个 ebpf map 的大小, 不填的用默认值, 改了之后已经 pin 好的 map 会换成新的大小, 见 plugins/vxlan/map
+	BPFMapSizes *bpf_map.MapSizes `json:"bpfMapSizes"`
+	// vxlan 模式下隧道的 VNI、端口和几块设备的名字, 不填的用默认值, 见 VxlanConf
+	Vxlan *VxlanConf `json:"vxlan"`
+}
+
+// VxlanConf 是 vxlan 模式下隧道的配置, 没填或者填 0 的用 consts 里的 VXLAN_DEFAULT_*
+// 集群里所有节点的 VNI 和端口要一样; 同一个节点上跑两个 cni-demo 网络的话, 端口和设备的名字都不能一样
+// cni-demo-agent 和 CNI 插件要用同一份配置, agent 重新挂 tc 程序的时候也要用这里的 VNI
+type VxlanConf struct {
+	// 封装的时候用的 VNI, 会在加载的时候写进 vxlan_egress.c 里
+	VNI uint32 `json:"vni"`
+	// 隧道的 udp 目标端口, 和节点上别的 overlay 冲突的时候改这个
+	Port uint16 `json:"port"`
+	// vxlan 设备的名字
+	Device string `json:"device"`
+	// 网关那对儿 veth 的名字, GatewayHost 上挂着 pod 的网关地址
+	GatewayHost string `json:"gatewayHost"`
+	GatewayNet  string `json:"gatewayNet"`
+	// 数据面, consts.VXLAN_DATAPATH_EBPF 或者 consts.VXLAN_DATAPATH_KERNEL, 不填的是 ebpf
+	// kernel 的时候没有 tc 程序, serviceLB 和流量事件都用不了, 网络策略用 iptables 做
+	Datapath string `json:"datapath"`
+}
+
+// VXLAN_MAX_VNI 是 VNI 能用的最大值, vxlan 头里的 VNI 只有 24 位
+const VXLAN_MAX_VNI = 1<<24 - 1
+
+// GetVxlanConf 返回 vxlan 模式下隧道的配置, 没填的字段换成默认值
+func (conf *PluginConf) GetVxlanConf() VxlanConf {
+	res := VxlanConf{}
+	if conf.Vxlan != nil {
+		res = *conf.Vxlan
+	}
+	if res.VNI == 0 {
+		res.VNI = consts.VXLAN_DEFAULT_VNI
+	}
+	if res.Port == 0 {
+		res.Port = consts.VXLAN_DEFAULT_PORT
+	}
+	if res.Device == "" {
+		res.Device = consts.VXLAN_DEFAULT_DEVICE
+	}
+	if res.GatewayHost == "" {
+		res.GatewayHost = consts.VXLAN_DEFAULT_GATEWAY_HOST
+	}
+	if res.GatewayNet == "" {
+		res.GatewayNet = consts.VXLAN_DEFAULT_GATEWAY_NET
+	}
+	if res.Datapath == "" {
+		res.Datapath = consts.VXLAN_DATAPATH_EBPF
+	}
+	return res
+}
+
+// Validate 检查填好默认值之后的配置能不能用
+func (c VxlanConf) Validate() error {
+	if c.VNI > VXLAN_MAX_VNI {
+		return fmt.Errorf("vxlan.vni %d 超过了 %d", c.VNI, VXLAN_MAX_VNI)
+	}
+	if c.Datapath != consts.VXLAN_DATAPATH_EBPF && c.Datapath != consts.VXLAN_DATAPATH_KERNEL {
+		return fmt.Errorf("vxlan.datapath 只能是 %s 或者 %s, 不能是 %q", consts.VXLAN_DATAPATH_EBPF, consts.VXLAN_DATAPATH_KERNEL, c.Datapath)
+	}
+	names := [][2]string{
+		{"vxlan.device", c.Device},
+		{"vxlan.gatewayHost", c.GatewayHost},
+		{"vxlan.gatewayNet", c.GatewayNet},
+	}
+	seen := map[string]string{}
+	for _, pair := range names {
+		field, name := pair[0], pair[1]
+		// 网卡的名字最长 15 个字节
+		if len(name) > 15 {
+			return fmt.Errorf("%s %q 太长了, 网卡的名字最多 15 个字节", field, name)
+		}
+		if other, ok := seen[name]; ok {
+			return fmt.Errorf("%s 和 %s 都是 %q", other, field, name)
+		}
+		seen[name] = field
+	}
+	return nil
 }
 
 var manager *CNIManager
@@ -212,7 +315,7 @@ func (manager *CNIManager) BootstrapCNI() error {
 	}
 	cniRes, err := cni.Bootstrap(args, configs)
 	if err != nil {
-		utils.WriteLog("出错的位置在 cni.Bootstrap")
+		logger.Error("出错的位置在 cni.Bootstrap")
 		return err
 	}
 
@@ -254,23 +357,37 @@ func (manager *CNIManager) CheckCNI() error {
 	return cni.Check(args, configs)
 }
 
-// PrintResult 方法用于打印 CNI 插件的执行结果。
+// MarshalResult 方法把 CNI 插件的执行结果按配置里的版本转换之后序列化, 和 PrintResult 打印出来的是一样的。
 // 如果无法获取到 CNI 插件的执行结果、配置信息或版本信息，它将返回相应的错误信息。
-func (manager *CNIManager) PrintResult() error {
+func (manager *CNIManager) MarshalResult() ([]byte, error) {
 	result := manager.getResult()
 	if result == nil {
-		return errors.New("PrintResult 无法获取到 cni 插件的执行结果")
+		return nil, errors.New("MarshalResult 无法获取到 cni 插件的执行结果")
 	}
 	config := manager.getBootstrapConfigs()
 	if config == nil {
-		return errors.New("PrintResult 无法获取到 cni 插件的配置信息")
+		return nil, errors.New("MarshalResult 无法获取到 cni 插件的配置信息")
 	}
 	version := config.CNIVersion
 	if version == "" {
-		return errors.New("PrintResult 无法获取到 cni 插件的版本信息")
+		return nil, errors.New("MarshalResult 无法获取到 cni 插件的版本信息")
 	}
-	cniTypes.PrintResult(result, version)
-	return nil
+	versioned, err := result.GetAsVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(versioned, "", "    ")
+}
+
+// PrintResult 方法用于打印 CNI 插件的执行结果。
+// 如果无法获取到 CNI 插件的执行结果、配置信息或版本信息，它将返回相应的错误信息。
+func (manager *CNIManager) PrintResult() error {
+	data, err := manager.MarshalResult()
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(data)
+	return err
 }
 
 // GetCNIManager 函数返回 CNIManager 实例。
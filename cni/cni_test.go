@@ -1,8 +1,10 @@
 package cni
 
 import (
+	"cni-demo/consts"
 	"cni-demo/tools/skel"
 	"errors"
+	"testing"
 	// currentTypes "github.com/containernetworking/cni/pkg/types"
 	// types "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/stretchr/testify/assert"
@@ -32,7 +34,7 @@ func (tmp *tmpcni) Check(args *skel.CmdArgs, pluginConfig *PluginConf) error {
 	return Err_TEST_ERROR
 }
 
-func cni-demo(t *testing.T) {
+func TestCNI(t *testing.T) {
 	test := assert.New(t)
 	manager := GetCNIManager()
 
@@ -119,3 +121,39 @@ func cni-demo(t *testing.T) {
 	// test.Nil(err)
 	// test.EqualValues(tmpRealCNIResult, testRealCNIResult)
 }
+
+func TestVxlanConf(t *testing.T) {
+	test := assert.New(t)
+
+	conf := (&PluginConf{}).GetVxlanConf()
+	test.Equal(VxlanConf{
+		VNI:         consts.VXLAN_DEFAULT_VNI,
+		Port:        consts.VXLAN_DEFAULT_PORT,
+		Device:      consts.VXLAN_DEFAULT_DEVICE,
+		GatewayHost: consts.VXLAN_DEFAULT_GATEWAY_HOST,
+		GatewayNet:  consts.VXLAN_DEFAULT_GATEWAY_NET,
+		Datapath:    consts.VXLAN_DATAPATH_EBPF,
+	}, conf)
+	test.Nil(conf.Validate())
+
+	// 没填的还是默认值
+	conf = (&PluginConf{Vxlan: &VxlanConf{VNI: 42, Port: 4789, Device: "ding_vxlan2"}}).GetVxlanConf()
+	test.Equal(uint32(42), conf.VNI)
+	test.Equal(uint16(4789), conf.Port)
+	test.Equal("ding_vxlan2", conf.Device)
+	test.Equal(consts.VXLAN_DEFAULT_GATEWAY_HOST, conf.GatewayHost)
+	test.Nil(conf.Validate())
+
+	conf.VNI = VXLAN_MAX_VNI + 1
+	test.NotNil(conf.Validate())
+	conf.VNI = 42
+	conf.GatewayNet = "a_very_long_device_name"
+	test.NotNil(conf.Validate())
+	conf.GatewayNet = conf.GatewayHost
+	test.NotNil(conf.Validate())
+
+	conf = (&PluginConf{Vxlan: &VxlanConf{Datapath: consts.VXLAN_DATAPATH_KERNEL}}).GetVxlanConf()
+	test.Nil(conf.Validate())
+	conf.Datapath = "tc"
+	test.NotNil(conf.Validate())
+}
@@ -17,16 +17,73 @@ const (
 
 const (
 	KUBE_API                               = "/api/v1"
+	KUBE_APIS                              = "/apis"
+	KUBE_NETWORKING_GROUP_VERSION          = "networking.k8s.io/v1"
+	KUBE_DISCOVERY_GROUP_VERSION           = "discovery.k8s.io/v1"
+	KUBE_APIEXTENSIONS_GROUP_VERSION       = "apiextensions.k8s.io/v1"
 	KUBE_DEFAULT_PATH                      = "/etc/kubernetes"
-	KUBE_LOCAL_DEFAULT_PATH                = "~/.kube/conf"
+	KUBE_LOCAL_DEFAULT_PATH                = "~/.kube/config"
 	KUBE_DEFAULT_CA_PATH                   = KUBE_DEFAULT_PATH + "/pki/ca.crt"
 	KUBELET_CONFIG_DEFAULT_PATH            = KUBE_DEFAULT_PATH + "/kubelet.conf"
 	KUBE_CONF_ADMIN_DEFAULT_PATH           = KUBE_DEFAULT_PATH + "/admin.conf"
 	KUBE_TEST_CNI_DEFAULT_PATH             = "/opt/cni-demo"
-	KUBE_TEST_CNI_TMP_DEAMON_DEFAULT_PATH  = KUBE_TEST_CNI_DEFAULT_PATH + "/deamon"
 	KUBE_TEST_CNI_TMP_CA_DEFAULT_PATH      = KUBE_TEST_CNI_DEFAULT_PATH + "/ca.crt"
 	KUBE_TEST_CNI_TMP_CERT_DEFAULT_PATH    = KUBE_TEST_CNI_DEFAULT_PATH + "/cert.crt"
 	KUBE_TEST_CNI_TMP_KEY_DEFAULT_PATH     = KUBE_TEST_CNI_DEFAULT_PATH + "/key.key"
 	KUBE_TEST_CNI_DEFAULT_BIRD_CONFIG_PATH = KUBE_TEST_CNI_DEFAULT_PATH + "/bird.cfg"
-	KUBE_TEST_CNI_DEFAULT_BIRD_DEAMON_PATH = KUBE_TEST_CNI_DEFAULT_PATH + "/bird_deamon"
+)
+
+const (
+	// 没有配置 etcd 的时候按 kubeadm 的默认部署来找: 和 apiserver 在同一台机器上, 用 healthcheck-client 的证书
+	ETCD_DEFAULT_PORT               = "2379"
+	KUBE_ETCD_DEFAULT_CA_PATH       = KUBE_DEFAULT_PATH + "/pki/etcd/ca.crt"
+	KUBE_ETCD_DEFAULT_CERT_PATH     = KUBE_DEFAULT_PATH + "/pki/etcd/healthcheck-client.crt"
+	KUBE_ETCD_DEFAULT_KEY_PATH      = KUBE_DEFAULT_PATH + "/pki/etcd/healthcheck-client.key"
+	ETCD_DISCOVERY_SRV_SERVICE_NAME = "etcd-client"
+)
+
+const (
+	// 以 pod 的形式跑在集群里的时候, apiserver 的地址从这两个环境变量里拿, 凭证用 service account 的
+	KUBE_SERVICE_HOST_ENV           = "KUBERNETES_SERVICE_HOST"
+	KUBE_SERVICE_PORT_ENV           = "KUBERNETES_SERVICE_PORT"
+	KUBE_SERVICE_ACCOUNT_PATH       = "/var/run/secrets/kubernetes.io/serviceaccount"
+	KUBE_SERVICE_ACCOUNT_TOKEN_PATH = KUBE_SERVICE_ACCOUNT_PATH + "/token"
+	KUBE_SERVICE_ACCOUNT_CA_PATH    = KUBE_SERVICE_ACCOUNT_PATH + "/ca.crt"
+	// 在 pod 里的时候从 default/kubernetes 的 endpoints 里拿 apiserver 的真实地址
+	KUBE_DEFAULT_NAMESPACE = "default"
+	KUBE_API_SERVICE_NAME  = "kubernetes"
+	// 和 kubectl 一样, 设置了 KUBECONFIG 的话优先用它指定的 kubeconfig
+	KUBECONFIG_ENV = "KUBECONFIG"
+)
+
+const (
+	// 防火墙规则的后端, 不配的话会自动探测
+	FIREWALL_AUTO     = ""
+	FIREWALL_IPTABLES = "iptables"
+	FIREWALL_NFTABLES = "nftables"
+)
+
+const (
+	// ipam 的数据存在哪里, 不配的话直接存在 etcd 里
+	DATASTORE_ETCD       = "etcd"
+	DATASTORE_KUBERNETES = "kubernetes"
+	// ipam 的 key 的前缀, 存在 kubernetes 里的时候也是按这个前缀来解析 key 的
+	IPAM_DATASTORE_PREFIX = "cni-demo/ipam"
+)
+
+const (
+	// vxlan 模式下隧道的默认配置, 插件配置里的 vxlan 字段没填的用这些
+	// 端口和 ip link 不指定 dstport 的时候内核用的一样, 以前的节点升级上来不用重建设备
+	VXLAN_DEFAULT_VNI          = 13190
+	VXLAN_DEFAULT_PORT         = 8472
+	VXLAN_DEFAULT_DEVICE       = "ding_vxlan"
+	VXLAN_DEFAULT_GATEWAY_HOST = "veth_host"
+	VXLAN_DEFAULT_GATEWAY_NET  = "veth_net"
+)
+
+const (
+	// vxlan 模式的数据面, ebpf 是默认的, 转发靠挂在 veth 和 vxlan 设备上的 tc 程序, 内核要 5.10 以上
+	// kernel 不挂 tc 程序, 和 flannel 一样由 cni-demo-agent 往 vxlan 设备上写 fdb、邻居和路由, 转发全交给内核
+	VXLAN_DATAPATH_EBPF   = "ebpf"
+	VXLAN_DATAPATH_KERNEL = "kernel"
 )
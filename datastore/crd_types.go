@@ -0,0 +1,148 @@
+package datastore
+
+import (
+	"cni-demo/client"
+	"cni-demo/consts"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	CRD_GROUP   = "ipam.cni-demo.io"
+	CRD_VERSION = "v1alpha1"
+	// 每个对象都会带上所属的网段, BlockAffinity 和 IPAllocation 还会带上节点, 方便按标签 list 和 watch
+	LABEL_POOL = CRD_GROUP + "/pool"
+	LABEL_NODE = CRD_GROUP + "/node"
+)
+
+var (
+	ipPoolResource        = client.CustomResource{Group: CRD_GROUP, Version: CRD_VERSION, Plural: "ippools"}
+	blockAffinityResource = client.CustomResource{Group: CRD_GROUP, Version: CRD_VERSION, Plural: "blockaffinities"}
+	ipAllocationResource  = client.CustomResource{Group: CRD_GROUP, Version: CRD_VERSION, Plural: "ipallocations"}
+)
+
+// IPPool 对应 etcd 里的 /cni-demo/ipam/<subnet>/<mask>/pool, 记录整个集群的网段还有哪些小网段没有分给节点
+type IPPool struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              IPPoolSpec `json:"spec"`
+}
+
+type IPPoolSpec struct {
+	// 集群的网段, 比如 10.244.0.0/16
+	CIDR string `json:"cidr"`
+	// 还没有分给任何节点的网段的网络地址
+	FreeBlocks []string `json:"freeBlocks,omitempty"`
+}
+
+// BlockAffinity 对应 etcd 里的 /cni-demo/ipam/<subnet>/<mask>/<hostname>, 记录某个节点分到了哪个网段
+// 以前的 maps 也是从所有的 BlockAffinity 推出来的, 不再单独存
+type BlockAffinity struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              BlockAffinitySpec `json:"spec"`
+}
+
+type BlockAffinitySpec struct {
+	CIDR  string `json:"cidr"`
+	Node  string `json:"node"`
+	Block string `json:"block"`
+}
+
+// IPAllocation 对应 etcd 里的 /cni-demo/ipam/<subnet>/<mask>/<hostname>/<block> 以及它下面的 range 和 owners
+// 记录某个节点的网段里已经用掉的 ip, 可以分配的 ip 范围以及每个 ip 分给了哪个 pod
+type IPAllocation struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              IPAllocationSpec `json:"spec"`
+}
+
+type IPAllocationSpec struct {
+	CIDR  string   `json:"cidr"`
+	Node  string   `json:"node"`
+	Block string   `json:"block"`
+	IPs   []string `json:"ips,omitempty"`
+	Range []string `json:"range,omitempty"`
+	// 每一项是 <ip>=<namespace>/<pod>
+	Owners []string `json:"owners,omitempty"`
+}
+
+// crdObject 是上面三种对象共同的部分
+type crdObject interface {
+	metav1.Object
+	setTypeMeta(meta metav1.TypeMeta)
+}
+
+func (p *IPPool) setTypeMeta(meta metav1.TypeMeta)        { p.TypeMeta = meta }
+func (b *BlockAffinity) setTypeMeta(meta metav1.TypeMeta) { b.TypeMeta = meta }
+func (a *IPAllocation) setTypeMeta(meta metav1.TypeMeta)  { a.TypeMeta = meta }
+
+// stringListSchema 是字符串数组的 schema
+var stringListSchema = map[string]interface{}{
+	"type":  "array",
+	"items": map[string]interface{}{"type": "string"},
+}
+
+// newCustomResourceDefinition 生成一个集群级别的 CRD, spec 的字段都是字符串或者字符串数组
+func newCustomResourceDefinition(res client.CustomResource, kind string, spec map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"apiVersion": consts.KUBE_APIEXTENSIONS_GROUP_VERSION,
+		"kind":       "CustomResourceDefinition",
+		"metadata": map[string]interface{}{
+			"name": res.Plural + "." + res.Group,
+		},
+		"spec": map[string]interface{}{
+			"group": res.Group,
+			"scope": "Cluster",
+			"names": map[string]interface{}{
+				"plural":   res.Plural,
+				"singular": strings.ToLower(kind),
+				"kind":     kind,
+				"listKind": kind + "List",
+			},
+			"versions": []interface{}{
+				map[string]interface{}{
+					"name":    res.Version,
+					"served":  true,
+					"storage": true,
+					"schema": map[string]interface{}{
+						"openAPIV3Schema": map[string]interface{}{
+							"type": "object",
+							"properties": map[string]interface{}{
+								"spec": map[string]interface{}{
+									"type":       "object",
+									"properties": spec,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// customResourceDefinitions 返回 kubernetes datastore 需要的所有 CRD
+func customResourceDefinitions() []map[string]interface{} {
+	str := map[string]interface{}{"type": "string"}
+	return []map[string]interface{}{
+		newCustomResourceDefinition(ipPoolResource, "IPPool", map[string]interface{}{
+			"cidr":       str,
+			"freeBlocks": stringListSchema,
+		}),
+		newCustomResourceDefinition(blockAffinityResource, "BlockAffinity", map[string]interface{}{
+			"cidr":  str,
+			"node":  str,
+			"block": str,
+		}),
+		newCustomResourceDefinition(ipAllocationResource, "IPAllocation", map[string]interface{}{
+			"cidr":   str,
+			"node":   str,
+			"block":  str,
+			"ips":    stringListSchema,
+			"range":  stringListSchema,
+			"owners": stringListSchema,
+		}),
+	}
+}
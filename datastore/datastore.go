@@ -0,0 +1,91 @@
+package datastore
+
+import (
+	"cni-demo/consts"
+	"fmt"
+	"sync"
+)
+
+// EventType 是 watch 到的变化的类型
+type EventType int
+
+const (
+	EVENT_PUT EventType = iota
+	EVENT_DELETE
+)
+
+func (t EventType) String() string {
+	if t == EVENT_DELETE {
+		return "DELETE"
+	}
+	return "PUT"
+}
+
+// WatchCallback 是 watch 到某个 key 变化时的回调, 删除的时候 value 是空的
+type WatchCallback func(_type EventType, key, value []byte)
+
+// Watcher 用来 watch 一批 key, Cancel 之后这个 Watcher 上所有的 watch 都会停掉
+type Watcher interface {
+	Watch(key string, cb WatchCallback)
+	Cancel()
+}
+
+// Datastore 是 ipam 和各个 watcher 存取数据用的接口
+// key 统一用 etcd 的路径的形式, 比如 /cni-demo/ipam/10.244.0.0/16/pool, 由各个实现自己决定怎么存
+type Datastore interface {
+	// Get 获取 key 对应的值, 不存在的话返回空字符串
+	Get(key string) (string, error)
+	// Exists 判断 key 是否存在
+	Exists(key string) (bool, error)
+	// Set 直接覆盖 key 对应的值
+	Set(key, value string) error
+	// Update 用 fn 基于当前的值算出新的值写回去, 期间被别人改过的话会重新读一遍再算
+	// 多个节点会同时改的 key 都应该用它而不是先 Get 再 Set
+	Update(key string, fn func(value string) (string, error)) error
+	// DelPrefix 删除所有以 prefix 开头的 key
+	DelPrefix(prefix string) error
+	// GetWatcher 返回一个 Watcher
+	GetWatcher() (Watcher, error)
+}
+
+var (
+	_datastoreLock    sync.Mutex
+	_datastoreBackend string
+	_datastore        Datastore
+)
+
+// InitDatastore 设置要使用的后端, 要在第一次 GetDatastore 之前调用, 不调的话用 etcd
+func InitDatastore(backend string) {
+	_datastoreLock.Lock()
+	defer _datastoreLock.Unlock()
+	if backend != _datastoreBackend {
+		_datastore = nil
+	}
+	_datastoreBackend = backend
+}
+
+// GetDatastore 返回当前使用的 Datastore, 第一次调用的时候才会创建
+func GetDatastore() (Datastore, error) {
+	_datastoreLock.Lock()
+	defer _datastoreLock.Unlock()
+	if _datastore != nil {
+		return _datastore, nil
+	}
+	ds, err := NewDatastore(_datastoreBackend)
+	if err != nil {
+		return nil, err
+	}
+	_datastore = ds
+	return _datastore, nil
+}
+
+// NewDatastore 根据 backend 创建对应的 Datastore, backend 为空的话用 etcd
+func NewDatastore(backend string) (Datastore, error) {
+	switch backend {
+	case consts.DATASTORE_ETCD, "":
+		return NewEtcdDatastore()
+	case consts.DATASTORE_KUBERNETES:
+		return NewKubernetesDatastore()
+	}
+	return nil, fmt.Errorf("不支持的 datastore: %s", backend)
+}
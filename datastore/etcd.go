@@ -0,0 +1,90 @@
+package datastore
+
+import (
+	"cni-demo/etcd"
+	"cni-demo/tools/logger"
+	"errors"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	oriEtcd "go.etcd.io/etcd/client/v3"
+)
+
+// etcdDatastore 直接把 key 存到 etcd 里, 就是以前 ipam 的存法
+type etcdDatastore struct {
+	client *etcd.EtcdClient
+}
+
+// etcdWatcher 把 etcd 的 watch 事件转成 Datastore 的
+type etcdWatcher struct {
+	watcher *etcd.Watcher
+}
+
+// NewEtcdDatastore 用 etcd.InitWithConfig 配置好的 etcd 客户端创建 Datastore
+func NewEtcdDatastore() (Datastore, error) {
+	etcd.Init()
+	client, err := etcd.GetEtcdClient()
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		return nil, errors.New("etcd client 初始化失败")
+	}
+	return &etcdDatastore{client: client}, nil
+}
+
+func (d *etcdDatastore) Get(key string) (string, error) {
+	return d.client.Get(key)
+}
+
+func (d *etcdDatastore) Exists(key string) (bool, error) {
+	k, err := d.client.GetKey(key)
+	if err != nil {
+		return false, err
+	}
+	return k != "", nil
+}
+
+func (d *etcdDatastore) Set(key, value string) error {
+	return d.client.Set(key, value)
+}
+
+func (d *etcdDatastore) Update(key string, fn func(value string) (string, error)) error {
+	return d.client.Update(key, fn)
+}
+
+func (d *etcdDatastore) DelPrefix(prefix string) error {
+	return d.client.Del(prefix, oriEtcd.WithPrefix())
+}
+
+func (d *etcdDatastore) GetWatcher() (Watcher, error) {
+	watcher, err := d.client.GetWatcher()
+	if err != nil {
+		return nil, err
+	}
+	// 出错之后 etcd 的 Watcher 会自己重试, 这里只记一下日志
+	go func() {
+		for {
+			select {
+			case err := <-watcher.Errors():
+				logger.Error("watch etcd 出错了", "err", err)
+			case <-watcher.Done():
+				return
+			}
+		}
+	}()
+	return &etcdWatcher{watcher: watcher}, nil
+}
+
+func (w *etcdWatcher) Watch(key string, cb WatchCallback) {
+	w.watcher.Watch(key, func(_type mvccpb.Event_EventType, key, value []byte) {
+		if _type == mvccpb.DELETE {
+			cb(EVENT_DELETE, key, value)
+			return
+		}
+		cb(EVENT_PUT, key, value)
+	})
+}
+
+func (w *etcdWatcher) Cancel() {
+	w.watcher.Cancel()
+}
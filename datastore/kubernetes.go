@@ -0,0 +1,488 @@
+package datastore
+
+import (
+	"cni-demo/client"
+	"cni-demo/consts"
+	"cni-demo/tools/logger"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// Update 的时候最多重试几次
+	maxUpdateRetries = 16
+	// CRD 刚创建出来的时候 apiserver 还不认识, 最多等这么久
+	crdEstablishTimeout  = 10 * time.Second
+	crdEstablishInterval = 500 * time.Millisecond
+)
+
+// errUpdateConflict 表示 Update 重试了 maxUpdateRetries 次都被别人抢先改了
+var errUpdateConflict = errors.New("更新 apiserver 上的对象时冲突太多次了")
+
+// keyKind 是 ipam 的 key 的种类, 每种对应一种对象或者对象上的一个字段
+type keyKind int
+
+const (
+	// /cni-demo/ipam/<subnet>/<mask>/pool
+	keyPool keyKind = iota
+	// /cni-demo/ipam/<subnet>/<mask>/maps
+	keyMaps
+	// /cni-demo/ipam/<subnet>/<mask>/<hostname>
+	keyAffinity
+	// /cni-demo/ipam/<subnet>/<mask>/<hostname>/<block>
+	keyAllocation
+	// /cni-demo/ipam/<subnet>/<mask>/<hostname>/<block>/range
+	keyRange
+	// /cni-demo/ipam/<subnet>/<mask>/<hostname>/<block>/owners
+	keyOwners
+)
+
+// ipamKey 是解析过的 ipam 的 key
+type ipamKey struct {
+	kind   keyKind
+	subnet string
+	mask   string
+	host   string
+	block  string
+}
+
+// parseKey 把 etcd 形式的 key 解析成 ipamKey
+func parseKey(key string) (*ipamKey, error) {
+	root := "/" + consts.IPAM_DATASTORE_PREFIX + "/"
+	if !strings.HasPrefix(key, root) {
+		return nil, fmt.Errorf("kubernetes datastore 不认识的 key: %s", key)
+	}
+	parts := strings.Split(strings.TrimPrefix(key, root), "/")
+	for _, part := range parts {
+		if part == "" {
+			return nil, fmt.Errorf("kubernetes datastore 不认识的 key: %s", key)
+		}
+	}
+	k := &ipamKey{subnet: parts[0]}
+	if len(parts) > 1 {
+		k.mask = parts[1]
+	}
+	switch {
+	case len(parts) == 3 && parts[2] == "pool":
+		k.kind = keyPool
+	case len(parts) == 3 && parts[2] == "maps":
+		k.kind = keyMaps
+	case len(parts) == 3:
+		k.kind = keyAffinity
+		k.host = parts[2]
+	case len(parts) == 4:
+		k.kind = keyAllocation
+		k.host, k.block = parts[2], parts[3]
+	case len(parts) == 5 && parts[4] == "range":
+		k.kind = keyRange
+		k.host, k.block = parts[2], parts[3]
+	case len(parts) == 5 && parts[4] == "owners":
+		k.kind = keyOwners
+		k.host, k.block = parts[2], parts[3]
+	default:
+		return nil, fmt.Errorf("kubernetes datastore 不认识的 key: %s", key)
+	}
+	return k, nil
+}
+
+// dashed 把 ip 里的点换成横线, 对象的名字里点是用来分隔的
+func dashed(ip string) string {
+	return strings.ReplaceAll(ip, ".", "-")
+}
+
+func (k *ipamKey) cidr() string {
+	return k.subnet + "/" + k.mask
+}
+
+// poolName 是 IPPool 的名字, 比如 10-244-0-0-16
+func (k *ipamKey) poolName() string {
+	return dashed(k.subnet) + "-" + k.mask
+}
+
+// affinityName 是 BlockAffinity 的名字, 比如 10-244-0-0-16.node1
+func (k *ipamKey) affinityName() string {
+	return k.poolName() + "." + strings.ToLower(k.host)
+}
+
+// allocationName 是 IPAllocation 的名字, 比如 10-244-0-0-16.node1.10-244-3-0
+func (k *ipamKey) allocationName() string {
+	return k.affinityName() + "." + dashed(k.block)
+}
+
+// splitValue 和 joinValue 在 etcd 里用分号拼起来的值和对象里的数组之间转换
+func splitValue(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ";")
+}
+
+func joinValue(values []string) string {
+	return strings.Join(values, ";")
+}
+
+// binding 描述一个 key 存在哪个对象的哪个字段上
+type binding struct {
+	res       client.CustomResource
+	kind      string
+	name      string
+	labels    map[string]string
+	newObject func() crdObject
+	get       func(obj crdObject) string
+	// set 除了写 key 对应的字段以外还会把 spec 里标识对象的字段补上
+	set func(obj crdObject, value string)
+}
+
+// binding 返回 key 对应的 binding, maps 不对应任何对象, 返回 nil
+func (k *ipamKey) binding() *binding {
+	pool := map[string]string{LABEL_POOL: k.poolName()}
+	node := map[string]string{LABEL_POOL: k.poolName(), LABEL_NODE: strings.ToLower(k.host)}
+	switch k.kind {
+	case keyPool:
+		return &binding{
+			res:       ipPoolResource,
+			kind:      "IPPool",
+			name:      k.poolName(),
+			labels:    pool,
+			newObject: func() crdObject { return &IPPool{} },
+			get:       func(obj crdObject) string { return joinValue(obj.(*IPPool).Spec.FreeBlocks) },
+			set: func(obj crdObject, value string) {
+				obj.(*IPPool).Spec = IPPoolSpec{CIDR: k.cidr(), FreeBlocks: splitValue(value)}
+			},
+		}
+	case keyAffinity:
+		return &binding{
+			res:       blockAffinityResource,
+			kind:      "BlockAffinity",
+			name:      k.affinityName(),
+			labels:    node,
+			newObject: func() crdObject { return &BlockAffinity{} },
+			get:       func(obj crdObject) string { return obj.(*BlockAffinity).Spec.Block },
+			set: func(obj crdObject, value string) {
+				obj.(*BlockAffinity).Spec = BlockAffinitySpec{CIDR: k.cidr(), Node: k.host, Block: value}
+			},
+		}
+	case keyAllocation, keyRange, keyOwners:
+		return &binding{
+			res:       ipAllocationResource,
+			kind:      "IPAllocation",
+			name:      k.allocationName(),
+			labels:    node,
+			newObject: func() crdObject { return &IPAllocation{} },
+			get: func(obj crdObject) string {
+				switch k.kind {
+				case keyRange:
+					return joinValue(obj.(*IPAllocation).Spec.Range)
+				case keyOwners:
+					return joinValue(obj.(*IPAllocation).Spec.Owners)
+				}
+				return joinValue(obj.(*IPAllocation).Spec.IPs)
+			},
+			set: func(obj crdObject, value string) {
+				spec := &obj.(*IPAllocation).Spec
+				spec.CIDR, spec.Node, spec.Block = k.cidr(), k.host, k.block
+				switch k.kind {
+				case keyRange:
+					spec.Range = splitValue(value)
+				case keyOwners:
+					spec.Owners = splitValue(value)
+				default:
+					spec.IPs = splitValue(value)
+				}
+			},
+		}
+	}
+	return nil
+}
+
+// kubernetesDatastore 把 ipam 的数据存成 apiserver 上的自定义资源, 不需要 cni 直接访问 etcd
+//   - pool 存成 IPPool
+//   - 每个节点分到的网段存成 BlockAffinity, maps 是 list 所有的 BlockAffinity 拼出来的
+//   - 每个网段已经用掉的 ip, range 和 ip 属于哪个 pod 存成 IPAllocation
+//
+// 并发的修改靠 resourceVersion 做乐观锁, 被别人抢先改了的话 apiserver 返回 409, 重新读一遍再改
+type kubernetesDatastore struct {
+	k8s *client.LightK8sClient
+}
+
+// kubernetesWatcher 每 watch 一个 key 就起一个 Reflector, Cancel 的时候一起停掉
+type kubernetesWatcher struct {
+	ds   *kubernetesDatastore
+	stop chan struct{}
+	once sync.Once
+}
+
+// NewKubernetesDatastore 用 client.InitDefault 找到的配置创建 kubernetes datastore, CRD 不存在的话会自动创建
+func NewKubernetesDatastore() (Datastore, error) {
+	err := client.InitDefault()
+	if err != nil {
+		return nil, err
+	}
+	k8s, err := client.GetLightK8sClient()
+	if err != nil {
+		return nil, err
+	}
+	return newKubernetesDatastore(k8s)
+}
+
+func newKubernetesDatastore(k8s *client.LightK8sClient) (*kubernetesDatastore, error) {
+	for _, crd := range customResourceDefinitions() {
+		err := k8s.Set().CreateCustomResourceDefinition(crd)
+		if err != nil {
+			return nil, err
+		}
+	}
+	d := &kubernetesDatastore{k8s: k8s}
+	err := d.waitForCRDs()
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// waitForCRDs 等到 apiserver 能 list 所有的自定义资源为止
+func (d *kubernetesDatastore) waitForCRDs() error {
+	deadline := time.Now().Add(crdEstablishTimeout)
+	for _, res := range []client.CustomResource{ipPoolResource, blockAffinityResource, ipAllocationResource} {
+		for {
+			_, _, err := d.k8s.Get().ListCustom(res, &client.ListOptions{Limit: 1})
+			if err == nil {
+				break
+			}
+			if !client.IsNotFound(err) || time.Now().After(deadline) {
+				return err
+			}
+			time.Sleep(crdEstablishInterval)
+		}
+	}
+	return nil
+}
+
+// read 读出 binding 对应的对象, 不存在的话返回一个空的对象
+func (d *kubernetesDatastore) read(b *binding) (crdObject, bool, error) {
+	obj := b.newObject()
+	err := d.k8s.Get().Custom(b.res, b.name, obj)
+	if client.IsNotFound(err) {
+		return obj, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return obj, true, nil
+}
+
+// write 把对象写回去, 已经存在的话带着读出来时的 resourceVersion 更新, 否则创建
+func (d *kubernetesDatastore) write(b *binding, obj crdObject, exists bool) error {
+	obj.setTypeMeta(metav1.TypeMeta{APIVersion: b.res.GroupVersion(), Kind: b.kind})
+	if exists {
+		return d.k8s.Set().UpdateCustom(b.res, b.name, obj, nil)
+	}
+	obj.SetName(b.name)
+	obj.SetLabels(b.labels)
+	return d.k8s.Set().CreateCustom(b.res, obj, nil)
+}
+
+// getMaps 把某个网段下所有的 BlockAffinity 拼成和 etcd 里一样的 maps, 也就是网段到主机名的 json
+func (d *kubernetesDatastore) getMaps(k *ipamKey) (string, error) {
+	items, _, err := d.k8s.Get().ListCustom(blockAffinityResource, &client.ListOptions{
+		LabelSelector: LABEL_POOL + "=" + k.poolName(),
+	})
+	if err != nil {
+		return "", err
+	}
+	maps := map[string]string{}
+	for _, item := range items {
+		affinity := &BlockAffinity{}
+		err := json.Unmarshal(item, affinity)
+		if err != nil {
+			return "", err
+		}
+		maps[affinity.Spec.Block] = affinity.Spec.Node
+	}
+	if len(maps) == 0 {
+		return "", nil
+	}
+	res, err := json.Marshal(maps)
+	if err != nil {
+		return "", err
+	}
+	return string(res), nil
+}
+
+// lookup 返回 key 当前的值以及 key 是否存在
+func (d *kubernetesDatastore) lookup(k *ipamKey) (string, bool, error) {
+	if k.kind == keyMaps {
+		value, err := d.getMaps(k)
+		return value, value != "", err
+	}
+	b := k.binding()
+	obj, exists, err := d.read(b)
+	if err != nil || !exists {
+		return "", false, err
+	}
+	value := b.get(obj)
+	// range 和 owners 只是 IPAllocation 上的字段, 没有设置过的话就当不存在
+	if (k.kind == keyRange || k.kind == keyOwners) && value == "" {
+		return "", false, nil
+	}
+	return value, true, nil
+}
+
+func (d *kubernetesDatastore) Get(key string) (string, error) {
+	k, err := parseKey(key)
+	if err != nil {
+		return "", err
+	}
+	value, _, err := d.lookup(k)
+	return value, err
+}
+
+func (d *kubernetesDatastore) Exists(key string) (bool, error) {
+	k, err := parseKey(key)
+	if err != nil {
+		return false, err
+	}
+	_, exists, err := d.lookup(k)
+	return exists, err
+}
+
+func (d *kubernetesDatastore) Set(key, value string) error {
+	return d.Update(key, func(string) (string, error) {
+		return value, nil
+	})
+}
+
+func (d *kubernetesDatastore) Update(key string, fn func(value string) (string, error)) error {
+	k, err := parseKey(key)
+	if err != nil {
+		return err
+	}
+	// maps 是从 BlockAffinity 推出来的, 写 BlockAffinity 的时候就已经更新了
+	if k.kind == keyMaps {
+		return nil
+	}
+	b := k.binding()
+	for i := 0; i < maxUpdateRetries; i++ {
+		obj, exists, err := d.read(b)
+		if err != nil {
+			return err
+		}
+		value := ""
+		if exists {
+			value = b.get(obj)
+		}
+		newValue, err := fn(value)
+		if err != nil {
+			return err
+		}
+		b.set(obj, newValue)
+		err = d.write(b, obj, exists)
+		if !client.IsConflict(err) {
+			return err
+		}
+	}
+	return errUpdateConflict
+}
+
+// DelPrefix 只支持删除所有的数据或者某个网段下的所有数据, ipam 也只会这么删
+func (d *kubernetesDatastore) DelPrefix(prefix string) error {
+	root := "/" + consts.IPAM_DATASTORE_PREFIX
+	if !strings.HasPrefix(prefix, root) {
+		return fmt.Errorf("kubernetes datastore 不认识的 key: %s", prefix)
+	}
+	opts := &client.ListOptions{}
+	if rest := strings.Trim(strings.TrimPrefix(prefix, root), "/"); rest != "" {
+		parts := strings.Split(rest, "/")
+		if len(parts) != 2 {
+			return fmt.Errorf("kubernetes datastore 只支持按整个网段删除: %s", prefix)
+		}
+		opts.LabelSelector = LABEL_POOL + "=" + (&ipamKey{subnet: parts[0], mask: parts[1]}).poolName()
+	}
+	for _, res := range []client.CustomResource{ipAllocationResource, blockAffinityResource, ipPoolResource} {
+		items, _, err := d.k8s.Get().ListCustom(res, opts)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			obj := &struct {
+				Metadata metav1.ObjectMeta `json:"metadata"`
+			}{}
+			err := json.Unmarshal(item, obj)
+			if err != nil {
+				return err
+			}
+			err = d.k8s.Set().DeleteCustom(res, obj.Metadata.Name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d *kubernetesDatastore) GetWatcher() (Watcher, error) {
+	return &kubernetesWatcher{ds: d, stop: make(chan struct{})}, nil
+}
+
+// Watch 和 etcd 一样只通知之后的变化
+// 一个对象上有好几个 key, 所以每收到一个事件都重新算一遍 key 的值, 只有值真的变了才回调
+// 重新 list 之后也会算一遍, 这样断开期间漏掉的变化也能补上
+func (w *kubernetesWatcher) Watch(key string, cb WatchCallback) {
+	k, err := parseKey(key)
+	if err != nil {
+		logger.Error("watch 失败", "key", key, "err", err)
+		return
+	}
+	opts := &client.ListOptions{}
+	res := blockAffinityResource
+	if k.kind == keyMaps {
+		opts.LabelSelector = LABEL_POOL + "=" + k.poolName()
+	} else {
+		b := k.binding()
+		res = b.res
+		opts.FieldSelector = "metadata.name=" + b.name
+	}
+
+	listed := false
+	last, lastExists := "", false
+	notify := func() {
+		value, exists, err := w.ds.lookup(k)
+		if err != nil {
+			logger.Error("获取失败", "key", key, "err", err)
+			return
+		}
+		switch {
+		case exists && (!lastExists || value != last):
+			cb(EVENT_PUT, []byte(key), []byte(value))
+		case !exists && lastExists:
+			cb(EVENT_DELETE, []byte(key), nil)
+		}
+		last, lastExists = value, exists
+	}
+	lw := w.ds.k8s.Get().CustomListWatch(res, opts, func([]json.RawMessage) {
+		if listed {
+			notify()
+			return
+		}
+		listed = true
+		value, exists, err := w.ds.lookup(k)
+		if err == nil {
+			last, lastExists = value, exists
+		}
+	})
+	go client.NewReflector("datastore "+key, lw, func(*client.WatchEvent) {
+		notify()
+	}).Run(w.stop)
+}
+
+func (w *kubernetesWatcher) Cancel() {
+	w.once.Do(func() {
+		close(w.stop)
+	})
+}
@@ -0,0 +1,194 @@
+package datastore
+
+import (
+	"cni-demo/client"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeApiserver 在内存里存自定义资源, 只实现了 datastore 用到的那部分接口
+type fakeApiserver struct {
+	lock    sync.Mutex
+	rv      int
+	objects map[string]map[string]map[string]interface{}
+}
+
+func (f *fakeApiserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if strings.HasSuffix(r.URL.Path, "/customresourcedefinitions") {
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/apis/"+CRD_GROUP+"/"+CRD_VERSION+"/"), "/")
+	if f.objects[parts[0]] == nil {
+		f.objects[parts[0]] = map[string]map[string]interface{}{}
+	}
+	objects := f.objects[parts[0]]
+	reply := func(code int, body interface{}) {
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(body)
+	}
+
+	if len(parts) == 1 && r.Method == http.MethodGet {
+		items := []interface{}{}
+		for name, obj := range objects {
+			meta := obj["metadata"].(map[string]interface{})
+			if selector := r.URL.Query().Get("fieldSelector"); selector != "" && selector != "metadata.name="+name {
+				continue
+			}
+			if selector := r.URL.Query().Get("labelSelector"); selector != "" {
+				kv := strings.SplitN(selector, "=", 2)
+				labels, _ := meta["labels"].(map[string]interface{})
+				if labels[kv[0]] != kv[1] {
+					continue
+				}
+			}
+			items = append(items, obj)
+		}
+		reply(http.StatusOK, map[string]interface{}{
+			"metadata": map[string]interface{}{"resourceVersion": strconv.Itoa(f.rv)},
+			"items":    items,
+		})
+		return
+	}
+
+	obj := map[string]interface{}{}
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		json.NewDecoder(r.Body).Decode(&obj)
+	}
+	name := ""
+	if len(parts) > 1 {
+		name = parts[1]
+	} else {
+		name = obj["metadata"].(map[string]interface{})["name"].(string)
+	}
+	old, exists := objects[name]
+	switch {
+	case r.Method == http.MethodGet && exists:
+		reply(http.StatusOK, old)
+	case r.Method == http.MethodDelete && exists:
+		delete(objects, name)
+		reply(http.StatusOK, old)
+	case r.Method == http.MethodPost && !exists, r.Method == http.MethodPut && exists:
+		if exists && obj["metadata"].(map[string]interface{})["resourceVersion"] != old["metadata"].(map[string]interface{})["resourceVersion"] {
+			reply(http.StatusConflict, map[string]interface{}{})
+			return
+		}
+		f.rv++
+		obj["metadata"].(map[string]interface{})["resourceVersion"] = strconv.Itoa(f.rv)
+		objects[name] = obj
+		reply(http.StatusCreated, obj)
+	case r.Method == http.MethodPost:
+		reply(http.StatusConflict, map[string]interface{}{})
+	default:
+		reply(http.StatusNotFound, map[string]interface{}{})
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	test := assert.New(t)
+
+	k, err := parseKey("/cni-demo/ipam/10.244.0.0/16/pool")
+	test.Nil(err)
+	test.Equal(keyPool, k.kind)
+	test.Equal("10-244-0-0-16", k.binding().name)
+
+	k, err = parseKey("/cni-demo/ipam/10.244.0.0/16/maps")
+	test.Nil(err)
+	test.Equal(keyMaps, k.kind)
+	test.Nil(k.binding())
+
+	k, err = parseKey("/cni-demo/ipam/10.244.0.0/16/Node-1")
+	test.Nil(err)
+	test.Equal(keyAffinity, k.kind)
+	test.Equal("10-244-0-0-16.node-1", k.binding().name)
+
+	k, err = parseKey("/cni-demo/ipam/10.244.0.0/16/node-1/10.244.3.0/range")
+	test.Nil(err)
+	test.Equal(keyRange, k.kind)
+	test.Equal("10-244-0-0-16.node-1.10-244-3-0", k.binding().name)
+
+	k, err = parseKey("/cni-demo/ipam/10.244.0.0/16/node-1/10.244.3.0/owners")
+	test.Nil(err)
+	test.Equal(keyOwners, k.kind)
+	test.Equal("10-244-0-0-16.node-1.10-244-3-0", k.binding().name)
+
+	_, err = parseKey("/cni-demo/ipam/10.244.0.0/16")
+	test.NotNil(err)
+	_, err = parseKey("/other/10.244.0.0/16/pool")
+	test.NotNil(err)
+}
+
+func TestKubernetesDatastore(t *testing.T) {
+	test := assert.New(t)
+	srv := httptest.NewServer(&fakeApiserver{objects: map[string]map[string]map[string]interface{}{}})
+	defer srv.Close()
+	client.InitWithConfig(&client.Config{Host: srv.URL})
+	k8s, err := client.GetLightK8sClient()
+	test.Nil(err)
+	d, err := newKubernetesDatastore(k8s)
+	test.Nil(err)
+
+	root := "/cni-demo/ipam/10.244.0.0/16"
+	test.Nil(d.Set(root+"/pool", "10.244.1.0;10.244.2.0;10.244.3.0"))
+	test.Nil(d.Set(root+"/node-1", "10.244.1.0"))
+	test.Nil(d.Set(root+"/node-2", "10.244.2.0"))
+	value, err := d.Get(root + "/pool")
+	test.Nil(err)
+	test.Equal("10.244.1.0;10.244.2.0;10.244.3.0", value)
+
+	// maps 是从 BlockAffinity 拼出来的
+	maps, err := d.Get(root + "/maps")
+	test.Nil(err)
+	test.JSONEq(`{"10.244.1.0":"node-1","10.244.2.0":"node-2"}`, maps)
+
+	// ip 记录和 range 存在同一个 IPAllocation 上, 互不影响
+	exists, err := d.Exists(root + "/node-1/10.244.1.0/range")
+	test.Nil(err)
+	test.False(exists)
+	test.Nil(d.Set(root+"/node-1/10.244.1.0/range", "10.244.1.10;10.244.1.11"))
+	test.Nil(d.Set(root+"/node-1/10.244.1.0", "10.244.1.10"))
+	exists, err = d.Exists(root + "/node-1/10.244.1.0/range")
+	test.Nil(err)
+	test.True(exists)
+	value, err = d.Get(root + "/node-1/10.244.1.0/range")
+	test.Nil(err)
+	test.Equal("10.244.1.10;10.244.1.11", value)
+	test.Nil(d.Set(root+"/node-1/10.244.1.0/owners", "10.244.1.10=default/nginx"))
+	value, err = d.Get(root + "/node-1/10.244.1.0/owners")
+	test.Nil(err)
+	test.Equal("10.244.1.10=default/nginx", value)
+	value, err = d.Get(root + "/node-1/10.244.1.0")
+	test.Nil(err)
+	test.Equal("10.244.1.10", value)
+
+	// 第一次算完之后被别人抢先改了, 应该重新读一遍再算, 两边的修改都不会丢
+	calls := 0
+	err = d.Update(root+"/node-1/10.244.1.0", func(value string) (string, error) {
+		calls++
+		if calls == 1 {
+			test.Nil(d.Set(root+"/node-1/10.244.1.0", value+";10.244.1.12"))
+		}
+		return value + ";10.244.1.11", nil
+	})
+	test.Nil(err)
+	test.Equal(2, calls)
+	value, err = d.Get(root + "/node-1/10.244.1.0")
+	test.Nil(err)
+	test.Equal("10.244.1.10;10.244.1.12;10.244.1.11", value)
+
+	test.Nil(d.DelPrefix("/cni-demo/ipam"))
+	for _, key := range []string{"/pool", "/maps", "/node-1", "/node-1/10.244.1.0"} {
+		value, err = d.Get(root + key)
+		test.Nil(err)
+		test.Equal("", value)
+	}
+}
@@ -1,18 +1,13 @@
 package etcd
 
 import (
-	"cni-demo/client"
-	"cni-demo/tools/utils"
+	"cni-demo/tools/logger"
 	"context"
 	"errors"
-	"fmt"
-	"io/ioutil"
-	"os"
 	"strings"
 	"time"
 
 	"go.etcd.io/etcd/api/v3/mvccpb"
-	"go.etcd.io/etcd/client/pkg/v3/transport"
 	etcd "go.etcd.io/etcd/client/v3"
 )
 
@@ -20,6 +15,8 @@ import (
 type WatchCallback func(_type mvccpb.Event_EventType, key, value []byte)
 
 // EtcdConfig 结构体用于定义 etcd 客户端的相关配置。
+// 可以写在网络配置的 etcd 字段里, 也可以用 envconfig 标签里的环境变量配置, 见 LoadEtcdConfig
+// EtcdEndpoints 和 EtcdAuthority 都可以用逗号分隔写多个, EtcdDiscoverySrv 是用来做 SRV 发现的域名
 type EtcdConfig struct {
 	EtcdScheme       string `json:"etcdScheme" envconfig:"APIV1_ETCD_SCHEME" default:""`
 	EtcdAuthority    string `json:"etcdAuthority" envconfig:"APIV1_ETCD_AUTHORITY" default:""`
@@ -32,13 +29,15 @@ type EtcdConfig struct {
 	EtcdCACertFile   string `json:"etcdCACertFile" envconfig:"APIV1_ETCD_CA_CERT_FILE"`
 }
 
-// EtcdConfig 结构体用于定义 etcd 客户端的相关配置。
+// Watcher 结构体用于 watch 一批 key, Cancel 之后上面所有的 watch 都会停掉, 见 watch.go
 type Watcher struct {
 	client        *EtcdClient
 	watcher       etcd.Watcher
 	cancelWatcher context.CancelFunc
 	ctx           context.Context
-	// kMap map[string]
+	errors        chan error
+	// 断开之后隔多久重新 watch
+	retryInterval time.Duration
 }
 
 // EtcdClient 结构体用于封装 etcd 客户端及其操作。
@@ -51,41 +50,50 @@ type EtcdClient struct {
 const (
 	clientTimeout = 30 * time.Second
 	etcdTimeout   = 2 * time.Second
+	// Update 的时候最多重试几次
+	maxUpdateRetries = 16
 )
 
-// newEtcdClient 根据给定的配置创建一个新的 etcd 客户端。
-func newEtcdClient(config *EtcdConfig) (*etcd.Client, error) {
-	var etcdLocation []string
-	if config.EtcdAuthority != "" {
-		etcdLocation = []string{config.EtcdScheme + "://" + config.EtcdAuthority}
-	}
-	if config.EtcdEndpoints != "" {
-		etcdLocation = strings.Split(config.EtcdEndpoints, ",")
-	}
+// ErrUpdateConflict 表示 Update 重试了 maxUpdateRetries 次都被别人抢先改了
+var ErrUpdateConflict = errors.New("更新 etcd 的时候冲突太多次了")
 
-	if len(etcdLocation) == 0 {
-		return nil, errors.New("找不到 etcd")
+// newEtcdClient 根据给定的配置创建一个新的 etcd 客户端。
+func newEtcdClient(config *EtcdConfig) (*etcd.Client, []string, error) {
+	endpoints, err := config.endpoints()
+	if err != nil {
+		return nil, nil, err
 	}
-
-	tlsInfo := transport.TLSInfo{
-		CertFile:      config.EtcdCertFile,
-		KeyFile:       config.EtcdKeyFile,
-		TrustedCAFile: config.EtcdCACertFile,
+	tlsConfig, err := config.tlsConfig(endpoints)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	tlsConfig, err := tlsInfo.ClientConfig()
-
 	client, err := etcd.New(etcd.Config{
-		Endpoints:   etcdLocation,
+		Endpoints:   endpoints,
 		TLS:         tlsConfig,
+		Username:    config.EtcdUsername,
+		Password:    config.EtcdPassword,
 		DialTimeout: clientTimeout,
 	})
-
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	return client, endpoints, nil
+}
 
-	return client, nil
+// getStatus 依次问每个 endpoint 的状态, 有一个能回就行
+func getStatus(client *etcd.Client, endpoints []string) (*etcd.StatusResponse, error) {
+	var lastErr error
+	for _, ep := range endpoints {
+		ctx, cancel := context.WithTimeout(context.Background(), clientTimeout)
+		status, err := client.Status(ctx, ep)
+		cancel()
+		if err == nil {
+			return status, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
 }
 
 var __GetEtcdClient func() (*EtcdClient, error)
@@ -101,76 +109,49 @@ func GetEtcdClient() (*EtcdClient, error) {
 }
 
 // _GetEtcdClient 函数用于初始化并返回一个 etcd 客户端实例。
-func _GetEtcdClient() func() (*EtcdClient, error) {
+// netconf 是网络配置里的 etcd 配置, 可以为空, 会和环境变量以及默认值合并, 见 LoadEtcdConfig
+func _GetEtcdClient(netconf *EtcdConfig) func() (*EtcdClient, error) {
 	var _client *EtcdClient
 
 	return func() (*EtcdClient, error) {
 		if _client != nil {
 			return _client, nil
-		} else {
-			// curl https://192.168.64.19:6443/openapi/v2 --cacert ./ca.crt --cert ./tmp_ca.crt --key ./tmp.key
-			// ETCDCTL_API=3 etcdctl --endpoints https://192.168.64.19:2379 --cacert /etc/kubernetes/pki/etcd/ca.crt --cert /etc/kubernetes/pki/etcd/healthcheck-client.crt --key /etc/kubernetes/pki/etcd/healthcheck-client.key get / --prefix --keys-only
-
-			configPath := client.GetClientConfigPath()
-			confByte, err := ioutil.ReadFile(configPath)
-			if err != nil {
-				panic(fmt.Sprintf("读取 path: %s 失败: %s", configPath, err.Error()))
-			}
-			master, err := client.GetLineFromYaml(string(confByte), "server")
-			if err != nil {
-				panic(fmt.Sprintf("在 etcd 初始化时尝试获取 master 节点失败: %s", err.Error()))
-			}
-			etcdEp := ""
-			if master != "" {
-				masteIp := strings.Split(master, ":")
-				if len(masteIp) == 3 {
-					etcdEp = fmt.Sprintf("%s:%s:2379", masteIp[0], masteIp[1])
-				}
-			}
-			if os.Getenv("ETCD_ENDPOINT") != "" {
-				etcdEp = os.Getenv("ETCD_ENDPOINT")
-			}
-			if etcdEp == "" {
-				panic("get etcd endpoint failed from env")
-			}
-			client, err := newEtcdClient(&EtcdConfig{
-				EtcdEndpoints:  etcdEp,
-				EtcdCertFile:   "/etc/kubernetes/pki/etcd/healthcheck-client.crt",
-				EtcdKeyFile:    "/etc/kubernetes/pki/etcd/healthcheck-client.key",
-				EtcdCACertFile: "/etc/kubernetes/pki/etcd/ca.crt",
-			})
-
-			if err != nil {
-				return nil, err
-			}
-
-			status, err := client.Status(context.TODO(), etcdEp)
-
-			if err != nil {
-				utils.WriteLog("无法获取到 etcd 版本")
-				return nil, err
-			}
-
-			if client != nil {
-				_client = &EtcdClient{
-					client: client,
-				}
-
-				if status != nil && status.Version != "" {
-					_client.Version = status.Version
-				}
-				// fmt.Println("etcd 客户端初始化成功")
-				return _client, nil
-			}
 		}
-		return nil, errors.New("初始化 etcd client 失败")
+		config, err := LoadEtcdConfig(netconf)
+		if err != nil {
+			logger.Error("获取 etcd 的配置失败", "err", err)
+			return nil, err
+		}
+		client, endpoints, err := newEtcdClient(config)
+		if err != nil {
+			logger.Error("创建 etcd client 失败", "err", err)
+			return nil, err
+		}
+
+		status, err := getStatus(client, endpoints)
+		if err != nil {
+			logger.Error("无法获取到 etcd 版本", "endpoints", strings.Join(endpoints, ","), "err", err)
+			client.Close()
+			return nil, err
+		}
+
+		_client = &EtcdClient{
+			client:  client,
+			Version: status.Version,
+		}
+		return _client, nil
 	}
 }
 
-// Init 函数用于初始化 etcd 客户端。
+// Init 函数用于初始化 etcd 客户端, 配置全部来自环境变量和默认值。
 func Init() {
+	InitWithConfig(nil)
+}
+
+// InitWithConfig 函数用于用网络配置里的 etcd 配置初始化 etcd 客户端, 已经初始化过的话什么也不做。
+func InitWithConfig(config *EtcdConfig) {
 	if __GetEtcdClient == nil {
-		__GetEtcdClient = _GetEtcdClient()
+		__GetEtcdClient = _GetEtcdClient(config)
 	}
 }
 
@@ -193,6 +174,39 @@ func (c *EtcdClient) Del(key string, opts ...etcd.OpOption) error {
 	return err
 }
 
+// Update 方法用 fn 基于 key 当前的值算出新的值再写回去, key 不存在的时候 fn 拿到的是空字符串
+// 写的时候会比较 ModRevision, 读完之后被别人改过的话就重新读一遍再算, 用来代替先 Get 再 Set
+func (c *EtcdClient) Update(key string, fn func(value string) (string, error)) error {
+	for i := 0; i < maxUpdateRetries; i++ {
+		resp, err := c.client.Get(context.TODO(), key)
+		if err != nil {
+			return err
+		}
+		value := ""
+		var revision int64
+		if len(resp.Kvs) > 0 {
+			value = string(resp.Kvs[0].Value)
+			revision = resp.Kvs[0].ModRevision
+		}
+		newValue, err := fn(value)
+		if err != nil {
+			return err
+		}
+		// key 不存在的时候 ModRevision 是 0, 所以同样可以防止两边同时创建
+		txn, err := c.client.Txn(context.TODO()).
+			If(etcd.Compare(etcd.ModRevision(key), "=", revision)).
+			Then(etcd.OpPut(key, newValue)).
+			Commit()
+		if err != nil {
+			return err
+		}
+		if txn.Succeeded {
+			return nil
+		}
+	}
+	return ErrUpdateConflict
+}
+
 // GetVersion 方法用于获取 etcd 中某个键的版本信息。
 func (c *EtcdClient) GetVersion(key string, opts ...etcd.OpOption) (int64, error) {
 	resp, err := c.client.Get(context.TODO(), key, opts...)
@@ -275,20 +289,6 @@ func (c *EtcdClient) GetAllKey(key string, opts ...etcd.OpOption) ([]string, err
 	return res, nil
 }
 
-// Watch 方法用于在 etcd 中监听一个键的变化，并通过回调函数处理变化事件。
-func (c *EtcdClient) Watch(key string, cb WatchCallback) {
-	go func() {
-		for {
-			change := c.client.Watch(context.Background(), key)
-			for wresp := range change {
-				for _, ev := range wresp.Events {
-					cb(ev.Type, ev.Kv.Key, ev.Kv.Value)
-				}
-			}
-		}
-	}()
-}
-
 // Done 方法返回一个 channel，当 Watcher 结束时会关闭该 channel。
 func (w *Watcher) Done() <-chan struct{} {
 	return w.ctx.Done()
@@ -312,26 +312,7 @@ func (w *Watcher) Value(_any interface{}) interface{} {
 // Cancel 方法用于取消 Watcher 的监听操作。
 func (w *Watcher) Cancel() {
 	w.cancelWatcher()
-}
-
-// Watch 方法用于监听一个键的变化，并通过回调函数处理变化事件。
-func (w *Watcher) Watch(key string, cb WatchCallback) {
-	go func() {
-		defer func() {
-			w.Cancel()
-			time.Sleep(2 * time.Second)
-		}()
-		for {
-			change := w.watcher.Watch(context.Background(), key)
-			for wresp := range change {
-				for _, ev := range wresp.Events {
-					cb(ev.Type, ev.Kv.Key, ev.Kv.Value)
-				}
-			}
-		}
-	}()
-	// TODO: sleep change to sync
-	time.Sleep(1 * time.Second)
+	w.watcher.Close()
 }
 
 // GetWatcher 方法返回一个新的 Watcher 实例。
@@ -345,6 +326,8 @@ func (c *EtcdClient) GetWatcher() (*Watcher, error) {
 	ctx, cancelFunc := context.WithCancel(context.TODO())
 	watcher.cancelWatcher = cancelFunc
 	watcher.ctx = ctx
+	watcher.errors = make(chan error, watchErrorsBuffer)
+	watcher.retryInterval = watchRetryInterval
 
 	return watcher, nil
 }
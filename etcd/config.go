@@ -0,0 +1,151 @@
+package etcd
+
+import (
+	"cni-demo/client"
+	"cni-demo/consts"
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+
+	"go.etcd.io/etcd/client/pkg/v3/srv"
+	"go.etcd.io/etcd/client/pkg/v3/transport"
+)
+
+// errNoEndpoints 表示既没有配置 endpoints/authority 也没有配置 SRV 发现
+var errNoEndpoints = errors.New("没有配置 etcd 的地址")
+
+// 以前的版本只认这一个环境变量, 为了兼容还是读一下
+const legacyEndpointEnv = "ETCD_ENDPOINT"
+
+// loadEnv 用 envconfig 标签对应的环境变量填上 config 中没有配置的字段, 都没有的话用 default 标签的值
+// 网络配置里写了的优先, 因为 kubelet 调 cni 插件的时候环境变量是不受我们控制的
+func (config *EtcdConfig) loadEnv() {
+	v := reflect.ValueOf(config).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() != reflect.String || field.String() != "" {
+			continue
+		}
+		if val, ok := os.LookupEnv(t.Field(i).Tag.Get("envconfig")); ok && val != "" {
+			field.SetString(val)
+			continue
+		}
+		field.SetString(t.Field(i).Tag.Get("default"))
+	}
+	if config.EtcdEndpoints == "" {
+		config.EtcdEndpoints = os.Getenv(legacyEndpointEnv)
+	}
+}
+
+// hasLocation 判断有没有配置任何一种找到 etcd 的方式
+func (config *EtcdConfig) hasLocation() bool {
+	return config.EtcdEndpoints != "" || config.EtcdAuthority != "" || config.EtcdDiscoverySrv != ""
+}
+
+// useKubeadmDefaults 没有配置 etcd 的时候, 和以前一样假设集群是 kubeadm 部署的:
+// etcd 和 apiserver 在同一台机器上, 证书用 healthcheck-client 的
+// apiserver 的地址在 pod 里的时候从 service account 能访问到的 endpoints 里拿, 否则从本机的 kubeconfig 里拿
+func (config *EtcdConfig) useKubeadmDefaults() error {
+	host, err := client.GetAPIServerHost()
+	if err != nil {
+		return err
+	}
+	config.EtcdEndpoints = "https://" + net.JoinHostPort(host, consts.ETCD_DEFAULT_PORT)
+	if config.EtcdCACertFile == "" && config.EtcdCertFile == "" && config.EtcdKeyFile == "" {
+		config.EtcdCACertFile = consts.KUBE_ETCD_DEFAULT_CA_PATH
+		config.EtcdCertFile = consts.KUBE_ETCD_DEFAULT_CERT_PATH
+		config.EtcdKeyFile = consts.KUBE_ETCD_DEFAULT_KEY_PATH
+	}
+	return nil
+}
+
+// LoadEtcdConfig 合并网络配置, 环境变量和默认值, 得到最终连接 etcd 用的配置
+// 优先级: 网络配置 > APIV1_ETCD_* 环境变量 > 从 apiserver 的地址推出来的 kubeadm 默认值
+func LoadEtcdConfig(netconf *EtcdConfig) (*EtcdConfig, error) {
+	config := &EtcdConfig{}
+	if netconf != nil {
+		*config = *netconf
+	}
+	config.loadEnv()
+	if !config.hasLocation() {
+		err := config.useKubeadmDefaults()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// tlsInfo 返回证书的配置
+func (config *EtcdConfig) tlsInfo() transport.TLSInfo {
+	return transport.TLSInfo{
+		CertFile:      config.EtcdCertFile,
+		KeyFile:       config.EtcdKeyFile,
+		TrustedCAFile: config.EtcdCACertFile,
+	}
+}
+
+// scheme 返回 authority 方式下要用的协议, 没配的话有证书就用 https, 否则用 http
+func (config *EtcdConfig) scheme() string {
+	if config.EtcdScheme != "" {
+		return config.EtcdScheme
+	}
+	if config.tlsInfo().Empty() && config.EtcdCACertFile == "" {
+		return "http"
+	}
+	return "https"
+}
+
+// endpoints 解析出要连接的 etcd 地址, 优先级: endpoints > authority > SRV 发现
+// endpoints 和 authority 都可以用逗号分隔写多个
+func (config *EtcdConfig) endpoints() ([]string, error) {
+	split := func(s string) []string {
+		var res []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				res = append(res, item)
+			}
+		}
+		return res
+	}
+
+	switch {
+	case config.EtcdEndpoints != "":
+		return split(config.EtcdEndpoints), nil
+	case config.EtcdAuthority != "":
+		var res []string
+		for _, authority := range split(config.EtcdAuthority) {
+			res = append(res, config.scheme()+"://"+authority)
+		}
+		return res, nil
+	case config.EtcdDiscoverySrv != "":
+		clients, err := srv.GetClient(consts.ETCD_DISCOVERY_SRV_SERVICE_NAME, config.EtcdDiscoverySrv, "")
+		if err != nil {
+			return nil, err
+		}
+		if len(clients.Endpoints) == 0 {
+			return nil, errors.New("通过 SRV 记录 " + config.EtcdDiscoverySrv + " 没有发现 etcd")
+		}
+		return clients.Endpoints, nil
+	}
+	return nil, errNoEndpoints
+}
+
+// tlsConfig 返回连接 etcd 用的 tls 配置, 没有配置证书并且也没有 https 的地址的话返回 nil
+func (config *EtcdConfig) tlsConfig(endpoints []string) (*tls.Config, error) {
+	info := config.tlsInfo()
+	if !info.Empty() || info.TrustedCAFile != "" {
+		return info.ClientConfig()
+	}
+	for _, ep := range endpoints {
+		if strings.HasPrefix(ep, "https://") {
+			// 没有给证书就用系统的根证书来校验
+			return &tls.Config{}, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,65 @@
+package etcd
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadEtcdConfig(t *testing.T) {
+	test := assert.New(t)
+
+	os.Setenv("APIV1_ETCD_ENDPOINTS", "http://10.0.0.1:2379")
+	os.Setenv("APIV1_ETCD_USERNAME", "root")
+	os.Setenv("APIV1_ETCD_PASSWORD", "from-env")
+	defer os.Unsetenv("APIV1_ETCD_ENDPOINTS")
+	defer os.Unsetenv("APIV1_ETCD_USERNAME")
+	defer os.Unsetenv("APIV1_ETCD_PASSWORD")
+
+	// 网络配置里写了的优先, 没写的用环境变量
+	config, err := LoadEtcdConfig(&EtcdConfig{
+		EtcdEndpoints: "https://10.0.0.2:2379, https://10.0.0.3:2379",
+		EtcdPassword:  "from-netconf",
+	})
+	test.Nil(err)
+	test.Equal("root", config.EtcdUsername)
+	test.Equal("from-netconf", config.EtcdPassword)
+	endpoints, err := config.endpoints()
+	test.Nil(err)
+	test.Equal([]string{"https://10.0.0.2:2379", "https://10.0.0.3:2379"}, endpoints)
+	tlsConfig, err := config.tlsConfig(endpoints)
+	test.Nil(err)
+	test.NotNil(tlsConfig)
+
+	config, err = LoadEtcdConfig(nil)
+	test.Nil(err)
+	endpoints, err = config.endpoints()
+	test.Nil(err)
+	test.Equal([]string{"http://10.0.0.1:2379"}, endpoints)
+	tlsConfig, err = config.tlsConfig(endpoints)
+	test.Nil(err)
+	test.Nil(tlsConfig)
+}
+
+func TestEtcdEndpoints(t *testing.T) {
+	test := assert.New(t)
+
+	endpoints, err := (&EtcdConfig{EtcdAuthority: "etcd-0:2379,etcd-1:2379"}).endpoints()
+	test.Nil(err)
+	test.Equal([]string{"http://etcd-0:2379", "http://etcd-1:2379"}, endpoints)
+
+	endpoints, err = (&EtcdConfig{EtcdAuthority: "etcd-0:2379", EtcdCACertFile: "/ca.crt"}).endpoints()
+	test.Nil(err)
+	test.Equal([]string{"https://etcd-0:2379"}, endpoints)
+
+	endpoints, err = (&EtcdConfig{EtcdAuthority: "etcd-0:2379", EtcdScheme: "http", EtcdCACertFile: "/ca.crt"}).endpoints()
+	test.Nil(err)
+	test.Equal([]string{"http://etcd-0:2379"}, endpoints)
+
+	_, err = (&EtcdConfig{}).endpoints()
+	test.Equal(errNoEndpoints, err)
+
+	_, err = (&EtcdConfig{EtcdDiscoverySrv: "invalid."}).endpoints()
+	test.NotNil(err)
+}
@@ -0,0 +1,208 @@
+package etcd
+
+import (
+	"cni-demo/tools/metrics"
+	"context"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	etcd "go.etcd.io/etcd/client/v3"
+)
+
+var watchRestarts = metrics.NewCounterVec(
+	"etcd_watch_restarts_total",
+	"etcd 的 watch 断开之后重新 watch 的次数, reason 是 disconnected 或者 compacted",
+	"reason",
+)
+
+const (
+	// watch 断开之后隔多久重新 watch
+	watchRetryInterval = 1 * time.Second
+	// Errors 里最多攒多少个错误, 没人读的话后面的错误就丢掉
+	watchErrorsBuffer = 16
+)
+
+// watchOptions 是 Watch 的可选配置
+type watchOptions struct {
+	prefix bool
+}
+
+type WatchOption func(*watchOptions)
+
+// WithPrefix 表示 watch 所有以 key 开头的 key
+func WithPrefix() WatchOption {
+	return func(o *watchOptions) {
+		o.prefix = true
+	}
+}
+
+// watchState 是一个 watch 当前看到的数据, 断开重连和 compaction 之后重新 list 都靠它
+type watchState struct {
+	key      string
+	opts     watchOptions
+	cb       WatchCallback
+	revision int64
+	values   map[string]string
+}
+
+// Errors 返回 watch 过程中遇到的错误, 比如连接断开或者 revision 被 compaction 掉了
+// 出错之后 Watcher 会自己重试, 这里只是告诉调用方发生了什么
+func (w *Watcher) Errors() <-chan error {
+	return w.errors
+}
+
+// sendError 发一个错误出去, 没人读并且攒满了的话就丢掉, 不能因为没人读就把 watch 卡住
+func (w *Watcher) sendError(err error) {
+	select {
+	case w.errors <- err:
+	default:
+	}
+}
+
+// list 读出 key 当前的值和 revision
+func (w *Watcher) list(key string, opts watchOptions) (map[string]string, int64, error) {
+	var ops []etcd.OpOption
+	if opts.prefix {
+		ops = append(ops, etcd.WithPrefix())
+	}
+	resp, err := w.client.client.Get(w.ctx, key, ops...)
+	if err != nil {
+		return nil, 0, err
+	}
+	values := map[string]string{}
+	for _, kv := range resp.Kvs {
+		values[string(kv.Key)] = string(kv.Value)
+	}
+	return values, resp.Header.Revision, nil
+}
+
+// Watch 方法用于监听一个键的变化，并通过回调函数处理变化事件。
+// 返回之前会先读一遍 key 当前的 revision, 之后的变化一个都不会漏掉:
+//  1. 连接断开之后从最后看到的 revision 接着 watch
+//  2. revision 被 compaction 掉了的话重新读一遍, 和之前看到的比一下, 把中间的变化补成 PUT 和 DELETE
+//  3. 错误从 Errors 里发出来, Cancel 之后停止
+func (w *Watcher) Watch(key string, cb WatchCallback, opts ...WatchOption) {
+	state := &watchState{key: key, cb: cb}
+	for _, opt := range opts {
+		opt(&state.opts)
+	}
+	values, revision, err := w.list(key, state.opts)
+	if err != nil {
+		// 第一次就读失败的话在后台接着试, 读到之前的变化就没法补了
+		w.sendError(err)
+	} else {
+		state.values, state.revision = values, revision
+	}
+	go w.run(state)
+}
+
+// run 一直 watch 直到 Cancel
+func (w *Watcher) run(state *watchState) {
+	for w.ctx.Err() == nil {
+		if state.values == nil {
+			values, revision, err := w.list(state.key, state.opts)
+			if err != nil {
+				w.sendError(err)
+				if !w.wait() {
+					return
+				}
+				continue
+			}
+			state.values, state.revision = values, revision
+		}
+
+		compacted := w.watchOnce(state)
+		if w.ctx.Err() != nil {
+			return
+		}
+		if !compacted {
+			watchRestarts.Inc("disconnected")
+		} else {
+			watchRestarts.Inc("compacted")
+			err := w.resync(state)
+			if err != nil {
+				w.sendError(err)
+			} else {
+				continue
+			}
+		}
+		if !w.wait() {
+			return
+		}
+	}
+}
+
+// watchOnce 从 state.revision 的下一个开始 watch, 直到连接断开或者出错, 返回 true 表示被 compaction 了
+func (w *Watcher) watchOnce(state *watchState) bool {
+	ops := []etcd.OpOption{etcd.WithRev(state.revision + 1)}
+	if state.opts.prefix {
+		ops = append(ops, etcd.WithPrefix())
+	}
+	// 没有 leader 的节点上的 watch 是收不到事件的, 让它直接断开换一个节点
+	ctx, cancel := context.WithCancel(etcd.WithRequireLeader(w.ctx))
+	defer cancel()
+	for wresp := range w.watcher.Watch(ctx, state.key, ops...) {
+		if wresp.CompactRevision != 0 {
+			w.sendError(wresp.Err())
+			return true
+		}
+		if err := wresp.Err(); err != nil {
+			w.sendError(err)
+			return false
+		}
+		for _, ev := range wresp.Events {
+			if ev.Type == mvccpb.DELETE {
+				delete(state.values, string(ev.Kv.Key))
+			} else {
+				state.values[string(ev.Kv.Key)] = string(ev.Kv.Value)
+			}
+			state.revision = ev.Kv.ModRevision
+			state.cb(ev.Type, ev.Kv.Key, ev.Kv.Value)
+		}
+		if wresp.IsProgressNotify() && wresp.Header.Revision > state.revision {
+			state.revision = wresp.Header.Revision
+		}
+	}
+	return false
+}
+
+// resync 重新读一遍, 把和之前看到的不一样的地方当成事件回调出去
+func (w *Watcher) resync(state *watchState) error {
+	values, revision, err := w.list(state.key, state.opts)
+	if err != nil {
+		return err
+	}
+	for key, value := range values {
+		if old, ok := state.values[key]; !ok || old != value {
+			state.cb(mvccpb.PUT, []byte(key), []byte(value))
+		}
+	}
+	for key := range state.values {
+		if _, ok := values[key]; !ok {
+			state.cb(mvccpb.DELETE, []byte(key), nil)
+		}
+	}
+	state.values, state.revision = values, revision
+	return nil
+}
+
+// wait 等一个重试的间隔, Cancel 了的话返回 false
+func (w *Watcher) wait() bool {
+	select {
+	case <-time.After(w.retryInterval):
+		return true
+	case <-w.ctx.Done():
+		return false
+	}
+}
+
+// Watch 方法用于在 etcd 中监听一个键的变化，并通过回调函数处理变化事件。
+// 每次都会用一个新的 Watcher, 返回它以便拿到错误和取消
+func (c *EtcdClient) Watch(key string, cb WatchCallback, opts ...WatchOption) (*Watcher, error) {
+	watcher, err := c.GetWatcher()
+	if err != nil {
+		return nil, err
+	}
+	watcher.Watch(key, cb, opts...)
+	return watcher, nil
+}
@@ -0,0 +1,147 @@
+package etcd
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	etcd "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+type testEvent struct {
+	_type mvccpb.Event_EventType
+	key   string
+	value string
+}
+
+// startEmbedEtcd 在临时目录里起一个单节点的 etcd, 返回连到它上面的 EtcdClient
+func startEmbedEtcd(t *testing.T) *EtcdClient {
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	clientURL, _ := url.Parse("http://127.0.0.1:0")
+	peerURL, _ := url.Parse("http://127.0.0.1:0")
+	cfg.LCUrls, cfg.ACUrls = []url.URL{*clientURL}, []url.URL{*clientURL}
+	cfg.LPUrls, cfg.APUrls = []url.URL{*peerURL}, []url.URL{*peerURL}
+	cfg.InitialCluster = cfg.Name + "=" + peerURL.String()
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatal("embed etcd 启动超时")
+	}
+
+	client, err := etcd.New(etcd.Config{
+		Endpoints:   []string{"http://" + e.Clients[0].Addr().String()},
+		DialTimeout: etcdTimeout,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return &EtcdClient{client: client}
+}
+
+func collect(events chan testEvent) WatchCallback {
+	return func(_type mvccpb.Event_EventType, key, value []byte) {
+		events <- testEvent{_type, string(key), string(value)}
+	}
+}
+
+func receive(t *testing.T, events chan testEvent) testEvent {
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("等 watch 事件超时")
+	}
+	return testEvent{}
+}
+
+func TestWatchPrefix(t *testing.T) {
+	test := assert.New(t)
+	c := startEmbedEtcd(t)
+
+	events := make(chan testEvent, 16)
+	w, err := c.Watch("/test/", collect(events), WithPrefix())
+	test.Nil(err)
+
+	// Watch 返回之后马上写也不会漏掉
+	test.Nil(c.Set("/test/a", "1"))
+	test.Nil(c.Set("/other", "1"))
+	test.Nil(c.Set("/test/b", "2"))
+	test.Nil(c.Del("/test/a"))
+	test.Equal(testEvent{mvccpb.PUT, "/test/a", "1"}, receive(t, events))
+	test.Equal(testEvent{mvccpb.PUT, "/test/b", "2"}, receive(t, events))
+	test.Equal(testEvent{mvccpb.DELETE, "/test/a", ""}, receive(t, events))
+
+	// Cancel 之后就收不到了
+	w.Cancel()
+	test.Nil(c.Set("/test/c", "3"))
+	select {
+	case ev := <-events:
+		t.Fatalf("Cancel 之后还收到了事件: %v", ev)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestWatchCompacted(t *testing.T) {
+	test := assert.New(t)
+	c := startEmbedEtcd(t)
+
+	test.Nil(c.Set("/test/a", "1"))
+	test.Nil(c.Set("/test/b", "1"))
+	w, err := c.GetWatcher()
+	test.Nil(err)
+	defer w.Cancel()
+	values, revision, err := w.list("/test/", watchOptions{prefix: true})
+	test.Nil(err)
+
+	// 在这之后的变化所在的 revision 都被 compaction 掉了, 只能重新 list 把它们补出来
+	test.Nil(c.Set("/test/a", "2"))
+	test.Nil(c.Del("/test/b"))
+	test.Nil(c.Set("/test/c", "3"))
+	resp, err := c.client.Get(context.TODO(), "/test/")
+	test.Nil(err)
+	_, err = c.client.Compact(context.TODO(), resp.Header.Revision)
+	test.Nil(err)
+
+	events := make(chan testEvent, 16)
+	go w.run(&watchState{
+		key:      "/test/",
+		opts:     watchOptions{prefix: true},
+		cb:       collect(events),
+		revision: revision,
+		values:   values,
+	})
+	got := map[string]testEvent{}
+	for i := 0; i < 3; i++ {
+		ev := receive(t, events)
+		got[ev.key] = ev
+	}
+	test.Equal(map[string]testEvent{
+		"/test/a": {mvccpb.PUT, "/test/a", "2"},
+		"/test/b": {mvccpb.DELETE, "/test/b", ""},
+		"/test/c": {mvccpb.PUT, "/test/c", "3"},
+	}, got)
+	select {
+	case err := <-w.Errors():
+		test.Equal(rpctypes.ErrCompacted, err)
+	case <-time.After(time.Second):
+		t.Fatal("没有收到 compaction 的错误")
+	}
+
+	// 补完之后从新的 revision 接着 watch
+	test.Nil(c.Set("/test/d", "4"))
+	test.Equal(testEvent{mvccpb.PUT, "/test/d", "4"}, receive(t, events))
+}
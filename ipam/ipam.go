@@ -8,36 +8,38 @@ package ipam
 import (
 	"cni-demo/client"
 	"cni-demo/consts"
-	"cni-demo/etcd"
+	"cni-demo/datastore"
+	"cni-demo/tools/logger"
 	utils2 "cni-demo/tools/utils"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/vishvananda/netlink"
-	oriEtcd "go.etcd.io/etcd/client/v3"
 	"os"
 	"strings"
 	"sync"
 )
 
 const (
-	prefix = "cni-demo/ipam"
+	prefix = consts.IPAM_DATASTORE_PREFIX
 )
 
 type Get struct {
-	etcdClient *etcd.EtcdClient
-	k8sClient  *client.LightK8sClient
+	store     datastore.Datastore
+	k8sClient *client.LightK8sClient
 	// 有些不会发生改变的东西可以做缓存
 	nodeIpCache map[string]string
 	cidrCache   map[string]string
+	// 节点离开集群的时候 watch 节点的协程会清缓存, 所以缓存的读写要加锁
+	cacheLock sync.Mutex
 }
 type Release struct {
-	etcdClient *etcd.EtcdClient
-	k8sClient  *client.LightK8sClient
+	store     datastore.Datastore
+	k8sClient *client.LightK8sClient
 }
 type Set struct {
-	etcdClient *etcd.EtcdClient
-	k8sClient  *client.LightK8sClient
+	store     datastore.Datastore
+	k8sClient *client.LightK8sClient
 }
 
 // operator 结构体用于获取、设置和释放 IP 地址
@@ -73,8 +75,8 @@ type IpamService struct {
 	PodMaskIP string
 	// 当前节点分配的网络地址
 	CurrentHostNetwork string
-	// Etcd 客户端
-	EtcdClient *etcd.EtcdClient
+	// 存 ipam 数据的地方, 可以是 etcd 也可以是 apiserver 上的自定义资源
+	Datastore datastore.Datastore
 	// Kubernetes 客户端
 	K8sClient *client.LightK8sClient
 	*operator
@@ -112,24 +114,23 @@ func lock() {
 	}
 }
 
-// getEtcdClient 函数用于获取 Etcd 客户端实例
-func getEtcdClient() *etcd.EtcdClient {
-	etcd.Init()
-	etcdClient, err := etcd.GetEtcdClient()
+// getDatastore 函数用于获取存 ipam 数据的 Datastore 实例, 用哪种后端由 datastore.InitDatastore 决定
+func getDatastore() datastore.Datastore {
+	store, err := datastore.GetDatastore()
 	if err != nil {
+		logger.Error("获取 datastore 失败", "err", err)
 		return nil
 	}
-	return etcdClient
+	return store
 }
 
 // getLightK8sClient 函数用于获取 Kubernetes 客户端实例
 func getLightK8sClient() *client.LightK8sClient {
-	paths, err := client.GetHostAuthenticationInfoPath()
+	err := client.InitDefault()
 	if err != nil {
-		utils2.WriteLog("GetHostAuthenticationInfoPath 执行失败")
+		logger.Error("初始化 k8s client 失败", "err", err)
 		return nil
 	}
-	client.Init(paths.CaPath, paths.CertPath, paths.KeyPath)
 	k8sClient, err := client.GetLightK8sClient()
 	if err != nil {
 		return nil
@@ -191,6 +192,27 @@ func (g *Get) Subnet() (string, error) {
 	return ipam.Subnet, nil
 }
 
+// blockOctetIndex 返回 subnet 中第一个 0 的位置, 每个节点的网段就是把这一位换成 0~255 得到的
+func blockOctetIndex(subnet string) int {
+	_temp := strings.Split(subnet, ".")
+	for _i := 0; _i < len(_temp); _i++ {
+		if _temp[_i] == "0" {
+			return _i
+		}
+	}
+	return 0
+}
+
+// BlockMaskSegment 方法返回分给每个节点的网段的掩码位数
+// 比如 10.244.0.0/16 分给每个节点的是 10.244.x.0/24, 和 PodMaskSegment 不是一回事
+func (g *Get) BlockMaskSegment() (int, error) {
+	ipam, err := GetIpamService()
+	if err != nil {
+		return 0, err
+	}
+	return 8 * (blockOctetIndex(ipam.Subnet) + 1), nil
+}
+
 // HostSubnetMapPath 方法返回主机子网映射的路径
 func (g *Get) HostSubnetMapPath() (string, error) {
 	ipam, err := GetIpamService()
@@ -239,7 +261,7 @@ func (g *Get) RecordByHost(hostname string) ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
-	str, err := g.etcdClient.Get(path)
+	str, err := g.store.Get(path)
 	if err != nil {
 		return nil, err
 	}
@@ -254,7 +276,7 @@ var getSet = func() func() *Set {
 			return _set
 		}
 		_set = &Set{}
-		_set.etcdClient = getEtcdClient()
+		_set.store = getDatastore()
 		_set.k8sClient = getLightK8sClient()
 		return _set
 	}
@@ -270,7 +292,7 @@ var getGet = func() func() *Get {
 			cidrCache:   map[string]string{},
 			nodeIpCache: map[string]string{},
 		}
-		_get.etcdClient = getEtcdClient()
+		_get.store = getDatastore()
 		_get.k8sClient = getLightK8sClient()
 		return _get
 	}
@@ -283,7 +305,7 @@ var getRelase = func() func() *Release {
 			return _release
 		}
 		_release = &Release{}
-		_release.etcdClient = getEtcdClient()
+		_release.store = getDatastore()
 		_release.k8sClient = getLightK8sClient()
 		return _release
 	}
@@ -309,47 +331,45 @@ func isRetainIP(ip string) bool {
 	return _arr[3] == "0"
 }
 
-// 将参数的 IPs 设置到 etcd 中。首先获取当前主机对应的网段，然后获取当前主机的网段下所有已经使用的 IP。遍历给定的 IPs，如果不存在于已使用的 IP 列表中，将其添加到 etcd。
+// 将参数的 IPs 设置到 datastore 中。首先获取当前主机对应的网段，然后获取当前主机的网段下所有已经使用的 IP。遍历给定的 IPs，如果不存在于已使用的 IP 列表中，将其添加到 datastore。
+// 同一个网段的记录在同一台主机上可能被好几个 cni 进程同时改, 所以用 Update 来改
 func (s *Set) IPs(ips ...string) error {
 	defer unlock()
 	// 先拿到当前主机对应的网段
-	currentNetwork, err := s.etcdClient.Get(getHostPath())
+	currentNetwork, err := s.store.Get(getHostPath())
 	if err != nil {
 		return err
 	}
 	// 拿到当前主机的网段下所有已经使用的 ip
-	allUsedIPs, err := s.etcdClient.Get(getRecordPath(currentNetwork))
-	if err != nil {
-		return err
-	}
-	_allUsedIPsArr := strings.Split(allUsedIPs, ";")
-	_tempIPs := allUsedIPs
-	for _, ip := range ips {
-		if _tempIPs == "" {
-			_tempIPs = ip
-		} else {
-			flag := true
-			for i := 0; i < len(_allUsedIPsArr); i++ {
-				if _allUsedIPsArr[i] == ip {
-					// 如果 etcd 上已经存了则不用再写入了
-					flag = false
-					break
+	return s.store.Update(getRecordPath(currentNetwork), func(allUsedIPs string) (string, error) {
+		_allUsedIPsArr := strings.Split(allUsedIPs, ";")
+		_tempIPs := allUsedIPs
+		for _, ip := range ips {
+			if _tempIPs == "" {
+				_tempIPs = ip
+			} else {
+				flag := true
+				for i := 0; i < len(_allUsedIPsArr); i++ {
+					if _allUsedIPsArr[i] == ip {
+						// 如果 datastore 上已经存了则不用再写入了
+						flag = false
+						break
+					}
+				}
+				if flag {
+					_tempIPs += ";" + ip
 				}
-			}
-			if flag {
-				_tempIPs += ";" + ip
 			}
 		}
-	}
-
-	return s.etcdClient.Set(getRecordPath(currentNetwork), _tempIPs)
+		return _tempIPs, nil
+	})
 }
 
-// 根据主机名获取一个当前主机可用的网段。如果主机对应的网段已存在，直接返回该网段；否则，从可用的 IP 池中选取一个网段，并更新 etcd 中的 IP 池。如果提供了 IP 地址范围，创建一个范围目录。
+// 根据主机名获取一个当前主机可用的网段。如果主机对应的网段已存在，直接返回该网段；否则，从可用的 IP 池中选取一个网段，并更新 datastore 中的 IP 池。如果提供了 IP 地址范围，创建一个范围目录。
 func (is *IpamService) networkInit(hostPath, poolPath string, ranges ...string) (string, error) {
 	lock()
 	defer unlock()
-	network, err := is.EtcdClient.Get(hostPath)
+	network, err := is.Datastore.Get(hostPath)
 	if err != nil {
 		return "", err
 	}
@@ -359,25 +379,24 @@ func (is *IpamService) networkInit(hostPath, poolPath string, ranges ...string)
 		return network, nil
 	}
 
-	// 从可用的 ip 池中捞一个
-	pool, err := is.EtcdClient.Get(poolPath)
-	if err != nil {
-		return "", err
-	}
-
-	_tempIPs := strings.Split(pool, ";")
-	tmpRandom := utils2.GetRandomNumber(len(_tempIPs))
-	// TODO: 这块还是得想办法加锁
-	currentHostNetwork := _tempIPs[tmpRandom]
-	newTmpIps := append([]string{}, _tempIPs[0:tmpRandom]...)
-	_tempIPs = append(newTmpIps, _tempIPs[tmpRandom+1:]...)
-	// 先把 pool 更新一下
-	err = is.EtcdClient.Set(poolPath, strings.Join(_tempIPs, ";"))
+	// 从可用的 ip 池中捞一个, 别的节点可能同时也在捞, 所以用 Update 防止两个节点拿到同一个网段
+	currentHostNetwork := ""
+	err = is.Datastore.Update(poolPath, func(pool string) (string, error) {
+		if pool == "" {
+			return "", errors.New("ip 池中已经没有可用的网段了")
+		}
+		_tempIPs := strings.Split(pool, ";")
+		tmpRandom := utils2.GetRandomNumber(len(_tempIPs))
+		currentHostNetwork = _tempIPs[tmpRandom]
+		newTmpIps := append([]string{}, _tempIPs[0:tmpRandom]...)
+		_tempIPs = append(newTmpIps, _tempIPs[tmpRandom+1:]...)
+		return strings.Join(_tempIPs, ";"), nil
+	})
 	if err != nil {
 		return "", err
 	}
 	// 再把这个网段存到对应的这台主机的 key 下
-	err = is.EtcdClient.Set(hostPath, currentHostNetwork)
+	err = is.Datastore.Set(hostPath, currentHostNetwork)
 	if err != nil {
 		return "", err
 	}
@@ -397,7 +416,7 @@ func (is *IpamService) networkInit(hostPath, poolPath string, ranges ...string)
 		ranges := utils2.GenIpRange(start, end)
 		if ranges != nil {
 			currentIpRanges := strings.Join(utils2.GenIpRange(start, end), ";")
-			err = is.EtcdClient.Set(fmt.Sprintf(
+			err = is.Datastore.Set(fmt.Sprintf(
 				"%s/%s/range",
 				hostPath,
 				currentHostNetwork,
@@ -418,7 +437,7 @@ func (is *IpamService) getHostSubnetMap() (map[string]string, error) {
 		return nil, err
 	}
 
-	_maps, err := is.EtcdClient.Get(path)
+	_maps, err := is.Datastore.Get(path)
 	if err != nil {
 		return nil, err
 	}
@@ -431,54 +450,44 @@ func (is *IpamService) getHostSubnetMap() (map[string]string, error) {
 	return resMaps, nil
 }
 
-// 初始化主机名和网段的映射。如果映射中已存在当前子网，直接返回；否则，将当前子网与主机名的映射添加到 etcd 中。
+// 初始化主机名和网段的映射。如果映射中已存在当前子网，直接返回；否则，将当前子网与主机名的映射添加到 datastore 中。
 func (is *IpamService) subnetMapInit(subnet, mask, hostname, currentSubnet string) error {
 	lock()
 	defer unlock()
 	m := fmt.Sprintf("/%s/%s/maps", subnet, mask)
 	path := getEtcdPathWithPrefix(m)
-	maps, err := is.EtcdClient.Get(path)
-	if err != nil {
-		return err
-	}
+	// 所有节点都会往这一个 key 里写, 用 Update 防止把别人刚加进去的覆盖掉
+	return is.Datastore.Update(path, func(maps string) (string, error) {
+		_tmpMaps := map[string]string{}
+		if len(maps) != 0 {
+			err := json.Unmarshal(([]byte)(maps), &_tmpMaps)
+			if err != nil {
+				return "", err
+			}
+		}
 
-	if len(maps) == 0 {
-		_maps := map[string]string{}
-		_maps[currentSubnet] = hostname
-		mapsStr, err := json.Marshal(_maps)
+		if _, ok := _tmpMaps[currentSubnet]; ok {
+			return maps, nil
+		}
+		_tmpMaps[currentSubnet] = hostname
+		mapsStr, err := json.Marshal(_tmpMaps)
 		if err != nil {
-			return err
+			return "", err
 		}
-		return is.EtcdClient.Set(path, string(mapsStr))
-	}
-
-	_tmpMaps := map[string]string{}
-	err = json.Unmarshal(([]byte)(maps), &_tmpMaps)
-	if err != nil {
-		return err
-	}
-
-	if _, ok := _tmpMaps[currentSubnet]; ok {
-		return nil
-	}
-	_tmpMaps[currentSubnet] = hostname
-	mapsStr, err := json.Marshal(_tmpMaps)
-	if err != nil {
-		return err
-	}
-	return is.EtcdClient.Set(path, string(mapsStr))
+		return string(mapsStr), nil
+	})
 }
 
 /**
- * 初始化 IP 网段池。如果网段池已存在，直接返回；否则，创建 255 个备用网段，并将其存储到 etcd 中。
+ * 初始化 IP 网段池。如果网段池已存在，直接返回；否则，创建 255 个备用网段，并将其存储到 datastore 中。
  * 比如 subnet 是 10.244.0.0, mask 是 24 的话
- * 就会在 etcd 中初始化出一个
+ * 就会在 datastore 中初始化出一个
  * 	10.244.0.0;10.244.1.0;10.244.2.0;......;10.244.254.0;10.244.255.0
  */
 func (is *IpamService) ipsPoolInit(poolPath string) error {
 	lock()
 	defer unlock()
-	val, err := is.EtcdClient.Get(poolPath)
+	val, err := is.Datastore.Get(poolPath)
 	if err != nil {
 		return err
 	}
@@ -487,14 +496,7 @@ func (is *IpamService) ipsPoolInit(poolPath string) error {
 	}
 	subnet := is.Subnet
 	_temp := strings.Split(subnet, ".")
-	_tempIndex := 0
-	for _i := 0; _i < len(_temp); _i++ {
-		if _temp[_i] == "0" {
-			// 找到 subnet 中第一个 0 的位置
-			_tempIndex = _i
-			break
-		}
-	}
+	_tempIndex := blockOctetIndex(subnet)
 	/**
 	 * FIXME: 对于子网网段的创建, 其实可以不完全是 8 的倍数
 	 * 比如 10.244.0.0/26 这种其实也可以
@@ -511,28 +513,23 @@ func (is *IpamService) ipsPoolInit(poolPath string) error {
 			_tempIpStr += ";" + _newIP
 		}
 	}
-	return is.EtcdClient.Set(poolPath, _tempIpStr)
+	return is.Datastore.Set(poolPath, _tempIpStr)
 }
 
 /**
- * 获取集群中全部的主机名。从 etcd 的 key 下获取全部节点的 key，而不是调用 Kubernetes API。
- * 这里直接从 etcd 的 key 下边查
+ * 获取集群中全部的主机名。通过 Kubernetes API 分页 list 节点，而不是直接去读 etcd 里的 /registry/minions/
  */
 func (g *Get) NodeNames() ([]string, error) {
 	defer unlock()
-	const _minionsNodePrefix = "/registry/minions/"
-
-	nodes, err := g.etcdClient.GetAllKey(_minionsNodePrefix, oriEtcd.WithKeysOnly(), oriEtcd.WithPrefix())
-
+	nodes, err := g.k8sClient.Get().Nodes()
 	if err != nil {
-		utils2.WriteLog("这里从 etcd 获取全部 nodes key 失败, err: ", err.Error())
+		logger.Error("从 apiserver 获取全部 nodes 失败", "err", err)
 		return nil, err
 	}
 
 	var res []string
-	for _, node := range nodes {
-		node = strings.Replace(node, _minionsNodePrefix, "", 1)
-		res = append(res, node)
+	for _, node := range nodes.Items {
+		res = append(res, node.Name)
 	}
 	return res, nil
 }
@@ -703,21 +700,21 @@ func (g *Get) HostNetwork() (*Network, error) {
 }
 
 // 根据主机名获取当前节点被分配到的网段和掩码。这个函数首先从缓存中查找 CIDR，如果找到则直接返回。
-// 如果缓存中没有，则从 Etcd 中获取 CIDR 信息，并将其与 IPAM 服务中的 PodMaskSegment
+// 如果缓存中没有，则从 datastore 中获取 CIDR 信息，并将其与 IPAM 服务中的 PodMaskSegment
 // 拼接成完整的 CIDR。将结果存储在缓存中并返回。
 func (g *Get) CIDR(hostName string) (string, error) {
 	defer unlock()
-	if val, ok := g.cidrCache[hostName]; ok {
+	if val, ok := g.getCache(g.cidrCache, hostName); ok {
 		return val, nil
 	}
 	_cidrPath := getEtcdPathWithPrefix("/" + getIpamSubnet() + "/" + getIpamMaskSegment() + "/" + hostName)
 
-	etcd := getEtcdClient()
-	if etcd == nil {
-		return "", errors.New("etcd client not found")
+	store := getDatastore()
+	if store == nil {
+		return "", errors.New("datastore not found")
 	}
 
-	cidr, err := etcd.Get(_cidrPath)
+	cidr, err := store.Get(_cidrPath)
 	if err != nil {
 		return "", err
 	}
@@ -732,7 +729,7 @@ func (g *Get) CIDR(hostName string) (string, error) {
 		return "", err
 	}
 	cidr += ("/" + ipam.PodMaskSegment)
-	g.cidrCache[hostName] = cidr
+	g.setCache(g.cidrCache, hostName, cidr)
 	return cidr, nil
 }
 
@@ -743,7 +740,7 @@ func (g *Get) CIDR(hostName string) (string, error) {
 */
 func (g *Get) NodeIp(hostName string) (string, error) {
 	defer unlock()
-	if val, ok := g.nodeIpCache[hostName]; ok {
+	if val, ok := g.getCache(g.nodeIpCache, hostName); ok {
 		return val, nil
 	}
 	node, err := g.k8sClient.Get().Node(hostName)
@@ -752,7 +749,7 @@ func (g *Get) NodeIp(hostName string) (string, error) {
 	}
 	for _, addr := range node.Status.Addresses {
 		if addr.Type == "InternalIP" {
-			g.nodeIpCache[hostName] = addr.Address
+			g.setCache(g.nodeIpCache, hostName, addr.Address)
 			return addr.Address, nil
 		}
 	}
@@ -764,11 +761,11 @@ func (g *Get) NodeIp(hostName string) (string, error) {
 // 该函数将从默认网关附近的 IP 地址中随机选择一个未使用的 IP。
 func (g *Get) nextUnusedIP() (string, error) {
 	defer unlock()
-	currentNetwork, err := g.etcdClient.Get(getHostPath())
+	currentNetwork, err := g.store.Get(getHostPath())
 	if err != nil {
 		return "", err
 	}
-	allUsedIPs, err := g.etcdClient.Get(getRecordPath(currentNetwork))
+	allUsedIPs, err := g.store.Get(getRecordPath(currentNetwork))
 	if err != nil {
 		return "", err
 	}
@@ -779,8 +776,8 @@ func (g *Get) nextUnusedIP() (string, error) {
 		ipsMap[ip] = true
 	}
 
-	if rangesPathExist, err := g.etcdClient.GetKey(getIpRangesPath(currentNetwork)); rangesPathExist != "" && err == nil {
-		if rangesIPs, err := g.etcdClient.Get(getIpRangesPath(currentNetwork)); err == nil {
+	if rangesPathExist, err := g.store.Exists(getIpRangesPath(currentNetwork)); rangesPathExist && err == nil {
+		if rangesIPs, err := g.store.Get(getIpRangesPath(currentNetwork)); err == nil {
 			rangeIpsArr := strings.Split(rangesIPs, ";")
 			if len(rangeIpsArr) == 0 {
 				return "", errors.New("all of the ips are used")
@@ -826,11 +823,11 @@ func (g *Get) nextUnusedIP() (string, error) {
 	return nextIp, nil
 }
 
-// 获取当前网络的网关 IP。这个函数首先从 Etcd 中获取当前网络的信息，
+// 获取当前网络的网关 IP。这个函数首先从 datastore 中获取当前网络的信息，
 // 然后将当前网络的 IP 地址加 1 作为网关 IP，并将其转换为字符串格式返回。
 func (g *Get) Gateway() (string, error) {
 	defer unlock()
-	currentNetwork, err := g.etcdClient.Get(getHostPath())
+	currentNetwork, err := g.store.Get(getHostPath())
 	if err != nil {
 		return "", err
 	}
@@ -842,7 +839,7 @@ func (g *Get) Gateway() (string, error) {
 // 然后将其与 IPAM 服务中的掩码段拼接起来，形成一个完整的网关 IP 和掩码段字符串并返回。
 func (g *Get) GatewayWithMaskSegment() (string, error) {
 	defer unlock()
-	currentNetwork, err := g.etcdClient.Get(getHostPath())
+	currentNetwork, err := g.store.Get(getHostPath())
 	if err != nil {
 		return "", err
 	}
@@ -850,15 +847,15 @@ func (g *Get) GatewayWithMaskSegment() (string, error) {
 	return utils2.InetInt2Ip((utils2.InetIP2Int(currentNetwork) + 1)) + "/" + getIpamMaskSegment(), nil
 }
 
-// 获取所有已使用的 IP 地址。这个函数首先从 Etcd 中获取当前网络的信息和所有已使用的 IP 地址，
+// 获取所有已使用的 IP 地址。这个函数首先从 datastore 中获取当前网络的信息和所有已使用的 IP 地址，
 // 然后将所有已使用的 IP 地址以字符串数组的形式返回。
 func (g *Get) AllUsedIPs() ([]string, error) {
 	defer unlock()
-	currentNetwork, err := g.etcdClient.Get(getHostPath())
+	currentNetwork, err := g.store.Get(getHostPath())
 	if err != nil {
 		return nil, err
 	}
-	allUsedIPs, err := g.etcdClient.Get(getRecordPath(currentNetwork))
+	allUsedIPs, err := g.store.Get(getRecordPath(currentNetwork))
 	if err != nil {
 		return nil, err
 	}
@@ -866,15 +863,15 @@ func (g *Get) AllUsedIPs() ([]string, error) {
 }
 
 // 根据主机名获取该主机上所有已使用的 IP 地址。
-// 这个函数首先从 Etcd 中获取当前网络的信息和所有已使用的 IP 地址，
+// 这个函数首先从 datastore 中获取当前网络的信息和所有已使用的 IP 地址，
 // 然后将所有已使用的 IP 地址以字符串数组的形式返回。
 func (g *Get) AllUsedIPsByHost(hostname string) ([]string, error) {
 	defer unlock()
-	currentNetwork, err := g.etcdClient.Get(getHostPath())
+	currentNetwork, err := g.store.Get(getHostPath())
 	if err != nil {
 		return nil, err
 	}
-	allUsedIPs, err := g.etcdClient.Get(getRecordPath(currentNetwork))
+	allUsedIPs, err := g.store.Get(getRecordPath(currentNetwork))
 	if err != nil {
 		return nil, err
 	}
@@ -886,6 +883,14 @@ func (g *Get) AllUsedIPsByHost(hostname string) ([]string, error) {
 // 然后继续查找下一个未使用的 IP。一旦找到一个有效的未使用 IP，该函数将其标记为已使用，并将其返回。
 func (g *Get) UnusedIP() (string, error) {
 	defer unlock()
+	ip, err := g.unusedIP()
+	if err != nil {
+		allocationFailures.Inc()
+	}
+	return ip, err
+}
+
+func (g *Get) unusedIP() (string, error) {
 	for {
 		ip, err := g.nextUnusedIP()
 		if err != nil {
@@ -911,47 +916,48 @@ func (g *Get) UnusedIP() (string, error) {
 
 /*
 *
-  - 这个函数用于释放一组 IP 地址。它首先从 Etcd 中获取当前主机的网络信息和已使用的 IP 地址。
+  - 这个函数用于释放一组 IP 地址。它首先从 datastore 中获取当前主机的网络信息和已使用的 IP 地址。
 
-然后，将要释放的 IP 地址从已使用的 IP 地址中移除，并将结果重新写入 Etcd。
+然后，将要释放的 IP 地址从已使用的 IP 地址中移除，并将结果重新写入 datastore。
 */
 func (r *Release) IPs(ips ...string) error {
 	defer unlock()
-	currentNetwork, err := r.etcdClient.Get(getHostPath())
-	if err != nil {
-		return err
-	}
-	allUsedIPs, err := r.etcdClient.Get(getRecordPath(currentNetwork))
+	currentNetwork, err := r.store.Get(getHostPath())
 	if err != nil {
 		return err
 	}
-	_allUsedIP := strings.Split(allUsedIPs, ";")
-	var _newIPs []string
-	for _, usedIP := range _allUsedIP {
-		flag := false
-		for _, ip := range ips {
-			if usedIP == ip {
-				flag = true
-				break
+	err = r.store.Update(getRecordPath(currentNetwork), func(allUsedIPs string) (string, error) {
+		_allUsedIP := strings.Split(allUsedIPs, ";")
+		var _newIPs []string
+		for _, usedIP := range _allUsedIP {
+			flag := false
+			for _, ip := range ips {
+				if usedIP == ip {
+					flag = true
+					break
+				}
+			}
+			if !flag {
+				_newIPs = append(_newIPs, usedIP)
 			}
 		}
-		if !flag {
-			_newIPs = append(_newIPs, usedIP)
-		}
+		return strings.Join(_newIPs, ";"), nil
+	})
+	if err != nil {
+		return err
 	}
-	newIPsString := strings.Join(_newIPs, ";")
-	return r.etcdClient.Set(getRecordPath(currentNetwork), newIPsString)
+	return r.releaseOwners(currentNetwork, ips...)
 }
 
-// 这个函数用于释放 IP 池。它首先从 Etcd 中获取当前 IP 池的网络信息，然后将其设置为空字符串。
+// 这个函数用于释放 IP 池。它首先从 datastore 中获取当前 IP 池的网络信息，然后将其设置为空字符串。
 func (r *Release) Pool() error {
 	defer unlock()
-	currentNetwork, err := r.etcdClient.Get(getIPsPoolPath(getIpamSubnet(), getIpamMaskSegment()))
+	currentNetwork, err := r.store.Get(getIPsPoolPath(getIpamSubnet(), getIpamMaskSegment()))
 	if err != nil {
 		return err
 	}
 
-	return r.etcdClient.Set(currentNetwork, "")
+	return r.store.Set(currentNetwork, "")
 }
 
 // 这个函数用于获取 IPAM 服务的 Get 实例。它首先加锁，然后返回 Get 实例。
@@ -1051,7 +1057,10 @@ func _GetIpamService(subnet string, options *IPAMOptions) func() (*IpamService,
 				PodMaskSegment: _podIpMaskSegment, // pod 的 mask 10 进制
 				PodMaskIP:      _podMaskIP,        // pod 的 mask ip
 			}
-			_ipam.EtcdClient = getEtcdClient()
+			_ipam.Datastore = getDatastore()
+			if _ipam.Datastore == nil {
+				return nil, errors.New("datastore 初始化失败")
+			}
 			_ipam.K8sClient = getLightK8sClient()
 			// 初始化一个 ip 网段的 pool
 			// 如果已经初始化过就不再初始化
@@ -1108,14 +1117,14 @@ func GetIpamService() (*IpamService, error) {
 	return ipamService, nil
 }
 
-// 这个函数用于清除 IPAM 服务的实例，并从 Etcd 中删除所有与之相关的键。
+// 这个函数用于清除 IPAM 服务的实例，并从 datastore 中删除所有与之相关的键。
 func (is *IpamService) clear() error {
 	__GetIpamService = nil
-	return is.EtcdClient.Del("/"+prefix, oriEtcd.WithPrefix())
+	return is.Datastore.DelPrefix("/" + prefix)
 }
 
 // 这个函数用于初始化 IPAM 服务。它首先检查服务是否已经初始化，如果没有，则调用 _GetIpamService() 函数进行初始化。
-// 然后，返回一个函数，该函数用于清除 IPAM 服务的实例并从 Etcd 中删除所有与之相关的键。
+// 然后，返回一个函数，该函数用于清除 IPAM 服务的实例并从 datastore 中删除所有与之相关的键。
 func Init(subnet string, options *IPAMOptions) func() error {
 	if __GetIpamService == nil {
 		__GetIpamService = _GetIpamService(subnet, options)
@@ -130,3 +130,11 @@ func TestIpam(t *testing.T) {
 	err = clear()
 	test.Nil(err)
 }
+
+func TestBlockOctetIndex(t *testing.T) {
+	test := assert.New(t)
+	// 10.244.0.0/16 分给每个节点的是 10.244.x.0/24
+	test.Equal(2, blockOctetIndex("10.244.0.0"))
+	test.Equal(1, blockOctetIndex("10.0.0.0"))
+	test.Equal(3, blockOctetIndex("192.168.64.0"))
+}
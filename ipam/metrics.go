@@ -0,0 +1,83 @@
+package ipam
+
+import (
+	"cni-demo/tools/metrics"
+	"strings"
+)
+
+// 没有配置 range 的时候 nextUnusedIP 是在网关后面的 2 ~ 253 里挑的, 一个网段最多能分出去这么多
+const defaultBlockCapacity = 252
+
+var (
+	allocationFailures = metrics.NewCounterVec(
+		"ipam_allocation_failures_total",
+		"给 pod 分配 ip 失败的次数",
+	)
+	blockAllocatedIPs = metrics.NewGaugeVec(
+		"ipam_block_allocated_ips",
+		"本节点网段里已经分配出去的 ip 数",
+		"block",
+	)
+	blockCapacityIPs = metrics.NewGaugeVec(
+		"ipam_block_capacity_ips",
+		"本节点网段里一共能分配的 ip 数",
+		"block",
+	)
+	poolFreeBlocks = metrics.NewGaugeVec(
+		"ipam_pool_free_blocks",
+		"集群网段里还没有分给节点的网段数",
+		"pool",
+	)
+)
+
+// blockUsage 根据记录和 range 算出一个网段用了多少个 ip, 一共能用多少个
+// 网关和 x.x.x.0 也会被记到记录里, 但是它们本来就不会分给 pod, 不算在里面
+func blockUsage(records, ranges string) (used int, capacity int) {
+	for _, ip := range strings.Split(records, ";") {
+		if ip == "" || isGatewayIP(ip) || isRetainIP(ip) {
+			continue
+		}
+		used++
+	}
+	capacity = defaultBlockCapacity
+	if ranges != "" {
+		capacity = len(strings.Split(ranges, ";"))
+	}
+	return used, capacity
+}
+
+// CollectMetrics 读一遍本节点网段的使用情况和集群网段池里剩下的网段, 更新到指标里
+// 由 cni-demo-agent 在每次被拉取指标的时候调用
+func (is *IpamService) CollectMetrics() error {
+	currentNetwork, err := is.Datastore.Get(getHostPath())
+	if err != nil {
+		return err
+	}
+	if currentNetwork != "" {
+		records, err := is.Datastore.Get(getRecordPath(currentNetwork))
+		if err != nil {
+			return err
+		}
+		ranges, err := is.Datastore.Get(getIpRangesPath(currentNetwork))
+		if err != nil {
+			return err
+		}
+		used, capacity := blockUsage(records, ranges)
+		block := currentNetwork + "/" + is.PodMaskSegment
+		blockAllocatedIPs.Set(float64(used), block)
+		blockCapacityIPs.Set(float64(capacity), block)
+	}
+
+	pool, err := is.Datastore.Get(getIPsPoolPath(is.Subnet, is.MaskSegment))
+	if err != nil {
+		return err
+	}
+	free := 0
+	for _, block := range strings.Split(pool, ";") {
+		if block != "" {
+			free++
+		}
+	}
+	poolFreeBlocks.Set(float64(free), is.Subnet+"/"+is.MaskSegment)
+	return nil
+}
@@ -0,0 +1,24 @@
+package ipam
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlockUsage(t *testing.T) {
+	test := assert.New(t)
+
+	used, capacity := blockUsage("", "")
+	test.Equal(0, used)
+	test.Equal(defaultBlockCapacity, capacity)
+
+	// 网关和 x.x.x.0 不算
+	used, capacity = blockUsage("10.244.1.1;10.244.1.0;10.244.1.5;10.244.1.6", "")
+	test.Equal(2, used)
+	test.Equal(defaultBlockCapacity, capacity)
+
+	used, capacity = blockUsage("10.244.1.10", "10.244.1.10;10.244.1.11;10.244.1.12")
+	test.Equal(1, used)
+	test.Equal(3, capacity)
+}
@@ -0,0 +1,131 @@
+package ipam
+
+import (
+	"cni-demo/client"
+	"cni-demo/tools/logger"
+	"encoding/json"
+	"errors"
+	"reflect"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// getCache 从缓存里读 hostname 对应的值
+func (g *Get) getCache(cache map[string]string, hostName string) (string, bool) {
+	g.cacheLock.Lock()
+	defer g.cacheLock.Unlock()
+	val, ok := cache[hostName]
+	return val, ok
+}
+
+// setCache 往缓存里写 hostname 对应的值
+func (g *Get) setCache(cache map[string]string, hostName, val string) {
+	g.cacheLock.Lock()
+	defer g.cacheLock.Unlock()
+	cache[hostName] = val
+}
+
+// forgetNode 清掉某个节点的缓存, 节点 ip 变了或者节点离开集群的时候用
+func (g *Get) forgetNode(hostName string) {
+	g.cacheLock.Lock()
+	defer g.cacheLock.Unlock()
+	delete(g.nodeIpCache, hostName)
+	delete(g.cidrCache, hostName)
+}
+
+// NodeHandler 是节点加入或者离开集群时的回调, 不关心的可以不填
+type NodeHandler struct {
+	OnAdd    func(node *v1.Node)
+	OnDelete func(node *v1.Node)
+}
+
+// nodeMembership 记录当前已知的节点, 并把 list 和 watch 到的变化转成 NodeHandler 的回调
+type nodeMembership struct {
+	get     *Get
+	known   map[string]*v1.Node
+	handler *NodeHandler
+}
+
+// nodeAddressChanged 判断节点的地址或者 podCIDR 有没有变, 只有这些变了缓存才需要清掉
+func nodeAddressChanged(old, node *v1.Node) bool {
+	if !reflect.DeepEqual(old.Status.Addresses, node.Status.Addresses) {
+		return true
+	}
+	return old.Spec.PodCIDR != node.Spec.PodCIDR || !reflect.DeepEqual(old.Spec.PodCIDRs, node.Spec.PodCIDRs)
+}
+
+func (m *nodeMembership) add(node *v1.Node) {
+	if old, ok := m.known[node.Name]; ok {
+		// kubelet 的心跳也是 MODIFIED, 每个节点每隔几秒就有一次, 地址没变的话不用清缓存
+		if nodeAddressChanged(old, node) {
+			m.get.forgetNode(node.Name)
+		}
+		m.known[node.Name] = node
+		return
+	}
+	m.known[node.Name] = node
+	if m.handler.OnAdd != nil {
+		m.handler.OnAdd(node)
+	}
+}
+
+func (m *nodeMembership) delete(node *v1.Node) {
+	m.get.forgetNode(node.Name)
+	if _, ok := m.known[node.Name]; !ok {
+		return
+	}
+	delete(m.known, node.Name)
+	if m.handler.OnDelete != nil {
+		m.handler.OnDelete(node)
+	}
+}
+
+// replace 用 list 到的全量节点替换当前已知的节点, 重新 list 期间漏掉的加入和离开都会在这里补上
+func (m *nodeMembership) replace(nodes *v1.NodeList) {
+	current := map[string]bool{}
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		current[node.Name] = true
+		m.add(node)
+	}
+	for name, node := range m.known {
+		if !current[name] {
+			m.delete(node)
+		}
+	}
+}
+
+// handle 处理一个 watch 到的节点事件
+func (m *nodeMembership) handle(event *client.WatchEvent) {
+	node := &v1.Node{}
+	err := json.Unmarshal(event.Object, node)
+	if err != nil {
+		logger.Error("解析节点的 watch 事件失败", "err", err)
+		return
+	}
+	switch event.Type {
+	case client.WATCH_ADDED:
+		m.add(node)
+	case client.WATCH_MODIFIED:
+		// 节点的 ip 变了的话 add 会清掉缓存, 下次用的时候重新查
+		m.add(node)
+	case client.WATCH_DELETED:
+		m.delete(node)
+	}
+}
+
+// WatchNodes 通过 apiserver 跟踪集群中的节点, 节点加入或者离开的时候调用 handler
+// 断开重连和 410 之后的重新 list 都由 client.Reflector 负责, 这个函数会一直阻塞到 stop 被关掉
+func (is *IpamService) WatchNodes(handler *NodeHandler, stop <-chan struct{}) error {
+	if is.K8sClient == nil {
+		return errors.New("k8s client 没有初始化")
+	}
+	m := &nodeMembership{
+		get:     getGet(),
+		known:   map[string]*v1.Node{},
+		handler: handler,
+	}
+	get := is.K8sClient.Get()
+	client.NewReflector("nodes", get.NodeListWatch(m.replace), m.handle).Run(stop)
+	return nil
+}
@@ -0,0 +1,76 @@
+package ipam
+
+import (
+	"cni-demo/client"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNodeMembership(t *testing.T) {
+	test := assert.New(t)
+
+	var added, deleted []string
+	get := &Get{
+		nodeIpCache: map[string]string{"node2": "192.168.1.2", "node3": "192.168.1.3"},
+		cidrCache:   map[string]string{"node2": "10.244.2.0/24"},
+	}
+	m := &nodeMembership{
+		get:   get,
+		known: map[string]*v1.Node{},
+		handler: &NodeHandler{
+			OnAdd:    func(node *v1.Node) { added = append(added, node.Name) },
+			OnDelete: func(node *v1.Node) { deleted = append(deleted, node.Name) },
+		},
+	}
+	newNode := func(name string) v1.Node {
+		return v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	}
+
+	m.replace(&v1.NodeList{Items: []v1.Node{newNode("node1"), newNode("node2")}})
+	test.ElementsMatch([]string{"node1", "node2"}, added)
+
+	// watch 到的重复 ADDED 不会再回调一次
+	raw, _ := json.Marshal(newNode("node1"))
+	m.handle(&client.WatchEvent{Type: client.WATCH_ADDED, Object: raw})
+	test.Len(added, 2)
+
+	// 重新 list 的时候 node2 不见了, node3 加进来了
+	m.replace(&v1.NodeList{Items: []v1.Node{newNode("node1"), newNode("node3")}})
+	test.ElementsMatch([]string{"node1", "node2", "node3"}, added)
+	test.Equal([]string{"node2"}, deleted)
+	_, ok := get.getCache(get.nodeIpCache, "node2")
+	test.False(ok)
+	_, ok = get.getCache(get.cidrCache, "node2")
+	test.False(ok)
+
+	// 地址没变的 MODIFIED(比如心跳)不清缓存, 也不算新加入
+	raw, _ = json.Marshal(newNode("node3"))
+	m.handle(&client.WatchEvent{Type: client.WATCH_MODIFIED, Object: raw})
+	_, ok = get.getCache(get.nodeIpCache, "node3")
+	test.True(ok)
+	test.Len(added, 3)
+
+	// ip 变了的话清掉节点的缓存
+	node3 := newNode("node3")
+	node3.Status.Addresses = []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "192.168.1.33"}}
+	raw, _ = json.Marshal(node3)
+	m.handle(&client.WatchEvent{Type: client.WATCH_MODIFIED, Object: raw})
+	_, ok = get.getCache(get.nodeIpCache, "node3")
+	test.False(ok)
+	test.Len(added, 3)
+
+	// podCIDR 变了也一样
+	get.setCache(get.cidrCache, "node3", "10.244.3.0/24")
+	node3.Spec.PodCIDR = "10.244.4.0/24"
+	raw, _ = json.Marshal(node3)
+	m.handle(&client.WatchEvent{Type: client.WATCH_MODIFIED, Object: raw})
+	_, ok = get.getCache(get.cidrCache, "node3")
+	test.False(ok)
+
+	m.handle(&client.WatchEvent{Type: client.WATCH_DELETED, Object: raw})
+	test.Equal([]string{"node2", "node3"}, deleted)
+}
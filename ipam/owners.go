@@ -0,0 +1,99 @@
+package ipam
+
+import (
+	"fmt"
+	"strings"
+)
+
+// 每个网段下的 owners 记录这个网段里的 ip 分给了哪个 pod, 值的格式是 <ip>=<namespace>/<pod>;<ip>=<namespace>/<pod>
+// 只有 ip 的记录是给分配 ip 用的, owners 只是给排查问题的时候把 ip 翻译成 pod 的名字, 写失败了也不影响 pod 创建
+
+// getIpOwnersPath 函数用于获取记录 ip 属于哪个 pod 的路径
+func getIpOwnersPath(network string) string {
+	return getHostPath() + "/" + network + "/owners"
+}
+
+// parseOwners 把 owners 的值解析成 ip 到 <namespace>/<pod> 的映射
+func parseOwners(value string) map[string]string {
+	owners := map[string]string{}
+	for _, item := range strings.Split(value, ";") {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			continue
+		}
+		owners[kv[0]] = kv[1]
+	}
+	return owners
+}
+
+// removeOwners 返回去掉了 ips 之后剩下的 owners 记录, 顺序不变
+func removeOwners(value string, ips ...string) []string {
+	var res []string
+	for _, item := range strings.Split(value, ";") {
+		if item == "" {
+			continue
+		}
+		ip := strings.SplitN(item, "=", 2)[0]
+		removed := false
+		for _, _ip := range ips {
+			if ip == _ip {
+				removed = true
+				break
+			}
+		}
+		if !removed {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+// Owner 记录当前节点上的 ip 分给了哪个 pod, owner 的格式是 <namespace>/<pod>
+// 同一个 ip 之前的记录会被覆盖掉
+func (s *Set) Owner(ip, owner string) error {
+	defer unlock()
+	if ip == "" || owner == "" {
+		return nil
+	}
+	currentNetwork, err := s.store.Get(getHostPath())
+	if err != nil {
+		return err
+	}
+	return s.store.Update(getIpOwnersPath(currentNetwork), func(owners string) (string, error) {
+		res := append(removeOwners(owners, ip), ip+"="+owner)
+		return strings.Join(res, ";"), nil
+	})
+}
+
+// releaseOwners 在释放 ip 的时候把这些 ip 的 owners 记录也删掉
+func (r *Release) releaseOwners(currentNetwork string, ips ...string) error {
+	path := getIpOwnersPath(currentNetwork)
+	exists, err := r.store.Exists(path)
+	if err != nil || !exists {
+		return err
+	}
+	return r.store.Update(path, func(owners string) (string, error) {
+		return strings.Join(removeOwners(owners, ips...), ";"), nil
+	})
+}
+
+// Owners 返回整个集群里 ip 到 <namespace>/<pod> 的映射, 没有记录过的 ip 不在里面
+func (g *Get) Owners() (map[string]string, error) {
+	defer unlock()
+	maps, err := g.HostSubnetMap()
+	if err != nil {
+		return nil, err
+	}
+	res := map[string]string{}
+	for block, host := range maps {
+		path := getEtcdPathWithPrefix(fmt.Sprintf("/%s/%s/%s/%s/owners", getIpamSubnet(), getIpamMaskSegment(), host, block))
+		value, err := g.store.Get(path)
+		if err != nil {
+			return nil, err
+		}
+		for ip, owner := range parseOwners(value) {
+			res[ip] = owner
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,24 @@
+package ipam
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOwners(t *testing.T) {
+	test := assert.New(t)
+
+	owners := parseOwners("10.244.1.10=default/nginx;;bad;10.244.1.11=kube-system/coredns-c676cc86f-4kz2t")
+	test.Equal(map[string]string{
+		"10.244.1.10": "default/nginx",
+		"10.244.1.11": "kube-system/coredns-c676cc86f-4kz2t",
+	}, owners)
+	test.Empty(parseOwners(""))
+
+	test.Equal(
+		[]string{"10.244.1.11=kube-system/coredns"},
+		removeOwners("10.244.1.10=default/nginx;10.244.1.11=kube-system/coredns;10.244.1.12=default/redis", "10.244.1.10", "10.244.1.12"),
+	)
+	test.Nil(removeOwners("", "10.244.1.10"))
+}
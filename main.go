@@ -1,65 +1,46 @@
 package main
 
 import (
-	"cni-demo/cni"
+	"cni-demo/agent"
 	"cni-demo/tools/helper"
 	"cni-demo/tools/skel"
-	"cni-demo/tools/utils"
-	"errors"
-	"fmt"
+	"os"
 
 	_ "cni-demo/plugins/hostgw"
 	_ "cni-demo/plugins/ipip"
 	_ "cni-demo/plugins/vxlan/vxlan"
 	_ "cni-demo/plugins/xvlan/ipvlan"
 	_ "cni-demo/plugins/xvlan/macvlan"
+	"cni-demo/tools/logger"
 	"github.com/containernetworking/cni/pkg/version"
 	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
 )
 
 // cmdAdd 函数用于处理 CNI ADD 操作，主要用于设置网络接口
+// 本机上的 cni-demo-agent 在提供服务的话直接转给它, 它那边的客户端和缓存都是热的; 没有的话自己执行
 func cmdAdd(args *skel.CmdArgs) error {
 	// 记录日志，表示进入 cmdAdd 函数
-	utils.WriteLog("进入到 cmdAdd")
+	logger.Debug("进入到 cmdAdd")
 	// 输出临时日志，打印 args
 	helper.TmpLogArgs(args)
 
-	// 从 args 里把 config 给捞出来
-	pluginConfig := helper.GetConfigs(args)
-	if pluginConfig == nil {
-		errMsg := fmt.Sprintf("add: 从 args 中获取 plugin config 失败, config: %s", string(args.StdinData))
-		utils.WriteLog(errMsg)
-		return errors.New(errMsg)
+	var result []byte
+	var err error
+	client := agent.NewCNIClient(agent.CNI_SOCKET_PATH)
+	if client.Available() {
+		result, err = client.Add(args)
+	} else {
+		result, err = helper.CmdAdd(args)
 	}
-
-	// 获取 CNI 模式和版本信息
-	mode, cniVersion := helper.GetBaseInfo(pluginConfig)
-	if pluginConfig.CNIVersion == "" {
-		pluginConfig.CNIVersion = cniVersion
-	}
-
-	// 将 args 和 configs 以及要使用的插件模式都传给 cni manager
-	cniManager := cni.
-		GetCNIManager().
-		SetBootstrapConfigs(pluginConfig).
-		SetBootstrapArgs(args).
-		SetBootstrapCNIMode(mode)
-	if cniManager == nil {
-		utils.WriteLog("cni 插件未初始化完成")
-		return errors.New("cni plugins register failed")
-	}
-
-	// 启动对应 mode 的插件开始设置乱七八糟的网卡等
-	err := cniManager.BootstrapCNI()
 	if err != nil {
-		utils.WriteLog("设置 cni 失败: ", err.Error())
+		logger.Error("设置 cni 失败", "err", err)
 		return err
 	}
 
 	// 将结果打印到标准输出
-	err = cniManager.PrintResult()
+	_, err = os.Stdout.Write(result)
 	if err != nil {
-		utils.WriteLog("打印 cni 执行结果失败: ", err.Error())
+		logger.Error("打印 cni 执行结果失败", "err", err)
 		return err
 	}
 	return nil
@@ -67,53 +48,26 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 // cmdDel 函数用于处理 CNI DEL 操作，主要用于清理网络接口
 func cmdDel(args *skel.CmdArgs) error {
-	utils.WriteLog("进入到 cmdDel")
+	logger.Debug("进入到 cmdDel")
 	helper.TmpLogArgs(args)
 
-	// 从 args 中获取 plugin config
-	pluginConfig := helper.GetConfigs(args)
-	if pluginConfig == nil {
-		errMsg := fmt.Sprintf("del: 从 args 中获取 plugin config 失败, config: %s", string(args.StdinData))
-		utils.WriteLog(errMsg)
-		return errors.New(errMsg)
+	client := agent.NewCNIClient(agent.CNI_SOCKET_PATH)
+	if client.Available() {
+		return client.Del(args)
 	}
-	mode, _ := helper.GetBaseInfo(pluginConfig)
-
-	// 设置卸载参数
-	cniManager := cni.
-		GetCNIManager().
-		SetUnmountConfigs(pluginConfig).
-		SetUnmountArgs(args).
-		SetUnmountCNIMode(mode)
-
-	// 进行卸载操作
-	return cniManager.UnmountCNI()
+	return helper.CmdDel(args)
 }
 
 // cmdCheck 函数用于处理 CNI CHECK 操作，主要用于检查网络接口状态
 func cmdCheck(args *skel.CmdArgs) error {
-	utils.WriteLog("进入到 cmdCheck")
+	logger.Debug("进入到 cmdCheck")
 	helper.TmpLogArgs(args)
 
-	// 从 args 中获取 plugin config
-	pluginConfig := helper.GetConfigs(args)
-	if pluginConfig == nil {
-		errMsg := fmt.Sprintf("check: 从 args 中获取 plugin config 失败, config: %s", string(args.StdinData))
-		utils.WriteLog(errMsg)
-		return errors.New(errMsg)
+	client := agent.NewCNIClient(agent.CNI_SOCKET_PATH)
+	if client.Available() {
+		return client.Check(args)
 	}
-	mode, _ := helper.GetBaseInfo(pluginConfig)
-
-	// 设置检查参数
-	cniManager := cni.
-		GetCNIManager().
-		SetCheckConfigs(pluginConfig).
-		SetCheckArgs(args).
-		SetCheckCNIMode(mode)
-
-	// 进行检查操作
-	return cniManager.CheckCNI()
-
+	return helper.CmdCheck(args)
 }
 
 func main() {
@@ -1,12 +1,13 @@
 package hostgw
 
 import (
+	"cni-demo/agent"
 	"cni-demo/cni"
 	"cni-demo/consts"
 	"cni-demo/ipam"
-	"cni-demo/nettools"
+	"cni-demo/tools/logger"
+	"cni-demo/tools/nettools"
 	"cni-demo/tools/skel"
-	"cni-demo/tools/utils"
 	types "github.com/containernetworking/cni/pkg/types/100"
 	"net"
 	// "github.com/containernetworking/cni/pkg/types"
@@ -30,21 +31,21 @@ func (hostGW *HostGatewayCNI) Bootstrap(
 	ipam.Init(pluginConfig.Subnet, nil)
 	ipamClient, err := ipam.GetIpamService()
 	if err != nil {
-		utils.WriteLog("创建 ipam 客户端出错, err: ", err.Error())
+		logger.Error("创建 ipam 客户端出错", "err", err)
 		return nil, err
 	}
 
 	// 根据 subnet 网段来得到网关, 表示所有的节点上的 pod 的 ip 都在这个网关范围内
 	gateway, err := ipamClient.Get().Gateway()
 	if err != nil {
-		utils.WriteLog("获取 gateway 出错, err: ", err.Error())
+		logger.Error("获取 gateway 出错", "err", err)
 		return nil, err
 	}
 
 	// 获取网关＋网段号
 	gatewayWithMaskSegment, err := ipamClient.Get().GatewayWithMaskSegment()
 	if err != nil {
-		utils.WriteLog("获取 gatewayWithMaskSegment 出错, err: ", err.Error())
+		logger.Error("获取 gatewayWithMaskSegment 出错", "err", err)
 		return nil, err
 	}
 
@@ -62,14 +63,14 @@ func (hostGW *HostGatewayCNI) Bootstrap(
 	// 根据 containerd 传过来的 netns 的地址获取 ns
 	netns, err := ns.GetNS(args.Netns)
 	if err != nil {
-		utils.WriteLog("获取 ns 失败: ", err.Error())
+		logger.Error("获取 ns 失败", "err", err)
 		return nil, err
 	}
 
 	// 从 ipam 中拿到一个未使用的 ip 地址
 	podIP, err := ipamClient.Get().UnusedIP()
 	if err != nil {
-		utils.WriteLog("获取 podIP 出错, err: ", err.Error())
+		logger.Error("获取 podIP 出错", "err", err)
 		return nil, err
 	}
 
@@ -95,10 +96,10 @@ func (hostGW *HostGatewayCNI) Bootstrap(
 
 	err = nettools.CreateBridgeAndCreateVethAndSetNetworkDeviceStatusAndSetVethMaster(bridgeName, gatewayWithMaskSegment, ifName, podIP, mtu, netns)
 	if err != nil {
-		utils.WriteLog("执行创建网桥, 创建 veth 设备, 添加默认路由等操作失败, err: ", err.Error())
+		logger.Error("执行创建网桥, 创建 veth 设备, 添加默认路由等操作失败", "err", err)
 		err = ipamClient.Release().IPs(podIP)
 		if err != nil {
-			utils.WriteLog("释放 podIP", podIP, " 失败: ", err.Error())
+			logger.Error("释放 podIP 失败", "ip", podIP, "err", err)
 		}
 	}
 
@@ -110,7 +111,7 @@ func (hostGW *HostGatewayCNI) Bootstrap(
 	 * 因为此时的流量包只能往外出而不能往里进
 	 * 原因是流量包往外出的时候还需要做一次 snat
 	 * 没做 nat 转换的话, 外网在往回送消息的时候不知道应该往哪儿发
-	 * 不过 cni-demo 这里暂时没有做 snat 的操作, 因为暂时没这个需求~
+	 * 如果配置里开了 ipMasq, 会在下边给这个 pod 单独建一条 snat 的链
 	 *
 	 *
 	 * 接下来要让不同节点上的 pod 互相通信了
@@ -124,32 +125,53 @@ func (hostGW *HostGatewayCNI) Bootstrap(
 	// 首先通过 ipam 获取到 etcd 中存放的集群中所有节点的相关网络信息
 	networks, err := ipamClient.Get().AllHostNetwork()
 	if err != nil {
-		utils.WriteLog("这里的获取所有节点的网络信息失败, err: ", err.Error())
+		logger.Error("获取所有节点的网络信息失败", "err", err)
 		return nil, err
 	}
 
 	// 然后获取一下本机的网卡信息
 	currentNetwork, err := ipamClient.Get().HostNetwork()
 	if err != nil {
-		utils.WriteLog("获取本机网卡信息失败, err: ", err.Error())
+		logger.Error("获取本机网卡信息失败", "err", err)
 		return nil, err
 	}
 
 	// 这里面要做的就是把其他节点上的 pods 的 cidr 和其主机的网卡 ip 作为一条路由规则创建到当前主机上
 	err = nettools.SetOtherHostRouteToCurrentHost(networks, currentNetwork)
 	if err != nil {
-		utils.WriteLog("给主机添加其他节点网络信息失败, err: ", err.Error())
+		logger.Error("给主机添加其他节点网络信息失败", "err", err)
 		return nil, err
 	}
 
 	link, err := netlink.LinkByName(currentNetwork.Name)
 	if err != nil {
-		utils.WriteLog("获取本机网卡失败, err: ", err.Error())
+		logger.Error("获取本机网卡失败", "err", err)
 		return nil, err
 	}
 	err = nettools.SetIptablesForDeviceToFarwordAccept(link.(*netlink.Device))
 	if err != nil {
-		utils.WriteLog("设置本机网卡转发规则失败")
+		logger.Error("设置本机网卡转发规则失败")
+		return nil, err
+	}
+
+	// 开了 ipMasq 的话给 pod 访问集群外的流量做 snat
+	if pluginConfig.IPMasq {
+		clusterCIDR, err := ipamClient.Get().CurrentSubnet()
+		if err != nil {
+			logger.Error("获取集群网段失败", "err", err)
+			return nil, err
+		}
+		err = nettools.SetupPodIPMasq(podIP, clusterCIDR, pluginConfig.NonMasqueradeCIDRs, args.ContainerID)
+		if err != nil {
+			logger.Error("设置 pod 的 snat 规则失败", "err", err)
+			return nil, err
+		}
+	}
+
+	// 网络策略由 cni-demo-agent 执行, 这里只确认它在运行
+	err = agent.CheckAlive()
+	if err != nil {
+		logger.Error("检查 cni-demo-agent 失败", "err", err)
 		return nil, err
 	}
 
@@ -176,6 +198,13 @@ func (hostGW *HostGatewayCNI) Unmount(
 	args *skel.CmdArgs,
 	pluginConfig *cni.PluginConf,
 ) error {
+	if pluginConfig.IPMasq {
+		err := nettools.TeardownIPMasq(args.ContainerID)
+		if err != nil {
+			logger.Error("删除 pod 的 snat 规则失败", "err", err)
+			return err
+		}
+	}
 	// TODO
 	return nil
 }
@@ -202,7 +231,7 @@ func init() {
 	manager := cni.GetCNIManager()
 	err := manager.Register(hostGatewayCNI)
 	if err != nil {
-		utils.WriteLog("注册 host gw cni 失败: ", err.Error())
+		logger.Error("注册 host gw cni 失败", "err", err)
 		panic(err.Error())
 	}
 }
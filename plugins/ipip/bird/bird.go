@@ -2,62 +2,153 @@ package bird
 
 import (
 	"cni-demo/consts"
+	"cni-demo/ipam"
+	"cni-demo/tools/logger"
 	"cni-demo/tools/utils"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
-	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
 )
 
-// StartBirdDaemon 用于启动 BIRD 守护进程。
-// 这个函数会先检查 BIRD 配置文件是否存在，然后确认 BIRD 守护进程是否已经在运行。
-// 如果已经在运行，函数会直接返回当前的进程 ID (PID)。
-// 如果没有运行，函数会启动一个新的 BIRD 守护进程，并将其 PID 写入一个文件，
-// 以便后续可以方便地找到并管理这个进程。
-//
-// 参数:
-//   - configPath: BIRD 配置文件的路径。
-//
-// 返回值:
-//   - int: BIRD 守护进程的 PID。
-//   - error: 如果在启动 BIRD 守护进程的过程中遇到错误，返回一个 error 对象
-func StartBirdDaemon(configPath string) (int, error) {
-	if !utils.FileIsExisted(configPath) {
-		return -1, fmt.Errorf("the config path %s not exist", configPath)
-	}
-
-	// 先看 bird deamon 这个路径是否存在
-	if utils.PathExists(consts.KUBE_TEST_CNI_DEFAULT_BIRD_DEAMON_PATH) {
-		// 如果该路径存在
-		pid, err := utils.ReadContentFromFile(consts.KUBE_TEST_CNI_DEFAULT_BIRD_DEAMON_PATH)
-		if err != nil {
-			return -1, err
-		}
-		// 尝试读出里头的 pid, 然后看这个 pid 当前是不是真的在运行
-		if utils.FileIsExisted(fmt.Sprintf("/proc/%s", pid)) {
-			// 说明当前 host 上的 bird 正在运行可以直接返回
-			return strconv.Atoi(pid)
-		} else {
-			// 说明当前 host 上的 bird 已经退出了, 那就删掉这个文件
-			utils.DeleteFile(consts.KUBE_TEST_CNI_DEFAULT_BIRD_DEAMON_PATH)
-		}
-	}
+const (
+	// BIRD 可执行文件的位置
+	BIRD_BIN_PATH = consts.KUBE_TEST_CNI_DEFAULT_PATH + "/bird"
+	// BIRD 的控制 socket
+	BIRD_CTL_PATH = "/var/run/bird.ctl"
+	// 发了 SIGTERM 之后最多等多久, 还不退就直接 kill 掉
+	stopTimeout = 5 * time.Second
+)
+
+// Bird 负责在前台运行 BIRD 并把它看住, 由 cni-demo-agent 调用
+// 以前是在 CNI ADD 里 fork 一个出来, pid 记在文件里, 挂了也没人管
+type Bird struct {
+	ConfigPath string
+
+	lock sync.Mutex
+	cmd  *exec.Cmd
+}
 
+func NewBird(configPath string) *Bird {
+	return &Bird{ConfigPath: configPath}
+}
+
+// Run 启动 BIRD 并等它退出, stop 被关掉的时候先发 SIGTERM 让它自己退
+// BIRD 自己退出的话返回 error, 交给 agent 重新拉起来
+func (b *Bird) Run(stop <-chan struct{}) error {
+	if !utils.FileIsExisted(b.ConfigPath) {
+		return fmt.Errorf("the config path %s not exist", b.ConfigPath)
+	}
 	cmd := exec.Command(
-		"/opt/cni-demo/bird",
+		BIRD_BIN_PATH,
 		"-R",
 		"-s",
-		"/var/run/bird.ctl",
+		BIRD_CTL_PATH,
+		// -d 会让 BIRD 跑在前台, 这样它退出了 agent 才能知道
 		"-d",
 		"-c",
-		configPath,
+		b.ConfigPath,
 	)
 	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
 	err := cmd.Start()
 	if err != nil {
-		return -1, err
+		return err
+	}
+	b.lock.Lock()
+	b.cmd = cmd
+	b.lock.Unlock()
+	defer func() {
+		b.lock.Lock()
+		b.cmd = nil
+		b.lock.Unlock()
+	}()
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	select {
+	case err = <-exited:
+		if err == nil {
+			err = errors.New("bird 退出了")
+		}
+		return err
+	case <-stop:
+	}
+	cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-exited:
+	case <-time.After(stopTimeout):
+		cmd.Process.Kill()
+		<-exited
+	}
+	return nil
+}
+
+// Reconfigure 让正在运行的 BIRD 重新读一遍配置文件, 没在运行的话下次启动自然会读到新的
+func (b *Bird) Reconfigure() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.cmd == nil || b.cmd.Process == nil {
+		return nil
+	}
+	return b.cmd.Process.Signal(syscall.SIGHUP)
+}
+
+// syncConfig 重新生成配置文件, 内容变了的话让 BIRD 重新加载
+func (b *Bird) syncConfig(is *ipam.IpamService) error {
+	config, err := GenConfig(is)
+	if err != nil {
+		return err
+	}
+	if old, err := utils.ReadContentFromFile(b.ConfigPath); err == nil && old == config {
+		return nil
+	}
+	err = utils.CreateFile(b.ConfigPath, ([]byte)(config), 0766)
+	if err != nil {
+		return err
+	}
+	return b.Reconfigure()
+}
+
+// Run 生成 BIRD 的配置并把 BIRD 跑起来, 节点加入或者离开集群的时候更新 BGP 邻居
+// 一直阻塞到 stop 被关掉
+func Run(is *ipam.IpamService, stop <-chan struct{}) error {
+	b := NewBird(consts.KUBE_TEST_CNI_DEFAULT_BIRD_CONFIG_PATH)
+	err := b.syncConfig(is)
+	if err != nil {
+		return err
 	}
-	pid := strconv.Itoa(cmd.Process.Pid)
-	utils.CreateFile(consts.KUBE_TEST_CNI_DEFAULT_BIRD_DEAMON_PATH, ([]byte)(pid), 0766)
-	return cmd.Process.Pid, nil
+
+	onChange := func(node *v1.Node) {
+		err := b.syncConfig(is)
+		if err != nil {
+			logger.Error("更新 bird 配置失败", "err", err)
+		}
+	}
+	// BIRD 自己退出的时候也要把 watch 停掉, 不然 agent 重新拉起来之后就有两个在 watch 了
+	done := make(chan struct{})
+	quit := make(chan struct{})
+	go func() {
+		select {
+		case <-stop:
+		case <-done:
+		}
+		close(quit)
+	}()
+	watchErr := make(chan error, 1)
+	go func() {
+		watchErr <- is.WatchNodes(&ipam.NodeHandler{OnAdd: onChange, OnDelete: onChange}, quit)
+	}()
+
+	err = b.Run(stop)
+	close(done)
+	<-watchErr
+	return err
 }
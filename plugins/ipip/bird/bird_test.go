@@ -5,6 +5,7 @@ import (
 	"cni-demo/tools/utils"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -35,7 +36,8 @@ func TestBird(t *testing.T) {
 	test.Equal(str, config)
 	// return
 	// utils.DeleteFile("/opt/cni-demo/bird.cfg")
-	pid, err := StartBirdDaemon("/opt/cni-demo/bird.cfg")
-	test.Nil(err)
-	fmt.Println("bird 的子进程 pid 是: ", pid)
+	stop := make(chan struct{})
+	b := NewBird("/opt/cni-demo/bird.cfg")
+	time.AfterFunc(time.Second, func() { close(stop) })
+	test.Nil(b.Run(stop))
 }
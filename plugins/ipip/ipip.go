@@ -1,13 +1,13 @@
 package ipip
 
 import (
+	"cni-demo/agent"
 	"cni-demo/cni"
 	"cni-demo/consts"
 	"cni-demo/ipam"
-	"cni-demo/nettools"
-	"cni-demo/plugins/ipip/bird"
+	"cni-demo/tools/logger"
+	"cni-demo/tools/nettools"
 	"cni-demo/tools/skel"
-	"cni-demo/tools/utils"
 	"errors"
 	"fmt"
 	types "github.com/containernetworking/cni/pkg/types/100"
@@ -41,13 +41,13 @@ func setFibTalbeIntoNs(gw string, veth *netlink.Veth) error {
 	// 这里的 gw 模仿 calico 使用 “169.254.1.1”
 	gwIp, gwNet, err := net.ParseCIDR(gw)
 	if err != nil {
-		utils.WriteLog("创建交换路由失败, err:", err.Error())
+		logger.Error("创建交换路由失败", "err", err)
 		return err
 	}
 
 	defIp, defNet, err := net.ParseCIDR("0.0.0.0/0")
 	if err != nil {
-		utils.WriteLog("创建交换路由失败, err:", err.Error())
+		logger.Error("创建交换路由失败", "err", err)
 		return err
 	}
 
@@ -55,14 +55,14 @@ func setFibTalbeIntoNs(gw string, veth *netlink.Veth) error {
 	// 注意这里在设置交换路由的时候, 第一条的 gw -> 0.0.0.0 需要是 scope_link
 	err = nettools.AddRoute(gwNet, defIp, veth, netlink.SCOPE_LINK)
 	if err != nil {
-		utils.WriteLog("设置交换路由 gw -> default 失败: ", err.Error())
+		logger.Error("设置交换路由 gw -> default 失败", "err", err)
 		return err
 	}
 	// 然后创建默认的 0.0.0.0 -> gw 时就可以走默认的 scope universe 了
 	// 否则会创建失败
 	err = nettools.AddRoute(defNet, gwIp, veth)
 	if err != nil {
-		utils.WriteLog("设置交换路由 default -> gw 失败: ", err.Error())
+		logger.Error("设置交换路由 default -> gw 失败", "err", err)
 		return err
 	}
 	return nil
@@ -102,13 +102,13 @@ func setUpHostPairForwarding(veth *netlink.Veth) error {
 func setLocalFibTable(podIP string, veth *netlink.Veth) error {
 	_, gwNet, err := net.ParseCIDR(podIP)
 	if err != nil {
-		utils.WriteLog("创建交换路由失败, err:", err.Error())
+		logger.Error("创建交换路由失败", "err", err)
 		return err
 	}
 
 	defIp, _, err := net.ParseCIDR("0.0.0.0/0")
 	if err != nil {
-		utils.WriteLog("创建交换路由失败, err:", err.Error())
+		logger.Error("创建交换路由失败", "err", err)
 		return err
 	}
 
@@ -132,28 +132,28 @@ func setPodNetwork(netns ns.NetNS, ifname string, podIP string) (*netlink.Veth,
 		// 在 netns 中创建一对儿 veth pair
 		containerVeth, hostVeth, err = nettools.CreateVethPair(ifname, 1500)
 		if err != nil {
-			utils.WriteLog("创建 veth 失败, err: ", err.Error())
+			logger.Error("创建 veth 失败", "err", err)
 			return err
 		}
 
 		// 把随机起名的 veth 那头放在主机上
 		err = nettools.SetVethNsFd(hostVeth, hostNs)
 		if err != nil {
-			utils.WriteLog("把 veth 设置到 ns 下失败: ", err.Error())
+			logger.Error("把 veth 设置到 ns 下失败", "err", err)
 			return err
 		}
 
 		// 然后把要被放到 pod 中的那头 veth 塞上 podIP
 		err = nettools.SetIpForVeth(containerVeth.Name, podIP)
 		if err != nil {
-			utils.WriteLog("给 veth 设置 ip 失败, err: ", err.Error())
+			logger.Error("给 veth 设置 ip 失败", "err", err)
 			return err
 		}
 
 		// 然后启动它
 		err = nettools.SetUpVeth(containerVeth)
 		if err != nil {
-			utils.WriteLog("启动 veth pair 失败, err: ", err.Error())
+			logger.Error("启动 veth pair 失败", "err", err)
 			return err
 		}
 
@@ -229,7 +229,7 @@ func (ipip *IpipCNI) Bootstrap(
 	// 从 ipam 中拿到一个未使用的 ip 地址
 	podIP, err := ipamClient.Get().UnusedIP()
 	if err != nil {
-		utils.WriteLog("获取 podIP 出错, err: ", err.Error())
+		logger.Error("获取 podIP 出错", "err", err)
 		return nil, err
 	}
 
@@ -239,7 +239,7 @@ func (ipip *IpipCNI) Bootstrap(
 	// 获取 netns
 	netns, err := ns.GetNS(args.Netns)
 	if err != nil {
-		utils.WriteLog("获取 ns 失败: ", err.Error())
+		logger.Error("获取 ns 失败", "err", err)
 		return nil, err
 	}
 
@@ -261,6 +261,27 @@ func (ipip *IpipCNI) Bootstrap(
 		return nil, err
 	}
 
+	// 开了 ipMasq 的话给 pod 访问集群外的流量做 snat
+	if pluginConfig.IPMasq {
+		clusterCIDR, err := ipamClient.Get().CurrentSubnet()
+		if err != nil {
+			logger.Error("获取集群网段失败", "err", err)
+			return nil, err
+		}
+		err = nettools.SetupPodIPMasq(podIP, clusterCIDR, pluginConfig.NonMasqueradeCIDRs, args.ContainerID)
+		if err != nil {
+			logger.Error("设置 pod 的 snat 规则失败", "err", err)
+			return nil, err
+		}
+	}
+
+	// 网络策略由 cni-demo-agent 执行, 这里只确认它在运行
+	err = agent.CheckAlive()
+	if err != nil {
+		logger.Error("检查 cni-demo-agent 失败", "err", err)
+		return nil, err
+	}
+
 	// 走到这儿基本上 pod 内部就配置完了
 	// 接下来要创建 ipip tunnel 设备
 	iptunl, err := nettools.CreateIPIPDeviceAndUp("tunl0")
@@ -280,18 +301,7 @@ func (ipip *IpipCNI) Bootstrap(
 		return nil, err
 	}
 
-	// 创建 bgp 协议需要的 bird config
-	err = bird.GenConfigFile(ipamClient)
-	if err != nil {
-		return nil, err
-	}
-
-	// 启动 bird
-	_, err = bird.StartBirdDaemon(consts.KUBE_TEST_CNI_DEFAULT_BIRD_CONFIG_PATH)
-	if err != nil {
-		return nil, err
-	}
-
+	// bird 的配置和启动都由 cni-demo-agent 负责
 	// 获取网关地址和 podIP 准备返回给外边
 	tunlIP := strings.Split(tunlCIDR, "/")[0]
 	_gw := net.ParseIP(tunlIP)
@@ -313,6 +323,13 @@ func (ipip *IpipCNI) Unmount(
 	args *skel.CmdArgs,
 	pluginConfig *cni.PluginConf,
 ) error {
+	if pluginConfig.IPMasq {
+		err := nettools.TeardownIPMasq(args.ContainerID)
+		if err != nil {
+			logger.Error("删除 pod 的 snat 规则失败", "err", err)
+			return err
+		}
+	}
 	// TODO
 	return nil
 }
@@ -337,7 +354,7 @@ func init() {
 	manager := cni.GetCNIManager()
 	err := manager.Register(ipipCNI)
 	if err != nil {
-		utils.WriteLog("注册 ipip cni 失败: ", err.Error())
+		logger.Error("注册 ipip cni 失败", "err", err)
 		panic(err.Error())
 	}
 }
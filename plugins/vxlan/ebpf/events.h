@@ -0,0 +1,41 @@
+#ifndef __CNI_DEMO_EVENTS_H
+#define __CNI_DEMO_EVENTS_H
+
+// 用到了 maps.h 里的 ding_events, ding_flow_cfg 和 policy.h 里的 l4Info, 需要在它们之后 include
+
+// flow_sampled 判断这个包要不要导出, 没配置或者 sample_rate 是 0 的话都不导出
+static __always_inline int flow_sampled(__u8 verdict) {
+  __u32 key = 0;
+  struct flowConfig *cfg = bpf_map_lookup_elem(&ding_flow_cfg, &key);
+  if (!cfg || cfg->sample_rate == 0) {
+    return 0;
+  }
+  // 丢掉的包不多, 又是排查问题最想看到的, 每个都导出
+  if (verdict == REASON_POLICY_DENY || verdict == REASON_TUNNEL_SET_FAIL) {
+    return 1;
+  }
+  return cfg->sample_rate == 1 || bpf_get_prandom_u32() % cfg->sample_rate == 0;
+}
+
+// flow_emit 把一个流量事件写到当前 cpu 的 perf 缓冲区里, 缓冲区满了的话这个事件就丢了, 由 go 那头记下丢了多少
+// src_ip, dst_ip 和 remote_node 都是主机字节序, l4 里的端口是网络字节序
+static __always_inline void flow_emit(struct __sk_buff *skb, __u8 point, __u32 src_ip, __u32 dst_ip,
+                                      struct l4Info *l4, __u8 verdict, __u32 remote_node) {
+  if (!flow_sampled(verdict)) {
+    return;
+  }
+  struct flowEvent ev = {};
+  ev.src_ip = src_ip;
+  ev.dst_ip = dst_ip;
+  ev.remote_node = remote_node;
+  ev.ifindex = skb->ifindex;
+  ev.len = skb->len;
+  ev.src_port = ntohs(l4->sport);
+  ev.dst_port = ntohs(l4->dport);
+  ev.proto = l4->proto;
+  ev.verdict = verdict;
+  ev.point = point;
+  bpf_perf_event_output(skb, &ding_events, BPF_F_CURRENT_CPU, &ev, sizeof(ev));
+}
+
+#endif
@@ -0,0 +1,154 @@
+#ifndef __CNI_DEMO_LB_H
+#define __CNI_DEMO_LB_H
+
+#include <linux/ip.h>
+#include <linux/tcp.h>
+#include <linux/udp.h>
+
+// 用到了 maps.h 里的 ding_svc 和 ding_ct, 需要在 maps.h 之后 include
+
+/**
+ * service 的 ClusterIP 负载均衡, vxlan 模式下用来替代 kube-proxy:
+ *  1. pod 发出来的包在它的 veth 上查 ding_svc, 目标是 ClusterIP:端口 的话选一个后端做 DNAT
+ *  2. 选中的后端记到 ding_ct 里, 同一个连接后面的包都发给同一个后端
+ *  3. 同时记一条回的方向的, 后端回包的时候把源地址改回 ClusterIP:端口
+ *     后端在本机的话回包是从后端的 veth 上过来的, 在其他节点的话是从 vxlan 设备上进来的
+ *     后端是本机自己的地址的话回包是内核从 vxlan 设备上发出来的, 见 vxlan_egress.c
+ *  4. DNAT 之后目标就是一个普通的 pod ip 了, 后面还是按 ding_lxc 和 ding_cidr 转发
+ * 连接跟踪都记在访问方所在的节点上, 所以回包只在送进访问方 pod 之前改回去
+ * 只处理 tcp 和 udp, 带 ip 选项的包和分片都不管
+ */
+
+#define LB_PASS 0           // 不用做负载均衡
+#define LB_NAT 1            // 包已经改好了
+#define LB_NO_BACKEND -1    // 访问的 service 没有可用的后端
+
+#define LB_IP_OFF sizeof(struct ethhdr)
+#define LB_L4_OFF (sizeof(struct ethhdr) + sizeof(struct iphdr))
+
+// lbPorts 是 tcp 和 udp 头的前 4 个字节
+struct lbPorts {
+  __u16 sport;
+  __u16 dport;
+};
+
+// lb_parse 把包的五元组填到 key 里, 不需要处理的包返回 -1
+static __always_inline int lb_parse(struct __sk_buff *skb, struct ctKey *key) {
+  void *data = (void *)(long)skb->data;
+  void *data_end = (void *)(long)skb->data_end;
+  struct iphdr *ip = data + LB_IP_OFF;
+  struct lbPorts *ports = data + LB_L4_OFF;
+  if ((void *)(ports + 1) > data_end) {
+    return -1;
+  }
+  if (ip->ihl != 5 || (ip->frag_off & __constant_htons(0x3fff)) != 0) {
+    return -1;
+  }
+  if (ip->protocol != IPPROTO_TCP && ip->protocol != IPPROTO_UDP) {
+    return -1;
+  }
+  key->src = ip->saddr;
+  key->dst = ip->daddr;
+  key->sport = ports->sport;
+  key->dport = ports->dport;
+  key->proto = ip->protocol;
+  return 0;
+}
+
+// lb_rewrite 把 ip 头里 ip_off 处的地址和四层头里 port_off 处的端口改掉, 三层和四层的校验和跟着一起改
+// udp 的校验和是 0 的话表示没有算, BPF_F_MARK_MANGLED_0 会让它保持是 0
+static __always_inline void lb_rewrite(struct __sk_buff *skb, __u8 proto,
+                                       int ip_off, __u32 old_ip, __u32 new_ip,
+                                       int port_off, __u16 old_port, __u16 new_port) {
+  int csum_off = LB_L4_OFF + offsetof(struct tcphdr, check);
+  __u64 flags = 0;
+  if (proto == IPPROTO_UDP) {
+    csum_off = LB_L4_OFF + offsetof(struct udphdr, check);
+    flags = BPF_F_MARK_MANGLED_0;
+  }
+  bpf_l4_csum_replace(skb, csum_off, old_ip, new_ip, flags | BPF_F_PSEUDO_HDR | sizeof(new_ip));
+  bpf_l4_csum_replace(skb, csum_off, old_port, new_port, flags | sizeof(new_port));
+  bpf_l3_csum_replace(skb, LB_IP_OFF + offsetof(struct iphdr, check), old_ip, new_ip, sizeof(new_ip));
+  bpf_skb_store_bytes(skb, ip_off, &new_ip, sizeof(new_ip), 0);
+  bpf_skb_store_bytes(skb, port_off, &new_port, sizeof(new_port), 0);
+}
+
+// lb_dnat 在 pod 发出来的包上查 ding_svc, 是访问 service 的话把目标改成一个后端
+// 返回 LB_NAT 的话原来的指针都失效了, 调用的地方要重新取
+static __always_inline int lb_dnat(struct __sk_buff *skb) {
+  struct ctKey key = {};
+  if (lb_parse(skb, &key) < 0) {
+    return LB_PASS;
+  }
+  struct svcKey svc = {};
+  svc.ip = key.dst;
+  svc.port = key.dport;
+  svc.proto = key.proto;
+  struct svcValue *head = bpf_map_lookup_elem(&ding_svc, &svc);
+  if (!head) {
+    return LB_PASS;
+  }
+  if (head->count == 0) {
+    return LB_NO_BACKEND;
+  }
+
+  // 已经建立的连接接着用上次选的后端, 新的连接随机选一个
+  struct ctValue backend = {};
+  key.dir = CT_ORIGINAL;
+  struct ctValue *ct = bpf_map_lookup_elem(&ding_ct, &key);
+  if (ct) {
+    backend.ip = ct->ip;
+    backend.port = ct->port;
+  } else {
+    svc.slot = bpf_get_prandom_u32() % head->count + 1;
+    struct svcValue *be = bpf_map_lookup_elem(&ding_svc, &svc);
+    if (!be) {
+      return LB_NO_BACKEND;
+    }
+    backend.ip = be->ip;
+    backend.port = be->port;
+    bpf_map_update_elem(&ding_ct, &key, &backend, BPF_ANY);
+  }
+
+  // 回的方向的条目可能被 LRU 单独淘汰掉了, 没有的话补上
+  struct ctKey reply = {};
+  reply.src = backend.ip;
+  reply.dst = key.src;
+  reply.sport = backend.port;
+  reply.dport = key.sport;
+  reply.proto = key.proto;
+  reply.dir = CT_REPLY;
+  if (!ct || !bpf_map_lookup_elem(&ding_ct, &reply)) {
+    struct ctValue orig = {};
+    orig.ip = key.dst;
+    orig.port = key.dport;
+    bpf_map_update_elem(&ding_ct, &reply, &orig, BPF_ANY);
+  }
+
+  lb_rewrite(skb, key.proto,
+             LB_IP_OFF + offsetof(struct iphdr, daddr), key.dst, backend.ip,
+             LB_L4_OFF + offsetof(struct lbPorts, dport), key.dport, backend.port);
+  return LB_NAT;
+}
+
+// lb_rev_nat 在要送进本机 pod 的包上查 ding_ct, 是后端回给它的包的话把源地址改回 ClusterIP:端口
+// 返回 LB_NAT 的话原来的指针都失效了
+static __always_inline int lb_rev_nat(struct __sk_buff *skb) {
+  struct ctKey key = {};
+  if (lb_parse(skb, &key) < 0) {
+    return LB_PASS;
+  }
+  key.dir = CT_REPLY;
+  struct ctValue *orig = bpf_map_lookup_elem(&ding_ct, &key);
+  if (!orig) {
+    return LB_PASS;
+  }
+  __u32 ip = orig->ip;
+  __u16 port = orig->port;
+  lb_rewrite(skb, key.proto,
+             LB_IP_OFF + offsetof(struct iphdr, saddr), key.src, ip,
+             LB_L4_OFF + offsetof(struct lbPorts, sport), key.sport, port);
+  return LB_NAT;
+}
+
+#endif
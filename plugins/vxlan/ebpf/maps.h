@@ -4,16 +4,19 @@
 
 #include "common.h"
 
-//这个代码片段定义了三个 eBPF maps，分别是 `ding_lxc`、`ding_ip` 和 `ding_local`。
-//它们分别用于存储终端信息、Pod 节点信息以及本地节点信息。这些 maps 的类型都是哈希表，
-//且最大条目数为 255。同时，这些 maps 的 pinning 类型都被指定为 `LIBBPF_PIN_BY_NAME`，
+//这个代码片段定义了三个 eBPF maps，分别是 `ding_lxc`、`ding_cidr` 和 `ding_local`。
+//它们分别用于存储终端信息、其他节点的 Pod 网段以及本地节点信息。`ding_cidr` 是 LPM trie，其他的都是哈希表，
+//最大条目数见各自的定义。同时，这些 maps 的 pinning 类型都被指定为 `LIBBPF_PIN_BY_NAME`，
 //意味着它们将与一个文件系统路径关联。具体的键值类型根据不同的 map 而异。
+//这里写的 max_entries 只是默认值，要和 plugins/vxlan/map/consts.go 里的一样，
+//加载的时候会换成插件配置里 bpfMapSizes 指定的大小。
 
-// 定义本地设备类型：VXLAN 和 VETH
+// 定义本地设备类型：VXLAN 和 VETH, 以及本机自己的地址
 #define LOCAL_DEV_VXLAN 1;
 #define LOCAL_DEV_VETH 2;
+#define LOCAL_DEV_HOST 3
 
-// 默认的隧道 ID
+// 默认的隧道 ID, 要和 consts.VXLAN_DEFAULT_VNI 一样, 加载的时候会换成插件配置里的 vxlan.vni, 见 vxlan_egress.c 里的 tunnel_id
 #define DEFAULT_TUNNEL_ID 13190
 
 // 定义 endpointKey 结构体，用于存储终端 IP 地址
@@ -32,7 +35,7 @@ struct endpointInfo {
 // 定义一个名为 ding_lxc 的 eBPF map，用于存储 endpointKey 和 endpointInfo
 struct {
 	__uint(type, BPF_MAP_TYPE_HASH);          // map 类型为哈希表
-  __uint(max_entries, 255);                 // 最大条目数为 255
+  __uint(max_entries, 1024);                // 最大条目数为 1024
 	__type(key, struct endpointKey);          // 键类型为 endpointKey
   __type(value, struct endpointInfo);       // 值类型为 endpointInfo
   // 如果别的地方已经往某条路径 pin 了, 需要加上这个属性
@@ -42,28 +45,52 @@ struct {
 // 这里 ding_lxc 是必须要和 bpftool map list 出来的那个 pinned 中路径的名字一样
 } ding_lxc __section_maps_btf;
 
-// 定义 podNodeKey 结构体，用于存储 Pod 节点 IP 地址
-struct podNodeKey {
-  __u32 ip;
+// 定义 lxcDevKey 结构体，key 是 pod 的 veth 留在 host 上那头的 ifindex
+struct lxcDevKey {
+  __u32 ifindex;
 };
 
-// 定义 podNodeValue 结构体，用于存储 Pod 节点相关信息
-struct podNodeValue {
-  __u32 ip;
+// 定义 lxcDevValue 结构体，存这块 veth 的 mac, 代答 pod 的 arp 和邻居请求的时候用
+struct lxcDevValue {
+  __u8 mac[8];
 };
 
-// 定义一个名为 ding_ip 的 eBPF map，用于存储 podNodeKey 和 podNodeValue
+// 定义一个名为 ding_lxc_dev 的 eBPF map，和 ding_lxc 一样每个本机 pod 一条
 struct {
 	__uint(type, BPF_MAP_TYPE_HASH);          // map 类型为哈希表
-  __uint(max_entries, 255);                 // 最大条目数为 255
-	__type(key, struct podNodeKey);           // 键类型为 podNodeKey
-  __type(value, struct podNodeValue);       // 值类型为 podNodeValue
+  __uint(max_entries, 1024);                // 最大条目数为 1024
+	__type(key, struct lxcDevKey);            // 键类型为 lxcDevKey
+  __type(value, struct lxcDevValue);        // 值类型为 lxcDevValue
   __uint(pinning, LIBBPF_PIN_BY_NAME);      // 指定 pinning 类型，将 map 与一个文件系统路径关联
-} ding_ip __section_maps_btf;
+} ding_lxc_dev __section_maps_btf;
+
+// 定义 podCIDRKey 结构体，存其他节点分到的 pod 网段
+// 查的时候 prefixlen 填 32, ip 填目标 pod 的 ip, 就能匹配到它所在的网段
+struct podCIDRKey {
+  __u32 prefixlen;    // 网段的掩码位数
+  __u32 ip;           // 网段的 ip, LPM trie 要按网络字节序存
+};
+
+// 定义 podCIDRValue 结构体，存网段所在的节点 ip, 主机字节序
+struct podCIDRValue {
+  __u32 ip;
+};
+
+// 定义一个名为 ding_cidr 的 eBPF map，每个节点一条, pod 的增删不用更新它
+struct {
+	__uint(type, BPF_MAP_TYPE_LPM_TRIE);      // map 类型为最长前缀匹配
+  __uint(max_entries, 1024);                // 最大条目数为 1024
+	__type(key, struct podCIDRKey);           // 键类型为 podCIDRKey
+  __type(value, struct podCIDRValue);       // 值类型为 podCIDRValue
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);      // 指定 pinning 类型，将 map 与一个文件系统路径关联
+} ding_cidr __section_maps_btf;
 
 // 定义 localNodeMapKey 结构体，用于存储本地节点类型
+// type 是 LOCAL_DEV_HOST 的时候 ip 是本机的一个地址, 按网络字节序存, 其他类型 ip 是 0
 struct localNodeMapKey {
 	__u32 type;
+	__u32 ip;
 };
 
 // 定义 localNodeMapValue 结构体，用于存储本地节点相关信息
@@ -80,3 +107,234 @@ __type(value, struct localNodeMapValue); // 值类型为 localNodeMapValue
 __uint(pinning, LIBBPF_PIN_BY_NAME); // 指定 pinning 类型，将 map 与一个文件系统路径关联
 } ding_local __section_maps_btf;
 
+// is_host_addr 判断 addr 是不是本机自己的地址, addr 是直接从 ip 头里拿出来的网络字节序
+static __always_inline int is_host_addr(__u32 addr) {
+  struct localNodeMapKey key = {};
+  key.type = LOCAL_DEV_HOST;
+  key.ip = addr;
+  return bpf_map_lookup_elem(&ding_local, &key) != NULL;
+}
+
+
+// 网络策略相关的 map 里的 ip 和端口都是直接按网络字节序存的, 和上面几个 map 不一样
+// 因为 LPM trie 是按字节从高到低做前缀匹配的, 必须是大端序
+
+// policyKey 里 peer_ip 前面要精确匹配的 pod_ip、direction、proto、port 一共 64 个 bit
+// prefixlen 是这 64 个 bit 再加上对端网段的掩码位数, 最长是 96
+#define POLICY_PREFIX_BASE 64
+#define POLICY_INGRESS 1
+#define POLICY_EGRESS 2
+#define POLICY_ACTION_ALLOW 1
+
+// 定义 policyPodKey 结构体，用于存储被网络策略选中的本机 pod ip
+struct policyPodKey {
+  __u32 ip;
+};
+
+// 定义 policyPodValue 结构体，标记 pod 在哪个方向上是被隔离的
+struct policyPodValue {
+  __u8 ingress;
+  __u8 egress;
+  __u8 pad[2];
+};
+
+// 定义一个名为 ding_policy_pod 的 eBPF map，没在这里面的 pod 不做任何限制
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);          // map 类型为哈希表
+  __uint(max_entries, 1024);                // 最大条目数为 1024
+	__type(key, struct policyPodKey);         // 键类型为 policyPodKey
+  __type(value, struct policyPodValue);     // 值类型为 policyPodValue
+  __uint(pinning, LIBBPF_PIN_BY_NAME);      // 指定 pinning 类型，将 map 与一个文件系统路径关联
+} ding_policy_pod __section_maps_btf;
+
+// 定义 policyKey 结构体，除了 peer_ip 之外的字段都需要精确匹配
+struct policyKey {
+  __u32 prefixlen;    // 前缀长度 = POLICY_PREFIX_BASE + 对端网段的掩码位数
+  __u32 pod_ip;       // 被隔离的 pod 的 ip
+  __u8 direction;     // POLICY_INGRESS 或者 POLICY_EGRESS
+  __u8 proto;         // 协议号, 0 表示所有协议
+  __u16 port;         // 目标端口, 0 表示所有端口
+  __u32 peer_ip;      // 对端 ip
+};
+
+// 定义 policyValue 结构体，except 的网段是 deny, 其他都是 allow
+struct policyValue {
+  __u8 action;
+  __u8 pad[3];
+};
+
+// 定义一个名为 ding_policy 的 eBPF map，LPM trie 必须带上 BPF_F_NO_PREALLOC
+struct {
+	__uint(type, BPF_MAP_TYPE_LPM_TRIE);      // map 类型为最长前缀匹配
+  __uint(max_entries, 10240);               // 最大条目数为 10240
+	__type(key, struct policyKey);            // 键类型为 policyKey
+  __type(value, struct policyValue);        // 值类型为 policyValue
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+  __uint(pinning, LIBBPF_PIN_BY_NAME);      // 指定 pinning 类型，将 map 与一个文件系统路径关联
+} ding_policy __section_maps_btf;
+
+
+// service 的负载均衡, ip 和端口和网络策略的 map 一样是网络字节序
+#define CT_ORIGINAL 1   // pod 发给 ClusterIP 的
+#define CT_REPLY 2      // 后端回给 pod 的
+#define CT_POLICY 3     // ingress 被隔离的 pod 发出去的连接, 见 policy.h, value 不用
+
+// 定义 svcKey 结构体，slot 为 0 的条目只记后端的个数, 1 到 count 是每个后端
+struct svcKey {
+  __u32 ip;           // ClusterIP
+  __u16 port;         // service 的端口
+  __u16 slot;
+  __u8 proto;         // 协议号
+  __u8 pad[3];
+};
+
+// 定义 svcValue 结构体，slot 为 0 的时候只有 count 有用
+struct svcValue {
+  __u32 ip;           // 后端的 pod ip
+  __u16 port;         // 后端的端口
+  __u16 count;        // 后端的个数
+};
+
+// 定义一个名为 ding_svc 的 eBPF map，由 cni-demo-agent 按 Service 和 EndpointSlice 写进来
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);          // map 类型为哈希表
+  __uint(max_entries, 16384);               // 最大条目数为 16384
+	__type(key, struct svcKey);               // 键类型为 svcKey
+  __type(value, struct svcValue);           // 值类型为 svcValue
+  __uint(pinning, LIBBPF_PIN_BY_NAME);      // 指定 pinning 类型，将 map 与一个文件系统路径关联
+} ding_svc __section_maps_btf;
+
+// 定义 ctKey 结构体，就是包的五元组加上方向
+struct ctKey {
+  __u32 src;
+  __u32 dst;
+  __u16 sport;
+  __u16 dport;
+  __u8 proto;
+  __u8 dir;           // CT_ORIGINAL、CT_REPLY 或者 CT_POLICY
+  __u8 pad[2];
+};
+
+// 定义 ctValue 结构体，去的方向是选中的后端, 回的方向是要改回去的 ClusterIP 和端口
+struct ctValue {
+  __u32 ip;
+  __u16 port;
+  __u8 pad[2];
+};
+
+// 定义一个名为 ding_ct 的 eBPF map，负载均衡和网络策略共用, 连接断了不用管, 满了之后 LRU 会把最久没动的淘汰掉
+struct {
+	__uint(type, BPF_MAP_TYPE_LRU_HASH);      // map 类型为 LRU 哈希表
+  __uint(max_entries, 65536);               // 最大条目数为 65536
+	__type(key, struct ctKey);                // 键类型为 ctKey
+  __type(value, struct ctValue);            // 值类型为 ctValue
+  __uint(pinning, LIBBPF_PIN_BY_NAME);      // 指定 pinning 类型，将 map 与一个文件系统路径关联
+} ding_ct __section_maps_btf;
+
+
+// 每个 pod 的收发包统计, ip 和 ding_lxc 一样是主机字节序
+#define STATS_DIR_TX 1    // pod 发出去的
+#define STATS_DIR_RX 2    // 发给 pod 的
+
+// 定义 statsKey 结构体，用于存储 pod ip 和方向
+struct statsKey {
+  __u32 ip;
+  __u8 direction;     // STATS_DIR_TX 或者 STATS_DIR_RX
+  __u8 pad[3];
+};
+
+// 定义 statsValue 结构体，都是累计值, 由 cni-demo-agent 把各个 cpu 上的加起来
+struct statsValue {
+  __u64 packets;
+  __u64 bytes;
+  __u64 drops;
+};
+
+// 定义一个名为 ding_stats 的 eBPF map，per cpu 的不需要原子操作, pod 删掉之后旧的条目由 LRU 自己淘汰
+struct {
+	__uint(type, BPF_MAP_TYPE_LRU_PERCPU_HASH); // map 类型为每个 cpu 一份的 LRU 哈希表
+  __uint(max_entries, 2048);                // 最大条目数为 2048
+	__type(key, struct statsKey);             // 键类型为 statsKey
+  __type(value, struct statsValue);         // 值类型为 statsValue
+  __uint(pinning, LIBBPF_PIN_BY_NAME);      // 指定 pinning 类型，将 map 与一个文件系统路径关联
+} ding_stats __section_maps_btf;
+
+
+// 数据面的计数器, 每个包最后是怎么处理的, 排查 pod 不通的时候不用再抓包
+// ip 是包所属的 endpoint: veth 上是源 pod, vxlan 上是目标 pod, 不是 ip 包的话是 0
+#define REASON_REDIRECT_LOCAL 1   // 重定向给了本机的 pod
+#define REASON_REDIRECT_VXLAN 2   // 重定向给了 vxlan 设备
+#define REASON_TUNNEL_SET_FAIL 3  // 设置 vxlan 隧道失败, 丢掉了
+#define REASON_MISS 4             // 在 map 里没找到, 交给内核协议栈
+#define REASON_NON_IP 5           // 不是 ipv4 的包, 也不是要代答的 arp 和邻居请求, 交给内核协议栈
+#define REASON_POLICY_DENY 6      // 被网络策略丢掉了
+#define REASON_PROXY_REPLY 7      // 代答了 pod 的 arp 或者 ipv6 邻居请求
+#define REASON_NO_BACKEND 8       // 访问的 service 没有可用的后端, 丢掉了
+#define REASON_TO_HOST 9          // 目标是本机自己的地址, 交给内核协议栈
+
+// 定义 counterKey 结构体，用于存储 endpoint 和原因
+struct counterKey {
+  __u32 ip;
+  __u8 reason;
+  __u8 pad[3];
+};
+
+// 定义 counterValue 结构体，都是累计值
+struct counterValue {
+  __u64 packets;
+  __u64 bytes;
+};
+
+// 定义一个名为 ding_counters 的 eBPF map，和 ding_stats 一样是 per cpu 的 LRU
+struct {
+	__uint(type, BPF_MAP_TYPE_LRU_PERCPU_HASH); // map 类型为每个 cpu 一份的 LRU 哈希表
+  __uint(max_entries, 8192);                // 最大条目数为 8192
+	__type(key, struct counterKey);           // 键类型为 counterKey
+  __type(value, struct counterValue);       // 值类型为 counterValue
+  __uint(pinning, LIBBPF_PIN_BY_NAME);      // 指定 pinning 类型，将 map 与一个文件系统路径关联
+} ding_counters __section_maps_btf;
+
+
+// 采样出来的流量事件, 排查跨节点不通的时候用, 由 cni-demo-agent 从 ding_events 里读出来
+// ip 和端口都是主机字节序
+#define FLOW_POINT_VETH_INGRESS 1   // pod 的 veth 上, 也就是 pod 发出来的包
+#define FLOW_POINT_VXLAN_INGRESS 2  // vxlan 设备收到的其他节点发过来的包
+#define FLOW_POINT_VXLAN_EGRESS 3   // 要从 vxlan 设备发到其他节点的包
+
+// 定义 flowEvent 结构体，go 那头按同样的布局解析
+struct flowEvent {
+  __u32 src_ip;
+  __u32 dst_ip;
+  __u32 remote_node;  // 对端节点的 ip, 和 ding_cidr 里的 value 一样, 不跨节点的话是 0
+  __u32 ifindex;      // 包是从哪块网卡上过的
+  __u32 len;
+  __u16 src_port;     // icmp 之类没有端口的是 0
+  __u16 dst_port;
+  __u8 proto;
+  __u8 verdict;       // 和 ding_counters 一样是 REASON_*
+  __u8 point;         // FLOW_POINT_*
+  __u8 pad;
+};
+
+// 定义一个名为 ding_events 的 eBPF map，每个 cpu 一个 perf 缓冲区
+// 低版本内核没有 ring buffer, 所以用 perf event array, max_entries 不写的话就是 cpu 的个数
+struct {
+	__uint(type, BPF_MAP_TYPE_PERF_EVENT_ARRAY); // map 类型为 perf event array
+	__uint(key_size, sizeof(__u32));
+	__uint(value_size, sizeof(__u32));
+  __uint(pinning, LIBBPF_PIN_BY_NAME);      // 指定 pinning 类型，将 map 与一个文件系统路径关联
+} ding_events __section_maps_btf;
+
+// 定义 flowConfig 结构体，由 cni-demo-agent 写进来
+struct flowConfig {
+  __u32 sample_rate;  // 0 表示不导出, 1 表示每个包都导出, N 表示平均 N 个包导出一个, 丢掉的包不抽样
+};
+
+// 定义一个名为 ding_flow_cfg 的 eBPF map，只有一个条目
+struct {
+	__uint(type, BPF_MAP_TYPE_ARRAY);         // map 类型为数组
+  __uint(max_entries, 1);                   // 只有一个条目
+	__type(key, __u32);                       // 键固定是 0
+  __type(value, struct flowConfig);         // 值类型为 flowConfig
+  __uint(pinning, LIBBPF_PIN_BY_NAME);      // 指定 pinning 类型，将 map 与一个文件系统路径关联
+} ding_flow_cfg __section_maps_btf;
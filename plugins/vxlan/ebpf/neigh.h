@@ -0,0 +1,185 @@
+#ifndef __CNI_DEMO_NEIGH_H
+#define __CNI_DEMO_NEIGH_H
+
+#include <linux/if_arp.h>
+#include <linux/ipv6.h>
+
+// 用到了 maps.h 里的 ding_lxc_dev 和 stats.h 里的 counter_update, 需要在它们之后 include
+
+/**
+ * pod 的默认路由指向网关, 发包之前会先用 arp 或者 ipv6 的邻居请求(ND)去问网关的 mac
+ * 这里在 pod 的 veth 留在 host 上那头的 ingress 上直接代答:
+ *  1. 不管问的是哪个 ip 都回 veth 留在 host 上那头的 mac, pod 发出来的包反正都要经过它
+ *  2. 所以 pod 里不用再写死网关的 arp 表项, 网关用哪个 ip 都可以
+ *  3. 回包是在原来的请求上原地改出来的, 再从同一块 veth 重定向回 pod 里
+ * 免费 arp 以及 ipv6 的重复地址检测不回, 不然 pod 会以为自己的 ip 冲突了
+ */
+
+#define NDISC_NEIGHBOUR_SOLICITATION 135
+#define NDISC_NEIGHBOUR_ADVERTISEMENT 136
+#define ND_OPT_SOURCE_LL_ADDR 1
+#define ND_OPT_TARGET_LL_ADDR 2
+// 邻居通告里的 Router, Solicited 和 Override 三个标记
+#define ND_NA_FLAGS 0xe0000000
+
+// arpPayload 是以太网上 ipv4 的 arp 包在 arphdr 后面的部分
+struct arpPayload {
+  __u8 sha[ETH_ALEN];
+  __u8 spa[4];
+  __u8 tha[ETH_ALEN];
+  __u8 tpa[4];
+} __packed;
+
+// ndPayload 是只带一个链路层地址选项的邻居请求或者通告, 两个长度一样, 可以原地改
+// 字段都是按自然对齐排的, 没有空洞, 不用 __packed, 算校验和的时候可以按 4 个字节读
+struct ndPayload {
+  __u8 type;
+  __u8 code;
+  __u16 cksum;
+  __u32 flags;
+  __u8 target[16];
+  __u8 opt_type;
+  __u8 opt_len;     // 以 8 个字节为单位
+  __u8 mac[ETH_ALEN];
+};
+
+// ndPseudoHdr 是 icmpv6 算校验和用的伪首部
+struct ndPseudoHdr {
+  __u8 saddr[16];
+  __u8 daddr[16];
+  __u32 len;
+  __u32 nexthdr;
+};
+
+// neigh_dev_mac 取这块 veth 留在 host 上那头的 mac, 没有的话返回 -1
+static __always_inline int neigh_dev_mac(struct __sk_buff *skb, __u8 *mac) {
+  struct lxcDevKey key = {};
+  key.ifindex = skb->ifindex;
+  struct lxcDevValue *dev = bpf_map_lookup_elem(&ding_lxc_dev, &key);
+  if (!dev) {
+    return -1;
+  }
+  bpf_memcpy(mac, dev->mac, ETH_ALEN);
+  return 0;
+}
+
+// neigh_csum_fold 把 bpf_csum_diff 算出来的 32 位的和折成 16 位的校验和
+static __always_inline __u16 neigh_csum_fold(__u32 sum) {
+  sum = (sum & 0xffff) + (sum >> 16);
+  sum = (sum & 0xffff) + (sum >> 16);
+  return (__u16)~sum;
+}
+
+// neigh_handle_arp 代答 pod 的 arp 请求, 回了的话返回重定向的结果, 不需要回的话返回 -1 交给调用的地方
+static __always_inline int neigh_handle_arp(struct __sk_buff *skb) {
+  void *data = (void *)(long)skb->data;
+  void *data_end = (void *)(long)skb->data_end;
+  struct arphdr *arp = data + sizeof(struct ethhdr);
+  struct arpPayload *payload = data + sizeof(struct ethhdr) + sizeof(struct arphdr);
+  if ((void *)(payload + 1) > data_end) {
+    return -1;
+  }
+  if (arp->ar_hrd != __constant_htons(ARPHRD_ETHER) || arp->ar_pro != __constant_htons(ETH_P_IP) ||
+      arp->ar_hln != ETH_ALEN || arp->ar_pln != 4 || arp->ar_op != __constant_htons(ARPOP_REQUEST)) {
+    return -1;
+  }
+  __u8 pod_mac[ETH_ALEN];
+  __u32 spa, tpa;
+  bpf_memcpy(pod_mac, payload->sha, ETH_ALEN);
+  bpf_memcpy(&spa, payload->spa, 4);
+  bpf_memcpy(&tpa, payload->tpa, 4);
+  // 免费 arp 和地址冲突检测
+  if (spa == 0 || spa == tpa) {
+    return -1;
+  }
+  __u8 dev_mac[ETH_ALEN];
+  if (neigh_dev_mac(skb, dev_mac) < 0) {
+    return -1;
+  }
+
+  // 以太网头换成从 veth 发给 pod 的
+  bpf_skb_store_bytes(skb, offsetof(struct ethhdr, h_dest), pod_mac, ETH_ALEN, 0);
+  bpf_skb_store_bytes(skb, offsetof(struct ethhdr, h_source), dev_mac, ETH_ALEN, 0);
+  // 请求改成应答, 问的那个 ip 就是 veth 的 mac
+  __u16 op = __constant_htons(ARPOP_REPLY);
+  int off = sizeof(struct ethhdr);
+  bpf_skb_store_bytes(skb, off + offsetof(struct arphdr, ar_op), &op, sizeof(op), 0);
+  off += sizeof(struct arphdr);
+  bpf_skb_store_bytes(skb, off + offsetof(struct arpPayload, sha), dev_mac, ETH_ALEN, 0);
+  bpf_skb_store_bytes(skb, off + offsetof(struct arpPayload, spa), &tpa, 4, 0);
+  bpf_skb_store_bytes(skb, off + offsetof(struct arpPayload, tha), pod_mac, ETH_ALEN, 0);
+  bpf_skb_store_bytes(skb, off + offsetof(struct arpPayload, tpa), &spa, 4, 0);
+
+  counter_update(htonl(spa), REASON_PROXY_REPLY, skb->len);
+  return bpf_redirect(skb->ifindex, 0);
+}
+
+// neigh_handle_nd 代答 pod 的 ipv6 邻居请求, 回了的话返回重定向的结果, 不需要回的话返回 -1 交给调用的地方
+static __always_inline int neigh_handle_nd(struct __sk_buff *skb) {
+  void *data = (void *)(long)skb->data;
+  void *data_end = (void *)(long)skb->data_end;
+  struct ethhdr *eth = data;
+  struct ipv6hdr *ip6 = data + sizeof(struct ethhdr);
+  struct ndPayload *nd = data + sizeof(struct ethhdr) + sizeof(struct ipv6hdr);
+  if ((void *)(nd + 1) > data_end) {
+    return -1;
+  }
+  // 只认没有扩展头并且只带了源链路层地址选项的, 这样回包和请求一样长
+  if (ip6->nexthdr != IPPROTO_ICMPV6 || ip6->hop_limit != 255 ||
+      ip6->payload_len != __constant_htons(sizeof(struct ndPayload))) {
+    return -1;
+  }
+  if (nd->type != NDISC_NEIGHBOUR_SOLICITATION || nd->code != 0 ||
+      nd->opt_type != ND_OPT_SOURCE_LL_ADDR || nd->opt_len != 1) {
+    return -1;
+  }
+  // 源地址是 :: 的是重复地址检测
+  __u32 saddr[4];
+  bpf_memcpy(saddr, &ip6->saddr, sizeof(saddr));
+  if ((saddr[0] | saddr[1] | saddr[2] | saddr[3]) == 0) {
+    return -1;
+  }
+  __u8 dev_mac[ETH_ALEN];
+  if (neigh_dev_mac(skb, dev_mac) < 0) {
+    return -1;
+  }
+  __u8 pod_mac[ETH_ALEN];
+  bpf_memcpy(pod_mac, eth->h_source, ETH_ALEN);
+
+  // 回包的源地址是被问的那个地址, 目标地址是 pod 自己的地址
+  struct ndPseudoHdr ph = {};
+  bpf_memcpy(ph.saddr, nd->target, 16);
+  bpf_memcpy(ph.daddr, saddr, 16);
+  ph.len = __constant_htonl(sizeof(struct ndPayload));
+  ph.nexthdr = __constant_htonl(IPPROTO_ICMPV6);
+
+  struct ndPayload na = {};
+  na.type = NDISC_NEIGHBOUR_ADVERTISEMENT;
+  na.flags = __constant_htonl(ND_NA_FLAGS);
+  bpf_memcpy(na.target, nd->target, 16);
+  na.opt_type = ND_OPT_TARGET_LL_ADDR;
+  na.opt_len = 1;
+  bpf_memcpy(na.mac, dev_mac, ETH_ALEN);
+
+  __s64 sum = bpf_csum_diff(0, 0, (__be32 *)&ph, sizeof(ph), 0);
+  if (sum < 0) {
+    return -1;
+  }
+  sum = bpf_csum_diff(0, 0, (__be32 *)&na, sizeof(na), sum);
+  if (sum < 0) {
+    return -1;
+  }
+  na.cksum = neigh_csum_fold(sum);
+
+  bpf_skb_store_bytes(skb, offsetof(struct ethhdr, h_dest), pod_mac, ETH_ALEN, 0);
+  bpf_skb_store_bytes(skb, offsetof(struct ethhdr, h_source), dev_mac, ETH_ALEN, 0);
+  // 伪首部里的两个地址和 ipv6 头里的顺序一样, 直接写过去
+  bpf_skb_store_bytes(skb, sizeof(struct ethhdr) + offsetof(struct ipv6hdr, saddr), &ph, 32, 0);
+  bpf_skb_store_bytes(skb, sizeof(struct ethhdr) + sizeof(struct ipv6hdr), &na, sizeof(na), 0);
+
+  // 没有 ipv4 的地址可以记, endpoint 和不是 ip 包的一样记成 0
+  counter_update(0, REASON_PROXY_REPLY, skb->len);
+  return bpf_redirect(skb->ifindex, 0);
+}
+
+#endif
@@ -0,0 +1,146 @@
+#ifndef __CNI_DEMO_POLICY_H
+#define __CNI_DEMO_POLICY_H
+
+#include <linux/ip.h>
+#include <linux/tcp.h>
+#include <linux/udp.h>
+#include <linux/icmp.h>
+
+// 用到了 maps.h 里的 ding_policy、ding_policy_pod 和 ding_ct, 需要在 maps.h 之后 include
+
+/**
+ * 网络策略的检查
+ * 规则只对 "新建连接" 的包做检查:
+ *  1. tcp 只检查 SYN 并且没有 ACK 的包
+ *  2. icmp 只检查 echo request
+ *  3. udp 以及其他协议每个包都检查
+ * 这样被隔离的 pod 回给对方的包不会被对方的策略拦下来
+ * udp 没法从包里看出是不是回包, 所以 ingress 被隔离的 pod 发出去的包都以 CT_POLICY 记到 ding_ct 里,
+ * 发给它的包先按反过来的五元组查一下, 是它自己发出去的连接的回包(比如 dns 的应答)的话不再检查 ingress 的规则
+ */
+
+// l4Info 是从包里解析出来的四层信息
+struct l4Info {
+  __u8 proto;
+  __u8 is_new;
+  __u16 dport;    // 网络字节序
+  __u16 sport;    // 网络字节序, 只有流量事件会用到
+};
+
+// policy_parse_l4 解析四层头, 包不完整的话返回 -1
+static __always_inline int policy_parse_l4(struct iphdr *ip, void *data_end, struct l4Info *info) {
+  info->proto = ip->protocol;
+  info->is_new = 1;
+  info->dport = 0;
+  info->sport = 0;
+
+  void *l4 = (void *)ip + (ip->ihl & 0xf) * 4;
+  if (ip->protocol == IPPROTO_TCP) {
+    struct tcphdr *tcp = l4;
+    if ((void *)(tcp + 1) > data_end) {
+      return -1;
+    }
+    info->dport = tcp->dest;
+    info->sport = tcp->source;
+    info->is_new = tcp->syn && !tcp->ack;
+  } else if (ip->protocol == IPPROTO_UDP || ip->protocol == IPPROTO_SCTP) {
+    // sctp 头的前 4 个字节也是源端口和目标端口, 这里直接当 udp 头来读
+    struct udphdr *udp = l4;
+    if ((void *)(udp + 1) > data_end) {
+      return -1;
+    }
+    info->dport = udp->dest;
+    info->sport = udp->source;
+  } else if (ip->protocol == IPPROTO_ICMP) {
+    struct icmphdr *icmp = l4;
+    if ((void *)(icmp + 1) > data_end) {
+      return -1;
+    }
+    info->is_new = icmp->type == ICMP_ECHO;
+  }
+  return 0;
+}
+
+// policy_match 在 ding_policy 中用指定的协议和端口做一次最长前缀匹配
+static __always_inline int policy_match(struct policyKey *key, __u8 proto, __u16 port) {
+  key->proto = proto;
+  key->port = port;
+  struct policyValue *value = bpf_map_lookup_elem(&ding_policy, key);
+  return value && value->action == POLICY_ACTION_ALLOW;
+}
+
+// policy_ct_key 填上 pod 和 peer 之间的连接在 ding_ct 里的 key, 两个方向的包填出来的是同一个
+// egress 的包 pod 的端口是源端口, ingress 的包 pod 的端口是目标端口
+static __always_inline void policy_ct_key(struct ctKey *key, __u32 pod_ip, __u8 direction, struct l4Info *info, __u32 peer_ip) {
+  key->src = pod_ip;
+  key->dst = peer_ip;
+  key->proto = info->proto;
+  key->dir = CT_POLICY;
+  if (direction == POLICY_EGRESS) {
+    key->sport = info->sport;
+    key->dport = info->dport;
+  } else {
+    key->sport = info->dport;
+    key->dport = info->sport;
+  }
+}
+
+// policy_rules_allowed 按 ding_policy 里的规则判断 pod_ip 这个 pod 在 direction 方向上和 peer_ip 之间的流量是否放行
+static __always_inline int policy_rules_allowed(__u32 pod_ip, __u8 direction, struct l4Info *info, __u32 peer_ip) {
+  if (!info->is_new) {
+    return 1;
+  }
+
+  struct policyKey key = {};
+  key.prefixlen = POLICY_PREFIX_BASE + 32;
+  key.pod_ip = pod_ip;
+  key.direction = direction;
+  key.peer_ip = peer_ip;
+  // 依次匹配: 指定协议指定端口, 指定协议所有端口, 所有协议
+  if (policy_match(&key, info->proto, info->dport)) {
+    return 1;
+  }
+  if (info->dport && policy_match(&key, info->proto, 0)) {
+    return 1;
+  }
+  return policy_match(&key, 0, 0);
+}
+
+// policy_allowed 判断 pod_ip 这个 pod 在 direction 方向上和 peer_ip 之间的流量是否放行
+// pod_ip 和 peer_ip 都是直接从 ip 头里拿出来的网络字节序
+// egress 方向放行了的包, pod 的 ingress 是被隔离的话顺便记一下连接, 回包的时候用
+static __always_inline int policy_allowed(__u32 pod_ip, __u8 direction, struct l4Info *info, __u32 peer_ip) {
+  struct policyPodKey podKey = {};
+  podKey.ip = pod_ip;
+  struct policyPodValue *pod = bpf_map_lookup_elem(&ding_policy_pod, &podKey);
+  if (!pod) {
+    return 1;
+  }
+
+  // icmp 的回包本来就不检查, 只有带端口的协议需要记连接
+  struct ctKey ct = {};
+  policy_ct_key(&ct, pod_ip, direction, info, peer_ip);
+  int track = info->proto != IPPROTO_ICMP;
+
+  if (direction == POLICY_INGRESS) {
+    if (!pod->ingress) {
+      return 1;
+    }
+    if (track && bpf_map_lookup_elem(&ding_ct, &ct)) {
+      return 1;
+    }
+    return policy_rules_allowed(pod_ip, direction, info, peer_ip);
+  }
+
+  if (pod->egress && !policy_rules_allowed(pod_ip, direction, info, peer_ip)) {
+    return 0;
+  }
+  // 已经记过的只查一下, LRU 会把它挪到前面, 不用每个包都写一次
+  if (pod->ingress && track && !bpf_map_lookup_elem(&ding_ct, &ct)) {
+    struct ctValue value = {};
+    bpf_map_update_elem(&ding_ct, &ct, &value, BPF_ANY);
+  }
+  return 1;
+}
+
+#endif
@@ -0,0 +1,50 @@
+#ifndef __CNI_DEMO_STATS_H
+#define __CNI_DEMO_STATS_H
+
+// 用到了 maps.h 里的 ding_stats 和 ding_counters, 需要在 maps.h 之后 include
+
+// stats_update 给 ip 这个 pod 在 direction 方向上记一个包, dropped 不为 0 的话记成丢包
+static __always_inline void stats_update(__u32 ip, __u8 direction, __u32 len, int dropped) {
+  struct statsKey key = {};
+  key.ip = ip;
+  key.direction = direction;
+
+  struct statsValue *value = bpf_map_lookup_elem(&ding_stats, &key);
+  if (!value) {
+    // 第一次见到这个 pod, 先插一条空的, 别的 cpu 同时插了也没关系
+    struct statsValue empty = {};
+    bpf_map_update_elem(&ding_stats, &key, &empty, BPF_NOEXIST);
+    value = bpf_map_lookup_elem(&ding_stats, &key);
+    if (!value) {
+      return;
+    }
+  }
+  // per cpu 的 map 每个 cpu 上各是一份, 直接加就行
+  if (dropped) {
+    value->drops++;
+    return;
+  }
+  value->packets++;
+  value->bytes += len;
+}
+
+// counter_update 给 ip 这个 endpoint 在 reason 上记一个包
+static __always_inline void counter_update(__u32 ip, __u8 reason, __u32 len) {
+  struct counterKey key = {};
+  key.ip = ip;
+  key.reason = reason;
+
+  struct counterValue *value = bpf_map_lookup_elem(&ding_counters, &key);
+  if (!value) {
+    struct counterValue empty = {};
+    bpf_map_update_elem(&ding_counters, &key, &empty, BPF_NOEXIST);
+    value = bpf_map_lookup_elem(&ding_counters, &key);
+    if (!value) {
+      return;
+    }
+  }
+  value->packets++;
+  value->bytes += len;
+}
+
+#endif
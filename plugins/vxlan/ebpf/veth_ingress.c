@@ -8,6 +8,11 @@
 
 #include "common.h"
 #include "maps.h"
+#include "policy.h"
+#include "stats.h"
+#include "events.h"
+#include "neigh.h"
+#include "lb.h"
 
 /**
  * 这里首先从 skb 里看是啥协议
@@ -20,12 +25,15 @@
  *  2. 访问其他 node 的 pod
  *  3. 访问本地某个进程
  *  4. 外网
- *  5. cilium 还有个访问 lb 的情况
+ *  5. 访问 service 的 ClusterIP
  * 
- * 当前暂只处理 1 和 2 的情况
+ * 当前处理 1, 2, 3 和 5 的情况, 5 是先 DNAT 成后端的 pod ip, 再按 1 或者 2 转发, 见 lb.h
+ * 3 是目标在 ding_local 里记着的本机地址, 直接交给内核协议栈, 回包走 vxlan 设备上集群网段的路由, 见 vxlan_egress.c
+ * 其他节点自己的 ip 在 ding_cidr 里有一条 /32, 和 2 一样封装过去
+ * 另外 pod 问网关 mac 的 arp 和 ipv6 邻居请求也在这里代答, 见 neigh.h
  * 1.
  *  a. 获取 dst ip
- *  b. 从 POD_MAP_DEFAULT_PATH 中查找 dst ip
+ *  b. 从 POD_CIDR_MAP_DEFAULT_PATH 中查找 dst ip 所在的网段
  *    b1. 没找到的话说明 dst ip 不是当前集群的 pod ip
  *        直接丢弃
  *    b2. 找到了说明是本集群内的 pod 的 ip
@@ -60,29 +68,77 @@
 //它尝试在 eBPF maps 中查找目标 IP 地址，并根据查找结果执行相应的操作。这里的逻辑主要分为两种情况：
 //
 //1.如果在 ding_lxc map 中找到了目标 IP 地址，说明数据包的目标是本机的一个 Pod。程序会修改数据包的 MAC 地址并将其转发给目标 Pod 的本地 veth 设备。
-//2.如果在 ding_ip map 中找到了目标 IP 地址，说明数据包的目标是集
+//2.如果在 ding_cidr map 中匹配到了目标 IP 地址所在的网段，说明数据包的目标是集
 __section("classifier")
 int cls_main(struct __sk_buff *skb) {
   // 一些基本的数据和边界检查
 	void *data = (void *)(long)skb->data;
 	void *data_end = (void *)(long)skb->data_end;
-	if (data + sizeof(struct ethhdr) + sizeof(struct iphdr) > data_end) {
+	if (data + sizeof(struct ethhdr) > data_end) {
+    counter_update(0, REASON_NON_IP, skb->len);
     return TC_ACT_UNSPEC;
   }
 
-  // 定义并获取以太网头和 IP 头的指针
+  // 定义并获取以太网头的指针
 	struct ethhdr  *eth  = data;
-	struct iphdr   *ip   = (data + sizeof(struct ethhdr));
+  // pod 问网关 mac 的 arp 和 ipv6 邻居请求在这里直接代答, 见 neigh.h
+  if (eth->h_proto == __constant_htons(ETH_P_ARP)) {
+    int ret = neigh_handle_arp(skb);
+    if (ret >= 0) {
+      return ret;
+    }
+  } else if (eth->h_proto == __constant_htons(ETH_P_IPV6)) {
+    int ret = neigh_handle_nd(skb);
+    if (ret >= 0) {
+      return ret;
+    }
+  }
   // 检查协议类型是否为 IP 协议
-  if (eth->h_proto != __constant_htons(ETH_P_IP)) {
+  if (eth->h_proto != __constant_htons(ETH_P_IP) ||
+      data + sizeof(struct ethhdr) + sizeof(struct iphdr) > data_end) {
+    counter_update(0, REASON_NON_IP, skb->len);
 		return TC_ACT_UNSPEC;
   }
+	struct iphdr   *ip   = (data + sizeof(struct ethhdr));
 
   // 在 go 那头儿往 ebpf 的 map 里存的时候我这个 arm 是按照小端序存的
   // 这里给转成网络的大端序
   //将 IP 地址从主机字节序转换为网络字节序
   __u32 src_ip = htonl(ip->saddr);
+
+  // 访问 service 的话先把目标换成后端, 后面的网络策略和转发看的都是后端的 pod ip
+  int lb = lb_dnat(skb);
+  if (lb == LB_NO_BACKEND) {
+    stats_update(src_ip, STATS_DIR_TX, skb->len, 1);
+    counter_update(src_ip, REASON_NO_BACKEND, skb->len);
+    return TC_ACT_SHOT;
+  }
+  if (lb == LB_NAT) {
+    // 改过包了, 指针要重新取
+    data = (void *)(long)skb->data;
+    data_end = (void *)(long)skb->data_end;
+    if (data + sizeof(struct ethhdr) + sizeof(struct iphdr) > data_end) {
+      return TC_ACT_SHOT;
+    }
+    ip = data + sizeof(struct ethhdr);
+  }
 	__u32 dst_ip = htonl(ip->daddr);
+
+  // 网络策略: 这块 veth 上进来的包都是 pod 发出来的, 先检查源 pod 的 egress
+  // 四层信息要在改包之前解析好, bpf_skb_store_bytes 之后原来的指针就都失效了
+  struct l4Info l4 = {};
+  if (policy_parse_l4(ip, data_end, &l4) < 0) {
+    return TC_ACT_UNSPEC;
+  }
+  if (!policy_allowed(ip->saddr, POLICY_EGRESS, &l4, ip->daddr)) {
+    stats_update(src_ip, STATS_DIR_TX, skb->len, 1);
+    counter_update(src_ip, REASON_POLICY_DENY, skb->len);
+    flow_emit(skb, FLOW_POINT_VETH_INGRESS, src_ip, dst_ip, &l4, REASON_POLICY_DENY, 0);
+    return TC_ACT_SHOT;
+  }
+  // 这块 veth 上进来的包都算源 pod 发出去的
+  stats_update(src_ip, STATS_DIR_TX, skb->len, 0);
+
   // 定义并获取源 MAC 和目标 MAC 地址
   __u8 src_mac[ETH_ALEN];
 	__u8 dst_mac[ETH_ALEN];
@@ -92,6 +148,18 @@ int cls_main(struct __sk_buff *skb) {
   struct endpointInfo *ep = bpf_map_lookup_elem(&ding_lxc, &epKey);
   if (ep) {
     // 如果能找到说明是要发往本机其他 pod 中的
+    // 目标 pod 就在本机, 顺便把目标 pod 的 ingress 也检查了
+    if (!policy_allowed(ip->daddr, POLICY_INGRESS, &l4, ip->saddr)) {
+      stats_update(dst_ip, STATS_DIR_RX, skb->len, 1);
+      counter_update(src_ip, REASON_POLICY_DENY, skb->len);
+      flow_emit(skb, FLOW_POINT_VETH_INGRESS, src_ip, dst_ip, &l4, REASON_POLICY_DENY, 0);
+      return TC_ACT_SHOT;
+    }
+    stats_update(dst_ip, STATS_DIR_RX, skb->len, 0);
+    counter_update(src_ip, REASON_REDIRECT_LOCAL, skb->len);
+    flow_emit(skb, FLOW_POINT_VETH_INGRESS, src_ip, dst_ip, &l4, REASON_REDIRECT_LOCAL, 0);
+    // 本机的后端回给本机 pod 的包, 源地址改回 ClusterIP, 改完之后 ip 就不能再用了
+    lb_rev_nat(skb);
     // 把 mac 地址改成目标 pod 的两对儿 veth 的 mac 地址
     bpf_memcpy(src_mac, ep->nodeMac, ETH_ALEN);
 	  bpf_memcpy(dst_mac, ep->mac, ETH_ALEN);
@@ -99,9 +167,17 @@ int cls_main(struct __sk_buff *skb) {
 	  bpf_skb_store_bytes(skb, offsetof(struct ethhdr, h_dest), src_mac, ETH_ALEN, 0);
     return bpf_redirect_peer(ep->lxcIfIndex, 0);
   }
-  struct podNodeKey podNodeKey = {};
-  podNodeKey.ip = dst_ip;
-  struct podNodeValue *podNode = bpf_map_lookup_elem(&ding_ip, &podNodeKey);
+  // 目标是本机自己的地址, 比如节点 ip, hostNetwork 的 pod 或者网关, 交给内核协议栈
+  if (is_host_addr(ip->daddr)) {
+    counter_update(src_ip, REASON_TO_HOST, skb->len);
+    flow_emit(skb, FLOW_POINT_VETH_INGRESS, src_ip, dst_ip, &l4, REASON_TO_HOST, 0);
+    return TC_ACT_UNSPEC;
+  }
+  // 按最长前缀匹配查目标 ip 在不在其他节点的网段里, 其他节点自己的 ip 也在里面
+  struct podCIDRKey podCIDRKey = {};
+  podCIDRKey.prefixlen = 32;
+  podCIDRKey.ip = ip->daddr;
+  struct podCIDRValue *podNode = bpf_map_lookup_elem(&ding_cidr, &podCIDRKey);
   if (podNode) {
     // 进到这里说明该目标 ip 是本集群内的 ip
     struct localNodeMapKey localKey = {};
@@ -110,10 +186,14 @@ int cls_main(struct __sk_buff *skb) {
     
     if (localValue) {
       // 转发给 vxlan 设备
+      // 流量事件等到 vxlan 的 egress 上设置完隧道再导出, 不然一个包会导出两次
+      counter_update(src_ip, REASON_REDIRECT_VXLAN, skb->len);
       return bpf_redirect(localValue->ifIndex, 0);
     } 
-    return TC_ACT_UNSPEC;
   }
+  // 不是集群内的 pod 或者 vxlan 设备还没记到 ding_local 里, 交给内核协议栈
+  counter_update(src_ip, REASON_MISS, skb->len);
+  flow_emit(skb, FLOW_POINT_VETH_INGRESS, src_ip, dst_ip, &l4, REASON_MISS, 0);
   return TC_ACT_UNSPEC;
 }
 
@@ -9,11 +9,15 @@
 
 #include "common.h"
 #include "maps.h"
+#include "policy.h"
+#include "stats.h"
+#include "events.h"
+#include "lb.h"
 
 /**
  * 此 eBPF 程序的主要目的是处理从 VXLAN 设备收到的数据包，并将其发送到其他节点上不同网段的 Pod。
  * 程序首先检查数据包的协议类型是否为 IP 协议，然后获取源 IP 和目标 IP 地址。接下来，
- * 它尝试在 eBPF map (ding_ip) 中查找目标 IP 地址所在的节点 IP。如果查找成功，
+ * 它尝试在 eBPF map (ding_cidr) 中按最长前缀匹配查找目标 IP 地址所在网段的节点 IP。如果查找成功，
  * 程序将为数据包设置一个隧道，并使用 bpf_skb_set_tunnel_key 函数为数据
  * 包设置外部 UDP 隧道目标 IP。隧道键中包含远程节点 IP、隧道 ID、隧道 TOS 和隧道 TTL。
  * 如果 bpf_skb_set_tunnel_key 函数调用成功，程序将返回 TC_ACT_OK，
@@ -23,11 +27,16 @@
  *
  * 如果 vxlan 设备收到了数据包
  * 说明是要发送到其他 node 中不同网段的 pod 上
- * 1. 在 POD_MAP_DEFAULT_PATH 中查询目标 pod 所在的 node ip
+ * 1. 在 POD_CIDR_MAP_DEFAULT_PATH 中查询目标 pod 所在网段的 node ip
  * 2. 用 bpf_skb_set_tunnel_key 给原始数据包设置外层的 udp 的 target ip
- * 
+ *
+ * 本机的进程访问 pod 或者回给 pod 的包也会走到这里, 因为整个集群的 pod 网段都路由到了 vxlan 设备上
+ * 目标是本机的 pod 的话不用封装, 和 vxlan_ingress.c 一样直接重定向到它的 veth 上
  */
 
+// 封装的时候用的 VNI, 在 .rodata 里, 加载的时候 tc.InitTunnelID 设置的值会把它换掉
+volatile const __u32 tunnel_id = DEFAULT_TUNNEL_ID;
+
 // 定义 eBPF 程序的入口点，作为一个分类器
 __section("classifier")
 int cls_main(struct __sk_buff *skb) {
@@ -35,6 +44,7 @@ int cls_main(struct __sk_buff *skb) {
 	void *data = (void *)(long)skb->data;
 	void *data_end = (void *)(long)skb->data_end;
 	if (data + sizeof(struct ethhdr) + sizeof(struct iphdr) > data_end) {
+    counter_update(0, REASON_NON_IP, skb->len);
     return TC_ACT_UNSPEC;
   }
   // 定义并获取以太网头和 IP 头的指针
@@ -42,16 +52,51 @@ int cls_main(struct __sk_buff *skb) {
 	struct iphdr   *ip   = (data + sizeof(struct ethhdr));
   // 检查协议类型是否为 IP 协议
   if (eth->h_proto != __constant_htons(ETH_P_IP)) {
+    counter_update(0, REASON_NON_IP, skb->len);
 		return TC_ACT_UNSPEC;
   }
 
   // 将 IP 地址从主机字节序转换为网络字节序
   __u32 src_ip = htonl(ip->saddr);
   __u32 dst_ip = htonl(ip->daddr);
-  // 查询目标 IP 所在的节点 IP
-  struct podNodeKey podNodeKey = {};
-  podNodeKey.ip = dst_ip;
-  struct podNodeValue *podNode = bpf_map_lookup_elem(&ding_ip, &podNodeKey);
+  // 只是给流量事件用的, 四层头不完整的话端口就是 0
+  struct l4Info l4 = {};
+  int l4_err = policy_parse_l4(ip, data_end, &l4);
+
+  struct endpointKey epKey = {};
+  epKey.ip = dst_ip;
+  struct endpointInfo *ep = bpf_map_lookup_elem(&ding_lxc, &epKey);
+  if (ep) {
+    // 本机自己发的 (kubelet 的探针这些) 不看网络策略, 其他的和别的节点过来的一样检查目标 pod 的 ingress
+    if (!is_host_addr(ip->saddr)) {
+      if (l4_err < 0) {
+        return TC_ACT_SHOT;
+      }
+      if (!policy_allowed(ip->daddr, POLICY_INGRESS, &l4, ip->saddr)) {
+        stats_update(dst_ip, STATS_DIR_RX, skb->len, 1);
+        counter_update(dst_ip, REASON_POLICY_DENY, skb->len);
+        flow_emit(skb, FLOW_POINT_VXLAN_EGRESS, src_ip, dst_ip, &l4, REASON_POLICY_DENY, 0);
+        return TC_ACT_SHOT;
+      }
+    }
+    stats_update(dst_ip, STATS_DIR_RX, skb->len, 0);
+    counter_update(dst_ip, REASON_REDIRECT_LOCAL, skb->len);
+    flow_emit(skb, FLOW_POINT_VXLAN_EGRESS, src_ip, dst_ip, &l4, REASON_REDIRECT_LOCAL, 0);
+    // 后端是 hostNetwork 的 service 回给本机 pod 的包, 源地址改回 ClusterIP, 见 lb.h
+    lb_rev_nat(skb);
+    __u8 src_mac[ETH_ALEN];
+    __u8 dst_mac[ETH_ALEN];
+    bpf_memcpy(src_mac, ep->nodeMac, ETH_ALEN);
+    bpf_memcpy(dst_mac, ep->mac, ETH_ALEN);
+    bpf_skb_store_bytes(skb, offsetof(struct ethhdr, h_dest), dst_mac, ETH_ALEN, 0);
+    bpf_skb_store_bytes(skb, offsetof(struct ethhdr, h_source), src_mac, ETH_ALEN, 0);
+    return bpf_redirect(ep->lxcIfIndex, 0);
+  }
+  // 查询目标 IP 所在网段的节点 IP, LPM trie 的 key 是网络字节序, 直接用 ip 头里的
+  struct podCIDRKey podCIDRKey = {};
+  podCIDRKey.prefixlen = 32;
+  podCIDRKey.ip = ip->daddr;
+  struct podCIDRValue *podNode = bpf_map_lookup_elem(&ding_cidr, &podCIDRKey);
   if (podNode) {
     __u32 dst_node_ip = podNode->ip;
     // 准备一个 tunnel
@@ -59,17 +104,23 @@ int cls_main(struct __sk_buff *skb) {
     int ret;
     __builtin_memset(&key, 0x0, sizeof(key));
     key.remote_ipv4 = podNode->ip;
-    key.tunnel_id = DEFAULT_TUNNEL_ID;
+    key.tunnel_id = tunnel_id;
     key.tunnel_tos = 0;
     key.tunnel_ttl = 64;
     // 添加外头的隧道 udp
     ret = bpf_skb_set_tunnel_key(skb, &key, sizeof(key), BPF_F_ZERO_CSUM_TX);
     if (ret < 0) {
       bpf_printk("bpf_skb_set_tunnel_key failed");
+      counter_update(dst_ip, REASON_TUNNEL_SET_FAIL, skb->len);
+      flow_emit(skb, FLOW_POINT_VXLAN_EGRESS, src_ip, dst_ip, &l4, REASON_TUNNEL_SET_FAIL, dst_node_ip);
       return TC_ACT_SHOT;
     }
+    flow_emit(skb, FLOW_POINT_VXLAN_EGRESS, src_ip, dst_ip, &l4, REASON_REDIRECT_VXLAN, dst_node_ip);
     return TC_ACT_OK;
   }
+  // 目标不在 ding_cidr 里, 没有设置隧道, vxlan 设备自己是发不出去的
+  counter_update(dst_ip, REASON_MISS, skb->len);
+  flow_emit(skb, FLOW_POINT_VXLAN_EGRESS, src_ip, dst_ip, &l4, REASON_MISS, 0);
   return TC_ACT_OK;
 }
 
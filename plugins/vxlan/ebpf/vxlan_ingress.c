@@ -3,15 +3,21 @@
 #include <bpf/bpf_helpers.h>
 #include <linux/if_ether.h>
 #include <linux/ip.h>
+#include <linux/if_packet.h>
 #include <netinet/in.h>
 
 #include "common.h"
 #include "maps.h"
+#include "policy.h"
+#include "stats.h"
+#include "events.h"
+#include "lb.h"
 /**
  * 在 vxlan 的 ingress 方向上收到包
  * 1. 先获取源 ip
  * 2. 根据 LXC_MAP_DEFAULT_PATH 判断源 ip 是否是本机 pod ip
  *  a. 不是集群内的 pod ip, 可能是不知道哪个东西发过来的 tunnel 包, 直接返回 TC_ACT_OK 给放掉
+ *     目标是本机自己的地址的话, 把包的类型改成 PACKET_HOST 再交给内核协议栈
  *  b. 是集群内的 pod ip, 此时在 LXC_MAP_DEFAULT_PATH 中
  *     根据目标 ip 查询 veth 的 mac 地址
  *    b-1. 替换掉 skb 中的源 mac 和目标 mac
@@ -35,12 +41,14 @@ int cls_main(struct __sk_buff *skb) {
   void *data = (void *)(long)skb->data;
 	void *data_end = (void *)(long)skb->data_end;
 	if (data + sizeof(struct ethhdr) + sizeof(struct iphdr) > data_end) {
+    counter_update(0, REASON_NON_IP, skb->len);
     return TC_ACT_UNSPEC;
   }
 
 	struct ethhdr  *eth  = data;
 	struct iphdr   *ip   = (data + sizeof(struct ethhdr));
   if (eth->h_proto != __constant_htons(ETH_P_IP)) {
+    counter_update(0, REASON_NON_IP, skb->len);
 		return TC_ACT_UNSPEC;
   }
 
@@ -49,15 +57,50 @@ int cls_main(struct __sk_buff *skb) {
   bpf_printk("the dst_ip is: %d", dst_ip);
   bpf_printk("the ip->daddr is: %d", ip->daddr);
 
+  // 四层信息要在改包之前解析好, bpf_skb_store_bytes 之后原来的指针就都失效了
+  struct l4Info l4 = {};
+  int l4_err = policy_parse_l4(ip, data_end, &l4);
+  // 解封装之后的包上还带着外层的隧道信息, remote_ipv4 就是发过来的那个节点的 ip
+  struct bpf_tunnel_key tunnel = {};
+  if (bpf_skb_get_tunnel_key(skb, &tunnel, sizeof(tunnel), 0) < 0) {
+    tunnel.remote_ipv4 = 0;
+  }
+
   // 拿到目标 ip
   struct endpointKey epKey = {};
   epKey.ip = dst_ip;
   // 在本地的 lxc map 中查找
   struct endpointInfo *ep = bpf_map_lookup_elem(&ding_lxc, &epKey);
+  if (!ep && is_host_addr(ip->daddr)) {
+    // 其他节点的 pod 访问本机自己的地址, 内层的目标 mac 不是这块 vxlan 设备的, 内核会当成别人的包丢掉
+    // 改成 PACKET_HOST 之后交给内核协议栈
+    bpf_skb_change_type(skb, PACKET_HOST);
+    counter_update(dst_ip, REASON_TO_HOST, skb->len);
+    flow_emit(skb, FLOW_POINT_VXLAN_INGRESS, src_ip, dst_ip, &l4, REASON_TO_HOST, tunnel.remote_ipv4);
+    return TC_ACT_OK;
+  }
   if (!ep) {
     // 如果没找到的话直接放到
+    counter_update(dst_ip, REASON_MISS, skb->len);
+    flow_emit(skb, FLOW_POINT_VXLAN_INGRESS, src_ip, dst_ip, &l4, REASON_MISS, tunnel.remote_ipv4);
     return TC_ACT_OK;
   }
+
+  // 网络策略: 从其他节点过来的包, 在这里检查目标 pod 的 ingress
+  if (l4_err < 0) {
+    return TC_ACT_OK;
+  }
+  if (!policy_allowed(ip->daddr, POLICY_INGRESS, &l4, ip->saddr)) {
+    stats_update(dst_ip, STATS_DIR_RX, skb->len, 1);
+    counter_update(dst_ip, REASON_POLICY_DENY, skb->len);
+    flow_emit(skb, FLOW_POINT_VXLAN_INGRESS, src_ip, dst_ip, &l4, REASON_POLICY_DENY, tunnel.remote_ipv4);
+    return TC_ACT_SHOT;
+  }
+  stats_update(dst_ip, STATS_DIR_RX, skb->len, 0);
+  counter_update(dst_ip, REASON_REDIRECT_LOCAL, skb->len);
+  flow_emit(skb, FLOW_POINT_VXLAN_INGRESS, src_ip, dst_ip, &l4, REASON_REDIRECT_LOCAL, tunnel.remote_ipv4);
+  // 其他节点上的后端回给本机 pod 的包, 源地址改回 ClusterIP, 见 lb.h
+  lb_rev_nat(skb);
   // 找到的话说明是发往本机 pod 中的流量
   // 此时需要做 stc mac 和 dst mac 的更新
 
@@ -0,0 +1,133 @@
+package flows
+
+import (
+	bpf_map "cni-demo/plugins/vxlan/map"
+	"cni-demo/tools/logger"
+	"cni-demo/tools/utils"
+	"strconv"
+	"time"
+)
+
+const (
+	// 多久重新从 ipam 里读一遍 pod 和节点的名字
+	resolveRefreshInterval = 30 * time.Second
+	// 遇到不认识的 ip 的时候最快多久重新读一次, 集群外的 ip 永远不认识, 不能每个事件都去读
+	resolveMinInterval = 5 * time.Second
+)
+
+// Endpoint 是流量的一端, Pod 是 <namespace>/<pod>, 不是本集群的 pod 或者 ipam 里没有记录的话是空的
+type Endpoint struct {
+	IP   string `json:"ip"`
+	Port uint16 `json:"port,omitempty"`
+	Pod  string `json:"pod,omitempty"`
+}
+
+// Flow 是解析并且补上了 pod 名字之后的流量事件, 每个事件输出成一行 json
+type Flow struct {
+	Time time.Time `json:"time"`
+	// 在哪里看到的: veth-ingress, vxlan-ingress 或者 vxlan-egress
+	Point string `json:"point"`
+	// 和数据面的计数器一样: redirect-local, redirect-vxlan, tunnel-set-fail, miss, policy-deny
+	Verdict string   `json:"verdict"`
+	Proto   string   `json:"proto"`
+	Src     Endpoint `json:"src"`
+	Dst     Endpoint `json:"dst"`
+	// 跨节点的时候是对端节点的 ip 和名字, vxlan-egress 上是选中的目标节点, vxlan-ingress 上是发过来的节点
+	RemoteNode     string `json:"remoteNode,omitempty"`
+	RemoteNodeName string `json:"remoteNodeName,omitempty"`
+	Ifindex        uint32 `json:"ifindex"`
+	Len            uint32 `json:"len"`
+}
+
+func protoName(proto uint8) string {
+	switch proto {
+	case 1:
+		return "icmp"
+	case 6:
+		return "tcp"
+	case 17:
+		return "udp"
+	case 132:
+		return "sctp"
+	}
+	return strconv.Itoa(int(proto))
+}
+
+// resolver 从 ipam 里查 ip 对应的 pod 和节点的名字, 查到的结果缓存起来定时刷新
+// 只在读 perf 缓冲区的那个协程里用, 不需要加锁
+type resolver struct {
+	// ip 到 <namespace>/<pod>
+	owners func() (map[string]string, error)
+	// 节点名字到节点 ip
+	nodes func() (map[string]string, error)
+
+	pods      map[string]string
+	nodeNames map[string]string
+	refreshed time.Time
+}
+
+func newResolver(owners, nodes func() (map[string]string, error)) *resolver {
+	return &resolver{
+		owners:    owners,
+		nodes:     nodes,
+		pods:      map[string]string{},
+		nodeNames: map[string]string{},
+	}
+}
+
+// refresh 重新读一遍, 读失败了的话继续用以前的
+func (r *resolver) refresh(now time.Time) {
+	r.refreshed = now
+	if r.owners != nil {
+		pods, err := r.owners()
+		if err != nil {
+			logger.Warn("从 ipam 读 pod 的名字失败", "err", err)
+		} else {
+			r.pods = pods
+		}
+	}
+	if r.nodes != nil {
+		nodes, err := r.nodes()
+		if err != nil {
+			logger.Warn("读节点的 ip 失败", "err", err)
+		} else {
+			r.nodeNames = map[string]string{}
+			for name, ip := range nodes {
+				r.nodeNames[ip] = name
+			}
+		}
+	}
+}
+
+// resolve 给 flow 补上 pod 和节点的名字
+func (r *resolver) resolve(flow *Flow, now time.Time) {
+	elapsed := now.Sub(r.refreshed)
+	missing := r.pods[flow.Src.IP] == "" || r.pods[flow.Dst.IP] == "" ||
+		(flow.RemoteNode != "" && r.nodeNames[flow.RemoteNode] == "")
+	if elapsed >= resolveRefreshInterval || (missing && elapsed >= resolveMinInterval) {
+		r.refresh(now)
+	}
+	flow.Src.Pod = r.pods[flow.Src.IP]
+	flow.Dst.Pod = r.pods[flow.Dst.IP]
+	if flow.RemoteNode != "" {
+		flow.RemoteNodeName = r.nodeNames[flow.RemoteNode]
+	}
+}
+
+// newFlow 把 tc 程序写出来的事件转成 Flow, 还没有补上名字
+func newFlow(ev *bpf_map.FlowEvent, now time.Time) *Flow {
+	flow := &Flow{
+		Time:    now,
+		Point:   ev.Point.String(),
+		Verdict: ev.Verdict.String(),
+		Proto:   protoName(ev.Proto),
+		Src:     Endpoint{IP: utils.InetUint32ToIp(ev.SrcIP), Port: ev.SrcPort},
+		Dst:     Endpoint{IP: utils.InetUint32ToIp(ev.DstIP), Port: ev.DstPort},
+		Ifindex: ev.Ifindex,
+		Len:     ev.Len,
+	}
+	if ev.RemoteNode != 0 {
+		flow.RemoteNode = utils.InetUint32ToIp(ev.RemoteNode)
+	}
+	return flow
+}
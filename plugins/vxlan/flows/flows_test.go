@@ -0,0 +1,122 @@
+package flows
+
+import (
+	"bufio"
+	"bytes"
+	bpf_map "cni-demo/plugins/vxlan/map"
+	"cni-demo/tools/utils"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlows(t *testing.T) {
+	test := assert.New(t)
+
+	// 和 tc 程序里的 struct flowEvent 一样是 28 个字节, perf 的记录后面会补齐到 8 字节
+	test.Equal(28, bpf_map.FLOW_EVENT_SIZE)
+	buf := &bytes.Buffer{}
+	test.Nil(binary.Write(buf, binary.LittleEndian, bpf_map.FlowEvent{
+		SrcIP:      utils.InetIpToUInt32("10.244.1.10"),
+		DstIP:      utils.InetIpToUInt32("10.244.2.20"),
+		RemoteNode: utils.InetIpToUInt32("192.168.1.2"),
+		Ifindex:    7,
+		Len:        98,
+		SrcPort:    34567,
+		DstPort:    80,
+		Proto:      6,
+		Verdict:    bpf_map.REASON_REDIRECT_VXLAN,
+		Point:      bpf_map.FLOW_POINT_VXLAN_EGRESS,
+	}))
+	buf.Write([]byte{0, 0, 0, 0})
+	ev, err := bpf_map.DecodeFlowEvent(buf.Bytes())
+	test.Nil(err)
+	_, err = bpf_map.DecodeFlowEvent(buf.Bytes()[:10])
+	test.NotNil(err)
+
+	ownerCalls := 0
+	r := newResolver(func() (map[string]string, error) {
+		ownerCalls++
+		return map[string]string{
+			"10.244.1.10": "default/client",
+			"10.244.2.20": "default/nginx",
+		}, nil
+	}, func() (map[string]string, error) {
+		return map[string]string{"node-2": "192.168.1.2"}, nil
+	})
+	now := time.Unix(1650000000, 0)
+	flow := newFlow(ev, now)
+	r.resolve(flow, now)
+	test.Equal(&Flow{
+		Time:           now,
+		Point:          "vxlan-egress",
+		Verdict:        "redirect-vxlan",
+		Proto:          "tcp",
+		Src:            Endpoint{IP: "10.244.1.10", Port: 34567, Pod: "default/client"},
+		Dst:            Endpoint{IP: "10.244.2.20", Port: 80, Pod: "default/nginx"},
+		RemoteNode:     "192.168.1.2",
+		RemoteNodeName: "node-2",
+		Ifindex:        7,
+		Len:            98,
+	}, flow)
+
+	// 集群外的 ip 不认识, 但是也不能每个事件都去读一遍 ipam
+	ev.DstIP = utils.InetIpToUInt32("8.8.8.8")
+	r.resolve(newFlow(ev, now.Add(time.Second)), now.Add(time.Second))
+	test.Equal(1, ownerCalls)
+	flow = newFlow(ev, now.Add(resolveMinInterval))
+	r.resolve(flow, now.Add(resolveMinInterval))
+	test.Equal(2, ownerCalls)
+	test.Equal("default/client", flow.Src.Pod)
+	test.Equal("", flow.Dst.Pod)
+}
+
+func TestObserver(t *testing.T) {
+	test := assert.New(t)
+	o := NewObserver(1, nil, func() (map[string]string, error) {
+		return map[string]string{"10.244.1.10": "default/client"}, nil
+	}, nil)
+	srv := httptest.NewServer(o)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + FLOWS_PATH + "?pod=default/client&verdict=policy-deny&limit=1")
+	test.Nil(err)
+	defer resp.Body.Close()
+	test.Equal("application/x-ndjson", resp.Header.Get("Content-Type"))
+
+	// 等订阅上了再发
+	for i := 0; i < 100; i++ {
+		o.lock.Lock()
+		n := len(o.subscribers)
+		o.lock.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ev := &bpf_map.FlowEvent{
+		SrcIP:   utils.InetIpToUInt32("10.244.1.10"),
+		DstIP:   utils.InetIpToUInt32("10.244.1.11"),
+		Proto:   1,
+		Verdict: bpf_map.REASON_REDIRECT_LOCAL,
+		Point:   bpf_map.FLOW_POINT_VETH_INGRESS,
+	}
+	o.handle(ev, time.Now())
+	ev.Verdict = bpf_map.REASON_POLICY_DENY
+	o.handle(ev, time.Now())
+
+	scanner := bufio.NewScanner(resp.Body)
+	test.True(scanner.Scan())
+	flow := &Flow{}
+	test.Nil(json.Unmarshal(scanner.Bytes(), flow))
+	test.Equal("policy-deny", flow.Verdict)
+	test.Equal("icmp", flow.Proto)
+	test.Equal("default/client", flow.Src.Pod)
+	// limit 是 1, 输出一个之后就结束了
+	test.False(scanner.Scan())
+}
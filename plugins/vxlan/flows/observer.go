@@ -0,0 +1,252 @@
+package flows
+
+import (
+	"cni-demo/consts"
+	bpf_map "cni-demo/plugins/vxlan/map"
+	"cni-demo/tools/logger"
+	"cni-demo/tools/metrics"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cilium/ebpf/perf"
+)
+
+const (
+	// 在 agent 的端口上流式地输出流量事件, 每行一个 json
+	FLOWS_PATH = consts.DEFAULT_TEST_CNI_API + "/agent/flows"
+	// 每个订阅者最多缓存多少个事件, 读得太慢的话后面的就丢了
+	subscriberBuffer = 1024
+)
+
+var (
+	flowEvents = metrics.NewCounterVec(
+		"flow_events_total",
+		"从 tc 程序读出来的流量事件数",
+		"verdict",
+	)
+	flowEventsLost = metrics.NewCounterVec(
+		"flow_events_lost_total",
+		"丢掉的流量事件数, where 是 perf 表示 perf 缓冲区满了, 是 subscriber 表示订阅者读得太慢",
+		"where",
+	)
+)
+
+// filter 是订阅的时候的过滤条件, 空的字段表示不过滤
+type filter struct {
+	// 源或者目标是这个 pod, <namespace>/<pod>
+	pod string
+	// 源或者目标是这个 ip
+	ip      string
+	verdict string
+}
+
+func parseFilter(query url.Values) *filter {
+	return &filter{
+		pod:     query.Get("pod"),
+		ip:      query.Get("ip"),
+		verdict: query.Get("verdict"),
+	}
+}
+
+func (f *filter) match(flow *Flow) bool {
+	if f.pod != "" && flow.Src.Pod != f.pod && flow.Dst.Pod != f.pod {
+		return false
+	}
+	if f.ip != "" && flow.Src.IP != f.ip && flow.Dst.IP != f.ip {
+		return false
+	}
+	if f.verdict != "" && flow.Verdict != f.verdict {
+		return false
+	}
+	return true
+}
+
+type subscriber struct {
+	ch     chan *Flow
+	filter *filter
+}
+
+// Observer 从 ding_events 里读出 tc 程序采样的流量事件, 补上 pod 的名字之后
+// 写到 json 日志里, 同时推给通过 FLOWS_PATH 订阅的客户端
+type Observer struct {
+	sampleRate uint32
+	// 每个事件写一行 json, nil 的话不写
+	out      io.Writer
+	resolver *resolver
+
+	lock        sync.Mutex
+	subscribers map[*subscriber]struct{}
+}
+
+// NewObserver sampleRate 是平均多少个包导出一个, 丢掉的包不抽样
+// owners 返回 ip 到 <namespace>/<pod> 的映射, nodes 返回节点名字到节点 ip 的映射, 都是用来补名字的
+func NewObserver(sampleRate uint32, out io.Writer, owners, nodes func() (map[string]string, error)) *Observer {
+	return &Observer{
+		sampleRate:  sampleRate,
+		out:         out,
+		resolver:    newResolver(owners, nodes),
+		subscribers: map[*subscriber]struct{}{},
+	}
+}
+
+// Run 打开 perf 缓冲区并且把采样率写给 tc 程序, 一直读到 stop 被关掉
+// 退出的时候把采样率改回 0, 没人读的时候 tc 程序也就不用再写了
+func (o *Observer) Run(stop <-chan struct{}) error {
+	defer o.closeSubscribers()
+	mm, err := bpf_map.GetMapsManager()
+	if err != nil {
+		return err
+	}
+	// tc 程序还没挂上去的话先建出来, 和其他的 map 一样
+	m, err := mm.CreateFlowEventsMap()
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return errors.New("加载 " + bpf_map.EVENTS_MAP_DEFAULT_PATH + " 失败")
+	}
+	defer m.Close()
+	rd, err := perf.NewReader(m, os.Getpagesize()*64)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+
+	err = mm.SetFlowSampleRate(o.sampleRate)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := mm.SetFlowSampleRate(0)
+		if err != nil {
+			logger.Warn("关闭流量事件失败", "err", err)
+		}
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+			// Read 会一直阻塞, 关掉之后才会返回
+			rd.Close()
+		case <-done:
+		}
+	}()
+
+	logger.Info("开始导出流量事件", "sampleRate", o.sampleRate)
+	for {
+		record, err := rd.Read()
+		if errors.Is(err, perf.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if record.LostSamples > 0 {
+			flowEventsLost.Add(float64(record.LostSamples), "perf")
+			continue
+		}
+		ev, err := bpf_map.DecodeFlowEvent(record.RawSample)
+		if err != nil {
+			logger.Warn("解析流量事件失败", "err", err)
+			continue
+		}
+		o.handle(ev, time.Now())
+	}
+}
+
+// handle 补上名字之后输出一个事件
+func (o *Observer) handle(ev *bpf_map.FlowEvent, now time.Time) {
+	flow := newFlow(ev, now)
+	o.resolver.resolve(flow, now)
+	flowEvents.Inc(flow.Verdict)
+	if o.out != nil {
+		line, err := json.Marshal(flow)
+		if err == nil {
+			o.out.Write(append(line, '\n'))
+		}
+	}
+	o.publish(flow)
+}
+
+func (o *Observer) publish(flow *Flow) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for sub := range o.subscribers {
+		if !sub.filter.match(flow) {
+			continue
+		}
+		select {
+		case sub.ch <- flow:
+		default:
+			flowEventsLost.Inc("subscriber")
+		}
+	}
+}
+
+func (o *Observer) subscribe(f *filter) *subscriber {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	sub := &subscriber{ch: make(chan *Flow, subscriberBuffer), filter: f}
+	o.subscribers[sub] = struct{}{}
+	return sub
+}
+
+func (o *Observer) unsubscribe(sub *subscriber) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if _, ok := o.subscribers[sub]; ok {
+		delete(o.subscribers, sub)
+		close(sub.ch)
+	}
+}
+
+// closeSubscribers 在 Run 退出的时候断开所有的订阅, 不然 agent 退出的时候要等它们超时
+func (o *Observer) closeSubscribers() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for sub := range o.subscribers {
+		delete(o.subscribers, sub)
+		close(sub.ch)
+	}
+}
+
+// ServeHTTP 流式地输出之后的流量事件, 每行一个 json, 可以用 pod, ip, verdict 过滤
+// limit 大于 0 的话输出这么多个之后就结束
+func (o *Observer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	sub := o.subscribe(parseFilter(r.URL.Query()))
+	defer o.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	encoder := json.NewEncoder(w)
+	for count := 0; limit <= 0 || count < limit; count++ {
+		select {
+		case flow, ok := <-sub.ch:
+			if !ok {
+				return
+			}
+			if encoder.Encode(flow) != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
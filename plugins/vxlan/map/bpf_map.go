@@ -1,7 +1,10 @@
 package bpf_map
 
 import (
+	"cni-demo/tools/logger"
 	utils2 "cni-demo/tools/utils"
+	"fmt"
+
 	"github.com/cilium/ebpf"
 )
 
@@ -66,7 +69,7 @@ func GetMapByPinned(pinPath string, opts ...*ebpf.LoadPinOptions) *ebpf.Map {
 	}
 	m, err := ebpf.LoadPinnedMap(pinPath, options)
 	if err != nil {
-		utils2.WriteLog("GetMapByPinned failed: ", err.Error())
+		logger.Error("GetMapByPinned failed", "path", pinPath, "err", err)
 	}
 	return m
 }
@@ -82,7 +85,7 @@ func createMap(
 ) (*ebpf.Map, error) {
 	spec := ebpf.MapSpec{
 		Name:       name,
-		Type:       ebpf.Hash,
+		Type:       _type,
 		KeySize:    keySize,
 		ValueSize:  valueSize,
 		MaxEntries: maxEntries,
@@ -97,6 +100,7 @@ func createMap(
 
 // CreateOnceMapWithPin 函数用于在固定路径下创建一个只会创建一次的 eBPF Map。如果固定路径已存在，则直接加载该 Map。否则，将创建一个新的 Map，并将其固定到指定的路径。
 // 该方法在同一节点上调用多次但是只会创建一个同名的 map
+// 已经 pin 了的 map 只有 maxEntries 不一样的话会换成一个新大小的, 旧的条目都拷过去, 见 TakeResizedMaps
 func CreateOnceMapWithPin(
 	pinPath string,
 	name string,
@@ -107,7 +111,26 @@ func CreateOnceMapWithPin(
 	flags uint32,
 ) (*ebpf.Map, error) {
 	if utils2.PathExists(pinPath) {
-		return GetMapByPinned(pinPath), nil
+		old := GetMapByPinned(pinPath)
+		if old == nil {
+			return nil, fmt.Errorf("加载 %s 失败", pinPath)
+		}
+		if old.Type() != _type || old.KeySize() != keySize || old.ValueSize() != valueSize || old.Flags() != flags {
+			old.Close()
+			return nil, fmt.Errorf("已经 pin 了的 %s 和现在的定义对不上, 需要手动删掉", pinPath)
+		}
+		// perf event array 的大小是 cpu 的个数, 不用管
+		if maxEntries == 0 || old.MaxEntries() == maxEntries {
+			return old, nil
+		}
+		defer old.Close()
+		return resizeMapWithPin(old, pinPath, name, &ebpf.MapSpec{
+			Type:       _type,
+			KeySize:    keySize,
+			ValueSize:  valueSize,
+			MaxEntries: maxEntries,
+			Flags:      flags,
+		})
 	}
 	m, err := createMap(
 		name,
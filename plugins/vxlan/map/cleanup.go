@@ -0,0 +1,254 @@
+package bpf_map
+
+import (
+	"cni-demo/tools/metrics"
+	"cni-demo/tools/utils"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/cilium/ebpf"
+)
+
+var staleEntries = metrics.NewCounterVec(
+	"bpf_map_stale_entries_total",
+	"清理 pin 住的 map 时删掉的已经不在了的条目数",
+	"map",
+)
+
+// LiveEndpoints 是清理 map 的时候本机的现状, 由调用的地方从 netlink 和 ipam 里拿
+type LiveEndpoints struct {
+	// 本机(host 的命名空间里)现在有的网卡的 ifindex
+	IfIndexes map[uint32]bool
+	// ipam 里本机已经分出去的 ip
+	PodIPs map[string]bool
+}
+
+// StaleEntries 是一次清理中每个 map 删掉了多少条, key 是 map 的名字
+type StaleEntries map[string]int
+
+// mapSnapshot 是清理之前从各个 map 里读出来的条目, 不存在的 map 对应的字段是 nil
+type mapSnapshot struct {
+	lxc       map[EndpointMapKey]EndpointMapInfo
+	lxcDev    map[LxcDevMapKey]LxcDevMapValue
+	local     map[LocalNodeMapKey]LocalNodeMapValue
+	stats     []StatsMapKey
+	policyPod []PolicyPodMapKey
+	policy    []PolicyMapKey
+}
+
+// staleLxcKeys 返回 ding_lxc 中 pod 已经不在了的条目: host 上那头的 veth 没了, 或者 ip 已经还给了 ipam
+// IfIndex 是 pod 的 netns 里那头 veth 的, 和 host 上的网卡不在一个命名空间里, 不能拿来比
+func staleLxcKeys(entries map[EndpointMapKey]EndpointMapInfo, live *LiveEndpoints) []interface{} {
+	res := []interface{}{}
+	for key, info := range entries {
+		if live.IfIndexes[info.LxcIfIndex] && live.PodIPs[utils.InetUint32ToIp(key.IP)] {
+			continue
+		}
+		res = append(res, key)
+	}
+	return res
+}
+
+// staleLxcDevKeys 返回 ding_lxc_dev 中 veth 已经没了的条目
+// CNI 插件先写 ding_lxc_dev 再写 ding_lxc, 所以不能按 ding_lxc 里有没有来判断
+func staleLxcDevKeys(entries map[LxcDevMapKey]LxcDevMapValue, live *LiveEndpoints) []interface{} {
+	res := []interface{}{}
+	for key := range entries {
+		if !live.IfIndexes[key.IfIndex] {
+			res = append(res, key)
+		}
+	}
+	return res
+}
+
+// staleNodeLocalKeys 返回 ding_local 中网卡已经没了的条目, 比如重建过的 vxlan 设备
+func staleNodeLocalKeys(entries map[LocalNodeMapKey]LocalNodeMapValue, live *LiveEndpoints) []interface{} {
+	res := []interface{}{}
+	for key, value := range entries {
+		if !live.IfIndexes[value.IfIndex] {
+			res = append(res, key)
+		}
+	}
+	return res
+}
+
+// staleStatsKeys 返回 ding_stats 中 ip 已经还给了 ipam 的 pod 的统计
+func staleStatsKeys(keys []StatsMapKey, live *LiveEndpoints) []interface{} {
+	res := []interface{}{}
+	for _, key := range keys {
+		if !live.PodIPs[utils.InetUint32ToIp(key.IP)] {
+			res = append(res, key)
+		}
+	}
+	return res
+}
+
+// stalePolicyPodKeys 返回 ding_policy_pod 中 ip 已经还给了 ipam 的 pod
+func stalePolicyPodKeys(keys []PolicyPodMapKey, live *LiveEndpoints) []interface{} {
+	res := []interface{}{}
+	for _, key := range keys {
+		if !live.PodIPs[net.IP(key.IP[:]).String()] {
+			res = append(res, key)
+		}
+	}
+	return res
+}
+
+// stalePolicyKeys 返回 ding_policy 中 ip 已经还给了 ipam 的 pod 的规则
+func stalePolicyKeys(keys []PolicyMapKey, live *LiveEndpoints) []interface{} {
+	res := []interface{}{}
+	for _, key := range keys {
+		if !live.PodIPs[net.IP(key.PodIP[:]).String()] {
+			res = append(res, key)
+		}
+	}
+	return res
+}
+
+// iterateIfExists 在 pinPath 存在的时候遍历一遍, 不存在的话说明还没有 pod 用到它, 什么都不做
+func iterateIfExists(pinPath string, fn func(itor *ebpf.MapIterator)) error {
+	if !utils.PathExists(pinPath) {
+		return nil
+	}
+	m := GetMapByPinned(pinPath)
+	if m == nil {
+		return fmt.Errorf("加载 %s 失败", pinPath)
+	}
+	defer m.Close()
+	itor := m.Iterate()
+	fn(itor)
+	return itor.Err()
+}
+
+// snapshot 把要清理的几个 map 读一遍
+func (mm *MapsManager) snapshot() (*mapSnapshot, error) {
+	s := &mapSnapshot{}
+	err := iterateIfExists(LXC_MAP_DEFAULT_PATH, func(itor *ebpf.MapIterator) {
+		s.lxc = map[EndpointMapKey]EndpointMapInfo{}
+		var key EndpointMapKey
+		var value EndpointMapInfo
+		for itor.Next(&key, &value) {
+			s.lxc[key] = value
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = iterateIfExists(LXC_DEV_MAP_DEFAULT_PATH, func(itor *ebpf.MapIterator) {
+		s.lxcDev = map[LxcDevMapKey]LxcDevMapValue{}
+		var key LxcDevMapKey
+		var value LxcDevMapValue
+		for itor.Next(&key, &value) {
+			s.lxcDev[key] = value
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = iterateIfExists(NODE_LOCAL_MAP_DEFAULT_PATH, func(itor *ebpf.MapIterator) {
+		s.local = map[LocalNodeMapKey]LocalNodeMapValue{}
+		var key LocalNodeMapKey
+		var value LocalNodeMapValue
+		for itor.Next(&key, &value) {
+			s.local[key] = value
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = iterateIfExists(STATS_MAP_DEFAULT_PATH, func(itor *ebpf.MapIterator) {
+		var key StatsMapKey
+		var values []StatsMapValue
+		for itor.Next(&key, &values) {
+			s.stats = append(s.stats, key)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = iterateIfExists(POLICY_POD_MAP_DEFAULT_PATH, func(itor *ebpf.MapIterator) {
+		var key PolicyPodMapKey
+		var value PolicyPodMapValue
+		for itor.Next(&key, &value) {
+			s.policyPod = append(s.policyPod, key)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = iterateIfExists(POLICY_MAP_DEFAULT_PATH, func(itor *ebpf.MapIterator) {
+		var key PolicyMapKey
+		var value PolicyMapValue
+		for itor.Next(&key, &value) {
+			s.policy = append(s.policy, key)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// deleteKeys 一条一条地删, 数据面和别的组件可能已经删掉了, 不存在的跳过, 返回真正删掉的条数
+func deleteKeys(pinPath string, keys []interface{}) (int, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	m := GetMapByPinned(pinPath)
+	if m == nil {
+		return 0, fmt.Errorf("加载 %s 失败", pinPath)
+	}
+	defer m.Close()
+	count := 0
+	for _, key := range keys {
+		err := m.Delete(key)
+		if errors.Is(err, ebpf.ErrKeyNotExist) {
+			continue
+		}
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// CleanupStaleEntries 方法删掉 pin 住的 map 里已经不在了的 pod 和网卡的条目, 返回每个 map 删掉的条数。
+// 插件崩溃或者 DEL 没执行完的时候这些条目会一直留着, 由 cni-demo-agent 启动的时候以及定时调用。
+// 先读 map 再调 live 拿本机的现状: CNI 插件总是先建好 veth、分好 ip 再写 map, 这样正在创建的 pod 不会被误删。
+// ding_cidr、ding_svc 由 agent 全量同步, ding_ct 和 ding_counters 是 LRU 的, 这里都不管。
+func (mm *MapsManager) CleanupStaleEntries(live func() (*LiveEndpoints, error)) (StaleEntries, error) {
+	s, err := mm.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	current, err := live()
+	if err != nil {
+		return nil, err
+	}
+
+	res := StaleEntries{}
+	for _, stale := range []struct {
+		name    string
+		pinPath string
+		keys    []interface{}
+	}{
+		{"ding_lxc", LXC_MAP_DEFAULT_PATH, staleLxcKeys(s.lxc, current)},
+		{"ding_lxc_dev", LXC_DEV_MAP_DEFAULT_PATH, staleLxcDevKeys(s.lxcDev, current)},
+		{"ding_local", NODE_LOCAL_MAP_DEFAULT_PATH, staleNodeLocalKeys(s.local, current)},
+		{"ding_stats", STATS_MAP_DEFAULT_PATH, staleStatsKeys(s.stats, current)},
+		{"ding_policy_pod", POLICY_POD_MAP_DEFAULT_PATH, stalePolicyPodKeys(s.policyPod, current)},
+		{"ding_policy", POLICY_MAP_DEFAULT_PATH, stalePolicyKeys(s.policy, current)},
+	} {
+		count, err := deleteKeys(stale.pinPath, stale.keys)
+		if count > 0 {
+			res[stale.name] = count
+			staleEntries.Add(float64(count), stale.name)
+		}
+		if err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
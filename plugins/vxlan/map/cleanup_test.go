@@ -0,0 +1,53 @@
+package bpf_map
+
+import (
+	"cni-demo/tools/utils"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaleKeys(t *testing.T) {
+	test := assert.New(t)
+
+	live := &LiveEndpoints{
+		IfIndexes: map[uint32]bool{2: true, 8: true, 11: true},
+		PodIPs:    map[string]bool{"10.244.3.5": true, "10.244.3.6": true},
+	}
+	// pod 的 netns 里那头的 ifindex 一般都是 2, host 上没有对应的网卡也不算不在了
+	alive := EndpointMapKey{IP: utils.InetIpToUInt32("10.244.3.5")}
+	// host 上那头的 veth 已经没了
+	vethGone := EndpointMapKey{IP: utils.InetIpToUInt32("10.244.3.6")}
+	// ip 已经还给 ipam 了, ifindex 被别的网卡用了
+	ipGone := EndpointMapKey{IP: utils.InetIpToUInt32("10.244.3.9")}
+	test.ElementsMatch([]interface{}{vethGone, ipGone}, staleLxcKeys(map[EndpointMapKey]EndpointMapInfo{
+		alive:    {IfIndex: 3, LxcIfIndex: 8},
+		vethGone: {IfIndex: 2, LxcIfIndex: 10},
+		ipGone:   {IfIndex: 2, LxcIfIndex: 11},
+	}, live))
+
+	test.Equal([]interface{}{LxcDevMapKey{IfIndex: 10}}, staleLxcDevKeys(map[LxcDevMapKey]LxcDevMapValue{
+		{IfIndex: 8}:  {},
+		{IfIndex: 10}: {},
+	}, live))
+
+	// 重建过的 vxlan 设备
+	test.Equal([]interface{}{LocalNodeMapKey{Type: VXLAN_DEV}}, staleNodeLocalKeys(map[LocalNodeMapKey]LocalNodeMapValue{
+		{Type: VXLAN_DEV}: {IfIndex: 5},
+		{Type: HOST_ADDR, IP: [4]byte{192, 168, 64, 13}}: {IfIndex: 2},
+	}, live))
+
+	test.Equal([]interface{}{StatsMapKey{IP: ipGone.IP, Direction: STATS_RX}}, staleStatsKeys([]StatsMapKey{
+		{IP: alive.IP, Direction: STATS_TX},
+		{IP: ipGone.IP, Direction: STATS_RX},
+	}, live))
+
+	test.Equal([]interface{}{PolicyPodMapKey{IP: [4]byte{10, 244, 3, 9}}}, stalePolicyPodKeys([]PolicyPodMapKey{
+		{IP: [4]byte{10, 244, 3, 5}},
+		{IP: [4]byte{10, 244, 3, 9}},
+	}, live))
+
+	test.Empty(stalePolicyKeys([]PolicyMapKey{
+		{Prefixlen: POLICY_PREFIX_BASE, PodIP: [4]byte{10, 244, 3, 6}},
+	}, live))
+}
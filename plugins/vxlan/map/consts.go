@@ -5,7 +5,24 @@ const (
 )
 
 const (
-	MAX_ENTRIES = 255
+	// 下面这些是默认值, 可以用插件配置里的 bpfMapSizes 改, 见 MapSizes
+	// maps.h 里的 max_entries 要和这里一样
+	// 本机的几种设备和本机的地址, 地址特别多的节点要调大
+	LOCAL_MAX_ENTRIES      = 255
+	LXC_MAX_ENTRIES        = 1024
+	POD_CIDR_MAX_ENTRIES   = 1024
+	POLICY_POD_MAX_ENTRIES = 1024
+	POLICY_MAX_ENTRIES     = 10240
+	// PodIP(32) + Direction(8) + Protocol(8) + Port(16)
+	POLICY_PREFIX_BASE = 64
+	// 每个 pod 两个方向
+	STATS_MAX_ENTRIES = 2048
+	// endpoint 数 * 原因数, 用不完的话 LRU 会把最久没动的淘汰掉
+	COUNTERS_MAX_ENTRIES = 8192
+	// 所有 service 的端口数 + 所有后端数
+	SERVICE_MAX_ENTRIES = 16384
+	// 经过 service 的连接每条两个方向, 用不完的话 LRU 会把最久没动的淘汰掉
+	CONNTRACK_MAX_ENTRIES = 65536
 )
 
 const (
@@ -20,8 +37,28 @@ const (
 const (
 	// 绑 veth 网卡的 ip 以及对应的 mac 地址还有 ifindex
 	LXC_MAP_DEFAULT_PATH = DEFAULT_TC_MAP_PREFIX + "_lxc"
-	// 绑每个 pod 网段 ip 对应的 node ip 地址
-	POD_MAP_DEFAULT_PATH = DEFAULT_TC_MAP_PREFIX + "_ip"
+	// 绑 veth 留在 host 上那头的 ifindex 以及它的 mac 地址
+	LXC_DEV_MAP_DEFAULT_PATH = DEFAULT_TC_MAP_PREFIX + "_lxc_dev"
+	// 绑其他节点的 pod 网段对应的 node ip 地址
+	POD_CIDR_MAP_DEFAULT_PATH = DEFAULT_TC_MAP_PREFIX + "_cidr"
+	// 以前按 pod ip 一条一条存的 map, 升级之后由 watcher 删掉
+	LEGACY_POD_MAP_DEFAULT_PATH = DEFAULT_TC_MAP_PREFIX + "_ip"
 	// 用来存本机的网卡设备们 ip 和 ifindex 等信息
 	NODE_LOCAL_MAP_DEFAULT_PATH = DEFAULT_TC_MAP_PREFIX + "_local"
+	// 存本机被网络策略隔离的 pod
+	POLICY_POD_MAP_DEFAULT_PATH = DEFAULT_TC_MAP_PREFIX + "_policy_pod"
+	// 存网络策略放行的规则
+	POLICY_MAP_DEFAULT_PATH = DEFAULT_TC_MAP_PREFIX + "_policy"
+	// 存每个 pod 的收发包统计
+	STATS_MAP_DEFAULT_PATH = DEFAULT_TC_MAP_PREFIX + "_stats"
+	// 存数据面每个 endpoint 按原因分的计数器
+	COUNTERS_MAP_DEFAULT_PATH = DEFAULT_TC_MAP_PREFIX + "_counters"
+	// 存 service 的 ClusterIP:端口 以及它的后端
+	SERVICE_MAP_DEFAULT_PATH = DEFAULT_TC_MAP_PREFIX + "_svc"
+	// 存访问 service 的连接选中的后端, 回包的时候按它改回去
+	CONNTRACK_MAP_DEFAULT_PATH = DEFAULT_TC_MAP_PREFIX + "_ct"
+	// tc 的程序往这里写采样出来的流量事件
+	EVENTS_MAP_DEFAULT_PATH = DEFAULT_TC_MAP_PREFIX + "_events"
+	// 流量事件的采样率
+	FLOW_CONFIG_MAP_DEFAULT_PATH = DEFAULT_TC_MAP_PREFIX + "_flow_cfg"
 )
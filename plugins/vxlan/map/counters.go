@@ -0,0 +1,101 @@
+package bpf_map
+
+import (
+	"cni-demo/tools/utils"
+	"errors"
+	"sort"
+
+	"github.com/cilium/ebpf"
+)
+
+func (r DATAPATH_REASON) String() string {
+	switch r {
+	case REASON_REDIRECT_LOCAL:
+		return "redirect-local"
+	case REASON_REDIRECT_VXLAN:
+		return "redirect-vxlan"
+	case REASON_TUNNEL_SET_FAIL:
+		return "tunnel-set-fail"
+	case REASON_MISS:
+		return "miss"
+	case REASON_NON_IP:
+		return "non-ip"
+	case REASON_POLICY_DENY:
+		return "policy-deny"
+	case REASON_PROXY_REPLY:
+		return "proxy-reply"
+	case REASON_NO_BACKEND:
+		return "no-backend"
+	case REASON_TO_HOST:
+		return "to-host"
+	}
+	return "unknown"
+}
+
+// DatapathCounter 是把各个 cpu 上的值加起来之后的一条计数器
+type DatapathCounter struct {
+	// 不是 ip 包的时候是空的
+	Endpoint string
+	Reason   DATAPATH_REASON
+	Packets  uint64
+	Bytes    uint64
+}
+
+// sumCounters 把 per cpu 的 map 里每个 cpu 上的值加起来
+func sumCounters(values []CounterMapValue) CounterMapValue {
+	total := CounterMapValue{}
+	for _, v := range values {
+		total.Packets += v.Packets
+		total.Bytes += v.Bytes
+	}
+	return total
+}
+
+// sortCounters 按 endpoint 和原因排好序, 打印出来和指标的输出都是稳定的
+func sortCounters(counters []DatapathCounter) {
+	sort.Slice(counters, func(i, j int) bool {
+		if counters[i].Endpoint != counters[j].Endpoint {
+			return counters[i].Endpoint < counters[j].Endpoint
+		}
+		return counters[i].Reason < counters[j].Reason
+	})
+}
+
+// DatapathCounters 方法用于读出 CountersMap 里所有的计数器, 每个 cpu 上的值已经加好了
+// map 还不存在的话说明 tc 程序还没挂上去, 返回空的
+func (mm *MapsManager) DatapathCounters() ([]DatapathCounter, error) {
+	if !utils.PathExists(COUNTERS_MAP_DEFAULT_PATH) {
+		return nil, nil
+	}
+	m := mm.GetCountersMap()
+	if m == nil {
+		return nil, errors.New("加载 " + COUNTERS_MAP_DEFAULT_PATH + " 失败")
+	}
+	defer m.Close()
+	if m.Type() != ebpf.LRUCPUHash {
+		return nil, errors.New("ding_counters 的类型不对: " + m.Type().String())
+	}
+
+	counters := []DatapathCounter{}
+	var key CounterMapKey
+	var values []CounterMapValue
+	itor := m.Iterate()
+	for itor.Next(&key, &values) {
+		total := sumCounters(values)
+		endpoint := ""
+		if key.IP != 0 {
+			endpoint = utils.InetUint32ToIp(key.IP)
+		}
+		counters = append(counters, DatapathCounter{
+			Endpoint: endpoint,
+			Reason:   key.Reason,
+			Packets:  total.Packets,
+			Bytes:    total.Bytes,
+		})
+	}
+	if err := itor.Err(); err != nil {
+		return nil, err
+	}
+	sortCounters(counters)
+	return counters, nil
+}
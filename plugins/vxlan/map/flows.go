@@ -0,0 +1,51 @@
+package bpf_map
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"unsafe"
+)
+
+// FLOW_EVENT_SIZE 是 tc 的程序里 struct flowEvent 的大小
+const FLOW_EVENT_SIZE = int(unsafe.Sizeof(FlowEvent{}))
+
+func (p FLOW_POINT) String() string {
+	switch p {
+	case FLOW_POINT_VETH_INGRESS:
+		return "veth-ingress"
+	case FLOW_POINT_VXLAN_INGRESS:
+		return "vxlan-ingress"
+	case FLOW_POINT_VXLAN_EGRESS:
+		return "vxlan-egress"
+	}
+	return "unknown"
+}
+
+// DecodeFlowEvent 把从 perf 缓冲区里读出来的一条记录解析成 FlowEvent
+// perf 的记录会按 8 字节对齐, 后面可能多出几个字节, 只读前面 FLOW_EVENT_SIZE 个
+// 和其他 map 一样按小端序解析, x86 和 arm64 都是小端序的
+func DecodeFlowEvent(raw []byte) (*FlowEvent, error) {
+	if len(raw) < FLOW_EVENT_SIZE {
+		return nil, errors.New("流量事件的长度不对")
+	}
+	ev := &FlowEvent{}
+	err := binary.Read(bytes.NewReader(raw[:FLOW_EVENT_SIZE]), binary.LittleEndian, ev)
+	if err != nil {
+		return nil, err
+	}
+	return ev, nil
+}
+
+// SetFlowSampleRate 方法用于设置流量事件的采样率, 0 表示不导出
+func (mm *MapsManager) SetFlowSampleRate(rate uint32) error {
+	m, err := mm.CreateFlowConfigMap()
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return errors.New("加载 " + FLOW_CONFIG_MAP_DEFAULT_PATH + " 失败")
+	}
+	defer m.Close()
+	return m.Put(uint32(0), FlowConfigMapValue{SampleRate: rate})
+}
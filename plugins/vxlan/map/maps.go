@@ -1,24 +1,53 @@
 package bpf_map
 
 import (
+	"cni-demo/tools/logger"
 	"cni-demo/tools/utils"
+	"fmt"
 	"unsafe"
 
 	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
 )
 
 type MapsManager struct{}
 
-// DeleteAllPodMap 方法用于删除 PodMap 中的所有键值对。
-func (mm *MapsManager) DeleteAllPodMap() (int, error) {
-	m := mm.GetPodMap()
+// PodCIDRMapEntries 方法用于获取 PodCIDRMap 中所有的键值对。
+func (mm *MapsManager) PodCIDRMapEntries() (map[PodCIDRMapKey]PodCIDRMapValue, error) {
+	m := mm.GetPodCIDRMap()
+	if m == nil {
+		return nil, fmt.Errorf("加载 %s 失败", POD_CIDR_MAP_DEFAULT_PATH)
+	}
+	defer m.Close()
 	itor := m.Iterate()
-	keys := []PodNodeMapKey{}
+	entries := map[PodCIDRMapKey]PodCIDRMapValue{}
 
-	var key PodNodeMapKey
-	var value PodNodeMapValue
+	var key PodCIDRMapKey
+	var value PodCIDRMapValue
 	for itor.Next(&key, &value) {
-		keys = append(keys, key)
+		entries[key] = value
+	}
+	return entries, itor.Err()
+}
+
+// DeletePodCIDRMapByNode 方法用于删除 PodCIDRMap 中所有指向 nodeIP 这个节点的键值对。
+func (mm *MapsManager) DeletePodCIDRMapByNode(nodeIP uint32) (int, error) {
+	m := mm.GetPodCIDRMap()
+	itor := m.Iterate()
+	keys := []PodCIDRMapKey{}
+
+	var key PodCIDRMapKey
+	var value PodCIDRMapValue
+	for itor.Next(&key, &value) {
+		if value.IP == nodeIP {
+			keys = append(keys, key)
+		}
+	}
+	if err := itor.Err(); err != nil {
+		return 0, err
+	}
+	if len(keys) == 0 {
+		return 0, nil
 	}
 	return BatchDelKey(m, keys)
 }
@@ -29,9 +58,9 @@ func (mm *MapsManager) BatchDelLxcMap(keys []EndpointMapKey) (int, error) {
 	return BatchDelKey(m, keys)
 }
 
-// BatchDelPodMap 方法用于批量删除 PodMap 中的一组键。
-func (mm *MapsManager) BatchDelPodMap(keys []PodNodeMapKey) (int, error) {
-	m := mm.GetPodMap()
+// BatchDelPodCIDRMap 方法用于批量删除 PodCIDRMap 中的一组键。
+func (mm *MapsManager) BatchDelPodCIDRMap(keys []PodCIDRMapKey) (int, error) {
+	m := mm.GetPodCIDRMap()
 	return BatchDelKey(m, keys)
 }
 
@@ -47,9 +76,16 @@ func (mm *MapsManager) BatchSetLxcMap(key []EndpointMapKey, value []EndpointMapI
 	return BatchSetMap(m, key, value)
 }
 
-// BatchSetPodMap 方法用于批量设置 PodMap 中的一组键值对。
-func (mm *MapsManager) BatchSetPodMap(key []PodNodeMapKey, value []PodNodeMapValue) (int, error) {
-	m := mm.GetPodMap()
+// BatchSetPodCIDRMap 方法用于批量设置 PodCIDRMap 中的一组键值对。
+// 条目数超过了 map 的大小的话直接报错, 不然只会写进去一部分, 剩下的节点就不通了
+func (mm *MapsManager) BatchSetPodCIDRMap(key []PodCIDRMapKey, value []PodCIDRMapValue) (int, error) {
+	m := mm.GetPodCIDRMap()
+	if m == nil {
+		return 0, fmt.Errorf("加载 %s 失败", POD_CIDR_MAP_DEFAULT_PATH)
+	}
+	if uint32(len(key)) > m.MaxEntries() {
+		return 0, fmt.Errorf("%d 个 pod 网段超过了 %s 的大小 %d, 需要调大插件配置里的 bpfMapSizes.podCIDR", len(key), POD_CIDR_MAP_DEFAULT_PATH, m.MaxEntries())
+	}
 	return BatchSetMap(m, key, value)
 }
 
@@ -65,9 +101,9 @@ func (mm *MapsManager) SetLxcMap(key EndpointMapKey, value EndpointMapInfo) erro
 	return SetMap(m, key, value)
 }
 
-// SetPodMap 方法用于设置 PodMap 中的一个键值对。
-func (mm *MapsManager) SetPodMap(key PodNodeMapKey, value PodNodeMapValue) error {
-	m := mm.GetPodMap()
+// SetPodCIDRMap 方法用于设置 PodCIDRMap 中的一个键值对。
+func (mm *MapsManager) SetPodCIDRMap(key PodCIDRMapKey, value PodCIDRMapValue) error {
+	m := mm.GetPodCIDRMap()
 	return SetMap(m, key, value)
 }
 
@@ -83,9 +119,9 @@ func (mm *MapsManager) DelLxcMap(key EndpointMapKey) error {
 	return DelKey(m, key)
 }
 
-// DelPodMap 方法用于删除 PodMap 中的一个键。
-func (mm *MapsManager) DelPodMap(key PodNodeMapKey) error {
-	m := mm.GetPodMap()
+// DelPodCIDRMap 方法用于删除 PodCIDRMap 中的一个键。
+func (mm *MapsManager) DelPodCIDRMap(key PodCIDRMapKey) error {
+	m := mm.GetPodCIDRMap()
 	return DelKey(m, key)
 }
 
@@ -100,9 +136,9 @@ func (mm *MapsManager) GetLxcMap() *ebpf.Map {
 	return GetMapByPinned(LXC_MAP_DEFAULT_PATH)
 }
 
-// GetPodMap 方法用于通过固定路径加载 PodMap。
-func (mm *MapsManager) GetPodMap() *ebpf.Map {
-	return GetMapByPinned(POD_MAP_DEFAULT_PATH)
+// GetPodCIDRMap 方法用于通过固定路径加载 PodCIDRMap。
+func (mm *MapsManager) GetPodCIDRMap() *ebpf.Map {
+	return GetMapByPinned(POD_CIDR_MAP_DEFAULT_PATH)
 }
 
 // GetNodeLocalMap 方法用于通过固定路径加载 NodeLocalMap。
@@ -121,10 +157,11 @@ func (mm *MapsManager) GetLxcMapValue(key EndpointMapKey) (*EndpointMapInfo, err
 	return value, nil
 }
 
-// GetPodMapValue 方法用于获取 PodMap 中指定键的值。
-func (mm *MapsManager) GetPodMapValue(key PodNodeMapKey) (*PodNodeMapValue, error) {
-	m := mm.GetPodMap()
-	value := &PodNodeMapValue{}
+// GetPodCIDRMapValue 方法用于获取 PodCIDRMap 中指定键的值。
+// LPM trie 查的时候是最长前缀匹配, key 里的 Prefixlen 填 32 就能查某个 pod ip 在哪个节点上
+func (mm *MapsManager) GetPodCIDRMapValue(key PodCIDRMapKey) (*PodCIDRMapValue, error) {
+	m := mm.GetPodCIDRMap()
+	value := &PodCIDRMapValue{}
 	err := GetMapValue(m, key, value)
 	if err != nil {
 		return nil, err
@@ -147,14 +184,14 @@ func (mm *MapsManager) GetNodeLocalMapValue(key LocalNodeMapKey) (*LocalNodeMapV
 // 创建一个用来存储本地 veth pair 网卡的 map
 func (mm *MapsManager) CreateLxcMap() (*ebpf.Map, error) {
 	const (
-		pinPath    = LXC_MAP_DEFAULT_PATH
-		name       = "lxc_map"
-		_type      = ebpf.Hash
-		keySize    = uint32(unsafe.Sizeof(EndpointMapKey{}))
-		valueSize  = uint32(unsafe.Sizeof(EndpointMapInfo{}))
-		maxEntries = MAX_ENTRIES
-		flags      = 0
+		pinPath   = LXC_MAP_DEFAULT_PATH
+		name      = "lxc_map"
+		_type     = ebpf.Hash
+		keySize   = uint32(unsafe.Sizeof(EndpointMapKey{}))
+		valueSize = uint32(unsafe.Sizeof(EndpointMapInfo{}))
+		flags     = 0
 	)
+	maxEntries := GetMapSizes().Lxc
 
 	m, err := CreateOnceMapWithPin(
 		pinPath,
@@ -172,18 +209,18 @@ func (mm *MapsManager) CreateLxcMap() (*ebpf.Map, error) {
 	return m, nil
 }
 
-// CreatePodMap 方法用于创建一个用于存储集群中其他节点上的 Pod IP 的 PodMap。
-// 创建一个用来存储集群中其他节点上的 pod ip 的 map
-func (mm *MapsManager) CreatePodMap() (*ebpf.Map, error) {
+// CreatePodCIDRMap 方法用于创建一个用于存储集群中其他节点的 pod 网段的 PodCIDRMap。
+// LPM trie 类型的 map 必须带上 BPF_F_NO_PREALLOC
+func (mm *MapsManager) CreatePodCIDRMap() (*ebpf.Map, error) {
 	const (
-		pinPath    = POD_MAP_DEFAULT_PATH
-		name       = "pod_map"
-		_type      = ebpf.Hash
-		keySize    = uint32(unsafe.Sizeof(PodNodeMapKey{}))
-		valueSize  = uint32(unsafe.Sizeof(PodNodeMapValue{}))
-		maxEntries = MAX_ENTRIES
-		flags      = 0
+		pinPath   = POD_CIDR_MAP_DEFAULT_PATH
+		name      = "pod_cidr_map"
+		_type     = ebpf.LPMTrie
+		keySize   = uint32(unsafe.Sizeof(PodCIDRMapKey{}))
+		valueSize = uint32(unsafe.Sizeof(PodCIDRMapValue{}))
+		flags     = unix.BPF_F_NO_PREALLOC
 	)
+	maxEntries := GetMapSizes().PodCIDR
 
 	m, err := CreateOnceMapWithPin(
 		pinPath,
@@ -201,19 +238,62 @@ func (mm *MapsManager) CreatePodMap() (*ebpf.Map, error) {
 	return m, nil
 }
 
+// 以前 ding_local 的 key 里只有 Type
+const legacyLocalNodeMapKeySize = 4
+
+// migrateNodeLocalMap 把 key 里只有 Type 的旧 ding_local 换成新的布局, 设备的条目都拷过去
+// 和扩容一样, 换了之后本机的 tc 程序要重新挂一遍, 见 TakeResizedMaps
+func migrateNodeLocalMap(old *ebpf.Map, pinPath string, name string, keySize, valueSize, maxEntries uint32) (*ebpf.Map, error) {
+	m, err := createMap(name, ebpf.Hash, keySize, valueSize, maxEntries, 0)
+	if err != nil {
+		return nil, err
+	}
+	itor := old.Iterate()
+	var _type uint32
+	var value LocalNodeMapValue
+	for itor.Next(&_type, &value) {
+		err = m.Put(LocalNodeMapKey{Type: LOCAL_DEV_TYPE(_type)}, value)
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+	}
+	if err = itor.Err(); err != nil {
+		m.Close()
+		return nil, err
+	}
+	err = replaceMapWithPin(m, pinPath)
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+	logger.Info("ding_local 换成了带地址的 key", "path", pinPath)
+	return m, nil
+}
+
 // CreateNodeLocalMap 方法用于创建一个用于存储本机网卡设备的 NodeLocalMap。
-// 创建一个用来存储本机网卡设备的 map
+// 创建一个用来存储本机网卡设备以及本机地址的 map
 func (mm *MapsManager) CreateNodeLocalMap() (*ebpf.Map, error) {
 	const (
-		pinPath    = NODE_LOCAL_MAP_DEFAULT_PATH
-		name       = "local_map"
-		_type      = ebpf.Hash
-		keySize    = uint32(unsafe.Sizeof(LocalNodeMapKey{}))
-		valueSize  = uint32(unsafe.Sizeof(LocalNodeMapValue{}))
-		maxEntries = MAX_ENTRIES
-		flags      = 0
+		pinPath   = NODE_LOCAL_MAP_DEFAULT_PATH
+		name      = "local_map"
+		_type     = ebpf.Hash
+		keySize   = uint32(unsafe.Sizeof(LocalNodeMapKey{}))
+		valueSize = uint32(unsafe.Sizeof(LocalNodeMapValue{}))
+		flags     = 0
 	)
+	maxEntries := GetMapSizes().Local
 
+	if utils.PathExists(pinPath) {
+		old := GetMapByPinned(pinPath)
+		if old != nil && old.KeySize() == legacyLocalNodeMapKeySize {
+			defer old.Close()
+			return migrateNodeLocalMap(old, pinPath, name, keySize, valueSize, maxEntries)
+		}
+		if old != nil {
+			old.Close()
+		}
+	}
 	m, err := CreateOnceMapWithPin(
 		pinPath,
 		name,
@@ -230,6 +310,420 @@ func (mm *MapsManager) CreateNodeLocalMap() (*ebpf.Map, error) {
 	return m, nil
 }
 
+// HostAddrEntries 方法用于获取 NodeLocalMap 中本机地址的条目, key 是网络字节序的地址, value 是地址所在网卡的 ifindex。
+func (mm *MapsManager) HostAddrEntries() (map[[4]byte]uint32, error) {
+	m := mm.GetNodeLocalMap()
+	if m == nil {
+		return nil, fmt.Errorf("加载 %s 失败", NODE_LOCAL_MAP_DEFAULT_PATH)
+	}
+	defer m.Close()
+	itor := m.Iterate()
+	res := map[[4]byte]uint32{}
+
+	var key LocalNodeMapKey
+	var value LocalNodeMapValue
+	for itor.Next(&key, &value) {
+		if key.Type == HOST_ADDR {
+			res[key.IP] = value.IfIndex
+		}
+	}
+	return res, itor.Err()
+}
+
+// GetLxcDevMap 方法用于通过固定路径加载 LxcDevMap。
+func (mm *MapsManager) GetLxcDevMap() *ebpf.Map {
+	return GetMapByPinned(LXC_DEV_MAP_DEFAULT_PATH)
+}
+
+// SetLxcDevMap 方法用于设置 LxcDevMap 中的一个键值对。
+func (mm *MapsManager) SetLxcDevMap(key LxcDevMapKey, value LxcDevMapValue) error {
+	m := mm.GetLxcDevMap()
+	return SetMap(m, key, value)
+}
+
+// DelLxcDevMap 方法用于删除 LxcDevMap 中的一个键。
+func (mm *MapsManager) DelLxcDevMap(key LxcDevMapKey) error {
+	m := mm.GetLxcDevMap()
+	return DelKey(m, key)
+}
+
+// CreateLxcDevMap 方法用于创建一个用于存储本地 veth 留在 host 上那头的 mac 的 LxcDevMap。
+// 和 LxcMap 一样每个本机 pod 一条, 大小也跟着 LxcMap 走
+func (mm *MapsManager) CreateLxcDevMap() (*ebpf.Map, error) {
+	const (
+		pinPath   = LXC_DEV_MAP_DEFAULT_PATH
+		name      = "lxc_dev_map"
+		_type     = ebpf.Hash
+		keySize   = uint32(unsafe.Sizeof(LxcDevMapKey{}))
+		valueSize = uint32(unsafe.Sizeof(LxcDevMapValue{}))
+		flags     = 0
+	)
+	maxEntries := GetMapSizes().Lxc
+
+	return CreateOnceMapWithPin(
+		pinPath,
+		name,
+		_type,
+		keySize,
+		valueSize,
+		maxEntries,
+		flags,
+	)
+}
+
+// GetPolicyPodMap 方法用于通过固定路径加载 PolicyPodMap。
+func (mm *MapsManager) GetPolicyPodMap() *ebpf.Map {
+	return GetMapByPinned(POLICY_POD_MAP_DEFAULT_PATH)
+}
+
+// GetPolicyMap 方法用于通过固定路径加载 PolicyMap。
+func (mm *MapsManager) GetPolicyMap() *ebpf.Map {
+	return GetMapByPinned(POLICY_MAP_DEFAULT_PATH)
+}
+
+// SetPolicyPodMap 方法用于设置 PolicyPodMap 中的一个键值对。
+func (mm *MapsManager) SetPolicyPodMap(key PolicyPodMapKey, value PolicyPodMapValue) error {
+	m := mm.GetPolicyPodMap()
+	return SetMap(m, key, value)
+}
+
+// SetPolicyMap 方法用于设置 PolicyMap 中的一个键值对。
+func (mm *MapsManager) SetPolicyMap(key PolicyMapKey, value PolicyMapValue) error {
+	m := mm.GetPolicyMap()
+	return SetMap(m, key, value)
+}
+
+// DelPolicyPodMap 方法用于删除 PolicyPodMap 中的一个键。
+func (mm *MapsManager) DelPolicyPodMap(key PolicyPodMapKey) error {
+	m := mm.GetPolicyPodMap()
+	return DelKey(m, key)
+}
+
+// DelPolicyMap 方法用于删除 PolicyMap 中的一个键。
+func (mm *MapsManager) DelPolicyMap(key PolicyMapKey) error {
+	m := mm.GetPolicyMap()
+	return DelKey(m, key)
+}
+
+// LxcMapValues 方法用于获取 LxcMap 中所有的值, 也就是本机所有 pod 的 veth 信息。
+func (mm *MapsManager) LxcMapValues() ([]EndpointMapInfo, error) {
+	m := mm.GetLxcMap()
+	if m == nil {
+		return nil, fmt.Errorf("加载 %s 失败", LXC_MAP_DEFAULT_PATH)
+	}
+	defer m.Close()
+	itor := m.Iterate()
+	values := []EndpointMapInfo{}
+
+	var key EndpointMapKey
+	var value EndpointMapInfo
+	for itor.Next(&key, &value) {
+		values = append(values, value)
+	}
+	return values, itor.Err()
+}
+
+// PolicyPodMapKeys 方法用于获取 PolicyPodMap 中所有的键。
+func (mm *MapsManager) PolicyPodMapKeys() ([]PolicyPodMapKey, error) {
+	m := mm.GetPolicyPodMap()
+	itor := m.Iterate()
+	keys := []PolicyPodMapKey{}
+
+	var key PolicyPodMapKey
+	var value PolicyPodMapValue
+	for itor.Next(&key, &value) {
+		keys = append(keys, key)
+	}
+	return keys, itor.Err()
+}
+
+// PolicyMapKeys 方法用于获取 PolicyMap 中所有的键。
+func (mm *MapsManager) PolicyMapKeys() ([]PolicyMapKey, error) {
+	m := mm.GetPolicyMap()
+	itor := m.Iterate()
+	keys := []PolicyMapKey{}
+
+	var key PolicyMapKey
+	var value PolicyMapValue
+	for itor.Next(&key, &value) {
+		keys = append(keys, key)
+	}
+	return keys, itor.Err()
+}
+
+// CreatePolicyPodMap 方法用于创建一个用于存储本机被网络策略隔离的 pod 的 PolicyPodMap。
+func (mm *MapsManager) CreatePolicyPodMap() (*ebpf.Map, error) {
+	const (
+		pinPath   = POLICY_POD_MAP_DEFAULT_PATH
+		name      = "policy_pod_map"
+		_type     = ebpf.Hash
+		keySize   = uint32(unsafe.Sizeof(PolicyPodMapKey{}))
+		valueSize = uint32(unsafe.Sizeof(PolicyPodMapValue{}))
+		flags     = 0
+	)
+	maxEntries := GetMapSizes().PolicyPod
+
+	return CreateOnceMapWithPin(
+		pinPath,
+		name,
+		_type,
+		keySize,
+		valueSize,
+		maxEntries,
+		flags,
+	)
+}
+
+// CreatePolicyMap 方法用于创建一个用于存储网络策略规则的 PolicyMap。
+// LPM trie 类型的 map 必须带上 BPF_F_NO_PREALLOC
+func (mm *MapsManager) CreatePolicyMap() (*ebpf.Map, error) {
+	const (
+		pinPath   = POLICY_MAP_DEFAULT_PATH
+		name      = "policy_map"
+		_type     = ebpf.LPMTrie
+		keySize   = uint32(unsafe.Sizeof(PolicyMapKey{}))
+		valueSize = uint32(unsafe.Sizeof(PolicyMapValue{}))
+		flags     = unix.BPF_F_NO_PREALLOC
+	)
+	maxEntries := GetMapSizes().Policy
+
+	return CreateOnceMapWithPin(
+		pinPath,
+		name,
+		_type,
+		keySize,
+		valueSize,
+		maxEntries,
+		flags,
+	)
+}
+
+// GetStatsMap 方法用于通过固定路径加载 StatsMap。
+func (mm *MapsManager) GetStatsMap() *ebpf.Map {
+	return GetMapByPinned(STATS_MAP_DEFAULT_PATH)
+}
+
+// CreateStatsMap 方法用于创建一个用于存储每个 pod 收发包统计的 StatsMap。
+// 删掉的 pod 不用专门去清理, LRU 满了会自己淘汰
+func (mm *MapsManager) CreateStatsMap() (*ebpf.Map, error) {
+	const (
+		pinPath   = STATS_MAP_DEFAULT_PATH
+		name      = "stats_map"
+		_type     = ebpf.LRUCPUHash
+		keySize   = uint32(unsafe.Sizeof(StatsMapKey{}))
+		valueSize = uint32(unsafe.Sizeof(StatsMapValue{}))
+		flags     = 0
+	)
+	maxEntries := GetMapSizes().Stats
+
+	return CreateOnceMapWithPin(
+		pinPath,
+		name,
+		_type,
+		keySize,
+		valueSize,
+		maxEntries,
+		flags,
+	)
+}
+
+// GetCountersMap 方法用于通过固定路径加载 CountersMap。
+func (mm *MapsManager) GetCountersMap() *ebpf.Map {
+	return GetMapByPinned(COUNTERS_MAP_DEFAULT_PATH)
+}
+
+// CreateCountersMap 方法用于创建一个用于存储数据面计数器的 CountersMap。
+func (mm *MapsManager) CreateCountersMap() (*ebpf.Map, error) {
+	const (
+		pinPath   = COUNTERS_MAP_DEFAULT_PATH
+		name      = "counters_map"
+		_type     = ebpf.LRUCPUHash
+		keySize   = uint32(unsafe.Sizeof(CounterMapKey{}))
+		valueSize = uint32(unsafe.Sizeof(CounterMapValue{}))
+		flags     = 0
+	)
+	maxEntries := GetMapSizes().Counters
+
+	return CreateOnceMapWithPin(
+		pinPath,
+		name,
+		_type,
+		keySize,
+		valueSize,
+		maxEntries,
+		flags,
+	)
+}
+
+// GetFlowEventsMap 方法用于通过固定路径加载 FlowEventsMap。
+func (mm *MapsManager) GetFlowEventsMap() *ebpf.Map {
+	return GetMapByPinned(EVENTS_MAP_DEFAULT_PATH)
+}
+
+// CreateFlowEventsMap 方法用于创建 tc 的程序写流量事件的 perf event array。
+// maxEntries 写 0 的话 cilium/ebpf 会用 cpu 的个数, 和 tc 的程序里不写 max_entries 是一样的
+func (mm *MapsManager) CreateFlowEventsMap() (*ebpf.Map, error) {
+	const (
+		pinPath    = EVENTS_MAP_DEFAULT_PATH
+		name       = "events_map"
+		_type      = ebpf.PerfEventArray
+		keySize    = uint32(4)
+		valueSize  = uint32(4)
+		maxEntries = 0
+		flags      = 0
+	)
+
+	return CreateOnceMapWithPin(
+		pinPath,
+		name,
+		_type,
+		keySize,
+		valueSize,
+		maxEntries,
+		flags,
+	)
+}
+
+// GetFlowConfigMap 方法用于通过固定路径加载 FlowConfigMap。
+func (mm *MapsManager) GetFlowConfigMap() *ebpf.Map {
+	return GetMapByPinned(FLOW_CONFIG_MAP_DEFAULT_PATH)
+}
+
+// CreateFlowConfigMap 方法用于创建存流量事件采样率的 FlowConfigMap。
+func (mm *MapsManager) CreateFlowConfigMap() (*ebpf.Map, error) {
+	const (
+		pinPath    = FLOW_CONFIG_MAP_DEFAULT_PATH
+		name       = "flow_cfg_map"
+		_type      = ebpf.Array
+		keySize    = uint32(4)
+		valueSize  = uint32(unsafe.Sizeof(FlowConfigMapValue{}))
+		maxEntries = 1
+		flags      = 0
+	)
+
+	return CreateOnceMapWithPin(
+		pinPath,
+		name,
+		_type,
+		keySize,
+		valueSize,
+		maxEntries,
+		flags,
+	)
+}
+
+// GetServiceMap 方法用于通过固定路径加载 ServiceMap。
+func (mm *MapsManager) GetServiceMap() *ebpf.Map {
+	return GetMapByPinned(SERVICE_MAP_DEFAULT_PATH)
+}
+
+// SetServiceMap 方法用于设置 ServiceMap 中的一个键值对。
+func (mm *MapsManager) SetServiceMap(key ServiceMapKey, value ServiceMapValue) error {
+	m := mm.GetServiceMap()
+	return SetMap(m, key, value)
+}
+
+// DelServiceMap 方法用于删除 ServiceMap 中的一个键。
+func (mm *MapsManager) DelServiceMap(key ServiceMapKey) error {
+	m := mm.GetServiceMap()
+	return DelKey(m, key)
+}
+
+// ServiceMapEntries 方法用于获取 ServiceMap 中所有的键值对。
+func (mm *MapsManager) ServiceMapEntries() (map[ServiceMapKey]ServiceMapValue, error) {
+	m := mm.GetServiceMap()
+	if m == nil {
+		return nil, fmt.Errorf("加载 %s 失败", SERVICE_MAP_DEFAULT_PATH)
+	}
+	defer m.Close()
+	itor := m.Iterate()
+	res := map[ServiceMapKey]ServiceMapValue{}
+
+	var key ServiceMapKey
+	var value ServiceMapValue
+	for itor.Next(&key, &value) {
+		res[key] = value
+	}
+	return res, itor.Err()
+}
+
+// CreateServiceMap 方法用于创建一个用于存储 service 及其后端的 ServiceMap。
+func (mm *MapsManager) CreateServiceMap() (*ebpf.Map, error) {
+	const (
+		pinPath   = SERVICE_MAP_DEFAULT_PATH
+		name      = "service_map"
+		_type     = ebpf.Hash
+		keySize   = uint32(unsafe.Sizeof(ServiceMapKey{}))
+		valueSize = uint32(unsafe.Sizeof(ServiceMapValue{}))
+		flags     = 0
+	)
+	maxEntries := GetMapSizes().Service
+
+	return CreateOnceMapWithPin(
+		pinPath,
+		name,
+		_type,
+		keySize,
+		valueSize,
+		maxEntries,
+		flags,
+	)
+}
+
+// GetConntrackMap 方法用于通过固定路径加载 ConntrackMap。
+func (mm *MapsManager) GetConntrackMap() *ebpf.Map {
+	return GetMapByPinned(CONNTRACK_MAP_DEFAULT_PATH)
+}
+
+// DelConntrackMap 方法用于删除 ConntrackMap 中的一个键。
+func (mm *MapsManager) DelConntrackMap(key ConntrackMapKey) error {
+	m := mm.GetConntrackMap()
+	return DelKey(m, key)
+}
+
+// ConntrackMapEntries 方法用于获取 ConntrackMap 中所有的键值对。
+// tc 的程序一直在往里写, 读到的只是某一刻的样子
+func (mm *MapsManager) ConntrackMapEntries() (map[ConntrackMapKey]ConntrackMapValue, error) {
+	m := mm.GetConntrackMap()
+	if m == nil {
+		return nil, fmt.Errorf("加载 %s 失败", CONNTRACK_MAP_DEFAULT_PATH)
+	}
+	defer m.Close()
+	itor := m.Iterate()
+	res := map[ConntrackMapKey]ConntrackMapValue{}
+
+	var key ConntrackMapKey
+	var value ConntrackMapValue
+	for itor.Next(&key, &value) {
+		res[key] = value
+	}
+	return res, itor.Err()
+}
+
+// CreateConntrackMap 方法用于创建一个用于存储访问 service 的连接的 ConntrackMap。
+// 断掉的连接不用专门去清理, LRU 满了会自己淘汰
+func (mm *MapsManager) CreateConntrackMap() (*ebpf.Map, error) {
+	const (
+		pinPath   = CONNTRACK_MAP_DEFAULT_PATH
+		name      = "conntrack_map"
+		_type     = ebpf.LRUHash
+		keySize   = uint32(unsafe.Sizeof(ConntrackMapKey{}))
+		valueSize = uint32(unsafe.Sizeof(ConntrackMapValue{}))
+		flags     = 0
+	)
+	maxEntries := GetMapSizes().Conntrack
+
+	return CreateOnceMapWithPin(
+		pinPath,
+		name,
+		_type,
+		keySize,
+		valueSize,
+		maxEntries,
+		flags,
+	)
+}
+
 // GetMapsManager 闭包函数用于创建或返回一个 MapsManager 实例。
 // 在首次调用时，它会创建一个新的 MapsManager 实例，并确保相关目录已创建。
 // 在后续调用时，它会返回已创建的 MapsManager 实例。
@@ -245,7 +739,7 @@ var GetMapsManager = func() func() (*MapsManager, error) {
 			if !utils.PathExists(lxcPath) {
 				err = utils.CreateDir(lxcPath)
 			}
-			podPath := utils.GetParentDirectory(POD_MAP_DEFAULT_PATH)
+			podPath := utils.GetParentDirectory(POD_CIDR_MAP_DEFAULT_PATH)
 			if !utils.PathExists(podPath) {
 				err = utils.CreateDir(podPath)
 			}
@@ -1,7 +1,6 @@
 package bpf_map
 
 import (
-	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -13,9 +12,6 @@ func TestMap(t *testing.T) {
 	test.Nil(err)
 	test.NotNil(mm)
 
-	nums, err := mm.DeleteAllPodMap()
-	test.Nil(err)
-	fmt.Printf("删除掉了 %d 个 keys", nums)
 	// ip := utils.InetIpToUInt32("10.244.134.23")
 	// v, err := mm.GetLxcMapValue(EndpointMapKey{IP: ip})
 	// test.Nil(err)
@@ -27,14 +23,26 @@ func TestMap(t *testing.T) {
 	test.Nil(err)
 	test.NotNil(lxcMap)
 
-	podMap, err := mm.CreatePodMap()
+	lxcDevMap, err := mm.CreateLxcDevMap()
+	test.Nil(err)
+	test.NotNil(lxcDevMap)
+
+	podCIDRMap, err := mm.CreatePodCIDRMap()
 	test.Nil(err)
-	test.NotNil(podMap)
+	test.NotNil(podCIDRMap)
 
 	localMap, err := mm.CreateNodeLocalMap()
 	test.Nil(err)
 	test.NotNil(localMap)
 
+	serviceMap, err := mm.CreateServiceMap()
+	test.Nil(err)
+	test.NotNil(serviceMap)
+
+	conntrackMap, err := mm.CreateConntrackMap()
+	test.Nil(err)
+	test.NotNil(conntrackMap)
+
 	/************ test set ************/
 	err = mm.SetLxcMap(
 		EndpointMapKey{IP: 1},
@@ -47,9 +55,15 @@ func TestMap(t *testing.T) {
 	)
 	test.Nil(err)
 
-	err = mm.SetPodMap(
-		PodNodeMapKey{IP: 10},
-		PodNodeMapValue{IP: 11},
+	err = mm.SetLxcDevMap(
+		LxcDevMapKey{IfIndex: 3},
+		LxcDevMapValue{MAC: [8]byte{5}},
+	)
+	test.Nil(err)
+
+	err = mm.SetPodCIDRMap(
+		PodCIDRMapKey{Prefixlen: 24, IP: [4]byte{10, 244, 1, 0}},
+		PodCIDRMapValue{IP: 11},
 	)
 	test.Nil(err)
 
@@ -59,7 +73,11 @@ func TestMap(t *testing.T) {
 	)
 	test.Nil(err)
 
-	nums, err = mm.BatchSetLxcMap(
+	svcKey := ServiceMapKey{IP: [4]byte{10, 96, 0, 10}, Port: [2]byte{0, 53}, Slot: 1, Protocol: 17}
+	err = mm.SetServiceMap(svcKey, ServiceMapValue{IP: [4]byte{10, 244, 1, 2}, Port: [2]byte{0, 53}})
+	test.Nil(err)
+
+	nums, err := mm.BatchSetLxcMap(
 		[]EndpointMapKey{
 			{IP: 3},
 			{IP: 4},
@@ -82,12 +100,12 @@ func TestMap(t *testing.T) {
 	test.Nil(err)
 	test.Equal(nums, 2)
 
-	nums, err = mm.BatchSetPodMap(
-		[]PodNodeMapKey{
-			{IP: 20},
-			{IP: 30},
+	nums, err = mm.BatchSetPodCIDRMap(
+		[]PodCIDRMapKey{
+			{Prefixlen: 24, IP: [4]byte{10, 244, 2, 0}},
+			{Prefixlen: 24, IP: [4]byte{10, 244, 3, 0}},
 		},
-		[]PodNodeMapValue{
+		[]PodCIDRMapValue{
 			{IP: 21},
 			{IP: 31},
 		},
@@ -118,9 +136,25 @@ func TestMap(t *testing.T) {
 		NodeMAC:    [8]byte{5},
 	})
 
-	pod, err := mm.GetPodMapValue(PodNodeMapKey{IP: 10})
+	// 用 /32 的 pod ip 去查, 最长前缀匹配到它所在的网段
+	pod, err := mm.GetPodCIDRMapValue(PodCIDRMapKey{Prefixlen: 32, IP: [4]byte{10, 244, 1, 5}})
+	test.Nil(err)
+	test.EqualValues(pod, &PodCIDRMapValue{IP: 11})
+
+	entries, err := mm.PodCIDRMapEntries()
+	test.Nil(err)
+	// pin 住的 map 里可能还有别的网段, 至少要有上面写进去的三个
+	test.GreaterOrEqual(len(entries), 3)
+	test.Equal(PodCIDRMapValue{IP: 11}, entries[PodCIDRMapKey{Prefixlen: 24, IP: [4]byte{10, 244, 1, 0}}])
+	test.Equal(PodCIDRMapValue{IP: 21}, entries[PodCIDRMapKey{Prefixlen: 24, IP: [4]byte{10, 244, 2, 0}}])
+	test.Equal(PodCIDRMapValue{IP: 31}, entries[PodCIDRMapKey{Prefixlen: 24, IP: [4]byte{10, 244, 3, 0}}])
+
+	services, err := mm.ServiceMapEntries()
+	test.Nil(err)
+	test.Equal(ServiceMapValue{IP: [4]byte{10, 244, 1, 2}, Port: [2]byte{0, 53}}, services[svcKey])
+
+	_, err = mm.ConntrackMapEntries()
 	test.Nil(err)
-	test.EqualValues(pod, &PodNodeMapValue{IP: 11})
 
 	local, err := mm.GetNodeLocalMapValue(LocalNodeMapKey{Type: 666})
 	test.Nil(err)
@@ -130,12 +164,18 @@ func TestMap(t *testing.T) {
 	err = mm.DelLxcMap(EndpointMapKey{IP: 1})
 	test.Nil(err)
 
-	err = mm.DelPodMap(PodNodeMapKey{IP: 10})
+	err = mm.DelLxcDevMap(LxcDevMapKey{IfIndex: 3})
+	test.Nil(err)
+
+	err = mm.DelPodCIDRMap(PodCIDRMapKey{Prefixlen: 24, IP: [4]byte{10, 244, 1, 0}})
 	test.Nil(err)
 
 	err = mm.DelNodeLocalMap(LocalNodeMapKey{Type: 666})
 	test.Nil(err)
 
+	err = mm.DelServiceMap(svcKey)
+	test.Nil(err)
+
 	nums, err = mm.BatchDelLxcMap(
 		[]EndpointMapKey{
 			{IP: 3},
@@ -145,10 +185,10 @@ func TestMap(t *testing.T) {
 	test.Nil(err)
 	test.Equal(nums, 2)
 
-	nums, err = mm.BatchDelPodMap(
-		[]PodNodeMapKey{
-			{IP: 20},
-			{IP: 30},
+	nums, err = mm.BatchDelPodCIDRMap(
+		[]PodCIDRMapKey{
+			{Prefixlen: 24, IP: [4]byte{10, 244, 2, 0}},
+			{Prefixlen: 24, IP: [4]byte{10, 244, 3, 0}},
 		},
 	)
 	test.Nil(err)
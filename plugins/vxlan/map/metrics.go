@@ -0,0 +1,148 @@
+package bpf_map
+
+import (
+	"cni-demo/tools/metrics"
+	"cni-demo/tools/utils"
+	"errors"
+
+	"github.com/cilium/ebpf"
+)
+
+var (
+	mapEntries = metrics.NewGaugeVec(
+		"bpf_map_entries",
+		"ebpf map 里当前的条目数",
+		"map",
+	)
+	podPackets = metrics.NewCounterVec(
+		"pod_packets_total",
+		"tc 程序看到的每个 pod 的包数, direction 是 tx 或者 rx",
+		"pod_ip", "direction",
+	)
+	podBytes = metrics.NewCounterVec(
+		"pod_bytes_total",
+		"tc 程序看到的每个 pod 的字节数, direction 是 tx 或者 rx",
+		"pod_ip", "direction",
+	)
+	podDrops = metrics.NewCounterVec(
+		"pod_drops_total",
+		"tc 程序给每个 pod 丢掉的包数, 目前只有网络策略会丢包",
+		"pod_ip", "direction",
+	)
+	// ding_counters 是 LRU 的, 条目被淘汰之后再出现会从 0 开始, 所以不能当成只增不减的 counter, 只能是 gauge
+	datapathPackets = metrics.NewGaugeVec(
+		"datapath_packets",
+		"tc 程序按原因统计的包数, endpoint 在 veth 上是源 pod, 在 vxlan 上是目标 pod, 条目被 LRU 淘汰之后会从 0 重新开始",
+		"endpoint", "reason",
+	)
+	datapathBytes = metrics.NewGaugeVec(
+		"datapath_bytes",
+		"tc 程序按原因统计的字节数, endpoint 在 veth 上是源 pod, 在 vxlan 上是目标 pod, 条目被 LRU 淘汰之后会从 0 重新开始",
+		"endpoint", "reason",
+	)
+)
+
+func (d STATS_DIRECTION) String() string {
+	switch d {
+	case STATS_TX:
+		return "tx"
+	case STATS_RX:
+		return "rx"
+	}
+	return "unknown"
+}
+
+// sumStats 把 per cpu 的 map 里每个 cpu 上的值加起来
+func sumStats(values []StatsMapValue) StatsMapValue {
+	total := StatsMapValue{}
+	for _, v := range values {
+		total.Packets += v.Packets
+		total.Bytes += v.Bytes
+		total.Drops += v.Drops
+	}
+	return total
+}
+
+// countEntries 遍历一遍 map 数一下有多少条, 内核没有直接拿条数的接口
+func countEntries(m *ebpf.Map) (int, error) {
+	var key, value []byte
+	count := 0
+	itor := m.Iterate()
+	for itor.Next(&key, &value) {
+		count++
+	}
+	return count, itor.Err()
+}
+
+// CollectMetrics 读一遍 ding_cidr, ding_lxc, ding_svc 和 ding_ct 的条数以及 ding_stats 和 ding_counters 里的统计, 更新到指标里
+// 由 cni-demo-agent 在每次被拉取指标的时候调用
+func (mm *MapsManager) CollectMetrics() error {
+	for name, m := range map[string]*ebpf.Map{
+		"ding_cidr": mm.GetPodCIDRMap(),
+		"ding_lxc":  mm.GetLxcMap(),
+		"ding_svc":  mm.GetServiceMap(),
+		"ding_ct":   mm.GetConntrackMap(),
+	} {
+		if m == nil {
+			continue
+		}
+		count, err := countEntries(m)
+		m.Close()
+		if err != nil {
+			return err
+		}
+		mapEntries.Set(float64(count), name)
+	}
+
+	err := mm.collectPodStats()
+	if err != nil {
+		return err
+	}
+	return mm.collectDatapathCounters()
+}
+
+func (mm *MapsManager) collectPodStats() error {
+	if !utils.PathExists(STATS_MAP_DEFAULT_PATH) {
+		// 还没有 pod 的话 tc 程序都没挂上去, map 不存在是正常的
+		return nil
+	}
+	m := mm.GetStatsMap()
+	if m == nil {
+		return errors.New("加载 " + STATS_MAP_DEFAULT_PATH + " 失败")
+	}
+	defer m.Close()
+	if m.Type() != ebpf.LRUCPUHash {
+		return errors.New("ding_stats 的类型不对: " + m.Type().String())
+	}
+
+	// 不在 map 里的 pod 已经被淘汰了, 先清掉再重新设置
+	podPackets.Reset()
+	podBytes.Reset()
+	podDrops.Reset()
+	var key StatsMapKey
+	var values []StatsMapValue
+	itor := m.Iterate()
+	for itor.Next(&key, &values) {
+		total := sumStats(values)
+		ip := utils.InetUint32ToIp(key.IP)
+		direction := key.Direction.String()
+		podPackets.Set(float64(total.Packets), ip, direction)
+		podBytes.Set(float64(total.Bytes), ip, direction)
+		podDrops.Set(float64(total.Drops), ip, direction)
+	}
+	return itor.Err()
+}
+
+func (mm *MapsManager) collectDatapathCounters() error {
+	counters, err := mm.DatapathCounters()
+	if err != nil {
+		return err
+	}
+	datapathPackets.Reset()
+	datapathBytes.Reset()
+	for _, c := range counters {
+		datapathPackets.Set(float64(c.Packets), c.Endpoint, c.Reason.String())
+		datapathBytes.Set(float64(c.Bytes), c.Endpoint, c.Reason.String())
+	}
+	return nil
+}
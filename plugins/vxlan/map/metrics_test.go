@@ -0,0 +1,51 @@
+package bpf_map
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSumStats(t *testing.T) {
+	test := assert.New(t)
+
+	total := sumStats([]StatsMapValue{
+		{Packets: 3, Bytes: 300, Drops: 1},
+		{},
+		{Packets: 2, Bytes: 120},
+	})
+	test.Equal(StatsMapValue{Packets: 5, Bytes: 420, Drops: 1}, total)
+	test.Equal(StatsMapValue{}, sumStats(nil))
+
+	test.Equal("tx", STATS_TX.String())
+	test.Equal("rx", STATS_RX.String())
+	test.Equal("unknown", STATS_DIRECTION(0).String())
+}
+
+func TestDatapathCounters(t *testing.T) {
+	test := assert.New(t)
+
+	total := sumCounters([]CounterMapValue{{Packets: 1, Bytes: 60}, {Packets: 4, Bytes: 400}})
+	test.Equal(CounterMapValue{Packets: 5, Bytes: 460}, total)
+
+	counters := []DatapathCounter{
+		{Endpoint: "10.244.1.3", Reason: REASON_MISS},
+		{Endpoint: "10.244.1.2", Reason: REASON_POLICY_DENY},
+		{Endpoint: "", Reason: REASON_NON_IP},
+		{Endpoint: "10.244.1.2", Reason: REASON_REDIRECT_LOCAL},
+	}
+	sortCounters(counters)
+	test.Equal([]DatapathCounter{
+		{Endpoint: "", Reason: REASON_NON_IP},
+		{Endpoint: "10.244.1.2", Reason: REASON_REDIRECT_LOCAL},
+		{Endpoint: "10.244.1.2", Reason: REASON_POLICY_DENY},
+		{Endpoint: "10.244.1.3", Reason: REASON_MISS},
+	}, counters)
+
+	test.Equal("redirect-vxlan", REASON_REDIRECT_VXLAN.String())
+	test.Equal("tunnel-set-fail", REASON_TUNNEL_SET_FAIL.String())
+	test.Equal("proxy-reply", REASON_PROXY_REPLY.String())
+	test.Equal("no-backend", REASON_NO_BACKEND.String())
+	test.Equal("to-host", REASON_TO_HOST.String())
+	test.Equal("unknown", DATAPATH_REASON(0).String())
+}
@@ -0,0 +1,171 @@
+package bpf_map
+
+import (
+	"cni-demo/tools/logger"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/cilium/ebpf"
+)
+
+// MapSizes 是各个 map 最多能放多少个条目, 对应插件配置里的 bpfMapSizes, 没填或者填 0 的用默认值
+// 已经 pin 好了的 map 和这里的大小不一样的话, 下次创建的时候会换成一个新的, 旧的条目都会拷过去
+type MapSizes struct {
+	// ding_lxc 和 ding_lxc_dev, 本机最多多少个 pod
+	Lxc uint32 `json:"lxc"`
+	// ding_cidr, 每个节点两条: 它的 pod 网段和它自己的 ip(/32), 所以要按集群节点数的两倍来配
+	PodCIDR uint32 `json:"podCIDR"`
+	// ding_local, 本机的几种设备加上本机所有的 ipv4 地址
+	Local uint32 `json:"local"`
+	// ding_policy_pod, 本机最多多少个被网络策略隔离的 pod
+	PolicyPod uint32 `json:"policyPod"`
+	// ding_policy, 本机所有网络策略展开之后一共多少条规则
+	Policy uint32 `json:"policy"`
+	// ding_stats, 每个 pod 两个方向各一条
+	Stats uint32 `json:"stats"`
+	// ding_counters, 每个 endpoint 每种原因一条
+	Counters uint32 `json:"counters"`
+	// ding_svc, 所有 service 的端口数加上所有的后端数
+	Service uint32 `json:"service"`
+	// ding_ct, 经过 service 的连接每条两个方向各一条, ingress 被隔离的 pod 发出去的连接每条一条
+	Conntrack uint32 `json:"conntrack"`
+}
+
+// DefaultMapSizes 返回默认的大小, 和 maps.h 里写的 max_entries 一样
+func DefaultMapSizes() MapSizes {
+	return MapSizes{
+		Lxc:       LXC_MAX_ENTRIES,
+		PodCIDR:   POD_CIDR_MAX_ENTRIES,
+		Local:     LOCAL_MAX_ENTRIES,
+		PolicyPod: POLICY_POD_MAX_ENTRIES,
+		Policy:    POLICY_MAX_ENTRIES,
+		Stats:     STATS_MAX_ENTRIES,
+		Counters:  COUNTERS_MAX_ENTRIES,
+		Service:   SERVICE_MAX_ENTRIES,
+		Conntrack: CONNTRACK_MAX_ENTRIES,
+	}
+}
+
+var (
+	_mapSizesLock sync.Mutex
+	_mapSizes     = DefaultMapSizes()
+	// 扩容过或者换了布局的 map pin 的文件名, 用过这些 map 的 tc 程序要重新挂一遍
+	_resizedMaps []string
+)
+
+// InitMapSizes 设置各个 map 的大小, 一般是拿插件配置里的 bpfMapSizes 字段来调用, 要在创建 map 之前调
+func InitMapSizes(sizes *MapSizes) {
+	_mapSizesLock.Lock()
+	defer _mapSizesLock.Unlock()
+	_mapSizes = DefaultMapSizes()
+	if sizes == nil {
+		return
+	}
+	set := func(dst *uint32, src uint32) {
+		if src > 0 {
+			*dst = src
+		}
+	}
+	set(&_mapSizes.Lxc, sizes.Lxc)
+	set(&_mapSizes.PodCIDR, sizes.PodCIDR)
+	set(&_mapSizes.Local, sizes.Local)
+	set(&_mapSizes.PolicyPod, sizes.PolicyPod)
+	set(&_mapSizes.Policy, sizes.Policy)
+	set(&_mapSizes.Stats, sizes.Stats)
+	set(&_mapSizes.Counters, sizes.Counters)
+	set(&_mapSizes.Service, sizes.Service)
+	set(&_mapSizes.Conntrack, sizes.Conntrack)
+}
+
+// GetMapSizes 返回现在用的各个 map 的大小
+func GetMapSizes() MapSizes {
+	_mapSizesLock.Lock()
+	defer _mapSizesLock.Unlock()
+	return _mapSizes
+}
+
+// TakeResizedMaps 返回上次调用以来扩容过或者换了布局的 map pin 的文件名, 比如 ding_cidr, 不为空的话要把本机的 tc 程序都重新挂一遍
+// 已经挂上去的程序引用的还是换下来的旧 map, 往新 map 里写的东西它们看不到
+func TakeResizedMaps() []string {
+	_mapSizesLock.Lock()
+	defer _mapSizesLock.Unlock()
+	resized := _resizedMaps
+	_resizedMaps = nil
+	return resized
+}
+
+func isPerCPU(_type ebpf.MapType) bool {
+	return _type == ebpf.PerCPUHash || _type == ebpf.PerCPUArray || _type == ebpf.LRUCPUHash
+}
+
+// copyMap 把 from 里的条目都拷到 to 里, 两个 map 的 key 和 value 大小要一样
+// 都按字节拷, per cpu 的 map 每个 cpu 的值分别拷
+func copyMap(from, to *ebpf.Map) (int, error) {
+	count := 0
+	itor := from.Iterate()
+	var key []byte
+	if isPerCPU(from.Type()) {
+		var values [][]byte
+		for itor.Next(&key, &values) {
+			if err := to.Put(key, values); err != nil {
+				return count, err
+			}
+			count++
+		}
+	} else {
+		var value []byte
+		for itor.Next(&key, &value) {
+			if err := to.Put(key, value); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+	return count, itor.Err()
+}
+
+// resizeMapWithPin 创建一个 maxEntries 大小的新 map, 把 old 里的条目拷过去之后替换掉 pinPath 上 pin 的旧 map
+// 先 pin 到旁边再 rename 过去, 别的进程不会看到 pinPath 不存在的时候
+// 新 map 放不下旧的条目的话(比如缩小了)什么都不动, 返回错误
+func resizeMapWithPin(old *ebpf.Map, pinPath, name string, spec *ebpf.MapSpec) (*ebpf.Map, error) {
+	m, err := createMap(name, spec.Type, spec.KeySize, spec.ValueSize, spec.MaxEntries, spec.Flags)
+	if err != nil {
+		return nil, err
+	}
+	count, err := copyMap(old, m)
+	if err != nil {
+		m.Close()
+		return nil, fmt.Errorf("把 %s 里的条目拷到新的 map 里失败, 已经拷了 %d 个: %v", pinPath, count, err)
+	}
+	err = replaceMapWithPin(m, pinPath)
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+	logger.Info("map 换成了新的大小", "path", pinPath, "from", old.MaxEntries(), "to", spec.MaxEntries, "entries", count)
+	return m, nil
+}
+
+// replaceMapWithPin 用 m 替换掉 pinPath 上 pin 的 map, 并记下来让用过旧 map 的 tc 程序重新挂一遍
+// 先 pin 到旁边再 rename 过去, 别的进程不会看到 pinPath 不存在的时候
+func replaceMapWithPin(m *ebpf.Map, pinPath string) error {
+	// bpffs 里的名字不能带点
+	tmpPath := pinPath + "_resize"
+	os.Remove(tmpPath)
+	err := m.Pin(tmpPath)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpPath, pinPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	_mapSizesLock.Lock()
+	_resizedMaps = append(_resizedMaps, filepath.Base(pinPath))
+	_mapSizesLock.Unlock()
+	return nil
+}
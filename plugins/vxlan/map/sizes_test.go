@@ -0,0 +1,144 @@
+package bpf_map
+
+import (
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/stretchr/testify/assert"
+)
+
+// maps.h 里写的 max_entries 要和 go 这边的默认值一样
+func TestMapSizesMatchMapsH(t *testing.T) {
+	test := assert.New(t)
+	content, err := ioutil.ReadFile("../ebpf/maps.h")
+	test.Nil(err)
+	re := regexp.MustCompile(`(?s)struct \{[^}]*?__uint\(max_entries, (\d+)\);[^}]*\} (ding_\w+) __section_maps_btf;`)
+	found := map[string]uint32{}
+	for _, match := range re.FindAllStringSubmatch(string(content), -1) {
+		n, err := strconv.Atoi(match[1])
+		test.Nil(err)
+		found[match[2]] = uint32(n)
+	}
+
+	InitMapSizes(nil)
+	specs := MapSpecs()
+	test.Len(found, len(specs)-1)
+	for name, n := range found {
+		test.Equal(specs[name].MaxEntries, n, name)
+	}
+}
+
+func TestInitMapSizes(t *testing.T) {
+	test := assert.New(t)
+	defer InitMapSizes(nil)
+
+	InitMapSizes(&MapSizes{PodCIDR: 4096, Lxc: 0})
+	sizes := GetMapSizes()
+	test.Equal(uint32(4096), sizes.PodCIDR)
+	test.Equal(uint32(LXC_MAX_ENTRIES), sizes.Lxc)
+	test.Equal(uint32(4096), MapSpecs()[APP_PREFIX+"_cidr"].MaxEntries)
+	InitMapSizes(nil)
+	test.Equal(DefaultMapSizes(), GetMapSizes())
+}
+
+func TestResizeMap(t *testing.T) {
+	test := assert.New(t)
+	const pinPath = DEFAULT_MAP_ROOT + "/ding_test_resize"
+	os.Remove(pinPath)
+	defer os.Remove(pinPath)
+	TakeResizedMaps()
+
+	m, err := CreateOnceMapWithPin(pinPath, "test_resize", ebpf.Hash, 4, 4, 4, 0)
+	test.Nil(err)
+	for i := uint32(1); i <= 3; i++ {
+		test.Nil(m.Put(i, i*10))
+	}
+	m.Close()
+
+	// 大小一样的话还是原来那个
+	m, err = CreateOnceMapWithPin(pinPath, "test_resize", ebpf.Hash, 4, 4, 4, 0)
+	test.Nil(err)
+	test.Equal(uint32(4), m.MaxEntries())
+	m.Close()
+	test.Empty(TakeResizedMaps())
+
+	// 扩容之后条目都还在
+	m, err = CreateOnceMapWithPin(pinPath, "test_resize", ebpf.Hash, 4, 4, 16, 0)
+	test.Nil(err)
+	test.Equal(uint32(16), m.MaxEntries())
+	m.Close()
+	test.Equal([]string{"ding_test_resize"}, TakeResizedMaps())
+	m = GetMapByPinned(pinPath)
+	test.Equal(uint32(16), m.MaxEntries())
+	var value uint32
+	test.Nil(m.Lookup(uint32(2), &value))
+	test.Equal(uint32(20), value)
+	m.Close()
+
+	// 放不下的话不换
+	_, err = CreateOnceMapWithPin(pinPath, "test_resize", ebpf.Hash, 4, 4, 2, 0)
+	test.NotNil(err)
+	m = GetMapByPinned(pinPath)
+	test.Equal(uint32(16), m.MaxEntries())
+	m.Close()
+	test.Empty(TakeResizedMaps())
+
+	// key 或者 value 变了的话不能拷
+	_, err = CreateOnceMapWithPin(pinPath, "test_resize", ebpf.Hash, 4, 8, 16, 0)
+	test.NotNil(err)
+}
+
+func TestResizePerCPUMap(t *testing.T) {
+	test := assert.New(t)
+	const pinPath = DEFAULT_MAP_ROOT + "/ding_test_resize_percpu"
+	os.Remove(pinPath)
+	defer os.Remove(pinPath)
+	defer TakeResizedMaps()
+
+	keySize := uint32(8)
+	valueSize := uint32(24)
+	m, err := CreateOnceMapWithPin(pinPath, "test_percpu", ebpf.LRUCPUHash, keySize, valueSize, 8, 0)
+	test.Nil(err)
+	// 只给第一个 cpu 写, 剩下的都是 0
+	key := StatsMapKey{IP: 1, Direction: STATS_TX}
+	test.Nil(m.Put(key, []StatsMapValue{{Packets: 3, Bytes: 300}}))
+	m.Close()
+
+	m, err = CreateOnceMapWithPin(pinPath, "test_percpu", ebpf.LRUCPUHash, keySize, valueSize, 32, 0)
+	test.Nil(err)
+	defer m.Close()
+	test.Equal(uint32(32), m.MaxEntries())
+	got := []StatsMapValue{}
+	test.Nil(m.Lookup(key, &got))
+	test.Equal(StatsMapValue{Packets: 3, Bytes: 300}, sumStats(got))
+}
+
+func TestMigrateNodeLocalMap(t *testing.T) {
+	test := assert.New(t)
+	const pinPath = DEFAULT_MAP_ROOT + "/ding_test_local"
+	os.Remove(pinPath)
+	defer os.Remove(pinPath)
+	TakeResizedMaps()
+
+	// 以前的 key 里只有 Type
+	old, err := CreateOnceMapWithPin(pinPath, "test_local", ebpf.Hash, legacyLocalNodeMapKeySize, 4, 255, 0)
+	test.Nil(err)
+	test.Nil(old.Put(uint32(VXLAN_DEV), LocalNodeMapValue{IfIndex: 7}))
+
+	m, err := migrateNodeLocalMap(old, pinPath, "test_local", 8, 4, 255)
+	old.Close()
+	test.Nil(err)
+	m.Close()
+	test.Equal([]string{"ding_test_local"}, TakeResizedMaps())
+
+	m = GetMapByPinned(pinPath)
+	test.Equal(uint32(8), m.KeySize())
+	var value LocalNodeMapValue
+	test.Nil(m.Lookup(LocalNodeMapKey{Type: VXLAN_DEV}, &value))
+	test.Equal(uint32(7), value.IfIndex)
+	m.Close()
+}
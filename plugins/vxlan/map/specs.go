@@ -0,0 +1,64 @@
+package bpf_map
+
+import (
+	"fmt"
+	"strings"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+// MapSpecs 返回 tc 程序里每个 map 在 go 这边应该是什么样的, key 是 map 的名字, 也就是 pin 在 DEFAULT_MAP_PREFIX 下的文件名
+// 大小都是按 types.go 里的结构体算的, max_entries 按 GetMapSizes, 和各个 Create*Map 里的参数一致
+func MapSpecs() map[string]*ebpf.MapSpec {
+	sizes := GetMapSizes()
+	spec := func(_type ebpf.MapType, keySize, valueSize uintptr, maxEntries, flags uint32) *ebpf.MapSpec {
+		return &ebpf.MapSpec{
+			Type:       _type,
+			KeySize:    uint32(keySize),
+			ValueSize:  uint32(valueSize),
+			MaxEntries: maxEntries,
+			Flags:      flags,
+		}
+	}
+	return map[string]*ebpf.MapSpec{
+		APP_PREFIX + "_lxc":        spec(ebpf.Hash, unsafe.Sizeof(EndpointMapKey{}), unsafe.Sizeof(EndpointMapInfo{}), sizes.Lxc, 0),
+		APP_PREFIX + "_lxc_dev":    spec(ebpf.Hash, unsafe.Sizeof(LxcDevMapKey{}), unsafe.Sizeof(LxcDevMapValue{}), sizes.Lxc, 0),
+		APP_PREFIX + "_cidr":       spec(ebpf.LPMTrie, unsafe.Sizeof(PodCIDRMapKey{}), unsafe.Sizeof(PodCIDRMapValue{}), sizes.PodCIDR, unix.BPF_F_NO_PREALLOC),
+		APP_PREFIX + "_local":      spec(ebpf.Hash, unsafe.Sizeof(LocalNodeMapKey{}), unsafe.Sizeof(LocalNodeMapValue{}), sizes.Local, 0),
+		APP_PREFIX + "_policy_pod": spec(ebpf.Hash, unsafe.Sizeof(PolicyPodMapKey{}), unsafe.Sizeof(PolicyPodMapValue{}), sizes.PolicyPod, 0),
+		APP_PREFIX + "_policy":     spec(ebpf.LPMTrie, unsafe.Sizeof(PolicyMapKey{}), unsafe.Sizeof(PolicyMapValue{}), sizes.Policy, unix.BPF_F_NO_PREALLOC),
+		APP_PREFIX + "_stats":      spec(ebpf.LRUCPUHash, unsafe.Sizeof(StatsMapKey{}), unsafe.Sizeof(StatsMapValue{}), sizes.Stats, 0),
+		APP_PREFIX + "_counters":   spec(ebpf.LRUCPUHash, unsafe.Sizeof(CounterMapKey{}), unsafe.Sizeof(CounterMapValue{}), sizes.Counters, 0),
+		APP_PREFIX + "_svc":        spec(ebpf.Hash, unsafe.Sizeof(ServiceMapKey{}), unsafe.Sizeof(ServiceMapValue{}), sizes.Service, 0),
+		APP_PREFIX + "_ct":         spec(ebpf.LRUHash, unsafe.Sizeof(ConntrackMapKey{}), unsafe.Sizeof(ConntrackMapValue{}), sizes.Conntrack, 0),
+		// perf event array 的 max_entries 是 0, 创建的时候才换成 cpu 的个数
+		APP_PREFIX + "_events":   spec(ebpf.PerfEventArray, 4, 4, 0, 0),
+		APP_PREFIX + "_flow_cfg": spec(ebpf.Array, 4, unsafe.Sizeof(FlowConfigMapValue{}), 1, 0),
+	}
+}
+
+// CheckMapSpec 检查 .o 里的一个 map 和 MapSpecs 里的定义是不是对得上, 对不上的话用这个 .o 读写 map 会出错
+// 只检查 APP_PREFIX 开头的 map, .rodata 这种编译器生成的不管
+// max_entries 不检查, 它是按配置来的, .o 里写的只是默认值, 加载的时候会换成 MapSpecs 里的
+func CheckMapSpec(spec *ebpf.MapSpec) error {
+	expected, ok := MapSpecs()[spec.Name]
+	if !ok {
+		if strings.HasPrefix(spec.Name, APP_PREFIX+"_") {
+			return fmt.Errorf("map %s 在 types.go 里没有对应的定义", spec.Name)
+		}
+		return nil
+	}
+	switch {
+	case spec.Type != expected.Type:
+		return fmt.Errorf("map %s 的类型是 %v, types.go 里是 %v", spec.Name, spec.Type, expected.Type)
+	case spec.KeySize != expected.KeySize:
+		return fmt.Errorf("map %s 的 key 是 %d 个字节, types.go 里是 %d 个字节", spec.Name, spec.KeySize, expected.KeySize)
+	case spec.ValueSize != expected.ValueSize:
+		return fmt.Errorf("map %s 的 value 是 %d 个字节, types.go 里是 %d 个字节", spec.Name, spec.ValueSize, expected.ValueSize)
+	case spec.Flags != expected.Flags:
+		return fmt.Errorf("map %s 的 flags 是 0x%x, go 这边是 0x%x", spec.Name, spec.Flags, expected.Flags)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package bpf_map
+
+import (
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckMapSpec(t *testing.T) {
+	test := assert.New(t)
+
+	for name, spec := range MapSpecs() {
+		spec.Name = name
+		test.Nil(CheckMapSpec(spec), name)
+	}
+	test.Nil(CheckMapSpec(&ebpf.MapSpec{Name: ".rodata", Type: ebpf.Array}))
+	test.NotNil(CheckMapSpec(&ebpf.MapSpec{Name: APP_PREFIX + "_unknown", Type: ebpf.Hash}))
+
+	spec := MapSpecs()[APP_PREFIX+"_policy"]
+	spec.Name = APP_PREFIX + "_policy"
+	spec.Flags = 0
+	test.NotNil(CheckMapSpec(spec))
+	spec = MapSpecs()[APP_PREFIX+"_stats"]
+	spec.Name = APP_PREFIX + "_stats"
+	spec.ValueSize = 16
+	test.NotNil(CheckMapSpec(spec))
+	test.Equal(uint32(24), MapSpecs()[APP_PREFIX+"_stats"].ValueSize)
+
+	// max_entries 是按配置来的, 和 .o 里的不一样也没关系
+	spec = MapSpecs()[APP_PREFIX+"_lxc"]
+	spec.Name = APP_PREFIX + "_lxc"
+	spec.MaxEntries = 1
+	test.Nil(CheckMapSpec(spec))
+}
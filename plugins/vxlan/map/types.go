@@ -7,10 +7,13 @@ type LOCAL_DEV_TYPE uint32
 const (
 	VXLAN_DEV LOCAL_DEV_TYPE = 1
 	VETH_DEV  LOCAL_DEV_TYPE = 2
+	HOST_ADDR LOCAL_DEV_TYPE = 3 // 本机的 ipv4 地址, 每个地址一条, IfIndex 是地址所在的网卡
 )
 
 type LocalNodeMapKey struct {
 	Type LOCAL_DEV_TYPE
+	// 只有 HOST_ADDR 用, 和策略的 map 一样按网络字节序存, 其他类型是 0
+	IP [4]byte
 }
 
 type LocalNodeMapValue struct {
@@ -32,13 +35,191 @@ type EndpointMapInfo struct {
 	NodeMAC [8]byte
 }
 
-/********* 存整个集群的 pod ip 以及对应的 node ip *********/
-/********* pin path: POD_MAP_DEFAULT_PATH *********/
-/********* 起一条常驻进程监听 etcd 以更新该 map *********/
-type PodNodeMapKey struct {
-	IP uint32
+/********* 存本机每个 pod 的 veth 留在 host 上那头的 mac *********/
+/********* pin path: LXC_DEV_MAP_DEFAULT_PATH *********/
+/********* tc 程序代答 pod 的 arp 和 ipv6 邻居请求的时候用 *********/
+type LxcDevMapKey struct {
+	IfIndex uint32
+}
+
+type LxcDevMapValue struct {
+	MAC [8]byte
 }
 
-type PodNodeMapValue struct {
+/********* 存集群里其他节点分到的 pod 网段以及对应的 node ip *********/
+/********* pin path: POD_CIDR_MAP_DEFAULT_PATH *********/
+/********* 这是一个 LPM trie, 条目数跟着节点数走, pod 的增删不用动它 *********/
+/********* 网段 IP 按网络字节序存, node ip 还是主机字节序 *********/
+type PodCIDRMapKey struct {
+	Prefixlen uint32
+	IP        [4]byte
+}
+
+type PodCIDRMapValue struct {
 	IP uint32
 }
+
+/********* 网络策略: 本机哪些 pod 在哪个方向上是被隔离的 *********/
+/********* pin path: POLICY_POD_MAP_DEFAULT_PATH *********/
+/********* 和上面几个 map 不一样, 策略相关的 map 里的 ip 都是按网络字节序直接存的字节 *********/
+type PolicyPodMapKey struct {
+	IP [4]byte
+}
+
+type PolicyPodMapValue struct {
+	Ingress uint8
+	Egress  uint8
+	Pad     [2]uint8
+}
+
+/********* 网络策略: 每个被隔离的 pod 放行的对端网段和端口 *********/
+/********* pin path: POLICY_MAP_DEFAULT_PATH *********/
+/********* 这是一个 LPM trie, Prefixlen 之后的字段按顺序参与最长前缀匹配 *********/
+/********* 除了 PeerIP 以外的字段都是要精确匹配的, 所以 Prefixlen 至少是 POLICY_PREFIX_BASE *********/
+type PolicyMapKey struct {
+	Prefixlen uint32
+	PodIP     [4]byte
+	Direction uint8
+	Protocol  uint8
+	Port      [2]byte // 网络字节序, 0 表示所有端口
+	PeerIP    [4]byte
+}
+
+type POLICY_ACTION uint8
+
+const (
+	POLICY_DENY  POLICY_ACTION = 0
+	POLICY_ALLOW POLICY_ACTION = 1
+)
+
+type PolicyMapValue struct {
+	Action POLICY_ACTION
+	Pad    [3]uint8
+}
+
+/********* service 的负载均衡: ClusterIP:端口 对应的后端 *********/
+/********* pin path: SERVICE_MAP_DEFAULT_PATH *********/
+/********* ip 和端口和策略的 map 一样是按网络字节序存的字节 *********/
+/********* Slot 为 0 的条目只用 Count 记后端的个数, 1 到 Count 的条目是每个后端 *********/
+type ServiceMapKey struct {
+	IP       [4]byte
+	Port     [2]byte
+	Slot     uint16
+	Protocol uint8
+	Pad      [3]uint8
+}
+
+type ServiceMapValue struct {
+	IP    [4]byte
+	Port  [2]byte
+	Count uint16
+}
+
+/********* 访问 service 的连接, 由 tc 的程序写, LRU 自己淘汰 *********/
+/********* pin path: CONNTRACK_MAP_DEFAULT_PATH *********/
+/********* 去的方向存选中的后端, 回的方向存要改回去的 ClusterIP:端口, 字节序和 ding_svc 一样 *********/
+type CT_DIRECTION uint8
+
+const (
+	CT_ORIGINAL CT_DIRECTION = 1 // pod 发给 ClusterIP 的
+	CT_REPLY    CT_DIRECTION = 2 // 后端回给 pod 的
+	CT_POLICY   CT_DIRECTION = 3 // ingress 被隔离的 pod 发出去的连接, 网络策略放行回包用, value 是空的
+)
+
+type ConntrackMapKey struct {
+	SrcIP     [4]byte
+	DstIP     [4]byte
+	SrcPort   [2]byte
+	DstPort   [2]byte
+	Protocol  uint8
+	Direction CT_DIRECTION
+	Pad       [2]uint8
+}
+
+type ConntrackMapValue struct {
+	IP   [4]byte
+	Port [2]byte
+	Pad  [2]uint8
+}
+
+/********* 每个 pod 的收发包统计, 由 tc 的程序更新 *********/
+/********* pin path: STATS_MAP_DEFAULT_PATH *********/
+/********* 是 per cpu 的 map, 读出来是每个 cpu 一个 value, 需要加起来 *********/
+type STATS_DIRECTION uint8
+
+const (
+	STATS_TX STATS_DIRECTION = 1 // pod 发出去的
+	STATS_RX STATS_DIRECTION = 2 // 发给 pod 的
+)
+
+type StatsMapKey struct {
+	IP        uint32
+	Direction STATS_DIRECTION
+	Pad       [3]uint8
+}
+
+type StatsMapValue struct {
+	Packets uint64
+	Bytes   uint64
+	Drops   uint64
+}
+
+/********* 数据面每个包最后是怎么处理的, 由 tc 的程序更新 *********/
+/********* pin path: COUNTERS_MAP_DEFAULT_PATH *********/
+/********* IP 在 veth 上是源 pod, 在 vxlan 上是目标 pod, 不是 ip 包的话是 0 *********/
+type DATAPATH_REASON uint8
+
+const (
+	REASON_REDIRECT_LOCAL  DATAPATH_REASON = 1 // 重定向给了本机的 pod
+	REASON_REDIRECT_VXLAN  DATAPATH_REASON = 2 // 重定向给了 vxlan 设备
+	REASON_TUNNEL_SET_FAIL DATAPATH_REASON = 3 // 设置 vxlan 隧道失败, 丢掉了
+	REASON_MISS            DATAPATH_REASON = 4 // 在 map 里没找到, 交给内核协议栈
+	REASON_NON_IP          DATAPATH_REASON = 5 // 不是 ipv4 的包, 也不是要代答的 arp 和邻居请求, 交给内核协议栈
+	REASON_POLICY_DENY     DATAPATH_REASON = 6 // 被网络策略丢掉了
+	REASON_PROXY_REPLY     DATAPATH_REASON = 7 // 代答了 pod 的 arp 或者 ipv6 邻居请求
+	REASON_NO_BACKEND      DATAPATH_REASON = 8 // 访问的 service 没有可用的后端, 丢掉了
+	REASON_TO_HOST         DATAPATH_REASON = 9 // 目标是本机自己的地址, 交给内核协议栈
+)
+
+type CounterMapKey struct {
+	IP     uint32
+	Reason DATAPATH_REASON
+	Pad    [3]uint8
+}
+
+type CounterMapValue struct {
+	Packets uint64
+	Bytes   uint64
+}
+
+/********* tc 的程序采样出来的流量事件 *********/
+/********* pin path: EVENTS_MAP_DEFAULT_PATH, 是 perf event array, 用 perf.Reader 读 *********/
+/********* ip 和端口都是主机字节序, RemoteNode 不跨节点的话是 0 *********/
+type FLOW_POINT uint8
+
+const (
+	FLOW_POINT_VETH_INGRESS  FLOW_POINT = 1 // pod 的 veth 上, 也就是 pod 发出来的包
+	FLOW_POINT_VXLAN_INGRESS FLOW_POINT = 2 // vxlan 设备收到的其他节点发过来的包
+	FLOW_POINT_VXLAN_EGRESS  FLOW_POINT = 3 // 要从 vxlan 设备发到其他节点的包
+)
+
+type FlowEvent struct {
+	SrcIP      uint32
+	DstIP      uint32
+	RemoteNode uint32
+	Ifindex    uint32
+	Len        uint32
+	SrcPort    uint16
+	DstPort    uint16
+	Proto      uint8
+	Verdict    DATAPATH_REASON
+	Point      FLOW_POINT
+	Pad        uint8
+}
+
+/********* 流量事件的配置, 只有一个条目, key 固定是 0 *********/
+/********* pin path: FLOW_CONFIG_MAP_DEFAULT_PATH *********/
+type FlowConfigMapValue struct {
+	// 0 表示不导出, 1 表示每个包都导出, N 表示平均 N 个包导出一个, 丢掉的包不抽样
+	SampleRate uint32
+}
@@ -0,0 +1,189 @@
+package service
+
+import (
+	bpf_map "cni-demo/plugins/vxlan/map"
+	"cni-demo/plugins/vxlan/tc"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// 协议号, 和 ip 头里的 protocol 字段一致
+var protocolNumbers = map[string]uint8{
+	PROTOCOL_TCP: 6,
+	PROTOCOL_UDP: 17,
+}
+
+// ipv4Bytes 把 ip 转成网络字节序的 4 个字节
+func ipv4Bytes(s string) ([4]byte, error) {
+	var res [4]byte
+	ip := net.ParseIP(s).To4()
+	if ip == nil {
+		return res, fmt.Errorf("%q is not an ipv4 address", s)
+	}
+	copy(res[:], ip)
+	return res, nil
+}
+
+// portBytes 把端口转成网络字节序的 2 个字节
+func portBytes(port uint16) [2]byte {
+	var res [2]byte
+	binary.BigEndian.PutUint16(res[:], port)
+	return res
+}
+
+// buildBPFEntries 把编译好的 ServicePort 转成 ding_svc 里的内容
+// 每个 ServicePort 在 slot 0 记后端的个数, 后端按顺序放在 1 到 N 的 slot 上
+func buildBPFEntries(services []*ServicePort) (map[bpf_map.ServiceMapKey]bpf_map.ServiceMapValue, error) {
+	entries := map[bpf_map.ServiceMapKey]bpf_map.ServiceMapValue{}
+	for _, sp := range services {
+		ip, err := ipv4Bytes(sp.IP)
+		if err != nil {
+			return nil, err
+		}
+		proto, ok := protocolNumbers[sp.Protocol]
+		if !ok {
+			return nil, fmt.Errorf("unsupported protocol %q", sp.Protocol)
+		}
+		key := bpf_map.ServiceMapKey{IP: ip, Port: portBytes(sp.Port), Protocol: proto}
+		entries[key] = bpf_map.ServiceMapValue{Count: uint16(len(sp.Backends))}
+		for idx, backend := range sp.Backends {
+			backendIP, err := ipv4Bytes(backend.IP)
+			if err != nil {
+				return nil, err
+			}
+			key.Slot = uint16(idx + 1)
+			entries[key] = bpf_map.ServiceMapValue{IP: backendIP, Port: portBytes(backend.Port)}
+		}
+	}
+	return entries, nil
+}
+
+// staleConntrackKeys 找出 ding_ct 中选中的后端已经不在了的连接, 两个方向的 key 都返回
+// tcp 的连接后端没了自然就断了, 但是 udp 的五元组不变的话会一直发给那个已经不在了的后端, 比如访问 dns 的
+func staleConntrackKeys(
+	conntrack map[bpf_map.ConntrackMapKey]bpf_map.ConntrackMapValue,
+	entries map[bpf_map.ServiceMapKey]bpf_map.ServiceMapValue,
+) []bpf_map.ConntrackMapKey {
+	type backend struct {
+		svc  bpf_map.ServiceMapKey
+		ip   [4]byte
+		port [2]byte
+	}
+	alive := map[backend]bool{}
+	for key, value := range entries {
+		if key.Slot == 0 {
+			continue
+		}
+		key.Slot = 0
+		alive[backend{svc: key, ip: value.IP, port: value.Port}] = true
+	}
+
+	var res []bpf_map.ConntrackMapKey
+	for key, value := range conntrack {
+		if key.Direction != bpf_map.CT_ORIGINAL {
+			continue
+		}
+		svc := bpf_map.ServiceMapKey{IP: key.DstIP, Port: key.DstPort, Protocol: key.Protocol}
+		if alive[backend{svc: svc, ip: value.IP, port: value.Port}] {
+			continue
+		}
+		res = append(res, key, bpf_map.ConntrackMapKey{
+			SrcIP:     value.IP,
+			DstIP:     key.SrcIP,
+			SrcPort:   value.Port,
+			DstPort:   key.SrcPort,
+			Protocol:  key.Protocol,
+			Direction: bpf_map.CT_REPLY,
+		})
+	}
+	return res
+}
+
+// BPFSyncer 把编译好的 service 写到 ding_svc 里, 给 vxlan 模式用
+// veth_ingress.c 会在转发之前查这个 map 做 DNAT, 见 lb.h
+type BPFSyncer struct {
+	mm *bpf_map.MapsManager
+}
+
+func NewBPFSyncer() (*BPFSyncer, error) {
+	mm, err := bpf_map.GetMapsManager()
+	if err != nil {
+		return nil, err
+	}
+	return &BPFSyncer{mm: mm}, nil
+}
+
+// Sync 把 service 全量同步到 ding_svc 里, 再把后端已经不在了的连接从 ding_ct 里删掉
+// 先写后端再写 slot 0 的个数, 删的时候先删 slot 0, 保证数据面按个数选 slot 的时候后端都在
+func (s *BPFSyncer) Sync(services []*ServicePort) error {
+	entries, err := buildBPFEntries(services)
+	if err != nil {
+		return err
+	}
+	if _, err = s.mm.CreateServiceMap(); err != nil {
+		return err
+	}
+	if _, err = s.mm.CreateConntrackMap(); err != nil {
+		return err
+	}
+	if err = tc.ReattachIfResized(); err != nil {
+		return err
+	}
+
+	prev, err := s.mm.ServiceMapEntries()
+	if err != nil {
+		return err
+	}
+	heads := []bpf_map.ServiceMapKey{}
+	for key, value := range entries {
+		if key.Slot == 0 {
+			heads = append(heads, key)
+			continue
+		}
+		if old, ok := prev[key]; ok && old == value {
+			continue
+		}
+		if err = s.mm.SetServiceMap(key, value); err != nil {
+			return err
+		}
+	}
+	for _, key := range heads {
+		if old, ok := prev[key]; ok && old == entries[key] {
+			continue
+		}
+		if err = s.mm.SetServiceMap(key, entries[key]); err != nil {
+			return err
+		}
+	}
+
+	dels := []bpf_map.ServiceMapKey{}
+	for key := range prev {
+		if _, ok := entries[key]; !ok {
+			dels = append(dels, key)
+		}
+	}
+	sort.Slice(dels, func(i, j int) bool { return dels[i].Slot < dels[j].Slot })
+	for _, key := range dels {
+		if err = s.mm.DelServiceMap(key); err != nil {
+			return err
+		}
+	}
+
+	conntrack, err := s.mm.ConntrackMapEntries()
+	if err != nil {
+		return err
+	}
+	stale := staleConntrackKeys(conntrack, entries)
+	for _, key := range stale {
+		// 数据面随时可能把条目换掉或者 LRU 淘汰掉, 删不掉的不管
+		s.mm.DelConntrackMap(key)
+	}
+	return nil
+}
+
+// Cleanup 清空 ding_svc, 也就是不再做负载均衡
+func (s *BPFSyncer) Cleanup() error {
+	return s.Sync(nil)
+}
@@ -0,0 +1,121 @@
+package service
+
+import (
+	"net"
+	"sort"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1beta1 "k8s.io/api/discovery/v1beta1"
+)
+
+// hasClusterIP 判断 service 需不需要做负载均衡, headless 和 ExternalName 的 service 都没有 ClusterIP
+func hasClusterIP(svc *v1.Service) bool {
+	if svc.Spec.Type == v1.ServiceTypeExternalName {
+		return false
+	}
+	ip := net.ParseIP(svc.Spec.ClusterIP)
+	return ip != nil && ip.To4() != nil
+}
+
+// portName 返回 EndpointSlice 里端口的名字, 没名字的是空字符串
+func portName(name *string) string {
+	if name == nil {
+		return ""
+	}
+	return *name
+}
+
+// endpointReady 判断一个 endpoint 能不能接流量, conditions 里没写 ready 的按 ready 算
+func endpointReady(ep *discoveryv1beta1.Endpoint) bool {
+	return ep.Conditions.Ready == nil || *ep.Conditions.Ready
+}
+
+// Compile 把集群中的 Service 和 EndpointSlice 编译成每个 ClusterIP:端口 以及它的后端
+// EndpointSlice 按 kubernetes.io/service-name 这个 label 对应到 service, service 的端口和 slice 的端口按名字和协议对应
+// targetPort 已经由 EndpointSlice 的控制器换成了 pod 上真正的端口, 这里不用再去看 pod
+// 只支持 ipv4 的 tcp 和 udp, 没有后端的 ServicePort 也会返回, 数据面会把访问它的包丢掉
+func Compile(services []v1.Service, slices []discoveryv1beta1.EndpointSlice) []*ServicePort {
+	type svcName struct {
+		namespace string
+		name      string
+	}
+	byService := map[svcName][]*discoveryv1beta1.EndpointSlice{}
+	for i := range slices {
+		slice := &slices[i]
+		if slice.AddressType != discoveryv1beta1.AddressTypeIPv4 {
+			continue
+		}
+		name := slice.Labels[discoveryv1beta1.LabelServiceName]
+		if name == "" {
+			continue
+		}
+		key := svcName{namespace: slice.Namespace, name: name}
+		byService[key] = append(byService[key], slice)
+	}
+
+	var res []*ServicePort
+	for i := range services {
+		svc := &services[i]
+		if !hasClusterIP(svc) {
+			continue
+		}
+		for _, port := range svc.Spec.Ports {
+			protocol := string(port.Protocol)
+			if protocol == "" {
+				protocol = PROTOCOL_TCP
+			}
+			if protocol != PROTOCOL_TCP && protocol != PROTOCOL_UDP {
+				continue
+			}
+			sp := &ServicePort{
+				Namespace: svc.Namespace,
+				Name:      svc.Name,
+				IP:        svc.Spec.ClusterIP,
+				Port:      uint16(port.Port),
+				Protocol:  protocol,
+			}
+			seen := map[Backend]bool{}
+			for _, slice := range byService[svcName{namespace: svc.Namespace, name: svc.Name}] {
+				for _, p := range slice.Ports {
+					if portName(p.Name) != port.Name || p.Port == nil {
+						continue
+					}
+					if p.Protocol != nil && string(*p.Protocol) != protocol {
+						continue
+					}
+					for j := range slice.Endpoints {
+						ep := &slice.Endpoints[j]
+						if !endpointReady(ep) {
+							continue
+						}
+						for _, addr := range ep.Addresses {
+							backend := Backend{IP: addr, Port: uint16(*p.Port)}
+							if !seen[backend] {
+								seen[backend] = true
+								sp.Backends = append(sp.Backends, backend)
+							}
+						}
+					}
+				}
+			}
+			// 排好序之后后端没变的话 slot 也不会变, 同步的时候不用动 map
+			sort.Slice(sp.Backends, func(i, j int) bool {
+				if sp.Backends[i].IP != sp.Backends[j].IP {
+					return sp.Backends[i].IP < sp.Backends[j].IP
+				}
+				return sp.Backends[i].Port < sp.Backends[j].Port
+			})
+			res = append(res, sp)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].IP != res[j].IP {
+			return res[i].IP < res[j].IP
+		}
+		if res[i].Port != res[j].Port {
+			return res[i].Port < res[j].Port
+		}
+		return res[i].Protocol < res[j].Protocol
+	})
+	return res
+}
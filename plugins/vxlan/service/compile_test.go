@@ -0,0 +1,143 @@
+package service
+
+import (
+	bpf_map "cni-demo/plugins/vxlan/map"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1beta1 "k8s.io/api/discovery/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newService(namespace, name, clusterIP string, ports ...v1.ServicePort) v1.Service {
+	return v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec:       v1.ServiceSpec{ClusterIP: clusterIP, Ports: ports},
+	}
+}
+
+func newSlice(namespace, service string, ports []discoveryv1beta1.EndpointPort, endpoints ...discoveryv1beta1.Endpoint) discoveryv1beta1.EndpointSlice {
+	return discoveryv1beta1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      service + "-abcde",
+			Labels:    map[string]string{discoveryv1beta1.LabelServiceName: service},
+		},
+		AddressType: discoveryv1beta1.AddressTypeIPv4,
+		Ports:       ports,
+		Endpoints:   endpoints,
+	}
+}
+
+func slicePort(name string, protocol v1.Protocol, port int32) discoveryv1beta1.EndpointPort {
+	return discoveryv1beta1.EndpointPort{Name: &name, Protocol: &protocol, Port: &port}
+}
+
+func endpoint(ready bool, addresses ...string) discoveryv1beta1.Endpoint {
+	return discoveryv1beta1.Endpoint{
+		Addresses:  addresses,
+		Conditions: discoveryv1beta1.EndpointConditions{Ready: &ready},
+	}
+}
+
+func TestCompile(t *testing.T) {
+	test := assert.New(t)
+
+	services := []v1.Service{
+		newService("kube-system", "kube-dns", "10.96.0.10",
+			v1.ServicePort{Name: "dns", Protocol: v1.ProtocolUDP, Port: 53},
+			v1.ServicePort{Name: "dns-tcp", Protocol: v1.ProtocolTCP, Port: 53},
+		),
+		newService("default", "web", "10.96.1.1", v1.ServicePort{Port: 80}),
+		newService("default", "empty", "10.96.1.2", v1.ServicePort{Port: 80}),
+		// headless 的和 ExternalName 的不做负载均衡
+		newService("default", "headless", "None", v1.ServicePort{Port: 80}),
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "external"},
+			Spec:       v1.ServiceSpec{Type: v1.ServiceTypeExternalName, ExternalName: "example.com"},
+		},
+	}
+	slices := []discoveryv1beta1.EndpointSlice{
+		newSlice("kube-system", "kube-dns",
+			[]discoveryv1beta1.EndpointPort{slicePort("dns", v1.ProtocolUDP, 53), slicePort("dns-tcp", v1.ProtocolTCP, 53)},
+			endpoint(true, "10.244.2.3"),
+			endpoint(true, "10.244.1.3"),
+			// 没 ready 的不要
+			endpoint(false, "10.244.3.3"),
+		),
+		// targetPort 和 service 的端口不一样, 同一个 service 有两个 slice
+		newSlice("default", "web", []discoveryv1beta1.EndpointPort{slicePort("", v1.ProtocolTCP, 8080)}, endpoint(true, "10.244.1.5")),
+		newSlice("default", "web", []discoveryv1beta1.EndpointPort{slicePort("", v1.ProtocolTCP, 8080)}, endpoint(true, "10.244.2.5", "10.244.1.5")),
+		// 别的 namespace 里同名的 service 的不要
+		newSlice("other", "web", []discoveryv1beta1.EndpointPort{slicePort("", v1.ProtocolTCP, 8080)}, endpoint(true, "10.244.9.9")),
+	}
+
+	res := Compile(services, slices)
+	test.Len(res, 4)
+
+	test.Equal(&ServicePort{
+		Namespace: "kube-system", Name: "kube-dns", IP: "10.96.0.10", Port: 53, Protocol: PROTOCOL_TCP,
+		Backends: []Backend{{IP: "10.244.1.3", Port: 53}, {IP: "10.244.2.3", Port: 53}},
+	}, res[0])
+	test.Equal(PROTOCOL_UDP, res[1].Protocol)
+	test.Len(res[1].Backends, 2)
+
+	test.Equal(&ServicePort{
+		Namespace: "default", Name: "web", IP: "10.96.1.1", Port: 80, Protocol: PROTOCOL_TCP,
+		Backends: []Backend{{IP: "10.244.1.5", Port: 8080}, {IP: "10.244.2.5", Port: 8080}},
+	}, res[2])
+
+	// 没有后端的也要有, 数据面会把访问它的包丢掉
+	test.Equal("empty", res[3].Name)
+	test.Empty(res[3].Backends)
+}
+
+func TestBuildBPFEntries(t *testing.T) {
+	test := assert.New(t)
+
+	entries, err := buildBPFEntries([]*ServicePort{{
+		IP: "10.96.0.10", Port: 53, Protocol: PROTOCOL_UDP,
+		Backends: []Backend{{IP: "10.244.1.3", Port: 53}, {IP: "10.244.2.3", Port: 5353}},
+	}})
+	test.Nil(err)
+	test.Len(entries, 3)
+
+	head := bpf_map.ServiceMapKey{IP: [4]byte{10, 96, 0, 10}, Port: [2]byte{0, 53}, Protocol: 17}
+	test.Equal(bpf_map.ServiceMapValue{Count: 2}, entries[head])
+	head.Slot = 2
+	test.Equal(bpf_map.ServiceMapValue{IP: [4]byte{10, 244, 2, 3}, Port: [2]byte{0x14, 0xe9}}, entries[head])
+
+	_, err = buildBPFEntries([]*ServicePort{{IP: "fd00::1", Port: 53, Protocol: PROTOCOL_UDP}})
+	test.NotNil(err)
+}
+
+func TestStaleConntrackKeys(t *testing.T) {
+	test := assert.New(t)
+
+	entries, err := buildBPFEntries([]*ServicePort{{
+		IP: "10.96.0.10", Port: 53, Protocol: PROTOCOL_UDP,
+		Backends: []Backend{{IP: "10.244.1.3", Port: 53}},
+	}})
+	test.Nil(err)
+
+	alive := bpf_map.ConntrackMapKey{
+		SrcIP: [4]byte{10, 244, 1, 9}, DstIP: [4]byte{10, 96, 0, 10},
+		SrcPort: [2]byte{0x9c, 0x40}, DstPort: [2]byte{0, 53},
+		Protocol: 17, Direction: bpf_map.CT_ORIGINAL,
+	}
+	gone := alive
+	gone.SrcPort = [2]byte{0x9c, 0x41}
+	reply := bpf_map.ConntrackMapKey{
+		SrcIP: [4]byte{10, 244, 2, 3}, DstIP: [4]byte{10, 244, 1, 9},
+		SrcPort: [2]byte{0, 53}, DstPort: [2]byte{0x9c, 0x41},
+		Protocol: 17, Direction: bpf_map.CT_REPLY,
+	}
+	conntrack := map[bpf_map.ConntrackMapKey]bpf_map.ConntrackMapValue{
+		alive: {IP: [4]byte{10, 244, 1, 3}, Port: [2]byte{0, 53}},
+		// 10.244.2.3 已经不是后端了
+		gone:  {IP: [4]byte{10, 244, 2, 3}, Port: [2]byte{0, 53}},
+		reply: {IP: [4]byte{10, 96, 0, 10}, Port: [2]byte{0, 53}},
+	}
+	test.ElementsMatch([]bpf_map.ConntrackMapKey{gone, reply}, staleConntrackKeys(conntrack, entries))
+}
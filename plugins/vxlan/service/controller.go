@@ -0,0 +1,192 @@
+package service
+
+import (
+	"cni-demo/client"
+	"cni-demo/tools/logger"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1beta1 "k8s.io/api/discovery/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// 同步失败之后隔多久重试
+	retryInterval = 5 * time.Second
+)
+
+// Controller 负责 list + watch Service 和 EndpointSlice
+// 两种资源各用一个 client.Reflector 维护本地的缓存, 有变化的时候从缓存全量地重新编译和同步, 不用每次都重新 list
+type Controller struct {
+	k8s    *client.LightK8sClient
+	syncer *BPFSyncer
+	resync chan struct{}
+
+	lock     sync.Mutex
+	services map[string]v1.Service
+	slices   map[string]discoveryv1beta1.EndpointSlice
+	// 两种资源都 list 过一遍之后才开始同步, 不然只看到一半的资源会把 map 里的后端清掉
+	servicesSynced bool
+	slicesSynced   bool
+}
+
+func NewController(k8s *client.LightK8sClient, syncer *BPFSyncer) *Controller {
+	return &Controller{
+		k8s:      k8s,
+		syncer:   syncer,
+		resync:   make(chan struct{}, 1),
+		services: map[string]v1.Service{},
+		slices:   map[string]discoveryv1beta1.EndpointSlice{},
+	}
+}
+
+// trigger 触发一次同步, 已经有一次在排队的话就不用再排了
+func (c *Controller) trigger() {
+	select {
+	case c.resync <- struct{}{}:
+	default:
+	}
+}
+
+func objectKey(meta metav1.ObjectMeta) string {
+	return meta.Namespace + "/" + meta.Name
+}
+
+// replaceServices 用 list 到的 Service 替换掉缓存
+func (c *Controller) replaceServices(services *v1.ServiceList) {
+	c.lock.Lock()
+	c.services = map[string]v1.Service{}
+	for _, svc := range services.Items {
+		c.services[objectKey(svc.ObjectMeta)] = svc
+	}
+	c.servicesSynced = true
+	c.lock.Unlock()
+	c.trigger()
+}
+
+// replaceSlices 用 list 到的 EndpointSlice 替换掉缓存
+func (c *Controller) replaceSlices(slices *discoveryv1beta1.EndpointSliceList) {
+	c.lock.Lock()
+	c.slices = map[string]discoveryv1beta1.EndpointSlice{}
+	for _, slice := range slices.Items {
+		c.slices[objectKey(slice.ObjectMeta)] = slice
+	}
+	c.slicesSynced = true
+	c.lock.Unlock()
+	c.trigger()
+}
+
+// handleService 把一个 watch 到的 Service 事件更新到缓存里
+func (c *Controller) handleService(event *client.WatchEvent) {
+	svc := v1.Service{}
+	err := json.Unmarshal(event.Object, &svc)
+	if err != nil {
+		logger.Error("解析 service 的 watch 事件失败", "err", err)
+		return
+	}
+	c.lock.Lock()
+	if event.Type == client.WATCH_DELETED {
+		delete(c.services, objectKey(svc.ObjectMeta))
+	} else {
+		c.services[objectKey(svc.ObjectMeta)] = svc
+	}
+	c.lock.Unlock()
+	c.trigger()
+}
+
+// handleSlice 把一个 watch 到的 EndpointSlice 事件更新到缓存里
+func (c *Controller) handleSlice(event *client.WatchEvent) {
+	slice := discoveryv1beta1.EndpointSlice{}
+	err := json.Unmarshal(event.Object, &slice)
+	if err != nil {
+		logger.Error("解析 endpointslice 的 watch 事件失败", "err", err)
+		return
+	}
+	c.lock.Lock()
+	if event.Type == client.WATCH_DELETED {
+		delete(c.slices, objectKey(slice.ObjectMeta))
+	} else {
+		c.slices[objectKey(slice.ObjectMeta)] = slice
+	}
+	c.lock.Unlock()
+	c.trigger()
+}
+
+// snapshot 返回缓存里的全部资源, 按 namespace/name 排好序; 还没有都 list 过的话 ok 是 false
+func (c *Controller) snapshot() (services []v1.Service, slices []discoveryv1beta1.EndpointSlice, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.servicesSynced || !c.slicesSynced {
+		return nil, nil, false
+	}
+	for _, svc := range c.services {
+		services = append(services, svc)
+	}
+	for _, slice := range c.slices {
+		slices = append(slices, slice)
+	}
+	sort.Slice(services, func(i, j int) bool {
+		return objectKey(services[i].ObjectMeta) < objectKey(services[j].ObjectMeta)
+	})
+	sort.Slice(slices, func(i, j int) bool {
+		return objectKey(slices[i].ObjectMeta) < objectKey(slices[j].ObjectMeta)
+	})
+	return services, slices, true
+}
+
+// Sync 把缓存里的资源编译之后写到 ebpf 的 map 里
+func (c *Controller) Sync() error {
+	services, slices, ok := c.snapshot()
+	if !ok {
+		return nil
+	}
+	compiled := Compile(services, slices)
+	err := c.syncer.Sync(compiled)
+	if err != nil {
+		return err
+	}
+	logger.Debug("同步 service 成功", "ports", len(compiled))
+	return nil
+}
+
+// Run 开始 watch 并且在有变化的时候同步, 直到 stop 被关掉
+// 断开重连和 410 之后的重新 list 都由 client.Reflector 负责
+func (c *Controller) Run(stop <-chan struct{}) {
+	get := c.k8s.Get()
+	go client.NewReflector("services", get.ServiceListWatch("", c.replaceServices), c.handleService).Run(stop)
+	go client.NewReflector("endpointslices", get.EndpointSliceListWatch("", c.replaceSlices), c.handleSlice).Run(stop)
+
+	for {
+		select {
+		case <-c.resync:
+			err := c.Sync()
+			if err != nil {
+				logger.Error("同步 service 失败", "err", err)
+				time.AfterFunc(retryInterval, c.trigger)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// RunController 在 cni-demo-agent 里做 vxlan 模式下 service 的负载均衡, 一直阻塞到 stop 被关掉
+func RunController(stop <-chan struct{}) error {
+	syncer, err := NewBPFSyncer()
+	if err != nil {
+		return err
+	}
+	err = client.InitDefault()
+	if err != nil {
+		return err
+	}
+	k8s, err := client.GetLightK8sClient()
+	if err != nil {
+		return err
+	}
+	NewController(k8s, syncer).Run(stop)
+	return nil
+}
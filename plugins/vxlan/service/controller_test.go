@@ -0,0 +1,53 @@
+package service
+
+import (
+	"cni-demo/client"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1beta1 "k8s.io/api/discovery/v1beta1"
+)
+
+func newEvent(test *assert.Assertions, eventType string, obj interface{}) *client.WatchEvent {
+	raw, err := json.Marshal(obj)
+	test.Nil(err)
+	return &client.WatchEvent{Type: eventType, Object: raw}
+}
+
+func TestControllerCache(t *testing.T) {
+	test := assert.New(t)
+	c := NewController(nil, nil)
+
+	web := newService("default", "web", "10.96.0.10", v1.ServicePort{Protocol: v1.ProtocolTCP, Port: 80})
+	dns := newService("kube-system", "dns", "10.96.0.53", v1.ServicePort{Protocol: v1.ProtocolUDP, Port: 53})
+	slice := newSlice("default", "web", nil)
+
+	// 只 list 了 Service 的时候不能同步, 不然会把后端都清掉
+	c.replaceServices(&v1.ServiceList{Items: []v1.Service{web}})
+	_, _, ok := c.snapshot()
+	test.False(ok)
+
+	c.replaceSlices(&discoveryv1beta1.EndpointSliceList{Items: []discoveryv1beta1.EndpointSlice{slice}})
+	services, slices, ok := c.snapshot()
+	test.True(ok)
+	test.Equal([]v1.Service{web}, services)
+	test.Equal([]discoveryv1beta1.EndpointSlice{slice}, slices)
+
+	// watch 到的事件直接更新缓存
+	c.handleService(newEvent(test, client.WATCH_ADDED, dns))
+	c.handleSlice(newEvent(test, client.WATCH_DELETED, slice))
+	services, slices, ok = c.snapshot()
+	test.True(ok)
+	test.Len(services, 2)
+	test.Equal("web", services[0].Name)
+	test.Equal("dns", services[1].Name)
+	test.Empty(slices)
+
+	// 重新 list 之后以 list 的结果为准
+	c.replaceServices(&v1.ServiceList{Items: []v1.Service{dns}})
+	services, _, _ = c.snapshot()
+	test.Len(services, 1)
+	test.Equal("dns", services[0].Name)
+}
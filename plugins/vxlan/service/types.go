@@ -0,0 +1,23 @@
+package service
+
+const (
+	PROTOCOL_TCP = "TCP"
+	PROTOCOL_UDP = "UDP"
+)
+
+// Backend 是 service 的一个后端, 也就是 EndpointSlice 里一个 ready 的 pod ip 和它的端口
+type Backend struct {
+	IP   string
+	Port uint16
+}
+
+// ServicePort 是编译之后的一个 ClusterIP:端口, 一个 service 有几个端口就有几个 ServicePort
+// Backends 是排好序的, 写到 ding_svc 里的时候按顺序放在 1 到 len(Backends) 的 slot 上
+type ServicePort struct {
+	Namespace string
+	Name      string
+	IP        string
+	Port      uint16
+	Protocol  string
+	Backends  []Backend
+}
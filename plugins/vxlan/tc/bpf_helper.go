@@ -1,8 +1,17 @@
 package tc
 
 import (
-	"cni-demo/consts"
+	"bytes"
+	bpf_map "cni-demo/plugins/vxlan/map"
+	"cni-demo/tools/logger"
+	"cni-demo/tools/utils"
 	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/vishvananda/netlink"
 )
 
 type BPF_TC_DIRECT string
@@ -12,49 +21,269 @@ const (
 	EGRESS  BPF_TC_DIRECT = "egress"
 )
 
-// GetVethIngressPath 函数返回 veth ingress eBPF 程序的默认路径。
-func GetVethIngressPath() string {
-	return consts.KUBE_TEST_CNI_DEFAULT_PATH + "/veth_ingress.o"
+// VERIFIER_LOG_SIZE 是加载失败的时候给内核的 verifier 日志留的大小, 程序大了之后默认的 64K 放不下
+const VERIFIER_LOG_SIZE = 1 << 20
+
+// loadSpec 优先用编进二进制里的程序, 没有的话才从 program 这个文件读
+func loadSpec(program string) (*ebpf.CollectionSpec, error) {
+	if load := embedded(program); load != nil {
+		return load()
+	}
+	return ebpf.LoadCollectionSpec(program)
+}
+
+// replaceMaps 检查 spec 里的 map 和 types.go 里的定义对不对得上, 已经 pin 好了的 ding_* 直接拿来用
+// 返回的 map 在加载完之后要关掉, 没 pin 的交给 PinPath 创建出来再 pin 上
+func replaceMaps(program string, spec *ebpf.CollectionSpec) (map[string]*ebpf.Map, error) {
+	replacements := map[string]*ebpf.Map{}
+	specs := bpf_map.MapSpecs()
+	for name, mapSpec := range spec.Maps {
+		err := bpf_map.CheckMapSpec(mapSpec)
+		if err != nil {
+			closeMaps(replacements)
+			return nil, fmt.Errorf("%s 和 go 这边的定义对不上: %v", program, err)
+		}
+		// 大小以配置为准, maps.h 里写的只是默认值
+		if expected, ok := specs[name]; ok {
+			mapSpec.MaxEntries = expected.MaxEntries
+		}
+		pinPath := bpf_map.DEFAULT_MAP_ROOT + "/" + bpf_map.DEFAULT_MAP_PREFIX + "/" + name
+		if _, ok := specs[name]; !ok || !utils.PathExists(pinPath) {
+			continue
+		}
+		m := bpf_map.GetMapByPinned(pinPath)
+		if m == nil {
+			closeMaps(replacements)
+			return nil, fmt.Errorf("加载 %s 失败", pinPath)
+		}
+		replacements[name] = m
+	}
+	return replacements, nil
+}
+
+func closeMaps(maps map[string]*ebpf.Map) {
+	for _, m := range maps {
+		m.Close()
+	}
+}
+
+// LoadProgram 函数用 cilium/ebpf 加载 program 里 classifier 段的程序, 编进二进制里了的话用编进去的那个
+// 用到的 map 先和 types.go 里的定义比一遍, 已经 pin 好了的直接复用, 没有的话创建出来再 pin 上
+// verifier 不让加载的话返回的错误里带着 verifier 的日志
+func LoadProgram(program string) (*ebpf.Program, error) {
+	spec, err := loadSpec(program)
+	if err != nil {
+		return nil, fmt.Errorf("解析 %s 失败: %v", program, err)
+	}
+	return loadClassifier(program, spec)
 }
 
-// GetVxlanIngressPath 函数返回 vxlan ingress eBPF 程序的默认路径。
-func GetVxlanIngressPath() string {
-	return consts.KUBE_TEST_CNI_DEFAULT_PATH + "/vxlan_ingress.o"
+// loadClassifier 把 spec 里的 classifier 程序加载到内核里, program 只是拿来报错用的
+func loadClassifier(program string, spec *ebpf.CollectionSpec) (*ebpf.Program, error) {
+	name := ""
+	for _name, prog := range spec.Programs {
+		if prog.Type == ebpf.SchedCLS {
+			name = _name
+			break
+		}
+	}
+	if name == "" {
+		return nil, fmt.Errorf("%s 里没有 classifier 段的程序", program)
+	}
+	err := rewriteConstants(spec)
+	if err != nil {
+		return nil, fmt.Errorf("改写 %s 里的常量失败: %v", program, err)
+	}
+	replacements, err := replaceMaps(program, spec)
+	if err != nil {
+		return nil, err
+	}
+	// 加载的时候会 clone 一份, 这边的可以关掉
+	defer closeMaps(replacements)
+	coll, err := ebpf.NewCollectionWithOptions(spec, ebpf.CollectionOptions{
+		Maps:            ebpf.MapOptions{PinPath: bpf_map.DEFAULT_MAP_ROOT + "/" + bpf_map.DEFAULT_MAP_PREFIX},
+		Programs:        ebpf.ProgramOptions{LogSize: VERIFIER_LOG_SIZE},
+		MapReplacements: replacements,
+	})
+	if err != nil {
+		var verr *ebpf.VerifierError
+		if errors.As(err, &verr) {
+			// %+v 会把 verifier 的日志全打出来, 不然只有最后几行
+			return nil, fmt.Errorf("加载 %s 失败: %+v", program, verr)
+		}
+		return nil, fmt.Errorf("加载 %s 失败: %v", program, err)
+	}
+	// 程序自己会引用用到的 map, 其他的都可以关掉
+	defer coll.Close()
+	return coll.DetachProgram(name), nil
 }
 
-// GetVxlanEgressPath 函数返回 vxlan egress eBPF 程序的默认路径。
-func GetVxlanEgressPath() string {
-	return consts.KUBE_TEST_CNI_DEFAULT_PATH + "/vxlan_egress.o"
+// programRodata 读出程序引用的 .rodata map 的内容, VNI 这种加载的时候改写的常量都在里面
+// 内核太老拿不到程序引用了哪些 map 的话返回 nil
+func programRodata(prog *ebpf.Program) ([]byte, error) {
+	info, err := prog.Info()
+	if err != nil {
+		return nil, err
+	}
+	ids, ok := info.MapIDs()
+	if !ok {
+		return nil, nil
+	}
+	for _, id := range ids {
+		m, err := ebpf.NewMapFromID(id)
+		if err != nil {
+			return nil, err
+		}
+		mapInfo, err := m.Info()
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+		// 内核不支持名字里带点的话 cilium/ebpf 会把点去掉, 所以只看有没有 rodata
+		if mapInfo.Type != ebpf.Array || !strings.Contains(mapInfo.Name, "rodata") {
+			m.Close()
+			continue
+		}
+		value, err := m.LookupBytes(uint32(0))
+		m.Close()
+		return value, err
+	}
+	return nil, nil
+}
+
+// sameProgram 判断设备上挂着的 id 这个程序和刚加载的 prog 是不是同一个: tag 一样并且 .rodata 里的常量也一样
+// tag 只按指令算, 引用 .rodata 里的值的 ld_imm64 的立即数不算进去, 所以只改了 VNI 的话 tag 是不会变的
+// netlink 解析 filter 的时候会把 tag 的最后一个字节当成结尾的 0 去掉, 所以不直接用 filter 上的 Tag
+func sameProgram(id int, prog *ebpf.Program) bool {
+	attached, err := ebpf.NewProgramFromID(ebpf.ProgramID(id))
+	if err != nil {
+		return false
+	}
+	defer attached.Close()
+	attachedInfo, err := attached.Info()
+	if err != nil {
+		return false
+	}
+	info, err := prog.Info()
+	if err != nil || attachedInfo.Tag != info.Tag {
+		return false
+	}
+	attachedRodata, err := programRodata(attached)
+	if err != nil {
+		return false
+	}
+	rodata, err := programRodata(prog)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(attachedRodata, rodata)
+}
+
+// filterName 和 tc 命令挂的时候显示的名字一样, 比如 veth_ingress.o:[classifier]
+func filterName(program string) string {
+	return filepath.Base(program) + ":[classifier]"
 }
 
 // TryAttachBPF 函数尝试将 eBPF 程序附加到指定的网络设备（dev）的 ingress 或 egress 方向（由 direct 参数决定）。
-// 如果设备上尚未存在 clsact qdisc，则先添加一个。如果设备上已存在相应方向的 eBPF 程序，则跳过附加操作。
+// 如果设备上尚未存在 clsact qdisc，则先添加一个。设备上已经挂了同一个程序（tag 和 .rodata 里的常量都一样）的话跳过,
+// 挂的是别的版本或者 VNI 不一样的话原地替换成新的, 这样升级 .o 文件或者改了 VNI 之后新创建的 pod 就能用上新的程序。
 func TryAttachBPF(dev string, direct BPF_TC_DIRECT, program string) error {
 	// 如果还没有 clsact 这根儿管子就先尝试 add 一个
-	if !ExistClsact(dev) {
-		err := AddClsactQdiscIntoDev(dev)
-		if err != nil {
-			return err
-		}
+	err := AddClsactQdiscIntoDev(dev)
+	if err != nil {
+		return err
 	}
+	prog, err := LoadProgram(program)
+	if err != nil {
+		return err
+	}
+	// 挂上去之后 filter 会引用这个程序, 这边的 fd 可以关掉
+	defer prog.Close()
+
+	attached, err := AttachedProgram(dev, direct)
+	if err != nil {
+		return err
+	}
+	if attached != nil && sameProgram(attached.Id, prog) {
+		return nil
+	}
+	return AttachProgram(dev, direct, prog, filterName(program))
+}
+
+// DetachBPF 函数用于卸载指定网络设备（dev）上一个方向上我们挂的 eBPF 程序, clsact 和另一个方向都不动。
+func DetachBPF(dev string, direct BPF_TC_DIRECT) error {
+	return DetachProgram(dev, direct, 0)
+}
 
-	// 如果当前 dev 上已经有 ingress 或者 egress 就跳过
-	switch direct {
-	case INGRESS:
-		if ExistIngress(dev) {
-			return nil
+// reattachBPF 重新加载 program 并且替换掉设备上已经挂着的那个, 没挂的话不管
+func reattachBPF(dev string, direct BPF_TC_DIRECT, program string) error {
+	attached, err := AttachedProgram(dev, direct)
+	if err != nil || attached == nil {
+		return err
+	}
+	prog, err := LoadProgram(program)
+	if err != nil {
+		return err
+	}
+	defer prog.Close()
+	return AttachProgram(dev, direct, prog, filterName(program))
+}
+
+// ReattachIfResized 函数在这个进程里有 map 扩容过的时候把本机的程序都重新挂一遍, 在创建完 map 之后调
+func ReattachIfResized() error {
+	resized := bpf_map.TakeResizedMaps()
+	if len(resized) == 0 {
+		return nil
+	}
+	logger.Info("map 扩容了, 重新挂本机的 tc 程序", "maps", resized)
+	return ReattachAllBPF()
+}
+
+// ReattachAllBPF 函数把本机 vxlan 设备和每个 pod 的 veth 上的程序都重新加载一遍并且原地替换掉
+// map 扩容换了 pin 之后调, 旧的程序引用的还是换下来的旧 map, 不换的话新写进去的条目它们看不到
+// 某个设备失败了也会接着换别的, 返回第一个错误
+func ReattachAllBPF() error {
+	mm, err := bpf_map.GetMapsManager()
+	if err != nil {
+		return err
+	}
+	var firstErr error
+	record := func(dev string, err error) {
+		if err == nil {
+			return
 		}
-		return AttachIngressBPFIntoDev(dev, program)
-	case EGRESS:
-		if ExistEgress(dev) {
-			return nil
+		logger.Error("重新挂 tc 程序失败", "dev", dev, "err", err)
+		if firstErr == nil {
+			firstErr = err
 		}
-		return AttachEgressBPFIntoDev(dev, program)
 	}
-	return errors.New("unknow error occurred in TryAttachBPF")
-}
 
-// DetachBPF 函数用于从指定网络设备（dev）上删除 clsact qdisc。
-func DetachBPF(dev string) error {
-	return DelClsactQdiscIntoDev(dev)
+	// 不是 vxlan 模式的话这几个 map 都没有, 也就没有要换的程序
+	if !utils.PathExists(bpf_map.NODE_LOCAL_MAP_DEFAULT_PATH) || !utils.PathExists(bpf_map.LXC_MAP_DEFAULT_PATH) {
+		return nil
+	}
+	vxlan, err := mm.GetNodeLocalMapValue(bpf_map.LocalNodeMapKey{Type: bpf_map.VXLAN_DEV})
+	if err == nil {
+		link, err := netlink.LinkByIndex(int(vxlan.IfIndex))
+		if err == nil {
+			name := link.Attrs().Name
+			record(name, reattachBPF(name, INGRESS, GetVxlanIngressPath()))
+			record(name, reattachBPF(name, EGRESS, GetVxlanEgressPath()))
+		}
+	}
+
+	endpoints, err := mm.LxcMapValues()
+	if err != nil {
+		return err
+	}
+	for _, endpoint := range endpoints {
+		// LxcIfIndex 是留在宿主机上的那半拉 veth, pod 已经删掉了的话找不到, 跳过
+		link, err := netlink.LinkByIndex(int(endpoint.LxcIfIndex))
+		if err != nil {
+			continue
+		}
+		name := link.Attrs().Name
+		record(name, reattachBPF(name, INGRESS, GetVethIngressPath()))
+	}
+	return firstErr
 }
@@ -0,0 +1,71 @@
+package tc
+
+import (
+	"cni-demo/consts"
+	"strings"
+	"sync"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/btf"
+)
+
+// TUNNEL_ID_CONSTANT 是 vxlan_egress.c 里 VNI 的变量名, 加载的时候换成配置里的值
+const TUNNEL_ID_CONSTANT = "tunnel_id"
+
+var (
+	_constantsLock sync.Mutex
+	_tunnelID      uint32 = consts.VXLAN_DEFAULT_VNI
+)
+
+// InitTunnelID 设置 vxlan 封装的时候用的 VNI, 一般拿插件配置里的 vxlan.vni 来调, 要在加载程序之前调, 0 的话用默认值
+// 已经挂着的程序不会变, VNI 改了之后要重新挂一遍, TryAttachBPF 发现 .rodata 里的 VNI 不一样的时候会原地替换
+func InitTunnelID(vni uint32) {
+	_constantsLock.Lock()
+	defer _constantsLock.Unlock()
+	if vni == 0 {
+		vni = consts.VXLAN_DEFAULT_VNI
+	}
+	_tunnelID = vni
+}
+
+// constants 返回加载的时候要改写的常量, key 是 ebpf 程序里 volatile const 的变量名
+func constants() map[string]interface{} {
+	_constantsLock.Lock()
+	defer _constantsLock.Unlock()
+	return map[string]interface{}{
+		TUNNEL_ID_CONSTANT: _tunnelID,
+	}
+}
+
+// declaredConstants 返回 spec 的 .rodata 里声明了的变量名, 没有 BTF 的程序是空的
+func declaredConstants(spec *ebpf.CollectionSpec) map[string]bool {
+	res := map[string]bool{}
+	for name, m := range spec.Maps {
+		if !strings.HasPrefix(name, ".rodata") {
+			continue
+		}
+		ds, ok := m.Value.(*btf.Datasec)
+		if !ok {
+			continue
+		}
+		for _, v := range ds.Vars {
+			res[v.Type.TypeName()] = true
+		}
+	}
+	return res
+}
+
+// rewriteConstants 把 spec 里用到了的常量换成现在的配置, 没用到的跳过, 不然 cilium/ebpf 会报错
+func rewriteConstants(spec *ebpf.CollectionSpec) error {
+	declared := declaredConstants(spec)
+	replacements := map[string]interface{}{}
+	for name, value := range constants() {
+		if declared[name] {
+			replacements[name] = value
+		}
+	}
+	if len(replacements) == 0 {
+		return nil
+	}
+	return spec.RewriteConstants(replacements)
+}
@@ -0,0 +1,43 @@
+package tc
+
+import (
+	"cni-demo/consts"
+	"path/filepath"
+
+	"github.com/cilium/ebpf"
+)
+
+// tc 的程序用 bpf2go 编译, 生成的 .o 和 go 文件都放在这个目录下, 带着 bpf_embed 这个 tag 编译的时候会被编进二进制里
+// 需要 clang, 生成的文件不提交, 用 make generate_ebpf 生成
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang -cflags "-O2 -g -Wall" -target bpfel -tags bpf_embed -no-global-types vethIngress ../ebpf/veth_ingress.c
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang -cflags "-O2 -g -Wall" -target bpfel -tags bpf_embed -no-global-types vxlanIngress ../ebpf/vxlan_ingress.c
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang -cflags "-O2 -g -Wall" -target bpfel -tags bpf_embed -no-global-types vxlanEgress ../ebpf/vxlan_egress.c
+
+const (
+	VETH_INGRESS_OBJECT  = "veth_ingress.o"
+	VXLAN_INGRESS_OBJECT = "vxlan_ingress.o"
+	VXLAN_EGRESS_OBJECT  = "vxlan_egress.o"
+)
+
+// objects 是编进二进制里的 tc 程序, key 是 .o 的文件名, 没带 bpf_embed 编译的话是空的
+var objects = map[string]func() (*ebpf.CollectionSpec, error){}
+
+// embedded 返回 program 对应的编进二进制里的程序, 没有的话返回 nil
+func embedded(program string) func() (*ebpf.CollectionSpec, error) {
+	return objects[filepath.Base(program)]
+}
+
+// GetVethIngressPath 函数返回 veth ingress eBPF 程序的默认路径, 编进二进制里了的话这个文件可以不存在。
+func GetVethIngressPath() string {
+	return consts.KUBE_TEST_CNI_DEFAULT_PATH + "/" + VETH_INGRESS_OBJECT
+}
+
+// GetVxlanIngressPath 函数返回 vxlan ingress eBPF 程序的默认路径, 编进二进制里了的话这个文件可以不存在。
+func GetVxlanIngressPath() string {
+	return consts.KUBE_TEST_CNI_DEFAULT_PATH + "/" + VXLAN_INGRESS_OBJECT
+}
+
+// GetVxlanEgressPath 函数返回 vxlan egress eBPF 程序的默认路径, 编进二进制里了的话这个文件可以不存在。
+func GetVxlanEgressPath() string {
+	return consts.KUBE_TEST_CNI_DEFAULT_PATH + "/" + VXLAN_EGRESS_OBJECT
+}
@@ -0,0 +1,11 @@
+//go:build bpf_embed
+// +build bpf_embed
+
+package tc
+
+// load* 是 bpf2go 生成的, 要先 go generate
+func init() {
+	objects[VETH_INGRESS_OBJECT] = loadVethIngress
+	objects[VXLAN_INGRESS_OBJECT] = loadVxlanIngress
+	objects[VXLAN_EGRESS_OBJECT] = loadVxlanEgress
+}
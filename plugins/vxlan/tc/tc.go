@@ -1,87 +1,243 @@
 package tc
 
 import (
+	"errors"
 	"fmt"
-	"os/exec"
 	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
-// _exec 函数是一个辅助函数，用于执行给定的 shell 命令。
-// TODO: 可以尝试换成 go-tc
-func _exec(command string) error {
-	processInfo := exec.Command("/bin/sh", "-c", command)
-	_, err := processInfo.Output()
-	return err
+// 以前是拼好 tc 命令之后用 /bin/sh 执行, 再在 tc filter show 的输出里找 direct-action
+// 现在 clsact 和 bpf filter 都直接通过 netlink 管理
+
+const (
+	// 我们挂的 filter 固定用这个优先级和 handle, 替换和删除的时候只动这一个
+	FILTER_PRIORITY = 1
+	FILTER_HANDLE   = 1
+	// 以前用 tc 命令挂的时候没指定优先级, 内核分的是 49152, 挂新程序的时候会把这些旧的删掉, 见 AttachProgram
+	LEGACY_FILTER_PRIORITY = 49152
+)
+
+// ErrProgramMismatch 表示要卸载的程序和设备上挂着的不是同一个
+var ErrProgramMismatch = errors.New("设备上挂着的不是要卸载的那个 ebpf 程序")
+
+func getLink(dev string) (netlink.Link, error) {
+	link, err := netlink.LinkByName(dev)
+	if err != nil {
+		return nil, fmt.Errorf("获取设备 %s 失败: %v", dev, err)
+	}
+	return link, nil
 }
 
-// AddClsactQdiscIntoDev 函数用于为指定的网络设备（dev）添加 clsact qdisc。
-func AddClsactQdiscIntoDev(dev string) error {
-	return _exec(
-		fmt.Sprintf("tc qdisc add dev %s clsact", dev),
-	)
+// filterParent 返回 clsact 上对应方向的 parent
+func filterParent(direct BPF_TC_DIRECT) (uint32, error) {
+	switch direct {
+	case INGRESS:
+		return netlink.HANDLE_MIN_INGRESS, nil
+	case EGRESS:
+		return netlink.HANDLE_MIN_EGRESS, nil
+	}
+	return 0, fmt.Errorf("不认识的方向: %s", direct)
 }
 
-// DelClsactQdiscIntoDev 函数用于从指定的网络设备（dev）上删除 clsact qdisc。
-func DelClsactQdiscIntoDev(dev string) error {
-	return _exec(
-		fmt.Sprintf("tc qdisc del dev %s clsact", dev),
-	)
+func clsactQdisc(link netlink.Link) *netlink.GenericQdisc {
+	return &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_CLSACT,
+		},
+		QdiscType: "clsact",
+	}
 }
 
-// AttachIngressBPFIntoDev 函数用于将 ingress eBPF 程序附加到指定的网络设备（dev）上。
-func AttachIngressBPFIntoDev(dev string, filepath string) error {
-	return _exec(
-		fmt.Sprintf("tc filter add dev %s ingress bpf direct-action obj %s", dev, filepath),
-	)
+// AddClsactQdiscIntoDev 函数用于为指定的网络设备（dev）添加 clsact qdisc, 已经有了的话不报错。
+func AddClsactQdiscIntoDev(dev string) error {
+	link, err := getLink(dev)
+	if err != nil {
+		return err
+	}
+	err = netlink.QdiscAdd(clsactQdisc(link))
+	if errors.Is(err, unix.EEXIST) {
+		return nil
+	}
+	return err
 }
 
-// AttachEgressBPFIntoDev 函数用于将 egress eBPF 程序附加到指定的网络设备（dev）上。
-func AttachEgressBPFIntoDev(dev string, filepath string) error {
-	return _exec(
-		fmt.Sprintf("tc filter add dev %s egress bpf direct-action obj %s", dev, filepath),
-	)
+// DelClsactQdiscIntoDev 函数用于从指定的网络设备（dev）上删除 clsact qdisc, 两个方向上所有的 filter 都会跟着被删掉。
+func DelClsactQdiscIntoDev(dev string) error {
+	link, err := getLink(dev)
+	if err != nil {
+		return err
+	}
+	return netlink.QdiscDel(clsactQdisc(link))
 }
 
 // ExistClsact 函数检查指定的网络设备（dev）上是否存在 clsact qdisc。
 func ExistClsact(dev string) bool {
-	processInfo := exec.Command(
-		"/bin/sh", "-c",
-		fmt.Sprintf("tc qdisc show dev %s", dev),
-	)
-	out, _ := processInfo.Output()
-	return strings.Contains(string(out), "clsact")
+	link, err := getLink(dev)
+	if err != nil {
+		return false
+	}
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return false
+	}
+	for _, qdisc := range qdiscs {
+		if qdisc.Type() == "clsact" {
+			return true
+		}
+	}
+	return false
+}
+
+// AttachedProgram 函数返回设备上指定方向上我们挂的那个 bpf filter, 里面有程序的 id 和 tag, 没有的话返回 nil
+func AttachedProgram(dev string, direct BPF_TC_DIRECT) (*netlink.BpfFilter, error) {
+	parent, err := filterParent(direct)
+	if err != nil {
+		return nil, err
+	}
+	link, err := getLink(dev)
+	if err != nil {
+		return nil, err
+	}
+	filters, err := netlink.FilterList(link, parent)
+	if err != nil {
+		// 没有 clsact 的时候内核会返回 EINVAL, 当成没有 filter
+		if errors.Is(err, unix.EINVAL) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	for _, filter := range filters {
+		bpf, ok := filter.(*netlink.BpfFilter)
+		if !ok {
+			continue
+		}
+		if bpf.Priority == FILTER_PRIORITY && bpf.Handle == FILTER_HANDLE {
+			return bpf, nil
+		}
+	}
+	return nil, nil
 }
 
 // ExistIngress 函数检查指定的网络设备（dev）上是否存在 ingress eBPF 程序。
 func ExistIngress(dev string) bool {
-	processInfo := exec.Command(
-		"/bin/sh", "-c",
-		fmt.Sprintf("tc filter show dev %s ingress", dev),
-	)
-	out, _ := processInfo.Output()
-	return strings.Contains(string(out), "direct-action")
+	filter, err := AttachedProgram(dev, INGRESS)
+	return err == nil && filter != nil
 }
 
 // ExistEgress 函数检查指定的网络设备（dev）上是否存在 egress eBPF 程序。
 func ExistEgress(dev string) bool {
-	processInfo := exec.Command(
-		"/bin/sh", "-c",
-		fmt.Sprintf("tc filter show dev %s egress", dev),
-	)
-	out, _ := processInfo.Output()
-	return strings.Contains(string(out), "direct-action")
+	filter, err := AttachedProgram(dev, EGRESS)
+	return err == nil && filter != nil
+}
+
+// legacyBPFFilters 返回 filters 里以前用 tc 命令挂的同一个程序, 也就是优先级是 LEGACY_FILTER_PRIORITY, 名字是 name 的 bpf filter
+// 别人挂的 filter(比如其他网络插件或者运维工具的)名字不一样, 不会被选中
+func legacyBPFFilters(filters []netlink.Filter, name string) []*netlink.BpfFilter {
+	res := []*netlink.BpfFilter{}
+	for _, filter := range filters {
+		bpf, ok := filter.(*netlink.BpfFilter)
+		if !ok {
+			continue
+		}
+		if bpf.Priority != LEGACY_FILTER_PRIORITY || bpf.Name != name {
+			continue
+		}
+		res = append(res, bpf)
+	}
+	return res
+}
+
+// AttachProgram 函数把已经加载好的程序挂到设备的指定方向上, 用的是 direct-action 模式
+// 已经挂了的话用同一个优先级和 handle 原地替换, 替换的过程中不会有包漏过去
+// 挂好之后把升级之前用 tc 命令挂的同一个程序删掉, 不然包还会再被旧的程序处理一遍, 别人挂的 filter 不动
+// name 只是给 tc filter show 看的, 一般写成 <文件名>:[<段名>], 和 tc 命令挂的时候一样
+func AttachProgram(dev string, direct BPF_TC_DIRECT, prog *ebpf.Program, name string) error {
+	parent, err := filterParent(direct)
+	if err != nil {
+		return err
+	}
+	link, err := getLink(dev)
+	if err != nil {
+		return err
+	}
+	err = netlink.FilterReplace(&netlink.BpfFilter{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    parent,
+			Handle:    FILTER_HANDLE,
+			Priority:  FILTER_PRIORITY,
+			Protocol:  unix.ETH_P_ALL,
+		},
+		Fd:           prog.FD(),
+		Name:         name,
+		DirectAction: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	filters, err := netlink.FilterList(link, parent)
+	if err != nil {
+		return err
+	}
+	for _, filter := range legacyBPFFilters(filters, name) {
+		err = netlink.FilterDel(filter)
+		if err != nil && !errors.Is(err, unix.ENOENT) {
+			return fmt.Errorf("删除 %s 上旧的 filter(pref %d handle 0x%x %s)失败: %v", dev, filter.Priority, filter.Handle, filter.Name, err)
+		}
+	}
+	return nil
+}
+
+// DetachProgram 函数只卸载设备上指定方向上我们挂的那个程序, 另一个方向不受影响
+// id 不为 0 的话, 只有挂着的程序的 id 就是它的时候才卸载, 否则返回 ErrProgramMismatch; 本来就没挂的话不报错
+func DetachProgram(dev string, direct BPF_TC_DIRECT, id int) error {
+	filter, err := AttachedProgram(dev, direct)
+	if err != nil || filter == nil {
+		return err
+	}
+	if id != 0 && filter.Id != id {
+		return ErrProgramMismatch
+	}
+	err = netlink.FilterDel(filter)
+	if errors.Is(err, unix.ENOENT) {
+		return nil
+	}
+	return err
 }
 
 // ShowBPF 函数显示指定网络设备（dev）上指定方向（direct 参数，可为 "ingress" 或 "egress"）的 eBPF 信息。
-// 返回 eBPF 信息字符串，如果发生错误则返回错误。
+// 每个 bpf filter 一行, 格式和 tc filter show 差不多, 返回 eBPF 信息字符串，如果发生错误则返回错误。
 func ShowBPF(dev string, direct string) (string, error) {
-	processInfo := exec.Command(
-		"/bin/sh", "-c",
-		fmt.Sprintf("tc filter show dev %s %s", dev, direct),
-	)
-	out, err := processInfo.Output()
+	parent, err := filterParent(BPF_TC_DIRECT(direct))
 	if err != nil {
 		return "", err
 	}
-	return string(out), nil
+	link, err := getLink(dev)
+	if err != nil {
+		return "", err
+	}
+	filters, err := netlink.FilterList(link, parent)
+	if err != nil {
+		return "", err
+	}
+	builder := strings.Builder{}
+	for _, filter := range filters {
+		bpf, ok := filter.(*netlink.BpfFilter)
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(&builder, "filter pref %d bpf handle 0x%x %s", bpf.Priority, bpf.Handle, bpf.Name)
+		if bpf.DirectAction {
+			builder.WriteString(" direct-action")
+		}
+		fmt.Fprintf(&builder, " id %d tag %s\n", bpf.Id, bpf.Tag)
+	}
+	return builder.String(), nil
 }
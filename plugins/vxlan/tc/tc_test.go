@@ -1,17 +1,25 @@
 package tc
 
 import (
-	"cni-demo/nettools"
+	"cni-demo/consts"
+	bpf_map "cni-demo/plugins/vxlan/map"
+	"cni-demo/tools/nettools"
+	"strings"
 	"testing"
 
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/btf"
 	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
 )
 
 // 编译 tc_test.c: clang -O2 -emit-llvm -c tc_test.c -o - | llc -march=bpf -filetype=obj -o tc_test.o
 func TestTC(t *testing.T) {
 	test := assert.New(t)
-	_, err := nettools.CreateVxlanAndUp("ding_test", 1500)
+	vxlan, err := nettools.CreateVxlanAndUp("ding_test", 1500)
 	test.Nil(err)
+	defer netlink.LinkDel(vxlan)
 
 	/********* test attach clsact *********/
 	exist := ExistClsact("ding_test")
@@ -20,19 +28,44 @@ func TestTC(t *testing.T) {
 	test.Nil(err)
 	exist = ExistClsact("ding_test")
 	test.True(exist)
+	// 已经有了的话不报错
+	err = AddClsactQdiscIntoDev("ding_test")
+	test.Nil(err)
 
 	/********* test attach ingress *********/
 	exist = ExistIngress("ding_test")
 	test.False(exist)
-	err = AttachIngressBPFIntoDev("ding_test", "./tc_test.o")
+	err = TryAttachBPF("ding_test", INGRESS, "./tc_test.o")
 	test.Nil(err)
 	exist = ExistIngress("ding_test")
 	test.True(exist)
-
-	/********* test attach egress *********/
 	exist = ExistEgress("ding_test")
 	test.False(exist)
-	err = AttachEgressBPFIntoDev("ding_test", "./tc_test.o")
+	ingress, err := AttachedProgram("ding_test", INGRESS)
+	test.Nil(err)
+	test.NotZero(ingress.Id)
+	test.NotEmpty(ingress.Tag)
+	test.True(ingress.DirectAction)
+
+	// 同一个程序再挂一次的话什么都不做, 还是原来那个
+	err = TryAttachBPF("ding_test", INGRESS, "./tc_test.o")
+	test.Nil(err)
+	again, err := AttachedProgram("ding_test", INGRESS)
+	test.Nil(err)
+	test.Equal(ingress.Id, again.Id)
+
+	// 原地替换成一个新加载的程序, 还是只有一个 filter
+	prog, err := LoadProgram("./tc_test.o")
+	test.Nil(err)
+	err = AttachProgram("ding_test", INGRESS, prog, filterName("./tc_test.o"))
+	test.Nil(err)
+	prog.Close()
+	replaced, err := AttachedProgram("ding_test", INGRESS)
+	test.Nil(err)
+	test.NotEqual(ingress.Id, replaced.Id)
+
+	/********* test attach egress *********/
+	err = TryAttachBPF("ding_test", EGRESS, "./tc_test.o")
 	test.Nil(err)
 	exist = ExistEgress("ding_test")
 	test.True(exist)
@@ -40,14 +73,33 @@ func TestTC(t *testing.T) {
 	/********* test show *********/
 	out, err := ShowBPF("ding_test", "ingress")
 	test.Nil(err)
-	test.Contains(out, "classifier")
-	// fmt.Println("ingress 方向: ", out)
+	test.Equal(1, strings.Count(out, "\n"))
+	test.Contains(out, "tc_test.o:[classifier] direct-action")
 	out, err = ShowBPF("ding_test", "egress")
 	test.Nil(err)
 	test.Contains(out, "classifier")
-	// fmt.Println("egress 方向", out)
+
+	/********* test detach *********/
+	// id 对不上的话不卸载
+	err = DetachProgram("ding_test", EGRESS, replaced.Id)
+	test.Equal(ErrProgramMismatch, err)
+	exist = ExistEgress("ding_test")
+	test.True(exist)
+	// 只卸载一个方向
+	err = DetachBPF("ding_test", EGRESS)
+	test.Nil(err)
+	exist = ExistEgress("ding_test")
+	test.False(exist)
+	exist = ExistIngress("ding_test")
+	test.True(exist)
+	err = DetachProgram("ding_test", INGRESS, replaced.Id)
+	test.Nil(err)
+	exist = ExistIngress("ding_test")
+	test.False(exist)
 
 	/********* test del clsact *********/
+	err = TryAttachBPF("ding_test", INGRESS, "./tc_test.o")
+	test.Nil(err)
 	err = DelClsactQdiscIntoDev("ding_test")
 	test.Nil(err)
 
@@ -58,3 +110,139 @@ func TestTC(t *testing.T) {
 	exist = ExistClsact("ding_test")
 	test.False(exist)
 }
+
+func TestLoadProgram(t *testing.T) {
+	test := assert.New(t)
+	// 没带 bpf_embed 编译的话只能从文件读
+	test.Nil(embedded(GetVethIngressPath()))
+	_, err := LoadProgram("./not_exist.o")
+	test.NotNil(err)
+
+	spec := &ebpf.CollectionSpec{
+		Maps: map[string]*ebpf.MapSpec{},
+		Programs: map[string]*ebpf.ProgramSpec{
+			"cls_main": {
+				Name: "cls_main",
+				Type: ebpf.SchedCLS,
+				// r2 没有初始化, verifier 不会让它加载
+				Instructions: asm.Instructions{
+					asm.Mov.Reg(asm.R0, asm.R2),
+					asm.Return(),
+				},
+				License: "GPL",
+			},
+		},
+	}
+	_, err = loadClassifier("bad.o", spec)
+	test.NotNil(err)
+	test.Contains(err.Error(), "R2 !read_ok")
+
+	// map 的大小和 types.go 里的对不上的话不加载
+	spec.Maps[bpf_map.APP_PREFIX+"_lxc"] = &ebpf.MapSpec{
+		Name:       bpf_map.APP_PREFIX + "_lxc",
+		Type:       ebpf.Hash,
+		KeySize:    4,
+		ValueSize:  8,
+		MaxEntries: bpf_map.LXC_MAX_ENTRIES,
+	}
+	_, err = loadClassifier("bad.o", spec)
+	test.NotNil(err)
+	test.Contains(err.Error(), "value")
+}
+
+func TestRewriteConstants(t *testing.T) {
+	test := assert.New(t)
+	defer InitTunnelID(0)
+
+	rodata := func() *ebpf.CollectionSpec {
+		return &ebpf.CollectionSpec{Maps: map[string]*ebpf.MapSpec{
+			".rodata": {
+				Name:       ".rodata",
+				Type:       ebpf.Array,
+				KeySize:    4,
+				ValueSize:  4,
+				MaxEntries: 1,
+				Value: &btf.Datasec{Name: ".rodata", Size: 4, Vars: []btf.VarSecinfo{{
+					Type:   &btf.Var{Name: TUNNEL_ID_CONSTANT, Type: &btf.Int{Size: 4}},
+					Offset: 0,
+					Size:   4,
+				}}},
+				Contents: []ebpf.MapKV{{Key: uint32(0), Value: []byte{0, 0, 0, 0}}},
+			},
+		}}
+	}
+	value := func(spec *ebpf.CollectionSpec) uint32 {
+		b := spec.Maps[".rodata"].Contents[0].Value.([]byte)
+		return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+	}
+
+	spec := rodata()
+	test.Nil(rewriteConstants(spec))
+	test.Equal(uint32(consts.VXLAN_DEFAULT_VNI), value(spec))
+
+	InitTunnelID(42)
+	spec = rodata()
+	test.Nil(rewriteConstants(spec))
+	test.Equal(uint32(42), value(spec))
+
+	// 没声明这个常量的程序不用改, 也不报错
+	test.Nil(rewriteConstants(&ebpf.CollectionSpec{Maps: map[string]*ebpf.MapSpec{}}))
+}
+
+func TestLegacyBPFFilters(t *testing.T) {
+	test := assert.New(t)
+
+	name := "veth_ingress.o:[classifier]"
+	ours := &netlink.BpfFilter{FilterAttrs: netlink.FilterAttrs{Priority: FILTER_PRIORITY, Handle: FILTER_HANDLE}, Name: name}
+	// 升级之前用 tc 命令挂的
+	old := &netlink.BpfFilter{FilterAttrs: netlink.FilterAttrs{Priority: LEGACY_FILTER_PRIORITY, Handle: 1}, Name: name}
+	// 别人挂的, 不管优先级是多少都不能动
+	other := &netlink.BpfFilter{FilterAttrs: netlink.FilterAttrs{Priority: LEGACY_FILTER_PRIORITY, Handle: 2}, Name: "bpf_lxc.o:[from-container]"}
+	otherPrio := &netlink.BpfFilter{FilterAttrs: netlink.FilterAttrs{Priority: 2, Handle: 1}, Name: name}
+	u32 := &netlink.U32{FilterAttrs: netlink.FilterAttrs{Priority: 2, Handle: 1}}
+	test.Equal([]*netlink.BpfFilter{old}, legacyBPFFilters([]netlink.Filter{ours, old, other, otherPrio, u32}, name))
+	test.Empty(legacyBPFFilters([]netlink.Filter{ours, other}, name))
+}
+
+func TestSameProgram(t *testing.T) {
+	test := assert.New(t)
+
+	// 指令一样, 只有 .rodata 里的 VNI 不一样, tag 是一样的
+	load := func(vni byte) *ebpf.Program {
+		rodata, err := ebpf.NewMap(&ebpf.MapSpec{
+			Name:       ".rodata",
+			Type:       ebpf.Array,
+			KeySize:    4,
+			ValueSize:  4,
+			MaxEntries: 1,
+			Contents:   []ebpf.MapKV{{Key: uint32(0), Value: []byte{vni, 0, 0, 0}}},
+		})
+		test.Nil(err)
+		defer rodata.Close()
+		prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+			Type:    ebpf.SchedCLS,
+			License: "GPL",
+			Instructions: asm.Instructions{
+				asm.LoadMapValue(asm.R1, rodata.FD(), 0),
+				asm.LoadMem(asm.R0, asm.R1, 0, asm.Word),
+				asm.Return(),
+			},
+		})
+		test.Nil(err)
+		return prog
+	}
+	attached, same, changed := load(1), load(1), load(2)
+	defer attached.Close()
+	defer same.Close()
+	defer changed.Close()
+
+	rodata, err := programRodata(attached)
+	test.Nil(err)
+	test.Equal([]byte{1, 0, 0, 0}, rodata)
+
+	info, err := attached.Info()
+	test.Nil(err)
+	id, _ := info.ID()
+	test.True(sameProgram(int(id), same))
+	test.False(sameProgram(int(id), changed))
+}
@@ -0,0 +1,222 @@
+package vxlan
+
+import (
+	"cni-demo/agent"
+	"cni-demo/cni"
+	_ipam "cni-demo/ipam"
+	"cni-demo/tools/logger"
+	"cni-demo/tools/nettools"
+	"cni-demo/tools/skel"
+	"fmt"
+	"net"
+	"os"
+
+	types "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// setHostPairKernelNetwork 函数配置 pod 的 veth 留在 host 上的那头, 和 ipip 模式一样:
+// 打开 proxy arp 和转发, 加一条 podIP/32 走这块 veth 的路由, 再让 FORWARD 放行
+// ebpf 数据面下这些都是 veth 上的 tc 程序做的
+func setHostPairKernelNetwork(podIP string, veth *netlink.Veth) error {
+	link, err := netlink.LinkByName(veth.Attrs().Name)
+	if err != nil {
+		return err
+	}
+	err = nettools.SetUpDeviceProxyArpV4(link)
+	if err != nil {
+		return err
+	}
+	err = nettools.SetUpDeviceForwarding(link)
+	if err != nil {
+		return err
+	}
+	_, dst, err := net.ParseCIDR(podIP)
+	if err != nil {
+		return err
+	}
+	err = netlink.RouteReplace(&netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Scope:     netlink.SCOPE_LINK,
+		Dst:       dst,
+	})
+	if err != nil {
+		logger.Error("设置去往 pod 的路由失败", "err", err)
+		return err
+	}
+	return nettools.SetIptablesForToForwardAccept(link)
+}
+
+// createKernelVxlan 函数创建 kernel 数据面用的 vxlan 设备, 封装的源地址是本机的 node ip,
+// 设备上挂着本机 pod 网段的网络地址 x.x.x.0/32 作为 vtep 地址, 其他节点的路由的下一跳就是这个地址
+func createKernelVxlan(ipam *_ipam.IpamService, conf cni.VxlanConf) (*netlink.Vxlan, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	nodeIP, err := ipam.Get().NodeIp(hostname)
+	if err != nil {
+		return nil, err
+	}
+	src := net.ParseIP(nodeIP)
+	if src == nil {
+		return nil, fmt.Errorf("invalid node ip %q", nodeIP)
+	}
+	cidr, err := ipam.Get().CIDR(hostname)
+	if err != nil {
+		return nil, err
+	}
+	vtep, err := nettools.VxlanVtepIP(cidr)
+	if err != nil {
+		return nil, err
+	}
+	// 封装之后外层多了 50 个字节, 和 pod 的 veth 一样用 1450, 见 createNsVethPair
+	vxlan, err := nettools.CreateKernelVxlanAndUp(conf.Device, 1450, conf.VNI, int(conf.Port), src, vtep)
+	if err != nil {
+		return nil, err
+	}
+	ipexist, _ := nettools.DeviceExistIp(vxlan)
+	if ipexist == "" {
+		err = nettools.SetIpForVxlan(vxlan.Name, vtep.String()+"/32")
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = nettools.SetUpDeviceForwarding(vxlan)
+	if err != nil {
+		return nil, err
+	}
+	return vxlan, nettools.SetIptablesForToForwardAccept(vxlan)
+}
+
+// setPeersIntoVxlan 函数把去往其他节点的 fdb、邻居和路由写到 vxlan 设备上
+// 之后节点有变化的时候由 cni-demo-agent 同步, 这里先写一遍, 不然本机第一个 pod 起来的时候要等 agent 的下一轮
+func setPeersIntoVxlan(ipam *_ipam.IpamService, vxlan *netlink.Vxlan) error {
+	networks, err := ipam.Get().AllHostNetwork()
+	if err != nil {
+		return err
+	}
+	return nettools.ReconcileVxlanPeers(networks, vxlan.Attrs().Name)
+}
+
+/**
+ * bootstrapKernel 是 vxlan.datapath 为 kernel 时的入口, 给没有 bpf_redirect_peer (5.10 以下) 的内核用
+ * 和 flannel 的 vxlan 一样不挂任何 tc 程序, 也不用 ebpf map:
+ * pod 的流量经过 host 上的 veth 进内核协议栈, 去往其他节点的 pod 网段的路由是
+ *   ${对端网段} via ${对端网段}.0 dev ding_vxlan onlink
+ * 邻居表把 ${对端网段}.0 解析成对端 vxlan 设备的 mac, fdb 再把这个 mac 封装到对端的 node ip 上
+ * 对端解封装之后按 podIP/32 的路由转给 pod 的 veth
+ */
+func (vx *VxlanCNI) bootstrapKernel(args *skel.CmdArgs, pluginConfig *cni.PluginConf, vxlanConf cni.VxlanConf) (*types.Result, error) {
+	logger.Debug("vxlan 模式用的是 kernel 数据面")
+
+	// 0. 只要 ipam, 用不上 ebpf map
+	ipam, err := initIpamClient(pluginConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// 1. 其他节点的 fdb 和路由由 cni-demo-agent 同步, 这里只确认它在运行
+	err = agent.CheckAlive()
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. 网关那对儿 veth 和 ebpf 数据面一样, veth_host 上挂着 pod 的网关地址
+	gwPair, netPair, err := createHostVethPair(args, vxlanConf)
+	if err != nil {
+		return nil, err
+	}
+	err = setUpHostVethPair(gwPair, netPair)
+	if err != nil {
+		return nil, err
+	}
+	gw, err := setIpIntoHostPair(ipam, gwPair)
+	if err != nil {
+		return nil, err
+	}
+
+	// 3. 获取 ns
+	netns, err := getNetns(args.Netns)
+	if err != nil {
+		return nil, err
+	}
+
+	var nsPair, hostPair *netlink.Veth
+	var podIP string
+	err = (*netns).Do(func(hostNs ns.NetNS) error {
+		// 4. 创建 pod 的 veth, 把一头放到 host 上
+		nsPair, hostPair, err = createNsVethPair(args, pluginConfig)
+		if err != nil {
+			return err
+		}
+		err = setHostVethIntoHost(ipam, hostPair, hostNs)
+		if err != nil {
+			return err
+		}
+
+		// 5. 给 ns 中的 veth 创建 ip/32
+		podIP, err = setIpIntoNsPair(ipam, nsPair)
+		if err != nil {
+			return err
+		}
+		err = setUpVeth(nsPair)
+		if err != nil {
+			return err
+		}
+
+		// 6. 默认路由指向网关, 网关地址是本机的, 问它的 arp 内核自己就会回
+		err = setFibTalbeIntoNs(gw, nsPair)
+		if err != nil {
+			return err
+		}
+		return setUpHostPair(hostNs, hostPair)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	setPodOwner(ipam, podIP, args)
+
+	// 7. host 上那头的 veth 交给内核转发
+	err = setHostPairKernelNetwork(podIP, hostPair)
+	if err != nil {
+		return nil, err
+	}
+
+	// 8. 创建 vxlan 设备并写上其他节点的 fdb、邻居和路由
+	vxlan, err := createKernelVxlan(ipam, vxlanConf)
+	if err != nil {
+		return nil, err
+	}
+	err = setPeersIntoVxlan(ipam, vxlan)
+	if err != nil {
+		return nil, err
+	}
+
+	// 9. 开了 ipMasq 的话给访问集群外的流量做 snat
+	if pluginConfig.IPMasq {
+		clusterCIDR, err := ipam.Get().CurrentSubnet()
+		if err != nil {
+			return nil, err
+		}
+		err = nettools.SetupPodIPMasq(podIP, clusterCIDR, pluginConfig.NonMasqueradeCIDRs, args.ContainerID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_gw, _, _ := net.ParseCIDR(gw)
+	_, _podIP, _ := net.ParseCIDR(podIP)
+	result := &types.Result{
+		CNIVersion: pluginConfig.CNIVersion,
+		IPs: []*types.IPConfig{
+			{
+				Address: *_podIP,
+				Gateway: _gw,
+			},
+		},
+	}
+	return result, nil
+}
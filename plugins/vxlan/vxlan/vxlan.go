@@ -1,21 +1,22 @@
 package vxlan
 
 import (
+	"cni-demo/agent"
 	"cni-demo/cni"
 	"cni-demo/consts"
-	_etcd "cni-demo/etcd"
 	"cni-demo/ipam"
 	_ipam "cni-demo/ipam"
-	"cni-demo/nettools"
 	bpf_map "cni-demo/plugins/vxlan/map"
 	"cni-demo/plugins/vxlan/tc"
-	"cni-demo/plugins/vxlan/watcher"
+	"cni-demo/tools/logger"
+	"cni-demo/tools/nettools"
 	"cni-demo/tools/skel"
 	utils2 "cni-demo/tools/utils"
 	"errors"
 	"fmt"
 	types "github.com/containernetworking/cni/pkg/types/100"
 	"net"
+	"os"
 	"strconv"
 	// "github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/plugins/pkg/ns"
@@ -31,66 +32,43 @@ func (vx *VxlanCNI) GetMode() string {
 	return MODE
 }
 
-// startWatchNodeChange 函数用于启动监听节点变化的进程。如果默认端口已经被占用，说明已经有子进程在监听 etcd 中节点上的 pod ip 变化，此时可以直接跳过。
-func startWatchNodeChange(ipam *_ipam.IpamService, etcd *_etcd.EtcdClient) error {
-	// 如果这个默认端口已经正在使用了, 则认为之前已经有 pod 在在调用 cni 时启动过监听进程了, 这里可直接跳过
-	pidInt, pidStr, err := utils2.GetPidByPort(consts.DEFAULT_TMP_PORT)
-	if err == nil && pidInt != -1 {
-		// 说明 3190 这个端口正在被监听着, 就跳过 start watcher
-		// 先看这个路径是否存在
-		if utils2.PathExists(consts.KUBE_TEST_CNI_TMP_DEAMON_DEFAULT_PATH) {
-			// 如果该路径存在
-			prevPidStr, err := utils2.ReadContentFromFile(consts.KUBE_TEST_CNI_TMP_DEAMON_DEFAULT_PATH)
-			// 尝试读出里头的 pid, 然后看这个 pid 和当前正在运行中的 port 对应的 pid 是否相等
-			if err != nil || prevPidStr != pidStr {
-				// 如果这个文件有问题的话, 就删掉文件重新把 pid 存进入
-				utils2.DeleteFile(consts.KUBE_TEST_CNI_TMP_DEAMON_DEFAULT_PATH)
-				utils2.CreateFile(consts.KUBE_TEST_CNI_TMP_DEAMON_DEFAULT_PATH, ([]byte)(pidStr), 0766)
-			}
-			return nil
-		}
-		// 如果该路径不存在文件的话, 可能是谁误删了, 那就再创建一份儿
-		utils2.CreateFile(consts.KUBE_TEST_CNI_TMP_DEAMON_DEFAULT_PATH, ([]byte)(pidStr), 0766)
-		return nil
-	}
-	// 走到这里说明还没有一条子进程能监听 etcd 中 node 上的 pod ip 的变换
-	// 这里就启动监听
-	return watcher.StartMapWatcher(ipam, etcd)
-}
-
-// initEveryClient 函数用于初始化 CNI 需要的每个客户端，包括 IPAM、etcd 和 ebpf map。
-func initEveryClient(args *skel.CmdArgs, pluginConfig *cni.PluginConf) (*_ipam.IpamService, *_etcd.EtcdClient, *bpf_map.MapsManager, error) {
+// initIpamClient 函数用于初始化 IPAM 客户端, 两种数据面都要用。
+func initIpamClient(pluginConfig *cni.PluginConf) (*_ipam.IpamService, error) {
 	_ipam.Init(pluginConfig.Subnet, &ipam.IPAMOptions{
 		MaskSegment:      "16",
 		PodIpMaskSegment: "32",
 	})
 	ipam, err := _ipam.GetIpamService()
 	if err != nil {
-		return nil, nil, nil, errors.New(fmt.Sprintf("初始化 ipam 客户端失败: %s", err.Error()))
+		return nil, errors.New(fmt.Sprintf("初始化 ipam 客户端失败: %s", err.Error()))
 	}
-	_etcd.Init()
-	etcd, err := _etcd.GetEtcdClient()
+	return ipam, nil
+}
+
+// initEveryClient 函数用于初始化 CNI 需要的每个客户端，包括 IPAM 和 ebpf map。
+func initEveryClient(args *skel.CmdArgs, pluginConfig *cni.PluginConf) (*_ipam.IpamService, *bpf_map.MapsManager, error) {
+	ipam, err := initIpamClient(pluginConfig)
 	if err != nil {
-		return nil, nil, nil, errors.New(fmt.Sprintf("初始化 etcd 客户端失败: %s", err.Error()))
+		return nil, nil, err
 	}
 
 	bpfmap, err := bpf_map.GetMapsManager()
 	if err != nil {
-		return nil, nil, nil, errors.New(fmt.Sprintf("初始化 ebpf map 失败: %s", err.Error()))
+		return nil, nil, errors.New(fmt.Sprintf("初始化 ebpf map 失败: %s", err.Error()))
 	}
-	return ipam, etcd, bpfmap, nil
+	return ipam, bpfmap, nil
 }
 
-// createHostVethPair 函数用于创建主机上的 veth 对。
-func createHostVethPair(args *skel.CmdArgs, pluginConfig *cni.PluginConf) (*netlink.Veth, *netlink.Veth, error) {
-	hostVeth, _ := netlink.LinkByName("veth_host")
-	netVeth, _ := netlink.LinkByName("veth_net")
+// createHostVethPair 函数用于创建主机上的 veth 对, 名字是配置里的 vxlan.gatewayHost 和 vxlan.gatewayNet。
+func createHostVethPair(args *skel.CmdArgs, conf cni.VxlanConf) (*netlink.Veth, *netlink.Veth, error) {
+	hostVeth, _ := netlink.LinkByName(conf.GatewayHost)
+	netVeth, _ := netlink.LinkByName(conf.GatewayNet)
 
 	if hostVeth != nil && netVeth != nil {
 		// 如果已经有了就直接跳过
 		return hostVeth.(*netlink.Veth), netVeth.(*netlink.Veth), nil
 	}
-	return nettools.CreateVethPair("veth_host", 1500, "veth_net")
+	return nettools.CreateVethPair(conf.GatewayHost, 1500, conf.GatewayNet)
 }
 
 // setUpHostVethPair 函数用于设置主机上的 veth 对。
@@ -139,7 +117,7 @@ func setIpIntoHostPair(ipam *_ipam.IpamService, veth *netlink.Veth) (string, err
 func getNetns(_ns string) (*ns.NetNS, error) {
 	netns, err := ns.GetNS(_ns)
 	if err != nil {
-		utils2.WriteLog("获取 ns 失败: ", err.Error())
+		logger.Error("获取 ns 失败", "err", err)
 		return nil, err
 	}
 	return &netns, nil
@@ -150,7 +128,7 @@ func setHostVethIntoHost(ipam *_ipam.IpamService, veth *netlink.Veth, netns ns.N
 	// 把随机起名的 veth 那头放在主机上
 	err := nettools.SetVethNsFd(veth, netns)
 	if err != nil {
-		utils2.WriteLog("把 veth 设置到 host 上失败: ", err.Error())
+		logger.Error("把 veth 设置到 host 上失败", "err", err)
 		return err
 	}
 	return nil
@@ -161,18 +139,34 @@ func setIpIntoNsPair(ipam *_ipam.IpamService, veth *netlink.Veth) (string, error
 	// 从 ipam 中拿到一个未使用的 ip 地址
 	podIP, err := ipam.Get().UnusedIP()
 	if err != nil {
-		utils2.WriteLog("获取 podIP 出错, err: ", err.Error())
+		logger.Error("获取 podIP 出错", "err", err)
 		return "", err
 	}
 	podIP = fmt.Sprintf("%s/%s", podIP, "32")
 	err = nettools.SetIpForVxlan(veth.Name, podIP)
 	if err != nil {
-		utils2.WriteLog("给 ns veth 设置 ip 失败, err: ", err.Error())
+		logger.Error("给 ns veth 设置 ip 失败", "err", err)
 		return "", err
 	}
 	return podIP, nil
 }
 
+// setPodOwner 函数用于在 ipam 中记录 pod ip 属于哪个 pod, 只是排查问题的时候用, 失败了不影响 pod 创建
+func setPodOwner(ipam *_ipam.IpamService, podIP string, args *skel.CmdArgs) {
+	owner := args.PodName()
+	if owner == "" {
+		return
+	}
+	ip, _, err := net.ParseCIDR(podIP)
+	if err != nil {
+		return
+	}
+	err = ipam.Set().Owner(ip.String(), owner)
+	if err != nil {
+		logger.Warn("记录 pod ip 的 owner 失败", "ip", ip.String(), "pod", owner, "err", err)
+	}
+}
+
 // setUpVeth 函数用于设置 veth 设备。
 func setUpVeth(veth *netlink.Veth) error {
 	return nettools.SetUpVeth(veth)
@@ -183,12 +177,12 @@ func setFibTalbeIntoNs(gw string, veth *netlink.Veth) error {
 	// 启动之后给这个 netns 设置默认路由 以便让其他网段的包也能从 veth 走到网桥
 	gwIp, gwNet, err := net.ParseCIDR(gw)
 	if err != nil {
-		utils2.WriteLog("创建交换路由失败, err:", err.Error())
+		logger.Error("创建交换路由失败", "err", err)
 		return err
 	}
 	defIp, defNet, err := net.ParseCIDR("0.0.0.0/0")
 	if err != nil {
-		utils2.WriteLog("创建交换路由失败, err:", err.Error())
+		logger.Error("创建交换路由失败", "err", err)
 		return err
 	}
 
@@ -196,43 +190,19 @@ func setFibTalbeIntoNs(gw string, veth *netlink.Veth) error {
 	// 注意这里在设置交换路由的时候, 第一条的 gw -> 0.0.0.0 需要是 scope_link
 	err = nettools.AddRoute(gwNet, defIp, veth, netlink.SCOPE_LINK)
 	if err != nil {
-		utils2.WriteLog("设置交换路由 gw -> default 失败: ", err.Error())
+		logger.Error("设置交换路由 gw -> default 失败", "err", err)
 		return err
 	}
 	// 然后创建默认的 0.0.0.0 -> gw 时就可以走默认的 scope universe 了
 	// 否则会创建失败
 	err = nettools.AddRoute(defNet, gwIp, veth)
 	if err != nil {
-		utils2.WriteLog("设置交换路由 default -> gw 失败: ", err.Error())
+		logger.Error("设置交换路由 default -> gw 失败", "err", err)
 		return err
 	}
 	return nil
 }
 
-// setArp 函数用于在给定的网络命名空间和设备上设置 ARP 表项。
-func setArp(ipam *_ipam.IpamService, hostns ns.NetNS, veth *netlink.Veth, dev string) error {
-	gw, err := ipam.Get().Gateway()
-	if err != nil {
-		return err
-	}
-
-	err = hostns.Do(func(nn ns.NetNS) error {
-		// 这里需要重新获取, 因为上边把这个 veth 从 ns 中给挪到了 host 上
-		// 导致 mac 发生了变化
-		v, err := netlink.LinkByName(veth.Attrs().Name)
-		if err != nil {
-			return err
-		}
-		veth = v.(*netlink.Veth)
-		mac := veth.LinkAttrs.HardwareAddr
-		_mac := mac.String()
-		return nn.Do(func(hostns ns.NetNS) error {
-			return nettools.CreateArpEntry(gw, _mac, dev)
-		})
-	})
-	return err
-}
-
 // setUpHostPair 函数用于设置主机 veth 对。
 func setUpHostPair(hostns ns.NetNS, veth *netlink.Veth) error {
 	return hostns.Do(func(nn ns.NetNS) error {
@@ -305,6 +275,40 @@ func setVethPairInfoToLxcMap(bpfmap *bpf_map.MapsManager, hostNs ns.NetNS, podIP
 	if err != nil {
 		return err
 	}
+	// tc 程序里会往这几个 map 里记每个 pod 的收发包数, 每个包是怎么处理的以及采样出来的流量事件
+	_, err = bpfmap.CreateStatsMap()
+	if err != nil {
+		return err
+	}
+	_, err = bpfmap.CreateCountersMap()
+	if err != nil {
+		return err
+	}
+	_, err = bpfmap.CreateFlowEventsMap()
+	if err != nil {
+		return err
+	}
+	_, err = bpfmap.CreateFlowConfigMap()
+	if err != nil {
+		return err
+	}
+	// 访问 service 的连接选中的后端也是 tc 程序自己记的, ding_svc 由 agent 创建
+	_, err = bpfmap.CreateConntrackMap()
+	if err != nil {
+		return err
+	}
+	// pod 问网关 mac 的时候 tc 程序按 ifindex 在这里面找 veth 留在 host 上那头的 mac 代答
+	_, err = bpfmap.CreateLxcDevMap()
+	if err != nil {
+		return err
+	}
+	err = bpfmap.SetLxcDevMap(
+		bpf_map.LxcDevMapKey{IfIndex: hostVethIndex},
+		bpf_map.LxcDevMapValue{MAC: hostVethMac},
+	)
+	if err != nil {
+		return err
+	}
 	return bpfmap.SetLxcMap(
 		bpf_map.EndpointMapKey{IP: nsVethPodIp},
 		bpf_map.EndpointMapInfo{
@@ -325,10 +329,48 @@ func attachTcBPFIntoVeth(veth *netlink.Veth) error {
 }
 
 // 该函数用于创建一个 Vxlan 设备并启动它。它调用 nettools.CreateVxlanAndUp2
-// 方法创建并启动一个名为 name 的 Vxlan 设备，MTU 为 1500。
-func createVxlan(name string) (*netlink.Vxlan, error) {
+// 方法创建并启动一个名字和端口是配置里的 vxlan.device 和 vxlan.port 的 Vxlan 设备，MTU 为 1500。
+func createVxlan(conf cni.VxlanConf) (*netlink.Vxlan, error) {
 	// return nettools.CreateVxlanAndUp(name, 1500)
-	return nettools.CreateVxlanAndUp2(name, 1500)
+	return nettools.CreateVxlanAndUp2(conf.Device, 1500, int(conf.Port))
+}
+
+// setClusterRouteIntoVxlan 函数给整个集群的 pod 网段加一条走 vxlan 设备的路由, 源地址用本机的 node ip。
+// 本机的进程访问 pod 以及回给 pod 的包 (kubelet 的探针, hostNetwork 的 pod, 节点 ip 上的服务) 都靠这条路由,
+// 其他节点的 pod 由 vxlan 的 egress 封装到对应的节点, 本机的 pod 由它直接重定向过去, 见 vxlan_egress.c
+// vxlan 设备本身是 external 的, 发不了 arp, 所以要把 arp 关掉, 不然内核一直在等邻居解析
+func setClusterRouteIntoVxlan(ipam *_ipam.IpamService, vxlan *netlink.Vxlan) error {
+	err := netlink.LinkSetARPOff(vxlan)
+	if err != nil {
+		return err
+	}
+	clusterCIDR, err := ipam.Get().CurrentSubnet()
+	if err != nil {
+		return err
+	}
+	_, dst, err := net.ParseCIDR(clusterCIDR)
+	if err != nil {
+		return err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	nodeIP, err := ipam.Get().NodeIp(hostname)
+	if err != nil {
+		return err
+	}
+	src := net.ParseIP(nodeIP)
+	if src == nil {
+		return fmt.Errorf("invalid node ip %q", nodeIP)
+	}
+	// 每个 pod 起来的时候都会走一遍, 用 replace 就不用管是不是已经有了
+	return netlink.RouteReplace(&netlink.Route{
+		LinkIndex: vxlan.Attrs().Index,
+		Scope:     netlink.SCOPE_LINK,
+		Dst:       dst,
+		Src:       src,
+	})
 }
 
 // 该函数用于将 TC-BPF 附加到 Vxlan 设备上。它首先获取 Vxlan 设备的名称，
@@ -347,8 +389,8 @@ func attachTcBPFIntoVxlan(vxlan *netlink.Vxlan) error {
 }
 
 /**
-* 该函数是 Vxlan 模式 CNI 插件的主要入口。它首先初始化 IPAM、etcd 和 bpfmap 客户端。
-* 然后开始监听 etcd 中 pod 和 subnet map 的变化，并在主机上创建一对 Veth Pair 设备作为默认网关。
+* 该函数是 Vxlan 模式 CNI 插件的主要入口。它首先初始化 IPAM、datastore 和 bpfmap 客户端。
+* 然后开始监听 datastore 中 pod 和 subnet map 的变化，并在主机上创建一对 Veth Pair 设备作为默认网关。
 * 接下来，将一对 Veth 设备加入到容器命名空间，并为容器命名空间中的 Veth 设备分配 IP 地址。
 * 最后，为 Vxlan 设备附加 TC-BPF 并将设备信息存储到本地 Map 中。
 * pluginConfig:
@@ -369,24 +411,36 @@ func attachTcBPFIntoVxlan(vxlan *netlink.Vxlan) error {
  * tc filter add dev ding_vxlan egress bpf direct-action obj vxlan_egress.o
  * tc filter add dev ding_vxlan ingress bpf direct-action obj vxlan_ingress.o
  * tc filter add dev ${pod veth name} ingress bpf direct-action obj veth_ingress.o
+ * 上面的 tc 命令只是等价的写法, 现在是用 cilium/ebpf 加载 .o 之后通过 netlink 挂上去的, 见 tc.TryAttachBPF
  */
 func (vx *VxlanCNI) Bootstrap(args *skel.CmdArgs, pluginConfig *cni.PluginConf) (*types.Result, error) {
-	utils2.WriteLog("进到了 vxlan 模式了")
+	logger.Debug("进到了 vxlan 模式了")
+
+	// 隧道和几块设备的配置, 没填的用默认值
+	vxlanConf := pluginConfig.GetVxlanConf()
+	err := vxlanConf.Validate()
+	if err != nil {
+		return nil, err
+	}
+	// 内核不支持 bpf_redirect_peer 的话用 kernel 数据面, 不挂 tc 程序, 见 bootstrapKernel
+	if vxlanConf.Datapath == consts.VXLAN_DATAPATH_KERNEL {
+		return vx.bootstrapKernel(args, pluginConfig, vxlanConf)
+	}
 
 	// 0. 先把各种能用的上的客户端初始化咯
-	ipam, etcd, bpfmap, err := initEveryClient(args, pluginConfig)
+	ipam, bpfmap, err := initEveryClient(args, pluginConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	// 1. 开始监听 etcd 中 pod 和 subnet map 的变化, 注意该行为只能有一次
-	err = startWatchNodeChange(ipam, etcd)
+	// 1. 监听 datastore 中 pod 和 subnet map 的变化由 cni-demo-agent 负责, 这里只确认它在运行
+	err = agent.CheckAlive()
 	if err != nil {
 		return nil, err
 	}
 
-	// 2. 创建一对 veth pair 设备 veth_host 和 veth_net 作为默认网关
-	gwPair, netPair, err := createHostVethPair(args, pluginConfig)
+	// 2. 创建一对 veth pair 设备 veth_host 和 veth_net (名字可以配) 作为默认网关
+	gwPair, netPair, err := createHostVethPair(args, vxlanConf)
 	if err != nil {
 		return nil, err
 	}
@@ -423,7 +477,7 @@ func (vx *VxlanCNI) Bootstrap(args *skel.CmdArgs, pluginConfig *cni.PluginConf)
 			return err
 		}
 
-		// 7. 给 ns 中的 veth 创建 ip/32, etcd 会自动通知其他 node
+		// 7. 给 ns 中的 veth 创建 ip/32, datastore 会自动通知其他 node
 		podIP, err = setIpIntoNsPair(ipam, nsPair)
 		if err != nil {
 			return err
@@ -435,17 +489,13 @@ func (vx *VxlanCNI) Bootstrap(args *skel.CmdArgs, pluginConfig *cni.PluginConf)
 			return err
 		}
 
-		// 8. 给这个 ns 中创建默认的路由表以及 arp 表, 让其能把流量都走到 ns 外
+		// 8. 给这个 ns 中创建默认的路由表, 让其能把流量都走到 ns 外
+		// 网关的 arp 不用再写死, veth 上挂的 tc 程序会直接代答
 		err = setFibTalbeIntoNs(gw, nsPair)
 		if err != nil {
 			return err
 		}
 
-		err = setArp(ipam, hostNs, hostPair, args.IfName)
-		if err != nil {
-			return err
-		}
-
 		// 启动 ns 留在 host 上那半拉 veth
 		err = setUpHostPair(hostNs, hostPair)
 		if err != nil {
@@ -465,6 +515,9 @@ func (vx *VxlanCNI) Bootstrap(args *skel.CmdArgs, pluginConfig *cni.PluginConf)
 		return nil, err
 	}
 
+	// 记一下这个 ip 分给了哪个 pod, cni-demo-agent 导出流量事件的时候用它把 ip 翻译成 pod 的名字
+	setPodOwner(ipam, podIP, args)
+
 	// 11. 给 veth pair 中留在 host 上的那半拉的 tc 打上 ingress
 	err = attachTcBPFIntoVeth(hostPair)
 	if err != nil {
@@ -472,7 +525,7 @@ func (vx *VxlanCNI) Bootstrap(args *skel.CmdArgs, pluginConfig *cni.PluginConf)
 	}
 
 	// 12. 创建一块儿 vxlan 设备
-	vxlan, err := createVxlan("ding_vxlan")
+	vxlan, err := createVxlan(vxlanConf)
 	if err != nil {
 		return nil, err
 	}
@@ -489,6 +542,30 @@ func (vx *VxlanCNI) Bootstrap(args *skel.CmdArgs, pluginConfig *cni.PluginConf)
 		return nil, err
 	}
 
+	// 15. 本机访问 pod 的流量从 vxlan 设备上走, 见 setClusterRouteIntoVxlan
+	err = setClusterRouteIntoVxlan(ipam, vxlan)
+	if err != nil {
+		return nil, err
+	}
+
+	// 上面创建 map 的时候如果按配置扩了容, 别的 pod 的 veth 上挂着的还是用旧 map 的程序, 都换一遍
+	err = tc.ReattachIfResized()
+	if err != nil {
+		return nil, err
+	}
+
+	// 16. 开了 ipMasq 的话, 访问集群外的流量会走内核协议栈, 在 POSTROUTING 上给它做 snat
+	if pluginConfig.IPMasq {
+		clusterCIDR, err := ipam.Get().CurrentSubnet()
+		if err != nil {
+			return nil, err
+		}
+		err = nettools.SetupPodIPMasq(podIP, clusterCIDR, pluginConfig.NonMasqueradeCIDRs, args.ContainerID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// 最后交给外头去打印到标准输出
 	_gw, _, _ := net.ParseCIDR(gw)
 	_, _podIP, _ := net.ParseCIDR(podIP)
@@ -504,11 +581,18 @@ func (vx *VxlanCNI) Bootstrap(args *skel.CmdArgs, pluginConfig *cni.PluginConf)
 	return result, nil
 }
 
-// 该函数用于卸载 Vxlan 模式 CNI 插件。目前尚未实现。
+// 该函数用于卸载 Vxlan 模式 CNI 插件。目前只会清理 snat 规则。
 func (hostGW *VxlanCNI) Unmount(
 	args *skel.CmdArgs,
 	pluginConfig *cni.PluginConf,
 ) error {
+	if pluginConfig.IPMasq {
+		err := nettools.TeardownIPMasq(args.ContainerID)
+		if err != nil {
+			logger.Error("删除 pod 的 snat 规则失败", "err", err)
+			return err
+		}
+	}
 	// TODO
 	return nil
 }
@@ -528,10 +612,10 @@ func init() {
 	VxlanCNI := &VxlanCNI{}
 	manager := cni.GetCNIManager()
 	err := manager.Register(VxlanCNI)
-	utils2.WriteLog("即将注册 vxlan 模式 cni")
+	logger.Debug("即将注册 vxlan 模式 cni")
 	if err != nil {
-		utils2.WriteLog("注册 vxlan cni 失败: ", err.Error())
+		logger.Error("注册 vxlan cni 失败", "err", err)
 		panic(err.Error())
 	}
-	utils2.WriteLog("注册 vxlan 模式 cni 成功")
+	logger.Debug("注册 vxlan 模式 cni 成功")
 }
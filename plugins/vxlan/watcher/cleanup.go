@@ -0,0 +1,85 @@
+package watcher
+
+import (
+	"cni-demo/ipam"
+	bpfmap "cni-demo/plugins/vxlan/map"
+	"cni-demo/tools/logger"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// 隔多久清理一次 map 里已经不在了的 pod, agent 启动的时候会先清理一次
+const mapCleanupInterval = 5 * time.Minute
+
+var cleanupLog = logger.With("processor", "MapCleaner")
+
+// getLiveEndpoints 函数把本机现有的网卡和 ipam 里本机已经分出去的 ip 整理成清理 map 时用的现状。
+// 本机最后一个 pod 删掉之后记录可能是空的, 这时候 map 里剩下的 pod 确实都不在了, 所以空的也照样用;
+// ipam 读失败的情况由调用的地方按 AllUsedIPs 的错误判断, 不会走到这里。
+func getLiveEndpoints(links []netlink.Link, usedIPs []string) *bpfmap.LiveEndpoints {
+	live := &bpfmap.LiveEndpoints{
+		IfIndexes: map[uint32]bool{},
+		PodIPs:    map[string]bool{},
+	}
+	for _, link := range links {
+		live.IfIndexes[uint32(link.Attrs().Index)] = true
+	}
+	for _, ip := range usedIPs {
+		if ip != "" {
+			live.PodIPs[ip] = true
+		}
+	}
+	return live
+}
+
+// cleanupMaps 函数清理一遍 pin 住的 map, 删掉了东西的话打一条日志。
+func cleanupMaps(is *ipam.IpamService, mm *bpfmap.MapsManager) error {
+	res, err := mm.CleanupStaleEntries(func() (*bpfmap.LiveEndpoints, error) {
+		links, err := netlink.LinkList()
+		if err != nil {
+			return nil, err
+		}
+		// 读 ipam 失败的话不能清理, 不然所有 pod 都会被当成不在了
+		usedIPs, err := is.Get().AllUsedIPs()
+		if err != nil {
+			return nil, err
+		}
+		return getLiveEndpoints(links, usedIPs), nil
+	})
+	if len(res) > 0 {
+		args := []interface{}{}
+		for name, count := range res {
+			args = append(args, name, count)
+		}
+		cleanupLog.Info("清理了 map 里已经不在了的条目", args...)
+	}
+	return err
+}
+
+// RunMapCleaner 函数在 agent 启动的时候以及之后定时清理 pin 住的 map 里已经不在了的 pod 和网卡, 一直阻塞到 stop 被关掉
+// 插件崩溃或者 DEL 没执行完的时候 ding_lxc 之类的 map 里会一直留着已经删掉了的 pod, 见 bpfmap.MapsManager.CleanupStaleEntries
+func RunMapCleaner(is *ipam.IpamService, stop <-chan struct{}) error {
+	mm, err := bpfmap.GetMapsManager()
+	if err != nil {
+		return err
+	}
+	err = cleanupMaps(is, mm)
+	if err != nil {
+		cleanupLog.Error("清理 map 失败", "err", err)
+	}
+
+	ticker := time.NewTicker(mapCleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return nil
+		}
+		err := cleanupMaps(is, mm)
+		if err != nil {
+			cleanupLog.Error("清理 map 失败", "err", err)
+		}
+	}
+}
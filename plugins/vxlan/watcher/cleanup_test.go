@@ -0,0 +1,28 @@
+package watcher
+
+import (
+	bpfmap "cni-demo/plugins/vxlan/map"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+)
+
+func TestLiveEndpoints(t *testing.T) {
+	test := assert.New(t)
+
+	links := []netlink.Link{
+		&netlink.Device{LinkAttrs: netlink.LinkAttrs{Index: 1, Name: "lo"}},
+		&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Index: 7, Name: "ding_lxc_12345"}},
+	}
+	live := getLiveEndpoints(links, []string{"10.244.3.0", "10.244.3.1", "10.244.3.5", ""})
+	test.Equal(&bpfmap.LiveEndpoints{
+		IfIndexes: map[uint32]bool{1: true, 7: true},
+		PodIPs:    map[string]bool{"10.244.3.0": true, "10.244.3.1": true, "10.244.3.5": true},
+	}, live)
+
+	// 本机最后一个 pod 删掉之后记录是空的, 这时候 map 里的 pod 都该清掉
+	live = getLiveEndpoints(links, []string{""})
+	test.Empty(live.PodIPs)
+	test.Len(live.IfIndexes, 2)
+}
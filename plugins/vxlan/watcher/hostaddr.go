@@ -0,0 +1,157 @@
+package watcher
+
+import (
+	bpfmap "cni-demo/plugins/vxlan/map"
+	"cni-demo/plugins/vxlan/tc"
+	"cni-demo/tools/logger"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// 订阅的地址变化可能会丢, 隔一段时间全量对一遍
+const hostAddrResyncInterval = time.Minute
+
+var hostAddrLog = logger.With("processor", "HostAddrSyncer")
+
+// dummyLinks 函数返回 dummy 类型网卡的 ifindex。
+// kube-proxy 的 ipvs 模式会把所有的 ClusterIP 都挂到 kube-ipvs0 这个 dummy 网卡上, 放进 ding_local 的话很快就满了,
+// 这些地址不用放: 查不到的包本来就会交给内核协议栈, 和命中本机地址的结果一样。
+func dummyLinks(links []netlink.Link) map[int]bool {
+	res := map[int]bool{}
+	for _, link := range links {
+		if link.Type() == "dummy" {
+			res[link.Attrs().Index] = true
+		}
+	}
+	return res
+}
+
+// getHostAddrEntries 函数算出 ding_local 中本机地址应该有的条目, key 是网络字节序的地址, value 是地址所在网卡的 ifindex。
+// 只要 ipv4 的, 回环地址不会从 pod 的 veth 上过来, 不用放进去; skip 里的网卡上的地址也不要。
+func getHostAddrEntries(addrs []netlink.Addr, skip map[int]bool) map[[4]byte]uint32 {
+	res := map[[4]byte]uint32{}
+	for _, addr := range addrs {
+		if addr.IPNet == nil || skip[addr.LinkIndex] {
+			continue
+		}
+		ip := addr.IP.To4()
+		if ip == nil || ip.IsLoopback() {
+			continue
+		}
+		var key [4]byte
+		copy(key[:], ip)
+		res[key] = uint32(addr.LinkIndex)
+	}
+	return res
+}
+
+// diffHostAddrEntries 函数比较 ding_local 中现有的本机地址 prev 和应该有的 next, 返回要删掉的 key 以及要写进去的键值对。
+func diffHostAddrEntries(prev, next map[[4]byte]uint32) ([]bpfmap.LocalNodeMapKey, []bpfmap.LocalNodeMapKey, []bpfmap.LocalNodeMapValue) {
+	dels := []bpfmap.LocalNodeMapKey{}
+	keys := []bpfmap.LocalNodeMapKey{}
+	values := []bpfmap.LocalNodeMapValue{}
+	for ip := range prev {
+		if _, ok := next[ip]; !ok {
+			dels = append(dels, bpfmap.LocalNodeMapKey{Type: bpfmap.HOST_ADDR, IP: ip})
+		}
+	}
+	for ip, ifindex := range next {
+		if old, ok := prev[ip]; ok && old == ifindex {
+			continue
+		}
+		keys = append(keys, bpfmap.LocalNodeMapKey{Type: bpfmap.HOST_ADDR, IP: ip})
+		values = append(values, bpfmap.LocalNodeMapValue{IfIndex: ifindex})
+	}
+	return dels, keys, values
+}
+
+// syncHostAddrs 函数把本机现在的 ipv4 地址同步到 ding_local 中, 数据面靠它判断包是不是发给本机的。
+func syncHostAddrs(mm *bpfmap.MapsManager) error {
+	addrs, err := netlink.AddrList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return err
+	}
+	prev, err := mm.HostAddrEntries()
+	if err != nil {
+		return err
+	}
+	next := getHostAddrEntries(addrs, dummyLinks(links))
+	dels, keys, values := diffHostAddrEntries(prev, next)
+	if len(dels) > 0 {
+		_, err = mm.BatchDelNodeLocalMap(dels)
+		if err != nil {
+			return err
+		}
+	}
+	if len(keys) > 0 {
+		_, err = mm.BatchSetNodeLocalMap(keys, values)
+		if err != nil {
+			return err
+		}
+	}
+	if len(dels) > 0 || len(keys) > 0 {
+		hostAddrLog.Info("同步本机地址成功", "total", len(next), "deleted", len(dels), "updated", len(keys))
+	}
+	return nil
+}
+
+// RunHostAddrWatcher 函数把本机的地址同步到 ding_local 中, 地址有变化的时候再同步, 一直阻塞到 stop 被关掉
+// 由 cni-demo-agent 调用, pod 访问节点 ip 或者 hostNetwork 的 pod 时数据面要靠它认出来是发给本机的
+func RunHostAddrWatcher(stop <-chan struct{}) error {
+	mm, err := bpfmap.GetMapsManager()
+	if err != nil {
+		return err
+	}
+	// 以前的 ding_local 的 key 里没有地址, 这里会换成新的, 已经挂着的程序要重新挂一遍
+	_, err = mm.CreateNodeLocalMap()
+	if err != nil {
+		return err
+	}
+	err = tc.ReattachIfResized()
+	if err != nil {
+		hostAddrLog.Error("重新挂 tc 程序失败", "err", err)
+	}
+	err = syncHostAddrs(mm)
+	if err != nil {
+		return err
+	}
+
+	updates := make(chan netlink.AddrUpdate, 16)
+	done := make(chan struct{})
+	defer close(done)
+	err = netlink.AddrSubscribeWithOptions(updates, done, netlink.AddrSubscribeOptions{
+		ErrorCallback: func(err error) {
+			hostAddrLog.Error("订阅地址变化出错", "err", err)
+		},
+	})
+	if err != nil {
+		// 订阅不了的话只靠定时同步
+		hostAddrLog.Error("订阅地址变化失败", "err", err)
+		updates = nil
+	}
+
+	ticker := time.NewTicker(hostAddrResyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case _, ok := <-updates:
+			if !ok {
+				hostAddrLog.Warn("地址变化的订阅断开了, 之后只靠定时同步")
+				updates = nil
+				continue
+			}
+		case <-ticker.C:
+		case <-stop:
+			return nil
+		}
+		err := syncHostAddrs(mm)
+		if err != nil {
+			hostAddrLog.Error("同步本机地址失败", "err", err)
+		}
+	}
+}
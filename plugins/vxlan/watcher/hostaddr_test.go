@@ -0,0 +1,48 @@
+package watcher
+
+import (
+	bpfmap "cni-demo/plugins/vxlan/map"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+)
+
+func newAddr(cidr string, ifindex int) netlink.Addr {
+	ip, ipnet, _ := net.ParseCIDR(cidr)
+	ipnet.IP = ip
+	return netlink.Addr{IPNet: ipnet, LinkIndex: ifindex}
+}
+
+func TestHostAddrEntries(t *testing.T) {
+	test := assert.New(t)
+
+	next := getHostAddrEntries([]netlink.Addr{
+		newAddr("127.0.0.1/8", 1),
+		newAddr("192.168.64.13/24", 2),
+		// pod 的网关挂在 veth_host 上
+		newAddr("10.244.3.1/32", 5),
+		newAddr("fd00::13/64", 2),
+		// kube-ipvs0 上的 ClusterIP
+		newAddr("10.96.0.1/32", 7),
+	}, dummyLinks([]netlink.Link{
+		&netlink.Device{LinkAttrs: netlink.LinkAttrs{Index: 2, Name: "eth0"}},
+		&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Index: 7, Name: "kube-ipvs0"}},
+	}))
+	test.Equal(map[[4]byte]uint32{
+		{192, 168, 64, 13}: 2,
+		{10, 244, 3, 1}:    5,
+	}, next)
+
+	// 网关没变, 节点 ip 换了网卡, 172.17.0.1 已经没了
+	prev := map[[4]byte]uint32{
+		{192, 168, 64, 13}: 3,
+		{10, 244, 3, 1}:    5,
+		{172, 17, 0, 1}:    4,
+	}
+	dels, keys, values := diffHostAddrEntries(prev, next)
+	test.Equal([]bpfmap.LocalNodeMapKey{{Type: bpfmap.HOST_ADDR, IP: [4]byte{172, 17, 0, 1}}}, dels)
+	test.Equal([]bpfmap.LocalNodeMapKey{{Type: bpfmap.HOST_ADDR, IP: [4]byte{192, 168, 64, 13}}}, keys)
+	test.Equal([]bpfmap.LocalNodeMapValue{{IfIndex: 2}}, values)
+}
@@ -1,150 +1,128 @@
 package watcher
 
 import (
-	"cni-demo/consts"
 	"cni-demo/ipam"
 	bpfmap "cni-demo/plugins/vxlan/map"
+	"cni-demo/tools/logger"
 	utils2 "cni-demo/tools/utils"
-	"fmt"
-	"go.etcd.io/etcd/api/v3/mvccpb"
-	"net/http"
-	"strconv"
-	"strings"
+	"net"
+	"sync"
 )
 
-// tmpKV 结构体用于临时存储 key 和 value，其中 key 为 bpfmap.PodNodeMapKey 类型，value 为 bpfmap.PodNodeMapValue 类型。
-type tmpKV struct {
-	key   bpfmap.PodNodeMapKey
-	value bpfmap.PodNodeMapValue
-}
-
-// TEST_CNI_DEFAULT_DEAMON_HEALTH 常量用于定义健康检查的路由。
-const TEST_CNI_DEFAULT_DEAMON_HEALTH = "/childprocess/health"
+var processorLog = logger.With("processor", "PodCIDRSyncProcessor")
 
-// startHealthServer 函数用于启动一个简单的 HTTP 服务，用于健康检查。
-func startHealthServer() {
-	http.HandleFunc(consts.DEFAULT_TEST_CNI_API+TEST_CNI_DEFAULT_DEAMON_HEALTH, func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte("OK"))
-	})
-	err := http.ListenAndServe(":"+consts.DEFAULT_TMP_PORT, nil)
-	if err != nil {
-		utils2.WriteLog("(RecordSyncProcessor) 启动监听子进程失败: ", err.Error())
+// getPodCIDREntries 函数根据 ipam 中网段和 hostname 的映射(map[网段 ip]hostname)算出 ding_cidr 中应该有的条目。
+// 本机的网段不用放进去, 本机的 pod 都在 ding_lxc 里。
+// 其他节点自己的 ip 也放一条 /32 进去, pod 访问其他节点的 ip 或者上面 hostNetwork 的 pod 时也封装过去, 值就是它自己。
+// 拿不到 node ip 的节点沿用 prev(ding_cidr 中现有的条目)里它的网段和节点 ip 的条目, 不然 apiserver 抖一下就把它的路由删了;
+// prev 里也没有的话先跳过, 等节点加入集群的时候会再同步一次。
+func getPodCIDREntries(blocks map[string]string, maskSegment int, hostname string, nodeIp func(string) (string, error), prev map[bpfmap.PodCIDRMapKey]bpfmap.PodCIDRMapValue) map[bpfmap.PodCIDRMapKey]bpfmap.PodCIDRMapValue {
+	res := map[bpfmap.PodCIDRMapKey]bpfmap.PodCIDRMapValue{}
+	mask := net.CIDRMask(maskSegment, 32)
+	for block, host := range blocks {
+		if host == "" || host == hostname {
+			continue
+		}
+		ip := net.ParseIP(block).To4()
+		if ip == nil {
+			processorLog.Error("网段的格式不对", "block", block, "host", host)
+			continue
+		}
+		key := bpfmap.PodCIDRMapKey{Prefixlen: uint32(maskSegment)}
+		copy(key.IP[:], ip.Mask(mask))
+		hostIp, err := nodeIp(host)
+		if err != nil || hostIp == "" {
+			processorLog.Error("获取 host ip 失败, 沿用现有的条目", "host", host, "err", err)
+			hostIp = ""
+			if value, ok := prev[key]; ok {
+				hostIp = utils2.InetUint32ToIp(value.IP)
+			}
+		}
+		if hostIp == "" {
+			continue
+		}
+		res[key] = bpfmap.PodCIDRMapValue{IP: utils2.InetIpToUInt32(hostIp)}
+		if nodeIP := net.ParseIP(hostIp).To4(); nodeIP != nil {
+			nodeKey := bpfmap.PodCIDRMapKey{Prefixlen: 32}
+			copy(nodeKey.IP[:], nodeIP)
+			res[nodeKey] = res[key]
+		}
 	}
+	return res
 }
 
-// getHostnameFromKey 函数根据传入的 key 字符串提取 hostname。
-func getHostnameFromKey(key string) string {
-	tmp := utils2.GetParentDirectory(key)
-	tmpArr := strings.Split(tmp, "/")
-	return tmpArr[len(tmpArr)-1]
+// diffPodCIDREntries 函数比较 ding_cidr 中现有的条目 prev 和应该有的条目 next, 返回要删掉的 key 以及要写进去的键值对。
+// 没变的条目不动, 免得数据面在删掉和写回去的间隙里查不到。
+func diffPodCIDREntries(prev, next map[bpfmap.PodCIDRMapKey]bpfmap.PodCIDRMapValue) ([]bpfmap.PodCIDRMapKey, []bpfmap.PodCIDRMapKey, []bpfmap.PodCIDRMapValue) {
+	dels := []bpfmap.PodCIDRMapKey{}
+	keys := []bpfmap.PodCIDRMapKey{}
+	values := []bpfmap.PodCIDRMapValue{}
+	for key := range prev {
+		if _, ok := next[key]; !ok {
+			dels = append(dels, key)
+		}
+	}
+	for key, value := range next {
+		if old, ok := prev[key]; ok && old == value {
+			continue
+		}
+		keys = append(keys, key)
+		values = append(values, value)
+	}
+	return dels, keys, values
 }
 
-// getIpsFromValue 函数根据传入的 value 字符串提取 IP 地址。
-func getIpsFromValue(value string) []string {
-	return strings.Split(value, ";")
+// PodCIDRSyncer 负责把 ipam 中其他节点分到的网段同步到 ding_cidr 中。
+// 只有节点分到或者还回网段、节点加入或者离开集群的时候才需要同步, pod 的增删和它无关。
+type PodCIDRSyncer struct {
+	ipam     *ipam.IpamService
+	hostname string
+	lock     sync.Mutex
 }
 
-// getBatchMapKV 函数根据传入的 initData（map[ip]hostname 形式），获取批量的 key 和 value 结构体数组。
-// 这里的 initData 是 map[ip]hostname 的形式
-func getBatchMapKV(ipam *ipam.IpamService, initData map[string]string) []tmpKV {
-	res := []tmpKV{}
-
-	for k, v := range initData {
-		hostIp, err := ipam.Get().NodeIp(v)
-		if err != nil {
-			utils2.WriteLog("(RecordSyncProcessor) 获取 host ip 失败")
-			return nil
-		}
-		res = append(res, tmpKV{
-			key: bpfmap.PodNodeMapKey{
-				IP: utils2.InetIpToUInt32(k),
-			},
-			value: bpfmap.PodNodeMapValue{
-				IP: utils2.InetIpToUInt32(hostIp),
-			},
-		})
+// NewPodCIDRSyncer 函数创建一个 PodCIDRSyncer, hostname 是本机的主机名。
+func NewPodCIDRSyncer(ipam *ipam.IpamService, hostname string) *PodCIDRSyncer {
+	return &PodCIDRSyncer{
+		ipam:     ipam,
+		hostname: hostname,
 	}
-	return res
 }
 
-// transformTmpKV2PodNodeMapKV 函数将传入的 tmpKV 结构体数组转换为两个数组，一个为 bpfmap.PodNodeMapKey 数组，一个为 bpfmap.PodNodeMapValue 数组。
-func transformTmpKV2PodNodeMapKV(tmp []tmpKV) ([]bpfmap.PodNodeMapKey, []bpfmap.PodNodeMapValue) {
-	keys := []bpfmap.PodNodeMapKey{}
-	values := []bpfmap.PodNodeMapValue{}
-	for _, item := range tmp {
-		keys = append(keys, item.key)
-		values = append(values, item.value)
-	}
-	return keys, values
-}
+// Sync 方法读一遍 ipam 中所有节点的网段, 把和 ding_cidr 中不一样的地方更新过去。
+func (s *PodCIDRSyncer) Sync() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
-// InitRecordSyncProcessor 函数用于初始化 RecordSyncProcessor，返回一个处理函数，该函数用于处理监听到的事件。
-func InitRecordSyncProcessor(ipam *ipam.IpamService, initData map[string]string) func(_type mvccpb.Event_EventType, key, value []byte) {
-	mm, err := bpfmap.GetMapsManager()
+	blocks, err := s.ipam.Get().HostSubnetMap()
 	if err != nil {
-		utils2.WriteLog("(RecordSyncProcessor) 获取 bpf maps manager 失败: ", err.Error())
-		return nil
+		return err
 	}
-	_, err = mm.CreatePodMap()
+	maskSegment, err := s.ipam.Get().BlockMaskSegment()
 	if err != nil {
-		utils2.WriteLog("(RecordSyncProcessor) 创建 pod map 失败: ", err.Error())
-		return nil
+		return err
 	}
-	// 获取当前 etcd 中已经存在的 node 和 pod ip 的对应关系
-	prevData := getBatchMapKV(ipam, initData)
-	// 然后转成 keys 和 values 的数据
-	prevKeys, prevValues := transformTmpKV2PodNodeMapKV(prevData)
-	// 批量更新到本地 ebpf map
-	res, err := mm.BatchSetPodMap(prevKeys, prevValues)
+	mm, err := bpfmap.GetMapsManager()
 	if err != nil {
-		utils2.WriteLog("(RecordSyncProcessor) 批量初始化 node-pod maps 失败: ", err.Error())
-		return nil
+		return err
 	}
-	utils2.WriteLog("(RecordSyncProcessor) 初始化 node-pod maps 成功, 数量: ", strconv.Itoa(res))
-	return func(_type mvccpb.Event_EventType, key, value []byte) {
-		utils2.WriteLog(fmt.Sprintf("进到了 Processor: %s, %q, %q\n", _type, key, value))
-		/**
-		 * 进到这里, 一定是监听到了其他节点上的网段已经对应的 pod ip 的关系变化
-		 * 比如其他节点添加了或者删除某个 pod, 这里能感知到其变化
-		 * 将其存入到 POD_MAP_DEFAULT_PATH 中
-		 */
-		// 先从 key 中拿到 hostname
-		hostname := getHostnameFromKey(string(key))
-		if hostname == "" {
-			utils2.WriteLog("(RecordSyncProcessor) 获取 hostname 失败")
-			return
-		}
-		// 从 value 获取到这次更新的 node 对应的所有 pod ip 地址
-		ips := getIpsFromValue(string(value))
-		// 存储格式 map[ip]hostname
-		_maps := map[string]string{}
-		for _, ip := range ips {
-			_maps[ip] = hostname
-		}
-		// 把当前的 ips 和 node ip 的对应关系搞出来
-		prevData = getBatchMapKV(ipam, _maps)
-		// 然后转成 keys 和 values 的数据
-		prevKeys, prevValues = transformTmpKV2PodNodeMapKV(prevData)
-
-		mm, err := bpfmap.GetMapsManager()
-		if err != nil {
-			utils2.WriteLog("(RecordSyncProcessor) 获取 bpf maps manager 失败: ", err.Error())
-			return
-		}
-
-		// 先删除当前 pod node map 中的所有
-		_, err = mm.DeleteAllPodMap()
+	prev, err := mm.PodCIDRMapEntries()
+	if err != nil {
+		return err
+	}
+	next := getPodCIDREntries(blocks, maskSegment, s.hostname, s.ipam.Get().NodeIp, prev)
+	dels, keys, values := diffPodCIDREntries(prev, next)
+	if len(dels) > 0 {
+		_, err = mm.BatchDelPodCIDRMap(dels)
 		if err != nil {
-			utils2.WriteLog("(RecordSyncProcessor) 批量删除上次 key 失败: ", err.Error())
-			// return
+			return err
 		}
-
-		// 然后再把本次的都批量更新到 map
-		_, err = mm.BatchSetPodMap(prevKeys, prevValues)
+	}
+	if len(keys) > 0 {
+		_, err = mm.BatchSetPodCIDRMap(keys, values)
 		if err != nil {
-			utils2.WriteLog("(RecordSyncProcessor) 批量更新 node-pod maps 失败: ", err.Error())
-			return
+			return err
 		}
-		utils2.WriteLog("(RecordSyncProcessor) 更新 node-pod maps 成功, 数量: ", strconv.Itoa(res))
 	}
+	processorLog.Info("同步 pod 网段成功", "total", len(next), "deleted", len(dels), "updated", len(keys))
+	return nil
 }
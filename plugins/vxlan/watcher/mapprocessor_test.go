@@ -0,0 +1,69 @@
+package watcher
+
+import (
+	bpfmap "cni-demo/plugins/vxlan/map"
+	"cni-demo/tools/utils"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPodCIDREntries(t *testing.T) {
+	test := assert.New(t)
+	nodeIps := map[string]string{
+		"node-1": "192.168.64.11",
+		"node-2": "192.168.64.12",
+	}
+	nodeIp := func(host string) (string, error) {
+		if ip, ok := nodeIps[host]; ok {
+			return ip, nil
+		}
+		return "", errors.New("not found")
+	}
+	blocks := map[string]string{
+		"10.244.1.0": "node-1",
+		"10.244.2.0": "node-2",
+		// 本机的网段不放进去
+		"10.244.3.0": "node-3",
+		// 还查不到 node ip 的先跳过
+		"10.244.4.0": "node-4",
+	}
+	next := getPodCIDREntries(blocks, 24, "node-3", nodeIp, nil)
+	node1 := bpfmap.PodCIDRMapKey{Prefixlen: 24, IP: [4]byte{10, 244, 1, 0}}
+	node2 := bpfmap.PodCIDRMapKey{Prefixlen: 24, IP: [4]byte{10, 244, 2, 0}}
+	// 其他节点自己的 ip 也各有一条 /32
+	node1Host := bpfmap.PodCIDRMapKey{Prefixlen: 32, IP: [4]byte{192, 168, 64, 11}}
+	node2Host := bpfmap.PodCIDRMapKey{Prefixlen: 32, IP: [4]byte{192, 168, 64, 12}}
+	test.Equal(map[bpfmap.PodCIDRMapKey]bpfmap.PodCIDRMapValue{
+		node1:     {IP: utils.InetIpToUInt32("192.168.64.11")},
+		node2:     {IP: utils.InetIpToUInt32("192.168.64.12")},
+		node1Host: {IP: utils.InetIpToUInt32("192.168.64.11")},
+		node2Host: {IP: utils.InetIpToUInt32("192.168.64.12")},
+	}, next)
+
+	// node-1 没变, node-2 换了 ip, 10.244.5.0 已经还回去了
+	stale := bpfmap.PodCIDRMapKey{Prefixlen: 24, IP: [4]byte{10, 244, 5, 0}}
+	prev := map[bpfmap.PodCIDRMapKey]bpfmap.PodCIDRMapValue{
+		node1:     {IP: utils.InetIpToUInt32("192.168.64.11")},
+		node2:     {IP: utils.InetIpToUInt32("192.168.64.99")},
+		node1Host: {IP: utils.InetIpToUInt32("192.168.64.11")},
+		node2Host: {IP: utils.InetIpToUInt32("192.168.64.12")},
+		stale:     {IP: utils.InetIpToUInt32("192.168.64.15")},
+	}
+	dels, keys, values := diffPodCIDREntries(prev, next)
+	test.Equal([]bpfmap.PodCIDRMapKey{stale}, dels)
+	test.Equal([]bpfmap.PodCIDRMapKey{node2}, keys)
+	test.Equal([]bpfmap.PodCIDRMapValue{{IP: utils.InetIpToUInt32("192.168.64.12")}}, values)
+
+	// node-4 已经在 ding_cidr 里了, 这次查 node ip 失败的话沿用原来的, 不能删掉
+	node4 := bpfmap.PodCIDRMapKey{Prefixlen: 24, IP: [4]byte{10, 244, 4, 0}}
+	node4Host := bpfmap.PodCIDRMapKey{Prefixlen: 32, IP: [4]byte{192, 168, 64, 14}}
+	prev[node4] = bpfmap.PodCIDRMapValue{IP: utils.InetIpToUInt32("192.168.64.14")}
+	prev[node4Host] = prev[node4]
+	next = getPodCIDREntries(blocks, 24, "node-3", nodeIp, prev)
+	test.Equal(prev[node4], next[node4])
+	test.Equal(prev[node4], next[node4Host])
+	dels, _, _ = diffPodCIDREntries(prev, next)
+	test.Equal([]bpfmap.PodCIDRMapKey{stale}, dels)
+}
@@ -1,63 +1,121 @@
 package watcher
 
 import (
-	"cni-demo/consts"
-	"cni-demo/etcd"
+	"cni-demo/datastore"
 	"cni-demo/ipam"
+	bpfmap "cni-demo/plugins/vxlan/map"
+	"cni-demo/plugins/vxlan/tc"
+	"cni-demo/tools/logger"
 	utils2 "cni-demo/tools/utils"
-	"fmt"
-	"strconv"
+	"os"
+
+	v1 "k8s.io/api/core/v1"
 )
 
-// getAllInitPath 函数用于获取所有节点的初始路径。
-func getAllInitPath(ipam *ipam.IpamService) (map[string]string, error) {
-	networks, err := ipam.Get().AllHostNetwork()
-	if err != nil {
-		return nil, err
-	}
-	maps := map[string]string{}
-	for _, network := range networks {
-		if network.IsCurrentHost || network.CIDR == "" {
-			continue
-		}
-		ips, err := ipam.Get().RecordByHost(network.Hostname)
-		if err != nil {
-			return nil, err
-		}
-		for _, ip := range ips {
-			maps[ip] = network.Hostname
+// getNodeInternalIP 函数返回节点的 InternalIP, 没有的话返回空字符串。
+func getNodeInternalIP(node *v1.Node) string {
+	for _, addr := range node.Status.Addresses {
+		if addr.Type == v1.NodeInternalIP {
+			return addr.Address
 		}
 	}
-	return maps, nil
+	return ""
 }
 
-// StartMapWatcher 函数用于启动 MapWatcher，负责监听各个节点的变换并将结果更新到 ebpf 的 map 中。
-func StartMapWatcher(ipam *ipam.IpamService, etcd *etcd.EtcdClient) error {
-	/**
-	 * 这里要负责监听各个节点的变换
-	 * 并把得到的结果给塞到 ebpf 的 map 中
-	 */
+// removeLegacyPodMap 函数删掉以前按 pod ip 一条一条存的 ding_ip。
+// 已经挂着的程序用的还是它, 删掉之后要把本机的程序都重新挂一遍, 换成用 ding_cidr 的新程序。
+func removeLegacyPodMap() error {
+	if !utils2.PathExists(bpfmap.LEGACY_POD_MAP_DEFAULT_PATH) {
+		return nil
+	}
+	err := os.Remove(bpfmap.LEGACY_POD_MAP_DEFAULT_PATH)
+	if err != nil {
+		return err
+	}
+	logger.Info("删掉了旧的 pod map", "path", bpfmap.LEGACY_POD_MAP_DEFAULT_PATH)
+	return tc.ReattachAllBPF()
+}
 
-	// 先去获取其他节点所有的 ip 地址
-	initMaps, err := getAllInitPath(ipam)
+// getNodeHandler 函数返回节点加入和离开集群时的处理逻辑。
+// 加入的节点可能在分到网段的时候还查不到 node ip, 所以再同步一次;
+// 离开的节点要把 ding_cidr 中指向它的网段都删掉, 免得继续往一个已经不存在的节点上发包。
+func getNodeHandler(syncer *PodCIDRSyncer) *ipam.NodeHandler {
+	return &ipam.NodeHandler{
+		OnAdd: func(node *v1.Node) {
+			err := syncer.Sync()
+			if err != nil {
+				logger.Error("同步 pod 网段失败", "node", node.Name, "err", err)
+			}
+		},
+		OnDelete: func(node *v1.Node) {
+			ip := getNodeInternalIP(node)
+			if ip == "" {
+				return
+			}
+			mm, err := bpfmap.GetMapsManager()
+			if err != nil {
+				logger.Error("获取 bpf maps manager 失败", "err", err)
+				return
+			}
+			n, err := mm.DeletePodCIDRMapByNode(utils2.InetIpToUInt32(ip))
+			if err != nil {
+				logger.Error("删除节点的 pod 网段失败", "node", node.Name, "err", err)
+				return
+			}
+			logger.Info("节点离开了集群, 删除了 pod 网段", "node", node.Name, "count", n)
+		},
+	}
+}
+
+// RunMapWatcher 函数负责监听各个节点分到的网段并将结果更新到 ebpf 的 map 中, 一直阻塞到 stop 被关掉
+// 由 cni-demo-agent 调用, 以前是在 CNI ADD 里 fork 出一个守护进程来跑的
+// ding_cidr 里是每个节点一条网段, 只用监听 ipam 里 hostname 和网段的映射, 不用再监听每个节点的 pod 记录
+func RunMapWatcher(ipam *ipam.IpamService, store datastore.Datastore, stop <-chan struct{}) error {
+	mm, err := bpfmap.GetMapsManager()
+	if err != nil {
+		return err
+	}
+	_, err = mm.CreatePodCIDRMap()
+	if err != nil {
+		return err
+	}
+	// 配置里的大小变了的话 ding_cidr 刚换成了新的, 已经挂着的程序要重新挂一遍才能用上
+	err = tc.ReattachIfResized()
+	if err != nil {
+		logger.Error("重新挂 tc 程序失败", "err", err)
+	}
+	err = removeLegacyPodMap()
+	if err != nil {
+		logger.Error("删除旧的 pod map 失败", "err", err)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	syncer := NewPodCIDRSyncer(ipam, hostname)
+	err = syncer.Sync()
 	if err != nil {
 		return err
 	}
 	handlers := &Handlers{
-		SubnetRecordHandler: InitRecordSyncProcessor(ipam, initMaps),
+		HostSubnetMapsHandler: func(_type datastore.EventType, key, value []byte) {
+			processorLog.Debug("收到了 watch 事件", "type", _type, "key", key, "value", value)
+			err := syncer.Sync()
+			if err != nil {
+				processorLog.Error("同步 pod 网段失败", "err", err)
+			}
+		},
 	}
-	watcher, err := GetWatcher(ipam, etcd, handlers)
+	// 每次都用一个新的, agent 重新拉起来的时候不能复用上次已经取消了的 watcher
+	watcher, err := NewWatcherProcess(ipam, store, handlers)
 	if err != nil {
 		return err
 	}
-
-	child := utils2.StartDeamon(func() {
-		watcher.StartWatch()
-		// 在最后启动一个 http 服务作为该子进程的健康检查
-		utils2.WriteLog("开始启动健康检查的服务")
-		startHealthServer()
-	})
-	utils2.CreateFile(consts.KUBE_TEST_CNI_TMP_DEAMON_DEFAULT_PATH, ([]byte)(strconv.Itoa(child.Pid)), 0766)
-	utils2.WriteLog(fmt.Sprintf("启动的守护进程是: %d", child.Pid))
-	return nil
+	cancel, err := watcher.StartWatch()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	// 节点的加入和离开直接跟着 apiserver 走, WatchNodes 会一直阻塞到 stop 被关掉
+	return ipam.WatchNodes(getNodeHandler(syncer), stop)
 }
@@ -1,37 +1,38 @@
 package watcher
 
 import (
-	"cni-demo/etcd"
+	"cni-demo/datastore"
 	"cni-demo/ipam"
 	"cni-demo/tools/utils"
 	"encoding/json"
 	"os"
 	"time"
-
-	"go.etcd.io/etcd/api/v3/mvccpb"
 )
 
 // ipam：IpamService 实例，用于 IP 地址管理相关操作
-// etcd：EtcdClient 实例，用于访问 etcd 数据
-// watcher：etcd Watcher 实例，用于监控 etcd 数据的变化
-// subnetRecordHandler：etcd WatchCallback 函数类型，处理 subnet 记录变化时调用的回调函数
+// store：Datastore 实例，用于访问 ipam 的数据
+// watcher：datastore Watcher 实例，用于监控 ipam 数据的变化
+// subnetRecordHandler：datastore WatchCallback 函数类型，处理 subnet 记录变化时调用的回调函数
+// hostSubnetMapsHandler：datastore WatchCallback 函数类型，处理 hostname 和网段映射变化时调用的回调函数
 // isWatching：布尔值，表示是否正在监控数据
 // watchingMap：保存当前正在监控的路径和其状态的映射
 // mapsPath：要监控的 maps 路径
 type WatcherProcess struct {
-	ipam                *ipam.IpamService
-	etcd                *etcd.EtcdClient
-	watcher             *etcd.Watcher
-	subnetRecordHandler etcd.WatchCallback
-	isWatching          bool
-	watchingMap         map[string]bool
-	mapsPath            string
+	ipam                  *ipam.IpamService
+	store                 datastore.Datastore
+	watcher               datastore.Watcher
+	subnetRecordHandler   datastore.WatchCallback
+	hostSubnetMapsHandler datastore.WatchCallback
+	isWatching            bool
+	watchingMap           map[string]bool
+	mapsPath              string
 }
 
-// SubnetRecordHandler：etcd WatchCallback 函数类型，处理 subnet 记录变化时调用的回调函数
+// SubnetRecordHandler：datastore WatchCallback 函数类型，处理 subnet 记录变化时调用的回调函数, 不设置的话不监听各个节点的 pod 记录
+// HostSubnetMapsHandler：datastore WatchCallback 函数类型，处理 hostname 和网段映射变化时调用的回调函数
 type Handlers struct {
-	// HostnameAndSubnetMapsHandler etcd.WatchCallback
-	SubnetRecordHandler etcd.WatchCallback
+	HostSubnetMapsHandler datastore.WatchCallback
+	SubnetRecordHandler   datastore.WatchCallback
 }
 
 // 对 promise 中的每个路径进行监控，将其添加到 watchingMap 中，并在每次添加后暂停 1 秒
@@ -71,6 +72,20 @@ func (wp *WatcherProcess) getShouldWatchPath(watching map[string]bool, promise m
 	return res, nil
 }
 
+// 监听 promise 中各个节点的 pod 记录, 已经在监听的不会重复监听
+// 没有设置 subnetRecordHandler 的话什么都不做
+func (wp *WatcherProcess) watchRecords(promise map[string]string) error {
+	if wp.subnetRecordHandler == nil {
+		return nil
+	}
+	paths, err := wp.getShouldWatchPath(wp.watchingMap, promise)
+	if err != nil {
+		return err
+	}
+	wp.doWatch(paths)
+	return nil
+}
+
 // 开始监控数据
 // 首先获取所有被分配的网段和对应的 hostname
 // 获取应该监控的路径，并调用 doWatch 进行监控
@@ -90,26 +105,24 @@ func (wp *WatcherProcess) StartWatch() (func(), error) {
 		return utils.Noop, err
 	}
 
-	paths, err := wp.getShouldWatchPath(wp.watchingMap, maps)
+	// 开始监听这些路径
+	err = wp.watchRecords(maps)
 	if err != nil {
 		return utils.Noop, err
 	}
-	// 开始监听这些路径
-	wp.doWatch(paths)
 
 	// 然后再开始监听 hostname 和网段关系映射的地址
-	wp.watcher.Watch(wp.mapsPath, func(_type mvccpb.Event_EventType, key, value []byte) {
+	wp.watcher.Watch(wp.mapsPath, func(_type datastore.EventType, key, value []byte) {
+		if wp.hostSubnetMapsHandler != nil {
+			wp.hostSubnetMapsHandler(_type, key, value)
+		}
 		// 每次监听到 maps 路径的变化时应该就多监听一个新加进来的 key
 		newMaps := map[string]string{}
 		err := json.Unmarshal(value, &newMaps)
 		if err != nil {
 			return
 		}
-		paths, err := wp.getShouldWatchPath(wp.watchingMap, newMaps)
-		if err != nil {
-			return
-		}
-		wp.doWatch(paths)
+		wp.watchRecords(newMaps)
 	})
 	return wp.CancelWatch, nil
 }
@@ -121,33 +134,44 @@ func (wp *WatcherProcess) CancelWatch() {
 	cancel()
 }
 
-// 初始化 WatcherProcess 实例，设置 ipam、etcd、watchingMap 和 subnetRecordHandler
+// NewWatcherProcess 创建一个新的 WatcherProcess 实例，设置 ipam、store、watchingMap 和 subnetRecordHandler
 // 获取 mapsPath，设置到 WatcherProcess 中
-// 创建 etcd Watcher 实例，设置到 WatcherProcess 中
-var GetWatcher = func() func(ipam *ipam.IpamService, etcd *etcd.EtcdClient, handlers *Handlers) (*WatcherProcess, error) {
+// 创建 datastore Watcher 实例，设置到 WatcherProcess 中
+func NewWatcherProcess(ipam *ipam.IpamService, store datastore.Datastore, handlers *Handlers) (*WatcherProcess, error) {
+	wp := &WatcherProcess{
+		ipam:                  ipam,
+		store:                 store,
+		watchingMap:           map[string]bool{},
+		subnetRecordHandler:   handlers.SubnetRecordHandler,
+		hostSubnetMapsHandler: handlers.HostSubnetMapsHandler,
+	}
+
+	mapsPath, err := ipam.Get().HostSubnetMapPath()
+	if err != nil {
+		return nil, err
+	}
+	wp.mapsPath = mapsPath
+
+	watcher, err := store.GetWatcher()
+	if err != nil {
+		return nil, err
+	}
+	wp.watcher = watcher
+	return wp, nil
+}
+
+// GetWatcher 返回一个 WatcherProcess 的单例
+var GetWatcher = func() func(ipam *ipam.IpamService, store datastore.Datastore, handlers *Handlers) (*WatcherProcess, error) {
 	var wp *WatcherProcess
-	return func(ipam *ipam.IpamService, etcd *etcd.EtcdClient, handlers *Handlers) (*WatcherProcess, error) {
+	return func(ipam *ipam.IpamService, store datastore.Datastore, handlers *Handlers) (*WatcherProcess, error) {
 		if wp != nil {
 			return wp, nil
 		}
-		wp = &WatcherProcess{
-			ipam:                ipam,
-			etcd:                etcd,
-			watchingMap:         map[string]bool{},
-			subnetRecordHandler: handlers.SubnetRecordHandler,
-		}
-
-		mapsPath, err := ipam.Get().HostSubnetMapPath()
-		if err != nil {
-			return nil, err
-		}
-		wp.mapsPath = mapsPath
-
-		watcher, err := etcd.GetWatcher()
+		_wp, err := NewWatcherProcess(ipam, store, handlers)
 		if err != nil {
 			return nil, err
 		}
-		wp.watcher = watcher
+		wp = _wp
 		return wp, nil
 	}
 }()
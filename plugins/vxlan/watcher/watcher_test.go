@@ -1,7 +1,7 @@
 package watcher
 
 import (
-	"cni-demo/etcd"
+	"cni-demo/datastore"
 	"cni-demo/ipam"
 	"fmt"
 	"sync"
@@ -9,7 +9,6 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
-	"go.etcd.io/etcd/api/v3/mvccpb"
 )
 
 func TestWatcher(t *testing.T) {
@@ -19,18 +18,17 @@ func TestWatcher(t *testing.T) {
 		PodIpMaskSegment: "32",
 	})
 	// ipam.Init("10.244.0.0", "16", "32")
-	etcd.Init()
 	i, err := ipam.GetIpamService()
 	test.Nil(err)
 	test.NotNil(i)
-	e, err := etcd.GetEtcdClient()
+	e, err := datastore.GetDatastore()
 	test.Nil(err)
 	test.NotNil(e)
 
 	wg := sync.WaitGroup{}
 	wg.Add(2)
 	nums := 0
-	var testHandler = func(_type mvccpb.Event_EventType, key, value []byte) {
+	var testHandler = func(_type datastore.EventType, key, value []byte) {
 		fmt.Printf("%s, %q, %q\n", _type, key, value)
 		nums++
 		wg.Done()
@@ -3,7 +3,7 @@ package xvlan_bash
 import (
 	"cni-demo/cni"
 	"cni-demo/ipam"
-	"cni-demo/nettools"
+	"cni-demo/tools/nettools"
 	"cni-demo/tools/skel"
 	"cni-demo/tools/utils"
 	"errors"
@@ -4,8 +4,8 @@ import (
 	"cni-demo/cni"
 	"cni-demo/consts"
 	base "cni-demo/plugins/xvlan/base"
+	"cni-demo/tools/logger"
 	"cni-demo/tools/skel"
-	"cni-demo/tools/utils"
 	types "github.com/containernetworking/cni/pkg/types/100"
 	"net"
 )
@@ -69,7 +69,7 @@ func init() {
 	manager := cni.GetCNIManager()
 	err := manager.Register(MacVlanCNI)
 	if err != nil {
-		utils.WriteLog("注册 macvlan cni 失败: ", err.Error())
+		logger.Error("注册 macvlan cni 失败", "err", err)
 		panic(err.Error())
 	}
 }
@@ -0,0 +1,229 @@
+package policy
+
+import (
+	bpf_map "cni-demo/plugins/vxlan/map"
+	"cni-demo/plugins/vxlan/tc"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// 协议号, 和 ip 头里的 protocol 字段一致
+var protocolNumbers = map[string]uint8{
+	PROTOCOL_TCP:  6,
+	PROTOCOL_UDP:  17,
+	PROTOCOL_SCTP: 132,
+}
+
+// BPFEnforcer 把网络策略写到 ebpf 的 map 里, 给 vxlan 模式用
+// veth_ingress.c 和 vxlan_ingress.c 会在转发之前查这两个 map
+type BPFEnforcer struct {
+	mm *bpf_map.MapsManager
+}
+
+func NewBPFEnforcer() (*BPFEnforcer, error) {
+	mm, err := bpf_map.GetMapsManager()
+	if err != nil {
+		return nil, err
+	}
+	return &BPFEnforcer{mm: mm}, nil
+}
+
+// ipv4Bytes 把 ip 转成网络字节序的 4 个字节
+func ipv4Bytes(ip net.IP) ([4]byte, error) {
+	var res [4]byte
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return res, fmt.Errorf("%s is not an ipv4 address", ip.String())
+	}
+	copy(res[:], ip4)
+	return res, nil
+}
+
+// policyKey 生成一条 LPM 的 key, cidr 是对端网段
+func policyKey(podIP [4]byte, direction Direction, port Port, cidr string) (bpf_map.PolicyMapKey, error) {
+	key := bpf_map.PolicyMapKey{PodIP: podIP, Direction: uint8(direction)}
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return key, err
+	}
+	ones, _ := ipNet.Mask.Size()
+	peer, err := ipv4Bytes(ipNet.IP)
+	if err != nil {
+		return key, err
+	}
+	key.Prefixlen = bpf_map.POLICY_PREFIX_BASE + uint32(ones)
+	key.PeerIP = peer
+	if port.Protocol != "" {
+		proto, ok := protocolNumbers[port.Protocol]
+		if !ok {
+			return key, fmt.Errorf("unsupported protocol %q", port.Protocol)
+		}
+		key.Protocol = proto
+		binary.BigEndian.PutUint16(key.Port[:], port.Port)
+	}
+	return key, nil
+}
+
+// containsCIDR 判断 outer 是否包含 inner
+func containsCIDR(outer, inner string) bool {
+	_, o, err := net.ParseCIDR(outer)
+	if err != nil {
+		return false
+	}
+	_, i, err := net.ParseCIDR(inner)
+	if err != nil {
+		return false
+	}
+	oOnes, _ := o.Mask.Size()
+	iOnes, _ := i.Mask.Size()
+	return oOnes <= iOnes && o.Contains(i.IP)
+}
+
+// buildBPFEntries 把策略转成两个 map 里的内容
+// 每条规则的每个端口, 每个对端网段都是一条 allow, except 的网段是一条更长前缀的 deny
+// 如果 except 的网段又被同一个方向同一个端口上的其他规则放行了, 就不写这条 deny, 否则会把别的规则放行的流量拦掉
+func buildBPFEntries(policies []*PodPolicy) (
+	map[bpf_map.PolicyPodMapKey]bpf_map.PolicyPodMapValue,
+	map[bpf_map.PolicyMapKey]bpf_map.PolicyMapValue,
+	error,
+) {
+	pods := map[bpf_map.PolicyPodMapKey]bpf_map.PolicyPodMapValue{}
+	entries := map[bpf_map.PolicyMapKey]bpf_map.PolicyMapValue{}
+	allow := bpf_map.PolicyMapValue{Action: bpf_map.POLICY_ALLOW}
+	deny := bpf_map.PolicyMapValue{Action: bpf_map.POLICY_DENY}
+
+	type except struct {
+		key  bpf_map.PolicyMapKey
+		port Port
+		cidr string
+		rule int
+	}
+	type allowed struct {
+		cidr string
+		rule int
+	}
+
+	for _, p := range policies {
+		ip, err := ipv4Bytes(net.ParseIP(p.IP))
+		if err != nil {
+			return nil, nil, err
+		}
+		value := bpf_map.PolicyPodMapValue{}
+		if p.IngressIsolated {
+			value.Ingress = 1
+		}
+		if p.EgressIsolated {
+			value.Egress = 1
+		}
+		pods[bpf_map.PolicyPodMapKey{IP: ip}] = value
+
+		for _, direction := range []Direction{INGRESS, EGRESS} {
+			rules := p.Ingress
+			if direction == EGRESS {
+				rules = p.Egress
+			}
+			var excepts []except
+			// 按端口记下每条规则放行的网段, 用来判断 except 是否被其他规则覆盖
+			allows := map[Port][]allowed{}
+			for idx, rule := range rules {
+				ports := rule.Ports
+				if len(ports) == 0 {
+					ports = []Port{{}}
+				}
+				peers := rule.Peers
+				if rule.AllPeers {
+					peers = []Peer{{CIDR: "0.0.0.0/0"}}
+				}
+				for _, port := range ports {
+					for _, peer := range peers {
+						key, err := policyKey(ip, direction, port, peer.CIDR)
+						if err != nil {
+							return nil, nil, err
+						}
+						entries[key] = allow
+						allows[port] = append(allows[port], allowed{cidr: peer.CIDR, rule: idx})
+						for _, e := range peer.Except {
+							key, err := policyKey(ip, direction, port, e)
+							if err != nil {
+								return nil, nil, err
+							}
+							excepts = append(excepts, except{key: key, port: port, cidr: e, rule: idx})
+						}
+					}
+				}
+			}
+			for _, e := range excepts {
+				covered := false
+				for _, a := range allows[e.port] {
+					if a.rule != e.rule && containsCIDR(a.cidr, e.cidr) {
+						covered = true
+						break
+					}
+				}
+				if _, ok := entries[e.key]; !ok && !covered {
+					entries[e.key] = deny
+				}
+			}
+		}
+	}
+	return pods, entries, nil
+}
+
+// Sync 把策略全量同步到 map 里
+// 先写规则再写 pod, 删的时候反过来, 保证 pod 被标记成隔离的时候它的规则已经在了
+func (e *BPFEnforcer) Sync(policies []*PodPolicy) error {
+	pods, entries, err := buildBPFEntries(policies)
+	if err != nil {
+		return err
+	}
+	if _, err = e.mm.CreatePolicyMap(); err != nil {
+		return err
+	}
+	if _, err = e.mm.CreatePolicyPodMap(); err != nil {
+		return err
+	}
+	if err = tc.ReattachIfResized(); err != nil {
+		return err
+	}
+
+	for key, value := range entries {
+		if err = e.mm.SetPolicyMap(key, value); err != nil {
+			return err
+		}
+	}
+	for key, value := range pods {
+		if err = e.mm.SetPolicyPodMap(key, value); err != nil {
+			return err
+		}
+	}
+
+	podKeys, err := e.mm.PolicyPodMapKeys()
+	if err != nil {
+		return err
+	}
+	for _, key := range podKeys {
+		if _, ok := pods[key]; !ok {
+			if err = e.mm.DelPolicyPodMap(key); err != nil {
+				return err
+			}
+		}
+	}
+	keys, err := e.mm.PolicyMapKeys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if _, ok := entries[key]; !ok {
+			if err = e.mm.DelPolicyMap(key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Cleanup 清空两个 map, 也就是不再做任何限制
+func (e *BPFEnforcer) Cleanup() error {
+	return e.Sync(nil)
+}
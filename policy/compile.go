@@ -0,0 +1,295 @@
+package policy
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// compiler 持有编译时需要的集群状态
+type compiler struct {
+	pods       []v1.Pod
+	namespaces map[string]labels.Set
+}
+
+// Compile 把集群中的 NetworkPolicy 编译成每个 pod 的放行规则
+// nodeName 不为空的话只返回调度到这个节点上的 pod 的策略, 不过对端还是会从整个集群的 pod 里选
+// 没有被任何策略选中的 pod 不会出现在返回值里, 也就是不做任何限制
+func Compile(pods []v1.Pod, namespaces []v1.Namespace, policies []networkingv1.NetworkPolicy, nodeName string) ([]*PodPolicy, error) {
+	c := &compiler{namespaces: map[string]labels.Set{}}
+	for _, ns := range namespaces {
+		c.namespaces[ns.Name] = labels.Set(ns.Labels)
+	}
+	for _, pod := range pods {
+		if podIP(&pod) == "" {
+			continue
+		}
+		c.pods = append(c.pods, pod)
+	}
+
+	var res []*PodPolicy
+	for i := range c.pods {
+		pod := &c.pods[i]
+		if nodeName != "" && pod.Spec.NodeName != nodeName {
+			continue
+		}
+		podPolicy := &PodPolicy{Namespace: pod.Namespace, Name: pod.Name, IP: podIP(pod)}
+		for j := range policies {
+			err := c.apply(podPolicy, pod, &policies[j])
+			if err != nil {
+				return nil, err
+			}
+		}
+		if podPolicy.IngressIsolated || podPolicy.EgressIsolated {
+			res = append(res, podPolicy)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].IP < res[j].IP })
+	return res, nil
+}
+
+// podIP 返回 pod 的 ip, 用主机网络的以及已经结束了的 pod 不参与网络策略
+func podIP(pod *v1.Pod) string {
+	if pod.Spec.HostNetwork || pod.Status.PodIP == "" {
+		return ""
+	}
+	if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+		return ""
+	}
+	return pod.Status.PodIP
+}
+
+// policyTypes 返回一条策略管的方向, 没写 policyTypes 的话按照 k8s 的规定:
+// 一定会管 ingress, 有 egress 规则的话才管 egress
+func policyTypes(policy *networkingv1.NetworkPolicy) (ingress, egress bool) {
+	if len(policy.Spec.PolicyTypes) == 0 {
+		return true, len(policy.Spec.Egress) > 0
+	}
+	for _, t := range policy.Spec.PolicyTypes {
+		switch t {
+		case networkingv1.PolicyTypeIngress:
+			ingress = true
+		case networkingv1.PolicyTypeEgress:
+			egress = true
+		}
+	}
+	return ingress, egress
+}
+
+// selectorMatches 判断 selector 是否选中了 set, nil 的 selector 什么都不选
+func selectorMatches(selector *metav1.LabelSelector, set labels.Set) (bool, error) {
+	if selector == nil {
+		return false, nil
+	}
+	s, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return false, err
+	}
+	return s.Matches(set), nil
+}
+
+// apply 看 policy 有没有选中 pod, 选中了的话把规则加到 podPolicy 上
+func (c *compiler) apply(podPolicy *PodPolicy, pod *v1.Pod, policy *networkingv1.NetworkPolicy) error {
+	if policy.Namespace != pod.Namespace {
+		return nil
+	}
+	selected, err := selectorMatches(&policy.Spec.PodSelector, labels.Set(pod.Labels))
+	if err != nil || !selected {
+		return err
+	}
+
+	ingress, egress := policyTypes(policy)
+	if ingress {
+		podPolicy.IngressIsolated = true
+		for _, rule := range policy.Spec.Ingress {
+			rules, err := c.compileRule(policy.Namespace, pod, rule.From, rule.Ports, INGRESS)
+			if err != nil {
+				return err
+			}
+			podPolicy.Ingress = append(podPolicy.Ingress, rules...)
+		}
+	}
+	if egress {
+		podPolicy.EgressIsolated = true
+		for _, rule := range policy.Spec.Egress {
+			rules, err := c.compileRule(policy.Namespace, pod, rule.To, rule.Ports, EGRESS)
+			if err != nil {
+				return err
+			}
+			podPolicy.Egress = append(podPolicy.Egress, rules...)
+		}
+	}
+	return nil
+}
+
+// selectPeerPods 根据 NetworkPolicyPeer 里的 podSelector 和 namespaceSelector 选出对端的 pod
+//   - 只有 podSelector: 策略所在 namespace 下被选中的 pod
+//   - 只有 namespaceSelector: 被选中的 namespace 下所有的 pod
+//   - 两个都有: 被选中的 namespace 下被 podSelector 选中的 pod
+func (c *compiler) selectPeerPods(namespace string, peer *networkingv1.NetworkPolicyPeer) ([]*v1.Pod, error) {
+	var res []*v1.Pod
+	for i := range c.pods {
+		pod := &c.pods[i]
+		if peer.NamespaceSelector == nil {
+			if pod.Namespace != namespace {
+				continue
+			}
+		} else {
+			ok, err := selectorMatches(peer.NamespaceSelector, c.namespaces[pod.Namespace])
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		if peer.PodSelector != nil {
+			ok, err := selectorMatches(peer.PodSelector, labels.Set(pod.Labels))
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		res = append(res, pod)
+	}
+	return res, nil
+}
+
+// resolvePorts 把 NetworkPolicyPort 转成数字端口, 有名字的端口要到 pod 的容器端口里去找
+// pod 为 nil 的时候(比如对端是 ipBlock)有名字的端口是没法解析的, 直接跳过
+func resolvePorts(ports []networkingv1.NetworkPolicyPort, pod *v1.Pod) []Port {
+	var res []Port
+	for _, port := range ports {
+		protocol := PROTOCOL_TCP
+		if port.Protocol != nil {
+			protocol = string(*port.Protocol)
+		}
+		if port.Port == nil {
+			res = append(res, Port{Protocol: protocol})
+			continue
+		}
+		if port.Port.Type == intstr.Int {
+			res = append(res, Port{Protocol: protocol, Port: uint16(port.Port.IntVal)})
+			continue
+		}
+		if pod == nil {
+			continue
+		}
+		for _, container := range pod.Spec.Containers {
+			for _, containerPort := range container.Ports {
+				cp := string(containerPort.Protocol)
+				if cp == "" {
+					cp = PROTOCOL_TCP
+				}
+				if containerPort.Name == port.Port.StrVal && cp == protocol {
+					res = append(res, Port{Protocol: protocol, Port: uint16(containerPort.ContainerPort)})
+				}
+			}
+		}
+	}
+	return res
+}
+
+// hasNamedPort 看端口列表里有没有用名字写的端口
+func hasNamedPort(ports []networkingv1.NetworkPolicyPort) bool {
+	for _, port := range ports {
+		if port.Port != nil && port.Port.Type == intstr.String {
+			return true
+		}
+	}
+	return false
+}
+
+// podPeer 把 pod 的 ip 转成 /32 的对端
+func podPeer(pod *v1.Pod) Peer {
+	return Peer{CIDR: podIP(pod) + "/32"}
+}
+
+// compileRule 把一条 ingress/egress 规则编译成一条或多条 Rule
+// ingress 方向有名字的端口是在被选中的 pod 自己身上解析的
+// egress 方向有名字的端口要在每个对端 pod 身上解析, 所以每个对端可能会拆成单独的一条 Rule
+func (c *compiler) compileRule(
+	namespace string,
+	pod *v1.Pod,
+	peers []networkingv1.NetworkPolicyPeer,
+	ports []networkingv1.NetworkPolicyPort,
+	direction Direction,
+) ([]Rule, error) {
+	var ipBlocks []Peer
+	var peerPods []*v1.Pod
+	for i := range peers {
+		peer := &peers[i]
+		if peer.IPBlock != nil {
+			if _, _, err := net.ParseCIDR(peer.IPBlock.CIDR); err != nil {
+				return nil, fmt.Errorf("invalid ipBlock cidr %q: %v", peer.IPBlock.CIDR, err)
+			}
+			ipBlocks = append(ipBlocks, Peer{CIDR: peer.IPBlock.CIDR, Except: peer.IPBlock.Except})
+			continue
+		}
+		selected, err := c.selectPeerPods(namespace, peer)
+		if err != nil {
+			return nil, err
+		}
+		peerPods = append(peerPods, selected...)
+	}
+	allPeers := len(peers) == 0
+	if allPeers {
+		for i := range c.pods {
+			peerPods = append(peerPods, &c.pods[i])
+		}
+	}
+
+	// 写了端口但是一个都解析不出来的话, 这条规则什么都不放行
+	emptyPorts := func(resolved []Port) bool {
+		return len(ports) > 0 && len(resolved) == 0
+	}
+
+	if direction == INGRESS || !hasNamedPort(ports) {
+		var target *v1.Pod
+		if direction == INGRESS {
+			target = pod
+		}
+		resolved := resolvePorts(ports, target)
+		if emptyPorts(resolved) {
+			return nil, nil
+		}
+		if allPeers {
+			return []Rule{{AllPeers: true, Ports: resolved}}, nil
+		}
+		rule := Rule{Peers: ipBlocks, Ports: resolved}
+		for _, peerPod := range peerPods {
+			rule.Peers = append(rule.Peers, podPeer(peerPod))
+		}
+		if len(rule.Peers) == 0 {
+			return nil, nil
+		}
+		return []Rule{rule}, nil
+	}
+
+	// egress 并且有名字的端口
+	var res []Rule
+	numeric := resolvePorts(ports, nil)
+	if len(numeric) > 0 {
+		if allPeers {
+			res = append(res, Rule{AllPeers: true, Ports: numeric})
+		} else if len(ipBlocks) > 0 {
+			res = append(res, Rule{Peers: ipBlocks, Ports: numeric})
+		}
+	}
+	for _, peerPod := range peerPods {
+		resolved := resolvePorts(ports, peerPod)
+		if emptyPorts(resolved) {
+			continue
+		}
+		res = append(res, Rule{Peers: []Peer{podPeer(peerPod)}, Ports: resolved})
+	}
+	return res, nil
+}
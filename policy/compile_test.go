@@ -0,0 +1,212 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func newPod(namespace, name, ip, node string, labels map[string]string, ports ...v1.ContainerPort) v1.Pod {
+	return v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: labels},
+		Spec: v1.PodSpec{
+			NodeName:   node,
+			Containers: []v1.Container{{Name: name, Ports: ports}},
+		},
+		Status: v1.PodStatus{PodIP: ip, Phase: v1.PodRunning},
+	}
+}
+
+func newNamespace(name string, labels map[string]string) v1.Namespace {
+	return v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+}
+
+func tcpPort(port intstr.IntOrString) networkingv1.NetworkPolicyPort {
+	protocol := v1.ProtocolTCP
+	return networkingv1.NetworkPolicyPort{Protocol: &protocol, Port: &port}
+}
+
+func findPolicy(policies []*PodPolicy, name string) *PodPolicy {
+	for _, p := range policies {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func TestCompile(t *testing.T) {
+	test := assert.New(t)
+
+	namespaces := []v1.Namespace{
+		newNamespace("default", nil),
+		newNamespace("monitoring", map[string]string{"team": "ops"}),
+	}
+	pods := []v1.Pod{
+		newPod("default", "web", "10.244.1.2", "node1", map[string]string{"app": "web"},
+			v1.ContainerPort{Name: "http", ContainerPort: 8080}),
+		newPod("default", "db", "10.244.1.3", "node1", map[string]string{"app": "db"}),
+		newPod("default", "client", "10.244.2.2", "node2", map[string]string{"app": "client"}),
+		newPod("monitoring", "prometheus", "10.244.2.3", "node2", map[string]string{"app": "prometheus"}),
+	}
+	policies := []networkingv1.NetworkPolicy{
+		{
+			// web 只允许 client 和 monitoring 下的 pod 访问 http 端口
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+			Spec: networkingv1.NetworkPolicySpec{
+				PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+				Ingress: []networkingv1.NetworkPolicyIngressRule{{
+					From: []networkingv1.NetworkPolicyPeer{
+						{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "client"}}},
+						{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "ops"}}},
+					},
+					Ports: []networkingv1.NetworkPolicyPort{tcpPort(intstr.FromString("http"))},
+				}},
+			},
+		},
+		{
+			// db 不允许任何出去的流量, 除了内网
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"},
+			Spec: networkingv1.NetworkPolicySpec{
+				PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}},
+				PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+				Egress: []networkingv1.NetworkPolicyEgressRule{{
+					To: []networkingv1.NetworkPolicyPeer{{
+						IPBlock: &networkingv1.IPBlock{CIDR: "192.168.0.0/16", Except: []string{"192.168.1.0/24"}},
+					}},
+				}},
+			},
+		},
+	}
+
+	res, err := Compile(pods, namespaces, policies, "node1")
+	test.Nil(err)
+	test.Len(res, 2)
+
+	web := findPolicy(res, "web")
+	test.NotNil(web)
+	test.True(web.IngressIsolated)
+	test.False(web.EgressIsolated)
+	test.Equal([]Rule{{
+		Peers: []Peer{{CIDR: "10.244.2.2/32"}, {CIDR: "10.244.2.3/32"}},
+		Ports: []Port{{Protocol: PROTOCOL_TCP, Port: 8080}},
+	}}, web.Ingress)
+
+	db := findPolicy(res, "db")
+	test.NotNil(db)
+	test.False(db.IngressIsolated)
+	test.True(db.EgressIsolated)
+	test.Equal([]Rule{{
+		Peers: []Peer{{CIDR: "192.168.0.0/16", Except: []string{"192.168.1.0/24"}}},
+	}}, db.Egress)
+
+	// 不限制节点的话 node2 上的 pod 没有被选中, 也不会出现
+	res, err = Compile(pods, namespaces, policies, "")
+	test.Nil(err)
+	test.Len(res, 2)
+}
+
+func TestCompileDefaultDenyAndNamedEgressPort(t *testing.T) {
+	test := assert.New(t)
+
+	pods := []v1.Pod{
+		newPod("default", "a", "10.244.1.2", "node1", map[string]string{"app": "a"}),
+		newPod("default", "b", "10.244.1.3", "node1", map[string]string{"app": "b"},
+			v1.ContainerPort{Name: "dns", ContainerPort: 53, Protocol: v1.ProtocolUDP}),
+		newPod("default", "c", "10.244.1.4", "node1", map[string]string{"app": "c"}),
+	}
+	udp := v1.ProtocolUDP
+	dns := intstr.FromString("dns")
+	policies := []networkingv1.NetworkPolicy{
+		{
+			// 空的 podSelector 选中整个 namespace, 没有规则就是全部拒绝
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "default-deny"},
+			Spec: networkingv1.NetworkPolicySpec{
+				PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress, networkingv1.PolicyTypeEgress},
+			},
+		},
+		{
+			// a 可以访问任何 pod 上叫 dns 的 udp 端口
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "a-dns"},
+			Spec: networkingv1.NetworkPolicySpec{
+				PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "a"}},
+				PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+				Egress: []networkingv1.NetworkPolicyEgressRule{{
+					Ports: []networkingv1.NetworkPolicyPort{{Protocol: &udp, Port: &dns}},
+				}},
+			},
+		},
+	}
+
+	res, err := Compile(pods, nil, policies, "node1")
+	test.Nil(err)
+	test.Len(res, 3)
+	for _, p := range res {
+		test.True(p.IngressIsolated)
+		test.True(p.EgressIsolated)
+		test.Empty(p.Ingress)
+	}
+	a := findPolicy(res, "a")
+	test.Equal([]Rule{{
+		Peers: []Peer{{CIDR: "10.244.1.3/32"}},
+		Ports: []Port{{Protocol: PROTOCOL_UDP, Port: 53}},
+	}}, a.Egress)
+	test.Empty(findPolicy(res, "c").Egress)
+}
+
+func TestBuildBPFEntries(t *testing.T) {
+	test := assert.New(t)
+
+	policies := []*PodPolicy{{
+		IP:              "10.244.1.2",
+		IngressIsolated: true,
+		Ingress: []Rule{
+			{Peers: []Peer{{CIDR: "10.0.0.0/8", Except: []string{"10.1.0.0/16", "10.2.0.0/16"}}}},
+			// 这条规则放行了 10.2.0.0/16, 所以上面的 except 里的 10.2.0.0/16 不能写成 deny
+			{Peers: []Peer{{CIDR: "10.2.0.0/16"}}},
+			{AllPeers: true, Ports: []Port{{Protocol: PROTOCOL_TCP, Port: 80}}},
+		},
+	}}
+	pods, entries, err := buildBPFEntries(policies)
+	test.Nil(err)
+	test.Len(pods, 1)
+	test.Len(entries, 4)
+
+	var denies []string
+	for key, value := range entries {
+		test.Equal(uint8(INGRESS), key.Direction)
+		test.Equal([4]byte{10, 244, 1, 2}, key.PodIP)
+		if value.Action == 0 {
+			denies = append(denies, string(key.PeerIP[:2]))
+			test.Equal(uint32(64+16), key.Prefixlen)
+		}
+		if key.Protocol == 6 {
+			test.Equal([2]byte{0, 80}, key.Port)
+			test.Equal(uint32(64), key.Prefixlen)
+		}
+	}
+	test.Equal([]string{string([]byte{10, 1})}, denies)
+}
+
+func TestBuildRuleSpecs(t *testing.T) {
+	test := assert.New(t)
+
+	specs := buildRuleSpecs(Rule{
+		Peers: []Peer{{CIDR: "10.244.1.0/24"}},
+		Ports: []Port{{Protocol: PROTOCOL_TCP, Port: 80}, {Protocol: PROTOCOL_UDP}},
+	}, "cni-demo-xxx", EGRESS)
+	test.Equal([][]string{
+		{"-m", "set", "--match-set", "cni-demo-xxx", "dst", "-p", "tcp", "--dport", "80", "-j", "RETURN"},
+		{"-m", "set", "--match-set", "cni-demo-xxx", "dst", "-p", "udp", "-j", "RETURN"},
+	}, specs)
+
+	specs = buildRuleSpecs(Rule{AllPeers: true}, "", INGRESS)
+	test.Equal([][]string{{"-j", "RETURN"}}, specs)
+
+	test.LessOrEqual(len(getPodChainName("10.244.1.2", INGRESS)), 28)
+	test.LessOrEqual(len(getIpsetName("10.244.1.2", INGRESS, 0)+"-t"), 31)
+}
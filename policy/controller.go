@@ -0,0 +1,163 @@
+package policy
+
+import (
+	"cni-demo/client"
+	"cni-demo/consts"
+	"cni-demo/tools/logger"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	// watch 断开之后隔多久重连, 同步失败之后隔多久重试
+	retryInterval = 5 * time.Second
+)
+
+// Controller 负责 list + watch pod, namespace 和 NetworkPolicy
+// 任何一个资源有变化都会触发一次全量的重新编译和同步
+// 全量同步虽然笨一点, 但是对一个节点上的 pod 数量来说足够了, 也不用处理事件乱序的问题
+type Controller struct {
+	k8s      *client.LightK8sClient
+	enforcer Enforcer
+	nodeName string
+	resync   chan struct{}
+}
+
+func NewController(k8s *client.LightK8sClient, enforcer Enforcer, nodeName string) *Controller {
+	return &Controller{
+		k8s:      k8s,
+		enforcer: enforcer,
+		nodeName: nodeName,
+		resync:   make(chan struct{}, 1),
+	}
+}
+
+// NewEnforcer 根据 cni 的 mode 返回对应的 Enforcer, datapath 是 vxlan 模式的数据面, 别的模式不用管
+func NewEnforcer(mode, datapath string) (Enforcer, error) {
+	switch mode {
+	case consts.MODE_HOST_GW, consts.MODE_IPIP:
+		return NewIptablesEnforcer(), nil
+	case consts.MODE_VXLAN:
+		// kernel 数据面没有 tc 程序, pod 的流量和 ipip 模式一样都过 FORWARD
+		if datapath == consts.VXLAN_DATAPATH_KERNEL {
+			return NewIptablesEnforcer(), nil
+		}
+		return NewBPFEnforcer()
+	}
+	return nil, fmt.Errorf("%s 模式暂不支持网络策略", mode)
+}
+
+// trigger 触发一次同步, 已经有一次在排队的话就不用再排了
+func (c *Controller) trigger() {
+	select {
+	case c.resync <- struct{}{}:
+	default:
+	}
+}
+
+// Sync 拉一遍全量的资源, 编译之后交给 enforcer
+func (c *Controller) Sync() error {
+	pods, err := c.k8s.Get().Pods("")
+	if err != nil {
+		return err
+	}
+	namespaces, err := c.k8s.Get().Namespaces()
+	if err != nil {
+		return err
+	}
+	policies, err := c.k8s.Get().NetworkPolicies("")
+	if err != nil {
+		return err
+	}
+	compiled, err := Compile(pods.Items, namespaces.Items, policies.Items, c.nodeName)
+	if err != nil {
+		return err
+	}
+	return c.enforcer.Sync(compiled)
+}
+
+// keepWatching 一直 watch 某个资源, 断开了就重连, 重连之后补一次同步防止漏掉中间的事件
+func (c *Controller) keepWatching(
+	name string,
+	watch func(handler client.WatchHandler) (func(), <-chan struct{}, error),
+	stop <-chan struct{},
+) {
+	handler := func(event *client.WatchEvent) {
+		if event.Type == client.WATCH_BOOKMARK {
+			return
+		}
+		c.trigger()
+	}
+	for {
+		cancel, done, err := watch(handler)
+		if err != nil {
+			logger.Error("watch 失败", "resource", name, "err", err)
+		} else {
+			c.trigger()
+			select {
+			case <-done:
+				logger.Warn("watch 断开了, 准备重连", "resource", name)
+			case <-stop:
+				cancel()
+				return
+			}
+		}
+		select {
+		case <-time.After(retryInterval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Run 开始 watch 并且在有变化的时候同步, 直到 stop 被关掉
+func (c *Controller) Run(stop <-chan struct{}) {
+	get := c.k8s.Get()
+	go c.keepWatching("pods", func(h client.WatchHandler) (func(), <-chan struct{}, error) {
+		return get.WatchPods("", "", h)
+	}, stop)
+	go c.keepWatching("namespaces", func(h client.WatchHandler) (func(), <-chan struct{}, error) {
+		return get.WatchNamespaces("", h)
+	}, stop)
+	go c.keepWatching("networkpolicies", func(h client.WatchHandler) (func(), <-chan struct{}, error) {
+		return get.WatchNetworkPolicies("", "", h)
+	}, stop)
+
+	c.trigger()
+	for {
+		select {
+		case <-c.resync:
+			err := c.Sync()
+			if err != nil {
+				logger.Error("同步网络策略失败", "err", err)
+				time.AfterFunc(retryInterval, c.trigger)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// RunController 在 cni-demo-agent 里执行网络策略, 一直阻塞到 stop 被关掉
+// 以前是在第一次 ADD 的时候 fork 一个守护进程出来跑的
+func RunController(mode, datapath string, stop <-chan struct{}) error {
+	enforcer, err := NewEnforcer(mode, datapath)
+	if err != nil {
+		return err
+	}
+	err = client.InitDefault()
+	if err != nil {
+		return err
+	}
+	k8s, err := client.GetLightK8sClient()
+	if err != nil {
+		return err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	NewController(k8s, enforcer, hostname).Run(stop)
+	return nil
+}
@@ -0,0 +1,111 @@
+package policy
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// ipset 没有好用的 go 库, 这里直接调命令
+// 所有的 set 都是 hash:net 类型, except 的网段用 nomatch 加进去, 匹配的时候会被排除掉
+
+// runIpset 执行一条 ipset 命令
+func runIpset(args ...string) (string, error) {
+	out, err := exec.Command("ipset", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("ipset %s 失败: %v, output: %s", strings.Join(args, " "), err, string(out))
+	}
+	return string(out), nil
+}
+
+// listIpsets 列出本机所有的 set 的名字
+func listIpsets() ([]string, error) {
+	out, err := runIpset("list", "-n")
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(out), nil
+}
+
+// ipsetNets 返回 cidr 在 hash:net 的 set 里对应的条目
+// hash:net 存不了 /0, 直接 add 0.0.0.0/0 会让整个 restore 失败, 所以拆成 0.0.0.0/1 和 128.0.0.0/1 两条
+func ipsetNets(cidr string) []string {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		// 不合法的交给 ipset 报错
+		return []string{cidr}
+	}
+	ones, bits := ipNet.Mask.Size()
+	if ones != 0 || bits != 32 {
+		return []string{cidr}
+	}
+	return []string{"0.0.0.0/1", "128.0.0.0/1"}
+}
+
+// buildIpsetRestore 生成往 set 里写 peers 的 ipset restore 的输入
+// 带 -exist 的 add 会覆盖已有条目的 nomatch 标记, 一个 peer 的 except 可能正好是另一个 peer 的 cidr,
+// 这时候应该放行, 所以先把所有 except 用 nomatch 写进去, 最后再写放行的网段
+func buildIpsetRestore(set string, peers []Peer) string {
+	var restore strings.Builder
+	for _, peer := range peers {
+		for _, except := range peer.Except {
+			for _, cidr := range ipsetNets(except) {
+				restore.WriteString(fmt.Sprintf("add %s %s nomatch -exist\n", set, cidr))
+			}
+		}
+	}
+	for _, peer := range peers {
+		for _, cidr := range ipsetNets(peer.CIDR) {
+			restore.WriteString(fmt.Sprintf("add %s %s -exist\n", set, cidr))
+		}
+	}
+	return restore.String()
+}
+
+// syncIpset 把名叫 name 的 set 的内容同步成 peers
+// 先往一个临时的 set 里写, 写完之后 swap 过去, 这样同步的过程中不会有 set 是空的窗口
+func syncIpset(name string, peers []Peer) error {
+	tmp := name + "-t"
+	_, err := runIpset("create", name, "hash:net", "-exist")
+	if err != nil {
+		return err
+	}
+	_, err = runIpset("create", tmp, "hash:net", "-exist")
+	if err != nil {
+		return err
+	}
+	_, err = runIpset("flush", tmp)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("ipset", "restore")
+	cmd.Stdin = strings.NewReader(buildIpsetRestore(tmp, peers))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ipset restore 失败: %v, output: %s", err, string(out))
+	}
+
+	_, err = runIpset("swap", tmp, name)
+	if err != nil {
+		return err
+	}
+	_, err = runIpset("destroy", tmp)
+	return err
+}
+
+// destroyIpset 删掉名叫 name 的 set, 不存在的话什么也不做
+func destroyIpset(name string) error {
+	sets, err := listIpsets()
+	if err != nil {
+		return err
+	}
+	for _, set := range sets {
+		if set == name {
+			_, err = runIpset("destroy", name)
+			return err
+		}
+	}
+	return nil
+}
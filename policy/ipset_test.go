@@ -0,0 +1,36 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIpsetNets(t *testing.T) {
+	test := assert.New(t)
+
+	test.Equal([]string{"10.244.0.0/16"}, ipsetNets("10.244.0.0/16"))
+	test.Equal([]string{"10.244.1.5/32"}, ipsetNets("10.244.1.5/32"))
+	// hash:net 存不了 /0
+	test.Equal([]string{"0.0.0.0/1", "128.0.0.0/1"}, ipsetNets("0.0.0.0/0"))
+}
+
+func TestBuildIpsetRestore(t *testing.T) {
+	test := assert.New(t)
+
+	peers := []Peer{
+		{CIDR: "10.0.0.0/8", Except: []string{"10.244.0.0/16"}},
+		{CIDR: "10.244.0.0/16"},
+	}
+	// 第二个 peer 放行了第一个 peer 排除掉的网段, 放行的条目要在 nomatch 后面写, 不然会被覆盖成 nomatch
+	test.Equal("add s 10.244.0.0/16 nomatch -exist\n"+
+		"add s 10.0.0.0/8 -exist\n"+
+		"add s 10.244.0.0/16 -exist\n", buildIpsetRestore("s", peers))
+
+	// 顺序反过来也一样
+	test.Equal("add s 10.244.0.0/16 nomatch -exist\n"+
+		"add s 10.244.0.0/16 -exist\n"+
+		"add s 10.0.0.0/8 -exist\n", buildIpsetRestore("s", []Peer{peers[1], peers[0]}))
+
+	test.Equal("add s 0.0.0.0/1 -exist\nadd s 128.0.0.0/1 -exist\n", buildIpsetRestore("s", []Peer{{CIDR: "0.0.0.0/0"}}))
+}
@@ -0,0 +1,296 @@
+package policy
+
+import (
+	"cni-demo/tools/logger"
+	"cni-demo/tools/nettools"
+	"crypto/sha512"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+const (
+	// POLICY_CHAIN 挂在 FORWARD 的最前面, 所有本机 pod 的策略都从这里分出去
+	// 要在 nettools 的 CNI-DEMO-FORWARD 之前, 不然流量在那边就已经被 ACCEPT 了
+	POLICY_CHAIN = "CNI-DEMO-POLICY"
+	// 每个 pod 每个方向一条链, 名字后面是 pod ip 的 hash
+	POLICY_INGRESS_CHAIN_PREFIX = "CNI-DEMO-PI-"
+	POLICY_EGRESS_CHAIN_PREFIX  = "CNI-DEMO-PE-"
+	// ipset 的名字最长 31 个字符, 前缀加 16 位 hash 再加上临时 set 的 "-t" 正好够用
+	POLICY_IPSET_PREFIX = "cni-demo-"
+
+	policyJumpComment = "cni-demo:policy"
+	hashLength        = 16
+)
+
+// IptablesEnforcer 用 iptables + ipset 来执行网络策略, 给 host-gw 和 ipip 模式用
+// 因为这两种模式下 pod 之间的流量都会经过主机的 FORWARD, 所以规则按 pod 的 ip 挂在 FORWARD 上
+// host-gw 模式下同一个网桥上的 pod 之间的流量需要开 br_netfilter(bridge-nf-call-iptables) 才会经过 iptables
+type IptablesEnforcer struct{}
+
+func NewIptablesEnforcer() *IptablesEnforcer {
+	return &IptablesEnforcer{}
+}
+
+func shortHash(s string) string {
+	return fmt.Sprintf("%x", sha512.Sum512([]byte(s)))[:hashLength]
+}
+
+// getPodChainName 返回 pod 在某个方向上的链名
+func getPodChainName(ip string, direction Direction) string {
+	if direction == INGRESS {
+		return POLICY_INGRESS_CHAIN_PREFIX + shortHash(ip)
+	}
+	return POLICY_EGRESS_CHAIN_PREFIX + shortHash(ip)
+}
+
+// getIpsetName 返回 pod 某个方向上第 idx 条规则的对端用的 ipset 的名字
+func getIpsetName(ip string, direction Direction, idx int) string {
+	return POLICY_IPSET_PREFIX + shortHash(fmt.Sprintf("%s/%d/%d", ip, direction, idx))
+}
+
+func getPolicyJumpRule() []string {
+	return []string{"-m", "comment", "--comment", policyJumpComment, "-j", POLICY_CHAIN}
+}
+
+// buildRuleSpecs 把一条 Rule 转成 iptables 的规则, 命中的话 RETURN 回 POLICY_CHAIN 接着检查另一个方向
+func buildRuleSpecs(rule Rule, set string, direction Direction) [][]string {
+	var match []string
+	if !rule.AllPeers {
+		// ingress 的对端是源地址, egress 的对端是目的地址
+		flag := "src"
+		if direction == EGRESS {
+			flag = "dst"
+		}
+		match = []string{"-m", "set", "--match-set", set, flag}
+	}
+	if len(rule.Ports) == 0 {
+		return [][]string{append(match, "-j", "RETURN")}
+	}
+	var res [][]string
+	for _, port := range rule.Ports {
+		spec := append([]string{}, match...)
+		spec = append(spec, "-p", strings.ToLower(port.Protocol))
+		if port.Port != 0 {
+			spec = append(spec, "--dport", strconv.Itoa(int(port.Port)))
+		}
+		res = append(res, append(spec, "-j", "RETURN"))
+	}
+	return res
+}
+
+// buildChainRestore 生成 iptables-restore 的输入, 把 chains 里的每条链的内容整个换成 rules 里对应的规则
+// 带 --noflush 的时候 ":链名" 这一行会新建或者清空这条链, 清空和写规则在同一个事务里提交,
+// 所以不会出现链被清空了但是规则还没写完的窗口, 中间失败的话整个事务都不生效
+func buildChainRestore(chains []string, rules map[string][][]string) string {
+	var restore strings.Builder
+	restore.WriteString("*filter\n")
+	for _, chain := range chains {
+		restore.WriteString(fmt.Sprintf(":%s - [0:0]\n", chain))
+	}
+	for _, chain := range chains {
+		for _, spec := range rules[chain] {
+			args := make([]string, 0, len(spec))
+			for _, arg := range spec {
+				if strings.ContainsAny(arg, " \t\"") {
+					arg = strconv.Quote(arg)
+				}
+				args = append(args, arg)
+			}
+			restore.WriteString(fmt.Sprintf("-A %s %s\n", chain, strings.Join(args, " ")))
+		}
+	}
+	restore.WriteString("COMMIT\n")
+	return restore.String()
+}
+
+// restoreChains 用 iptables-restore 把 chains 一次性换成 rules 里的内容, 没在 chains 里的链和规则不动
+func restoreChains(chains []string, rules map[string][][]string) error {
+	cmd := exec.Command("iptables-restore", "--noflush")
+	cmd.Stdin = strings.NewReader(buildChainRestore(chains, rules))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		logger.Error("写入网络策略规则失败", "chains", chains, "err", err)
+		return fmt.Errorf("iptables-restore 失败: %v, output: %s", err, string(out))
+	}
+	return nil
+}
+
+// policyJumpInPlace 检查 FORWARD 上跳到 POLICY_CHAIN 的规则是不是在跳到 nettools.FORWARD_CHAIN 的规则前面
+// rules 是 ipt.List 的输出, 格式是 "-A FORWARD -m comment --comment xxx -j CNI-DEMO-xxx"
+// nettools 那边在 FORWARD 上没有跳转规则的时候也会插到第一条, 谁后插谁在前面, 所以每次同步都要检查一遍
+func policyJumpInPlace(rules []string) bool {
+	for _, rule := range rules {
+		spec := strings.Fields(rule)
+		if len(spec) < 2 || spec[0] != "-A" {
+			continue
+		}
+		switch spec[len(spec)-1] {
+		case POLICY_CHAIN:
+			return true
+		case nettools.FORWARD_CHAIN:
+			return false
+		}
+	}
+	return false
+}
+
+// ensurePolicyChain 保证 POLICY_CHAIN 存在, 并且 FORWARD 上跳过来的规则在 nettools.FORWARD_CHAIN 的前面
+// 位置不对的话删掉重新插到第一条
+func ensurePolicyChain(ipt *iptables.IPTables) error {
+	exist, err := ipt.ChainExists("filter", POLICY_CHAIN)
+	if err != nil {
+		return err
+	}
+	if !exist {
+		err = ipt.NewChain("filter", POLICY_CHAIN)
+		if err != nil {
+			return err
+		}
+	}
+	rules, err := ipt.List("filter", "FORWARD")
+	if err != nil {
+		return err
+	}
+	if policyJumpInPlace(rules) {
+		return nil
+	}
+	err = ipt.DeleteIfExists("filter", "FORWARD", getPolicyJumpRule()...)
+	if err != nil {
+		return err
+	}
+	return ipt.Insert("filter", "FORWARD", 1, getPolicyJumpRule()...)
+}
+
+// Sync 把本机 pod 的策略全量同步到 iptables 和 ipset 上
+//  1. 每个被隔离的 pod 每个方向一条链, 命中规则的 RETURN, 都不命中的话 DROP
+//  2. POLICY_CHAIN 里先放掉已经建立的连接, 然后按 pod ip 跳到各自的链
+//  3. 上面这些链用 iptables-restore 一次性整体替换, 不会有规则写了一半的时候
+//  4. 最后删掉已经不需要的链和 ipset
+func (e *IptablesEnforcer) Sync(policies []*PodPolicy) error {
+	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		return err
+	}
+	err = ensurePolicyChain(ipt)
+	if err != nil {
+		return err
+	}
+
+	chains := map[string]bool{}
+	sets := map[string]bool{}
+	// 所有 pod 的链和 POLICY_CHAIN 最后在一个事务里一起写进去
+	var order []string
+	chainRules := map[string][][]string{}
+	jumps := [][]string{
+		{"-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "RETURN"},
+	}
+	writeDirection := func(p *PodPolicy, rules []Rule, direction Direction) error {
+		chain := getPodChainName(p.IP, direction)
+		var specs [][]string
+		for idx, rule := range rules {
+			set := ""
+			if !rule.AllPeers {
+				set = getIpsetName(p.IP, direction, idx)
+				if err := syncIpset(set, rule.Peers); err != nil {
+					return err
+				}
+				sets[set] = true
+			}
+			specs = append(specs, buildRuleSpecs(rule, set, direction)...)
+		}
+		specs = append(specs, []string{"-j", "DROP"})
+		order = append(order, chain)
+		chainRules[chain] = specs
+		chains[chain] = true
+
+		addr := "-d"
+		if direction == EGRESS {
+			addr = "-s"
+		}
+		jumps = append(jumps, []string{addr, p.IP + "/32", "-j", chain})
+		return nil
+	}
+
+	for _, p := range policies {
+		if p.IngressIsolated {
+			if err := writeDirection(p, p.Ingress, INGRESS); err != nil {
+				return err
+			}
+		}
+		if p.EgressIsolated {
+			if err := writeDirection(p, p.Egress, EGRESS); err != nil {
+				return err
+			}
+		}
+	}
+
+	order = append(order, POLICY_CHAIN)
+	chainRules[POLICY_CHAIN] = jumps
+	err = restoreChains(order, chainRules)
+	if err != nil {
+		return err
+	}
+	return e.deleteStale(ipt, chains, sets)
+}
+
+// deleteStale 删掉不在 chains 和 sets 里的属于 cni-demo 的 pod 链和 ipset
+func (e *IptablesEnforcer) deleteStale(ipt *iptables.IPTables, chains, sets map[string]bool) error {
+	all, err := ipt.ListChains("filter")
+	if err != nil {
+		return err
+	}
+	for _, chain := range all {
+		if !strings.HasPrefix(chain, POLICY_INGRESS_CHAIN_PREFIX) && !strings.HasPrefix(chain, POLICY_EGRESS_CHAIN_PREFIX) {
+			continue
+		}
+		if chains[chain] {
+			continue
+		}
+		err = ipt.ClearAndDeleteChain("filter", chain)
+		if err != nil {
+			return err
+		}
+	}
+
+	allSets, err := listIpsets()
+	if err != nil {
+		return err
+	}
+	for _, set := range allSets {
+		if !strings.HasPrefix(set, POLICY_IPSET_PREFIX) || sets[set] {
+			continue
+		}
+		err = destroyIpset(set)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Cleanup 删掉网络策略相关的所有 iptables 规则和 ipset
+func (e *IptablesEnforcer) Cleanup() error {
+	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		return err
+	}
+	err = ipt.DeleteIfExists("filter", "FORWARD", getPolicyJumpRule()...)
+	if err != nil {
+		return err
+	}
+	exist, err := ipt.ChainExists("filter", POLICY_CHAIN)
+	if err != nil {
+		return err
+	}
+	if exist {
+		err = ipt.ClearAndDeleteChain("filter", POLICY_CHAIN)
+		if err != nil {
+			return err
+		}
+	}
+	return e.deleteStale(ipt, map[string]bool{}, map[string]bool{})
+}
@@ -0,0 +1,47 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicyJumpInPlace(t *testing.T) {
+	test := assert.New(t)
+
+	policyJump := "-A FORWARD -m comment --comment cni-demo:policy -j CNI-DEMO-POLICY"
+	forwardJump := `-A FORWARD -m comment --comment "cni-demo:forward" -j CNI-DEMO-FORWARD`
+	test.True(policyJumpInPlace([]string{"-P FORWARD ACCEPT", policyJump, forwardJump, "-A FORWARD -j DOCKER-USER"}))
+	test.True(policyJumpInPlace([]string{"-P FORWARD DROP", policyJump}))
+	// nettools 后插的跳转跑到了前面
+	test.False(policyJumpInPlace([]string{"-P FORWARD ACCEPT", forwardJump, policyJump}))
+	test.False(policyJumpInPlace([]string{"-P FORWARD ACCEPT", forwardJump}))
+	test.False(policyJumpInPlace([]string{"-P FORWARD ACCEPT"}))
+}
+
+func TestBuildChainRestore(t *testing.T) {
+	test := assert.New(t)
+
+	chain := getPodChainName("10.244.1.5", INGRESS)
+	rules := map[string][][]string{
+		chain: {
+			{"-m", "set", "--match-set", "cni-demo-xxx", "src", "-j", "RETURN"},
+			{"-j", "DROP"},
+		},
+		POLICY_CHAIN: {
+			{"-m", "comment", "--comment", "has space", "-j", "RETURN"},
+			{"-d", "10.244.1.5/32", "-j", chain},
+		},
+	}
+	test.Equal("*filter\n"+
+		":"+chain+" - [0:0]\n"+
+		":CNI-DEMO-POLICY - [0:0]\n"+
+		"-A "+chain+" -m set --match-set cni-demo-xxx src -j RETURN\n"+
+		"-A "+chain+" -j DROP\n"+
+		"-A CNI-DEMO-POLICY -m comment --comment \"has space\" -j RETURN\n"+
+		"-A CNI-DEMO-POLICY -d 10.244.1.5/32 -j "+chain+"\n"+
+		"COMMIT\n", buildChainRestore([]string{chain, POLICY_CHAIN}, rules))
+
+	// 没有策略的时候 POLICY_CHAIN 也要被清空
+	test.Equal("*filter\n:CNI-DEMO-POLICY - [0:0]\nCOMMIT\n", buildChainRestore([]string{POLICY_CHAIN}, map[string][][]string{}))
+}
@@ -0,0 +1,57 @@
+package policy
+
+// Direction 表示规则是管进 pod 的流量还是出 pod 的流量
+type Direction uint8
+
+const (
+	INGRESS Direction = 1
+	EGRESS  Direction = 2
+)
+
+const (
+	PROTOCOL_TCP  = "TCP"
+	PROTOCOL_UDP  = "UDP"
+	PROTOCOL_SCTP = "SCTP"
+)
+
+// Peer 是一个允许访问(或者被访问)的网段, Except 里的网段是要从 CIDR 里抠掉的
+// 从 pod 选出来的对端都是 /32 的网段
+type Peer struct {
+	CIDR   string
+	Except []string
+}
+
+// Port 是一个允许的端口, Port 为 0 表示这个协议的所有端口
+type Port struct {
+	Protocol string
+	Port     uint16
+}
+
+// Rule 是编译之后的一条放行规则, 对端和端口同时满足才放行
+// AllPeers 为 true 的时候表示不限制对端, 此时 Peers 是空的
+// Ports 为空表示不限制端口
+type Rule struct {
+	AllPeers bool
+	Peers    []Peer
+	Ports    []Port
+}
+
+// PodPolicy 是某个 pod 最终要执行的策略
+// 只要有一条 NetworkPolicy 在某个方向上选中了这个 pod, 这个 pod 在这个方向上就是隔离的
+// 隔离之后只有命中 Ingress/Egress 里任意一条规则的流量才放行
+type PodPolicy struct {
+	Namespace       string
+	Name            string
+	IP              string
+	IngressIsolated bool
+	EgressIsolated  bool
+	Ingress         []Rule
+	Egress          []Rule
+}
+
+// Enforcer 负责把编译好的策略落到数据面上
+// 每次调用 Sync 传进来的都是本机上所有需要隔离的 pod 的全量策略, 不在里面的 pod 的规则需要被清掉
+type Enforcer interface {
+	Sync(policies []*PodPolicy) error
+	Cleanup() error
+}
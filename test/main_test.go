@@ -7,7 +7,7 @@ import (
 	"testing"
 
 	"cni-demo/ipam"
-	"cni-demo/nettools"
+	"cni-demo/tools/nettools"
 	"encoding/json"
 
 	"github.com/containernetworking/cni/pkg/types"
@@ -0,0 +1,176 @@
+package helper
+
+import (
+	"cni-demo/cni"
+	"cni-demo/datastore"
+	"cni-demo/etcd"
+	bpf_map "cni-demo/plugins/vxlan/map"
+	"cni-demo/plugins/vxlan/tc"
+	"cni-demo/tools/logger"
+	"cni-demo/tools/metrics"
+	"cni-demo/tools/nettools"
+	"cni-demo/tools/skel"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	cniOperations = metrics.NewCounterVec(
+		"cni_operations_total",
+		"CNI 的 ADD, DEL 和 CHECK 的执行次数, result 是 success 或者 error",
+		"op", "mode", "result",
+	)
+	cniOperationDuration = metrics.NewHistogramVec(
+		"cni_operation_duration_seconds",
+		"CNI 的 ADD, DEL 和 CHECK 的耗时",
+		nil,
+		"op", "mode",
+	)
+)
+
+// 输入参数: log 是带着这次请求的 Logger, op 是 add, del 或者 check, mode 是配置里的模式, 配置都没解析出来的话是空的
+// 函数功能: 记录一次操作的次数和耗时, 并打一行这次请求的结果
+func observe(log *logger.Logger, op, mode string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+		log.Error("执行 CNI 请求失败", "mode", mode, "err", err)
+	} else {
+		log.Info("执行 CNI 请求成功", "mode", mode, "duration", time.Since(start))
+	}
+	cniOperations.Inc(op, mode, result)
+	cniOperationDuration.Observe(time.Since(start).Seconds(), op, mode)
+}
+
+// 日志也和 etcd 一样只在第一次解析出配置的时候初始化
+var initLogger sync.Once
+
+// 输入参数: args *skel.CmdArgs 是从 CNI 插件收到的命令行参数, op 是 add, del 或者 check, 只用来打日志
+// 函数功能: 解析配置并初始化防火墙、etcd 和 datastore, 这些都是单例, 在 agent 里只有第一次调用的时候才会真的去连
+// 返回值: 解析后的配置和工作模式
+func initClients(args *skel.CmdArgs, op string) (*cni.PluginConf, string, error) {
+	pluginConfig := GetConfigs(args)
+	if pluginConfig == nil {
+		errMsg := fmt.Sprintf("%s: 从 args 中获取 plugin config 失败, config: %s", op, string(args.StdinData))
+		logger.Error(errMsg)
+		return nil, "", errors.New(errMsg)
+	}
+	initLogger.Do(func() {
+		err := logger.Init(pluginConfig.Log)
+		if err != nil {
+			logger.Error("初始化日志失败", "err", err)
+		}
+	})
+	mode, cniVersion := GetBaseInfo(pluginConfig)
+	nettools.InitFirewall(pluginConfig.Firewall)
+	etcd.InitWithConfig(pluginConfig.Etcd)
+	datastore.InitDatastore(pluginConfig.Datastore)
+	bpf_map.InitMapSizes(pluginConfig.BPFMapSizes)
+	tc.InitTunnelID(pluginConfig.GetVxlanConf().VNI)
+	if pluginConfig.CNIVersion == "" {
+		pluginConfig.CNIVersion = cniVersion
+	}
+	return pluginConfig, mode, nil
+}
+
+// 输入参数: args *skel.CmdArgs 是从 CNI 插件收到的命令行参数
+// 函数功能: 执行一次 ADD, CNI 插件自己执行或者 cni-demo-agent 收到 CNI 插件转过来的请求时都走这里
+// 返回值: 按配置里的版本序列化好的结果, 原样打印到标准输出就行
+func CmdAdd(args *skel.CmdArgs) ([]byte, error) {
+	// 请求的结果用带着 command 和 containerID 的 Logger 打, agent 里别的组件的日志不受影响
+	log := logger.WithRequest("ADD", args.ContainerID)
+	start := time.Now()
+	result, mode, err := cmdAdd(args)
+	observe(log, "add", mode, start, err)
+	return result, err
+}
+
+func cmdAdd(args *skel.CmdArgs) ([]byte, string, error) {
+	pluginConfig, mode, err := initClients(args, "add")
+	if err != nil {
+		return nil, "", err
+	}
+
+	// 将 args 和 configs 以及要使用的插件模式都传给 cni manager
+	cniManager := cni.
+		GetCNIManager().
+		SetBootstrapConfigs(pluginConfig).
+		SetBootstrapArgs(args).
+		SetBootstrapCNIMode(mode)
+	if cniManager == nil {
+		logger.Error("cni 插件未初始化完成")
+		return nil, mode, errors.New("cni plugins register failed")
+	}
+
+	// 启动对应 mode 的插件开始设置乱七八糟的网卡等
+	err = cniManager.BootstrapCNI()
+	if err != nil {
+		logger.Error("设置 cni 失败", "err", err)
+		return nil, mode, err
+	}
+
+	result, err := cniManager.MarshalResult()
+	if err != nil {
+		logger.Error("序列化 cni 执行结果失败", "err", err)
+		return nil, mode, err
+	}
+	return result, mode, nil
+}
+
+// 输入参数: args *skel.CmdArgs 是从 CNI 插件收到的命令行参数
+// 函数功能: 执行一次 DEL
+func CmdDel(args *skel.CmdArgs) error {
+	// 请求的结果用带着 command 和 containerID 的 Logger 打, agent 里别的组件的日志不受影响
+	log := logger.WithRequest("DEL", args.ContainerID)
+	start := time.Now()
+	mode, err := cmdDel(args)
+	observe(log, "del", mode, start, err)
+	return err
+}
+
+func cmdDel(args *skel.CmdArgs) (string, error) {
+	pluginConfig, mode, err := initClients(args, "del")
+	if err != nil {
+		return "", err
+	}
+
+	// 设置卸载参数
+	cniManager := cni.
+		GetCNIManager().
+		SetUnmountConfigs(pluginConfig).
+		SetUnmountArgs(args).
+		SetUnmountCNIMode(mode)
+
+	// 进行卸载操作
+	return mode, cniManager.UnmountCNI()
+}
+
+// 输入参数: args *skel.CmdArgs 是从 CNI 插件收到的命令行参数
+// 函数功能: 执行一次 CHECK
+func CmdCheck(args *skel.CmdArgs) error {
+	// 请求的结果用带着 command 和 containerID 的 Logger 打, agent 里别的组件的日志不受影响
+	log := logger.WithRequest("CHECK", args.ContainerID)
+	start := time.Now()
+	mode, err := cmdCheck(args)
+	observe(log, "check", mode, start, err)
+	return err
+}
+
+func cmdCheck(args *skel.CmdArgs) (string, error) {
+	pluginConfig, mode, err := initClients(args, "check")
+	if err != nil {
+		return "", err
+	}
+
+	// 设置检查参数
+	cniManager := cni.
+		GetCNIManager().
+		SetCheckConfigs(pluginConfig).
+		SetCheckArgs(args).
+		SetCheckCNIMode(mode)
+
+	// 进行检查操作
+	return mode, cniManager.CheckCNI()
+}
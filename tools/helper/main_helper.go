@@ -3,8 +3,8 @@ package helper
 import (
 	"cni-demo/cni"
 	"cni-demo/consts"
+	"cni-demo/tools/logger"
 	"cni-demo/tools/skel"
-	"cni-demo/tools/utils"
 	"encoding/json"
 )
 
@@ -14,15 +14,18 @@ import (
 func GetConfigs(args *skel.CmdArgs) *cni.PluginConf {
 	pluginConfig := &cni.PluginConf{}
 	if err := json.Unmarshal(args.StdinData, pluginConfig); err != nil {
-		utils.WriteLog("args.StdinData 转 pluginConfig 失败")
+		logger.Error("args.StdinData 转 pluginConfig 失败", "err", err)
 		return nil
 	}
-	// utils.WriteLog("这里的结果是: pluginConfig.Bridge", pluginConfig.Bridge)
-	// utils.WriteLog("这里的结果是: pluginConfig.CNIVersion", pluginConfig.CNIVersion)
-	// utils.WriteLog("这里的结果是: pluginConfig.Name", pluginConfig.Name)
-	// utils.WriteLog("这里的结果是: pluginConfig.Subnet", pluginConfig.Subnet)
-	// utils.WriteLog("这里的结果是: pluginConfig.Type", pluginConfig.Type)
-	// utils.WriteLog("这里的结果是: pluginConfig.Mode", pluginConfig.Mode)
+	logger.Debug(
+		"解析 pluginConfig 成功",
+		"name", pluginConfig.Name,
+		"type", pluginConfig.Type,
+		"cniVersion", pluginConfig.CNIVersion,
+		"mode", pluginConfig.Mode,
+		"subnet", pluginConfig.Subnet,
+		"bridge", pluginConfig.Bridge,
+	)
 	return pluginConfig
 }
 
@@ -43,13 +46,14 @@ func GetBaseInfo(plugin *cni.PluginConf) (mode string, cniVersion string) {
 
 // 输入参数: args *skel.CmdArgs 是从 CNI 插件收到的命令行参数
 // 函数功能: 将传入的 args 中的各项参数（ContainerID、Netns、IfName、Args、Path 和 StdinData）记录到日志中，用于调试和跟踪
+// StdinData 里可能有 etcd 的密码, 只在 debug 级别打出来
 func TmpLogArgs(args *skel.CmdArgs) {
-	utils.WriteLog(
-		"这里的 CmdArgs 是: ", "ContainerID: ", args.ContainerID,
-		"Netns: ", args.Netns,
-		"IfName: ", args.IfName,
-		"Args: ", args.Args,
-		"Path: ", args.Path,
-		"StdinData: ", string(args.StdinData),
+	logger.Debug(
+		"收到了 CNI 请求",
+		"netns", args.Netns,
+		"ifName", args.IfName,
+		"args", args.Args,
+		"path", args.Path,
+		"stdinData", string(args.StdinData),
 	)
 }
@@ -0,0 +1,115 @@
+package logger
+
+import (
+	"os"
+	"strconv"
+)
+
+const (
+	DEFAULT_LOG_FILE = "/var/log/cni-demo/cni-demo.log"
+	// 单位是 MB
+	DEFAULT_MAX_SIZE    = 100
+	DEFAULT_MAX_BACKUPS = 3
+)
+
+// 以前的版本用这两个环境变量指定日志文件和打开调试日志, 为了兼容还是读一下
+const (
+	legacyLogPathEnv = "TEST_CNI_LOG_PATH"
+	legacyDebugEnv   = "TEST_CNI_DEBUG"
+)
+
+// Config 是网络配置里的 "log" 字段, 没写的字段用 CNI_DEMO_LOG_* 环境变量, 都没有的话用默认值
+// 和 etcd 的配置一样, 网络配置里写了的优先, 因为 kubelet 调 cni 插件的时候环境变量是不受我们控制的
+type Config struct {
+	// debug, info, warn 或者 error, 默认 info
+	Level string `json:"level"`
+	// 日志文件的路径, 写成 "-" 的话不写文件, 只打到标准错误
+	File string `json:"file"`
+	// 日志文件超过多少 MB 之后切割, 0 表示用默认值, 小于 0 表示不切割
+	MaxSize int `json:"maxSize"`
+	// 最多留几个切割出来的旧文件
+	MaxBackups int `json:"maxBackups"`
+	// 是否同时打到标准错误, CNI 插件出错的时候 kubelet 会把标准错误记到自己的日志里
+	Stderr *bool `json:"stderr"`
+}
+
+// loadEnv 用环境变量填上 config 中没有配置的字段, 都没有的话用默认值
+func (config *Config) loadEnv() {
+	lookup := func(name string) (string, bool) {
+		val, ok := os.LookupEnv(name)
+		return val, ok && val != ""
+	}
+	if config.Level == "" {
+		if val, ok := lookup("CNI_DEMO_LOG_LEVEL"); ok {
+			config.Level = val
+		} else if _, ok := lookup(legacyDebugEnv); ok {
+			config.Level = LevelDebug.String()
+		} else {
+			config.Level = LevelInfo.String()
+		}
+	}
+	if config.File == "" {
+		if val, ok := lookup("CNI_DEMO_LOG_FILE"); ok {
+			config.File = val
+		} else if val, ok := lookup(legacyLogPathEnv); ok {
+			config.File = val
+		} else {
+			config.File = DEFAULT_LOG_FILE
+		}
+	}
+	if config.MaxSize == 0 {
+		config.MaxSize = DEFAULT_MAX_SIZE
+		if val, ok := lookup("CNI_DEMO_LOG_MAX_SIZE"); ok {
+			if size, err := strconv.Atoi(val); err == nil {
+				config.MaxSize = size
+			}
+		}
+	}
+	if config.MaxBackups == 0 {
+		config.MaxBackups = DEFAULT_MAX_BACKUPS
+		if val, ok := lookup("CNI_DEMO_LOG_MAX_BACKUPS"); ok {
+			if backups, err := strconv.Atoi(val); err == nil {
+				config.MaxBackups = backups
+			}
+		}
+	}
+	if config.Stderr == nil {
+		stderr := false
+		if val, ok := lookup("CNI_DEMO_LOG_STDERR"); ok {
+			stderr, _ = strconv.ParseBool(val)
+		}
+		config.Stderr = &stderr
+	}
+}
+
+// LoadConfig 合并网络配置, 环境变量和默认值, 得到最终的日志配置
+func LoadConfig(netconf *Config) *Config {
+	config := &Config{}
+	if netconf != nil {
+		*config = *netconf
+	}
+	config.loadEnv()
+	return config
+}
+
+// Init 按网络配置和环境变量设置默认的 Logger, 在解析完网络配置之后调用
+// 没调用之前打的日志用的是只有环境变量的配置
+func Init(netconf *Config) error {
+	config := LoadConfig(netconf)
+	level, err := ParseLevel(config.Level)
+	SetLevel(level)
+
+	if config.File == "-" {
+		SetOutput(nil, true)
+		return err
+	}
+	maxSize := int64(config.MaxSize) * 1024 * 1024
+	file, openErr := NewRotateFile(config.File, maxSize, config.MaxBackups)
+	if openErr != nil {
+		// 文件打不开的话至少还能在标准错误里看到
+		SetOutput(nil, true)
+		return openErr
+	}
+	SetOutput(file, *config.Stderr)
+	return err
+}
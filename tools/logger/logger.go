@@ -0,0 +1,267 @@
+package logger
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+// 结构化的日志, 每一行都是 logfmt 格式的 key=value:
+// time=2022-05-01T12:00:00.000+08:00 level=info command=ADD containerID=abc msg="设置 veth 成功" ip=10.244.1.2
+// command 和 containerID 每一行都有, 在 CNI 插件里从 CNI_COMMAND 和 CNI_CONTAINERID 环境变量里取,
+// 在 cni-demo-agent 里 command 是 agent, 处理 CNI 请求的地方用 WithRequest 拿一个带着这次请求的 Logger 来打
+// agent 里还有别的组件在同时打日志, 所以请求的信息只跟着 Logger 走, 不改全局的
+
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// ParseLevel 把配置里的 debug, info, warn, error 转成 Level
+func ParseLevel(level string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(level)) {
+	case "debug":
+		return LevelDebug, nil
+	case "info", "":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, errors.New("不认识的日志级别: " + level)
+}
+
+// output 是所有 Logger 共用的输出, With 出来的 Logger 只是多带了几个字段
+type output struct {
+	level int32
+	// 调过 SetOutput 之后是 1, 没调过的话第一次打日志的时候按环境变量初始化一下
+	configured int32
+	lazyInit   sync.Once
+
+	lock        sync.Mutex
+	file        io.Writer
+	stderr      bool
+	command     string
+	containerID string
+}
+
+type Logger struct {
+	out *output
+	// 不为空的话每一行的 command 和 containerID 用它的, 而不是 output 里的
+	request *request
+	fields  []interface{}
+}
+
+// request 是 WithRequest 带上的一次 CNI 请求
+type request struct {
+	command     string
+	containerID string
+}
+
+var std = &Logger{out: &output{
+	level:       int32(LevelInfo),
+	command:     os.Getenv("CNI_COMMAND"),
+	containerID: os.Getenv("CNI_CONTAINERID"),
+}}
+
+// With 返回一个每一行都带上 keysAndValues 的 Logger, 一般用来标记是哪个组件打的日志
+func (l *Logger) With(keysAndValues ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keysAndValues))
+	fields = append(append(fields, l.fields...), keysAndValues...)
+	return &Logger{out: l.out, request: l.request, fields: fields}
+}
+
+// WithRequest 返回一个每一行的 command 和 containerID 都是这次 CNI 请求的 Logger
+func (l *Logger) WithRequest(command, containerID string) *Logger {
+	return &Logger{out: l.out, request: &request{command: command, containerID: containerID}, fields: l.fields}
+}
+
+func (l *Logger) Debug(msg string, keysAndValues ...interface{}) {
+	l.log(LevelDebug, msg, keysAndValues)
+}
+
+func (l *Logger) Info(msg string, keysAndValues ...interface{}) {
+	l.log(LevelInfo, msg, keysAndValues)
+}
+
+func (l *Logger) Warn(msg string, keysAndValues ...interface{}) {
+	l.log(LevelWarn, msg, keysAndValues)
+}
+
+func (l *Logger) Error(msg string, keysAndValues ...interface{}) {
+	l.log(LevelError, msg, keysAndValues)
+}
+
+func (l *Logger) Enabled(level Level) bool {
+	return level >= Level(atomic.LoadInt32(&l.out.level))
+}
+
+func (l *Logger) log(level Level, msg string, keysAndValues []interface{}) {
+	if atomic.LoadInt32(&l.out.configured) == 0 {
+		l.out.lazyInit.Do(func() {
+			Init(nil)
+		})
+	}
+	if !l.Enabled(level) {
+		return
+	}
+	l.out.lock.Lock()
+	defer l.out.lock.Unlock()
+
+	buf := &bytes.Buffer{}
+	writeField(buf, "time", time.Now().Format("2006-01-02T15:04:05.000Z07:00"))
+	writeField(buf, "level", level.String())
+	command, containerID := l.out.command, l.out.containerID
+	if l.request != nil {
+		command, containerID = l.request.command, l.request.containerID
+	}
+	writeField(buf, "command", command)
+	writeField(buf, "containerID", containerID)
+	writeField(buf, "msg", msg)
+	writeFields(buf, l.fields)
+	writeFields(buf, keysAndValues)
+	buf.WriteByte('\n')
+
+	line := buf.Bytes()
+	written := false
+	if l.out.file != nil {
+		if _, err := l.out.file.Write(line); err == nil {
+			written = true
+		}
+	}
+	// CNI 插件的标准输出是给运行时返回结果用的, 只能往标准错误里打
+	if l.out.stderr || !written {
+		os.Stderr.Write(line)
+	}
+}
+
+func writeFields(buf *bytes.Buffer, keysAndValues []interface{}) {
+	for i := 0; i < len(keysAndValues); i += 2 {
+		key := fmt.Sprint(keysAndValues[i])
+		if i+1 >= len(keysAndValues) {
+			// 少写了一个 value 的话也别丢, 原样打出来
+			writeField(buf, "!BADKEY", key)
+			return
+		}
+		writeField(buf, key, formatValue(keysAndValues[i+1]))
+	}
+}
+
+func writeField(buf *bytes.Buffer, key, value string) {
+	if buf.Len() > 0 {
+		buf.WriteByte(' ')
+	}
+	buf.WriteString(key)
+	buf.WriteByte('=')
+	if needQuote(value) {
+		buf.WriteString(strconv.Quote(value))
+	} else {
+		buf.WriteString(value)
+	}
+}
+
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "<nil>"
+	case error:
+		return v.Error()
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case fmt.Stringer:
+		return v.String()
+	}
+	return fmt.Sprint(value)
+}
+
+func needQuote(value string) bool {
+	if value == "" {
+		return true
+	}
+	for _, r := range value {
+		if r == '=' || r == '"' || unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetCommand 设置默认的 command, cni-demo-agent 启动的时候设置成 agent
+func SetCommand(command string) {
+	std.out.lock.Lock()
+	defer std.out.lock.Unlock()
+	std.out.command = command
+}
+
+func SetLevel(level Level) {
+	atomic.StoreInt32(&std.out.level, int32(level))
+}
+
+// SetOutput 设置写到哪里, file 为空的话只打到标准错误
+func SetOutput(file io.Writer, stderr bool) {
+	std.out.lock.Lock()
+	defer std.out.lock.Unlock()
+	if closer, ok := std.out.file.(io.Closer); ok && std.out.file != file {
+		closer.Close()
+	}
+	std.out.file = file
+	std.out.stderr = stderr
+	atomic.StoreInt32(&std.out.configured, 1)
+}
+
+func Default() *Logger {
+	return std
+}
+
+func With(keysAndValues ...interface{}) *Logger {
+	return std.With(keysAndValues...)
+}
+
+func WithRequest(command, containerID string) *Logger {
+	return std.WithRequest(command, containerID)
+}
+
+func Debug(msg string, keysAndValues ...interface{}) {
+	std.log(LevelDebug, msg, keysAndValues)
+}
+
+func Info(msg string, keysAndValues ...interface{}) {
+	std.log(LevelInfo, msg, keysAndValues)
+}
+
+func Warn(msg string, keysAndValues ...interface{}) {
+	std.log(LevelWarn, msg, keysAndValues)
+}
+
+func Error(msg string, keysAndValues ...interface{}) {
+	std.log(LevelError, msg, keysAndValues)
+}
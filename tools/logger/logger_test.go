@@ -0,0 +1,88 @@
+package logger
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogger(t *testing.T) {
+	test := assert.New(t)
+	buf := &bytes.Buffer{}
+	SetOutput(buf, false)
+	SetLevel(LevelInfo)
+	SetCommand("agent")
+	defer SetCommand("")
+	req := WithRequest("ADD", "abc")
+
+	req.Debug("不会打出来")
+	req.With("component", "ipam").Error("分配 ip 失败", "subnet", "10.244.0.0/16", "err", errors.New("没有可用的 ip"))
+	req.Info("odd", "key")
+	// 别的组件打的日志不会带上正在处理的请求
+	With("component", "watcher").Info("同步完成")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	test.Len(lines, 3)
+	test.Contains(lines[0], ` level=error command=ADD containerID=abc msg="分配 ip 失败" component=ipam subnet=10.244.0.0/16 err="没有可用的 ip"`)
+	test.True(strings.HasPrefix(lines[0], "time="))
+	test.Contains(lines[1], `command=ADD containerID=abc msg=odd !BADKEY=key`)
+	test.Contains(lines[2], `command=agent containerID="" msg=同步完成 component=watcher`)
+
+	level, err := ParseLevel("WARN")
+	test.Nil(err)
+	test.Equal(LevelWarn, level)
+	_, err = ParseLevel("verbose")
+	test.NotNil(err)
+}
+
+func TestLoadConfig(t *testing.T) {
+	test := assert.New(t)
+	os.Setenv("CNI_DEMO_LOG_LEVEL", "debug")
+	os.Setenv("CNI_DEMO_LOG_FILE", "/tmp/env.log")
+	defer os.Unsetenv("CNI_DEMO_LOG_LEVEL")
+	defer os.Unsetenv("CNI_DEMO_LOG_FILE")
+
+	// 网络配置里写了的优先
+	config := LoadConfig(&Config{File: "/tmp/netconf.log"})
+	test.Equal("debug", config.Level)
+	test.Equal("/tmp/netconf.log", config.File)
+	test.Equal(DEFAULT_MAX_SIZE, config.MaxSize)
+	test.Equal(DEFAULT_MAX_BACKUPS, config.MaxBackups)
+	test.False(*config.Stderr)
+
+	config = LoadConfig(nil)
+	test.Equal("/tmp/env.log", config.File)
+}
+
+func TestRotateFile(t *testing.T) {
+	test := assert.New(t)
+	path := filepath.Join(t.TempDir(), "log", "cni.log")
+	rf, err := NewRotateFile(path, 10, 2)
+	test.Nil(err)
+	defer rf.Close()
+
+	for _, line := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+		_, err = rf.Write([]byte(line))
+		test.Nil(err)
+	}
+	read := func(p string) string {
+		data, _ := ioutil.ReadFile(p)
+		return string(data)
+	}
+	test.Equal("dddddddd\n", read(path))
+	test.Equal("cccccccc\n", read(path+".1"))
+	test.Equal("bbbbbbbb\n", read(path+".2"))
+	test.NoFileExists(path + ".3")
+
+	// 别的进程把文件切走了之后要写到新的文件里
+	test.Nil(os.Rename(path, path+".1"))
+	_, err = rf.Write([]byte("eeee\n"))
+	test.Nil(err)
+	test.Equal("eeee\n", read(path))
+}
@@ -0,0 +1,106 @@
+package logger
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// RotateFile 是按大小切割的日志文件, 超过 maxSize 之后把 xxx.log 改名成 xxx.log.1, 原来的 .1 改成 .2, 依此类推
+// 每次执行 CNI 插件都是一个新的进程, 和 cni-demo-agent 一起往同一个文件里写,
+// 所以每次写之前都看一眼路径上的文件还是不是自己打开的那个, 被别的进程切走了的话重新打开
+type RotateFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewRotateFile maxSize 是字节数, 小于等于 0 的话不切割, maxBackups 是最多留几个切出来的文件
+func NewRotateFile(path string, maxSize int64, maxBackups int) (*RotateFile, error) {
+	rf := &RotateFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	err := rf.open()
+	if err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotateFile) open() error {
+	err := os.MkdirAll(filepath.Dir(rf.path), 0755)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rf.file = file
+	rf.size = info.Size()
+	return nil
+}
+
+// reopenIfMoved 文件被别的进程切走或者删掉了的话重新打开
+func (rf *RotateFile) reopenIfMoved() error {
+	info, err := os.Stat(rf.path)
+	if err == nil {
+		current, err := rf.file.Stat()
+		if err == nil && os.SameFile(info, current) {
+			rf.size = current.Size()
+			return nil
+		}
+	}
+	rf.file.Close()
+	return rf.open()
+}
+
+func (rf *RotateFile) backupPath(index int) string {
+	return rf.path + "." + strconv.Itoa(index)
+}
+
+func (rf *RotateFile) rotate() error {
+	rf.file.Close()
+	if rf.maxBackups <= 0 {
+		os.Remove(rf.path)
+	} else {
+		os.Remove(rf.backupPath(rf.maxBackups))
+		for i := rf.maxBackups - 1; i >= 1; i-- {
+			os.Rename(rf.backupPath(i), rf.backupPath(i+1))
+		}
+		os.Rename(rf.path, rf.backupPath(1))
+	}
+	return rf.open()
+}
+
+func (rf *RotateFile) Write(p []byte) (int, error) {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	err := rf.reopenIfMoved()
+	if err != nil {
+		return 0, err
+	}
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		err = rf.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *RotateFile) Close() error {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	return rf.file.Close()
+}
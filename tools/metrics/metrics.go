@@ -0,0 +1,296 @@
+package metrics
+
+import (
+	"bufio"
+	"cni-demo/tools/logger"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 指标名的前缀
+const NAMESPACE = "cni_demo"
+
+// 请求耗时默认的分桶, 单位是秒, CNI 的一次 ADD 从几毫秒到几十秒都有可能
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// 和 LightK8sClient 一样, 只实现了用得到的那一点 prometheus 的东西, 不引入 client_golang 那一整套
+// 输出的是 prometheus 的文本格式: https://prometheus.io/docs/instrumenting/exposition_formats/
+
+type metricType string
+
+const (
+	typeCounter   metricType = "counter"
+	typeGauge     metricType = "gauge"
+	typeHistogram metricType = "histogram"
+)
+
+// series 是一组 label 取值对应的数据
+type series struct {
+	labelValues []string
+	value       float64
+	// 下面几个只有 histogram 用
+	buckets []uint64
+	count   uint64
+}
+
+// vec 是所有类型的指标共用的部分, 按 label 的取值存每一条数据
+type vec struct {
+	name       string
+	help       string
+	_type      metricType
+	labelNames []string
+	buckets    []float64
+
+	lock   sync.Mutex
+	series map[string]*series
+}
+
+func newVec(name, help string, _type metricType, buckets []float64, labelNames []string) *vec {
+	return &vec{
+		name:       NAMESPACE + "_" + name,
+		help:       help,
+		_type:      _type,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     map[string]*series{},
+	}
+}
+
+// with 返回 labelValues 对应的数据, 没有的话新建一条, 调用方要持有锁
+func (v *vec) with(labelValues []string) *series {
+	if len(labelValues) != len(v.labelNames) {
+		// 写错了也不能让 CNI 插件 panic, 记一下日志就行
+		logger.Error("指标的 label 个数不对", "metric", v.name, "want", len(v.labelNames), "got", len(labelValues))
+		labelValues = append(append([]string{}, labelValues...), make([]string, len(v.labelNames))...)[:len(v.labelNames)]
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string{}, labelValues...)}
+		if v._type == typeHistogram {
+			s.buckets = make([]uint64, len(v.buckets))
+		}
+		v.series[key] = s
+	}
+	return s
+}
+
+// Reset 清掉所有数据, 采集的时候用来把已经不存在的 pod 之类的去掉
+func (v *vec) Reset() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.series = map[string]*series{}
+}
+
+// CounterVec 是只增不减的计数器
+type CounterVec struct {
+	*vec
+}
+
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{newVec(name, help, typeCounter, nil, labelNames)}
+	register(c.vec)
+	return c
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.with(labelValues).value += delta
+}
+
+// Set 直接设置计数器的值, 只给从 ebpf map 之类的地方读出来的、本身就是累计值的数据用
+func (c *CounterVec) Set(value float64, labelValues ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.with(labelValues).value = value
+}
+
+// GaugeVec 是可增可减的当前值
+type GaugeVec struct {
+	*vec
+}
+
+func NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	g := &GaugeVec{newVec(name, help, typeGauge, nil, labelNames)}
+	register(g.vec)
+	return g
+}
+
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.with(labelValues).value = value
+}
+
+// HistogramVec 统计分布, 比如请求的耗时
+type HistogramVec struct {
+	*vec
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64{}, buckets...)
+	sort.Float64s(buckets)
+	h := &HistogramVec{newVec(name, help, typeHistogram, buckets, labelNames)}
+	register(h.vec)
+	return h
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	s := h.with(labelValues)
+	for i, le := range h.buckets {
+		if value <= le {
+			s.buckets[i]++
+		}
+	}
+	s.count++
+	s.value += value
+}
+
+// Registry 存所有的指标和采集函数
+type Registry struct {
+	lock       sync.Mutex
+	vecs       map[string]*vec
+	collectors []func() error
+}
+
+func NewRegistry() *Registry {
+	return &Registry{vecs: map[string]*vec{}}
+}
+
+var defaultRegistry = NewRegistry()
+
+// register 把指标注册到默认的 Registry 上, NewXxxVec 的时候会自动调用
+func register(v *vec) {
+	defaultRegistry.register(v)
+}
+
+func (r *Registry) register(v *vec) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.vecs[v.name] = v
+}
+
+// RegisterCollector 注册一个在每次被拉取之前执行的函数, 用来更新那些需要现查的指标, 比如 ipam 的使用率和 ebpf map 的条数
+func RegisterCollector(fn func() error) {
+	defaultRegistry.registerCollector(fn)
+}
+
+func (r *Registry) registerCollector(fn func() error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.collectors = append(r.collectors, fn)
+}
+
+func escape(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+	return strings.Replace(value, `"`, `\"`, -1)
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// formatLabels 拼出 {a="1",b="2"}, extra 是 histogram 的 le
+func formatLabels(names, values []string, extra ...string) string {
+	pairs := []string{}
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, escape(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], escape(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// write 把一个指标按文本格式写出去, 每条数据按 label 排好序, 输出是稳定的
+func (v *vec) write(w *bufio.Writer) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if len(v.series) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, strings.Replace(v.help, "\n", " ", -1))
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v._type)
+	for _, key := range keys {
+		s := v.series[key]
+		if v._type != typeHistogram {
+			fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labelNames, s.labelValues), formatFloat(s.value))
+			continue
+		}
+		for i, le := range v.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(v.labelNames, s.labelValues, "le", formatFloat(le)), s.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(v.labelNames, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, formatLabels(v.labelNames, s.labelValues), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, formatLabels(v.labelNames, s.labelValues), s.count)
+	}
+}
+
+// ServeHTTP 先跑一遍采集函数, 然后把所有指标按名字排好序写出去
+func (r *Registry) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	r.lock.Lock()
+	collectors := append([]func() error{}, r.collectors...)
+	vecs := make([]*vec, 0, len(r.vecs))
+	for _, v := range r.vecs {
+		vecs = append(vecs, v)
+	}
+	r.lock.Unlock()
+
+	for _, collect := range collectors {
+		// 某一个采集失败了不影响别的指标
+		if err := collect(); err != nil {
+			logger.Error("采集指标失败", "err", err)
+		}
+	}
+	sort.Slice(vecs, func(i, j int) bool {
+		return vecs[i].name < vecs[j].name
+	})
+
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w := bufio.NewWriter(rw)
+	for _, v := range vecs {
+		v.write(w)
+	}
+	w.Flush()
+}
+
+// Handler 返回默认 Registry 的 http.Handler, 挂到 agent 的 /metrics 上
+func Handler() http.Handler {
+	return defaultRegistry
+}
@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func scrape(t *testing.T) string {
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := ioutil.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	test := assert.New(t)
+
+	ops := NewCounterVec("test_operations_total", "测试用的计数器", "op", "mode")
+	ops.Inc("add", "vxlan")
+	ops.Inc("add", "vxlan")
+	ops.Add(3, "del", "host-gw")
+	// 少传了 label 也不能 panic
+	ops.Inc("check")
+
+	usage := NewGaugeVec("test_block_allocated_ips", "测试用的 gauge", "block")
+	collected := 0
+	RegisterCollector(func() error {
+		collected++
+		usage.Reset()
+		usage.Set(float64(collected), `10.244.1.0/24`)
+		return nil
+	})
+	RegisterCollector(func() error {
+		return errors.New("采集失败也不影响别的")
+	})
+
+	latency := NewHistogramVec("test_duration_seconds", "测试用的 histogram", []float64{1, 0.1}, "op")
+	latency.Observe(0.05, "add")
+	latency.Observe(0.5, "add")
+	latency.Observe(5, "add")
+
+	body := scrape(t)
+	test.Contains(body, "# TYPE cni_demo_test_operations_total counter\n")
+	test.Contains(body, `cni_demo_test_operations_total{op="add",mode="vxlan"} 2`+"\n")
+	test.Contains(body, `cni_demo_test_operations_total{op="del",mode="host-gw"} 3`+"\n")
+	test.Contains(body, `cni_demo_test_operations_total{op="check",mode=""} 1`+"\n")
+	test.Contains(body, `cni_demo_test_block_allocated_ips{block="10.244.1.0/24"} 1`+"\n")
+
+	// 分桶是累计的, 并且会按从小到大排好
+	test.Contains(body, `cni_demo_test_duration_seconds_bucket{op="add",le="0.1"} 1`+"\n")
+	test.Contains(body, `cni_demo_test_duration_seconds_bucket{op="add",le="1"} 2`+"\n")
+	test.Contains(body, `cni_demo_test_duration_seconds_bucket{op="add",le="+Inf"} 3`+"\n")
+	test.Contains(body, `cni_demo_test_duration_seconds_sum{op="add"} 5.55`+"\n")
+	test.Contains(body, `cni_demo_test_duration_seconds_count{op="add"} 3`+"\n")
+
+	// 每次拉取之前都会重新采集
+	body = scrape(t)
+	test.Contains(body, `cni_demo_test_block_allocated_ips{block="10.244.1.0/24"} 2`+"\n")
+	test.True(strings.Index(body, "cni_demo_test_block") < strings.Index(body, "cni_demo_test_duration"))
+}
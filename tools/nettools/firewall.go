@@ -0,0 +1,158 @@
+package nettools
+
+import (
+	"cni-demo/consts"
+	"cni-demo/tools/logger"
+	"fmt"
+	"net"
+	"os/exec"
+	"sync"
+)
+
+// Firewall 是 cni-demo 下发防火墙规则的接口
+// 目前有 iptables 和 nftables 两种实现, 新一点的发行版上可能只有 nftables, 没有 iptables-legacy
+// 所有实现都需要保证重复调用是幂等的, 并且只动 cni-demo 自己创建的规则
+type Firewall interface {
+	// Backend 返回当前实现的名字, 也就是 consts.FIREWALL_XXX
+	Backend() string
+	// AddForwardAccept 允许从某块网卡进来的流量做转发
+	AddForwardAccept(name string) error
+	// DelForwardAccept 删掉某块网卡的转发放行规则
+	DelForwardAccept(name string) error
+	// SyncForwardAccept 把转发放行规则整体同步成只有 names 这些网卡
+	SyncForwardAccept(names []string) error
+	// SetupIPMasq 给一个 pod 设置 snat, 目标是 clusterCIDR 和 nonMasqCIDRs 的流量不做 snat
+	SetupIPMasq(podIP net.IP, clusterCIDR string, nonMasqCIDRs []string, containerID string) error
+	// TeardownIPMasq 删掉某个 pod 的 snat 规则
+	TeardownIPMasq(containerID string) error
+	// Cleanup 删掉 cni-demo 创建的所有规则
+	Cleanup() error
+}
+
+var (
+	_firewallLock    sync.Mutex
+	_firewallBackend string
+	_firewall        Firewall
+)
+
+// InitFirewall 设置要使用的防火墙后端, 一般是拿插件配置里的 firewall 字段来调用
+// backend 为空的话会在第一次用到的时候自动探测
+func InitFirewall(backend string) {
+	_firewallLock.Lock()
+	defer _firewallLock.Unlock()
+	if backend != _firewallBackend {
+		_firewall = nil
+	}
+	_firewallBackend = backend
+}
+
+// GetFirewall 返回当前使用的防火墙实现, 第一次调用的时候才会创建
+func GetFirewall() (Firewall, error) {
+	_firewallLock.Lock()
+	defer _firewallLock.Unlock()
+	if _firewall != nil {
+		return _firewall, nil
+	}
+	fw, err := NewFirewall(_firewallBackend)
+	if err != nil {
+		return nil, err
+	}
+	_firewall = fw
+	return _firewall, nil
+}
+
+// NewFirewall 根据 backend 创建对应的防火墙实现, backend 为空的话自动探测
+func NewFirewall(backend string) (Firewall, error) {
+	if backend == consts.FIREWALL_AUTO {
+		backend = DetectFirewallBackend()
+	}
+	switch backend {
+	case consts.FIREWALL_IPTABLES:
+		return &iptablesFirewall{}, nil
+	case consts.FIREWALL_NFTABLES:
+		return &nftablesFirewall{}, nil
+	}
+	return nil, fmt.Errorf("unknown firewall backend %q", backend)
+}
+
+// DetectFirewallBackend 探测本机应该用哪个后端
+// 能找到 iptables 命令的话还是优先用 iptables, 和之前的行为保持一致(iptables-nft 也是能正常工作的)
+// 找不到的话再看内核支不支持 nftables
+func DetectFirewallBackend() string {
+	if _, err := exec.LookPath("iptables"); err == nil {
+		return consts.FIREWALL_IPTABLES
+	}
+	if nftablesAvailable(0) {
+		return consts.FIREWALL_NFTABLES
+	}
+	logger.Warn("iptables 和 nftables 都不可用, 先按 iptables 处理")
+	return consts.FIREWALL_IPTABLES
+}
+
+// 下面这几个是为了让调用方不用关心具体用的是哪个后端
+
+// SetupIPMasq 给一个 pod 设置 snat, 具体的流程见各个后端的实现
+// podIP 需要是 pod 自己的 ip, 而不是 pod 所在的网段
+func SetupIPMasq(podIP net.IP, clusterCIDR string, nonMasqCIDRs []string, containerID string) error {
+	fw, err := GetFirewall()
+	if err != nil {
+		return err
+	}
+	return fw.SetupIPMasq(podIP, clusterCIDR, nonMasqCIDRs, containerID)
+}
+
+// SetupPodIPMasq 给刚分到 ip 的 pod 设置 snat, 目标是集群网段 clusterCIDR 的流量不做 snat
+// podIP 是分给 pod 的 ip/掩码, 各个模式的插件在开了 ipMasq 的时候从 ipam 里拿到集群网段之后调用
+func SetupPodIPMasq(podIP, clusterCIDR string, nonMasqCIDRs []string, containerID string) error {
+	ip, _, err := net.ParseCIDR(podIP)
+	if err != nil {
+		return err
+	}
+	return SetupIPMasq(ip, clusterCIDR, nonMasqCIDRs, containerID)
+}
+
+// TeardownIPMasq 在 DEL 的时候删掉 SetupIPMasq 创建的规则, 多次调用也没问题
+func TeardownIPMasq(containerID string) error {
+	fw, err := GetFirewall()
+	if err != nil {
+		return err
+	}
+	return fw.TeardownIPMasq(containerID)
+}
+
+// DelForwardAccept 删掉某块网卡的转发放行规则, 规则不存在的话什么也不做
+func DelForwardAccept(name string) error {
+	fw, err := GetFirewall()
+	if err != nil {
+		return err
+	}
+	return fw.DelForwardAccept(name)
+}
+
+// SyncForwardAccept 把转发放行规则整体同步成只放行 names 这些网卡
+// 适合由常驻进程拿着本机当前真实存在的网卡列表定期调用, 顺便清掉已经被删掉的网卡留下的规则
+func SyncForwardAccept(names []string) error {
+	fw, err := GetFirewall()
+	if err != nil {
+		return err
+	}
+	return fw.SyncForwardAccept(names)
+}
+
+// CleanupFirewall 删掉 cni-demo 创建的所有防火墙规则
+func CleanupFirewall() error {
+	fw, err := GetFirewall()
+	if err != nil {
+		return err
+	}
+	return fw.Cleanup()
+}
+
+// addForwardAccept 允许某块网卡做转发, 已经存在的话不会重复添加
+func addForwardAccept(name string) error {
+	fw, err := GetFirewall()
+	if err != nil {
+		return err
+	}
+	return fw.AddForwardAccept(name)
+}
@@ -0,0 +1,129 @@
+package nettools
+
+import (
+	"net"
+	"os/exec"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/google/nftables"
+	"github.com/stretchr/testify/assert"
+)
+
+// withTestNetNS 创建一个用完就扔的 netns, 防火墙的测试都在这里面跑, 不会动到主机上的规则
+func withTestNetNS(t *testing.T, fn func(netns ns.NetNS)) {
+	netns, err := testutils.NewNS()
+	if err != nil {
+		t.Skip("创建测试用的 netns 失败, 可能不是 root: ", err.Error())
+	}
+	defer func() {
+		netns.Close()
+		testutils.UnmountNS(netns)
+	}()
+	fn(netns)
+}
+
+func TestNewFirewall(t *testing.T) {
+	test := assert.New(t)
+
+	fw, err := NewFirewall("iptables")
+	test.Nil(err)
+	test.Equal("iptables", fw.Backend())
+
+	fw, err = NewFirewall("nftables")
+	test.Nil(err)
+	test.Equal("nftables", fw.Backend())
+
+	_, err = NewFirewall("ebtables")
+	test.NotNil(err)
+}
+
+func TestNftablesFirewall(t *testing.T) {
+	withTestNetNS(t, func(netns ns.NetNS) {
+		test := assert.New(t)
+		fd := int(netns.Fd())
+		if !nftablesAvailable(fd) {
+			t.Skip("内核不支持 nftables")
+		}
+		fw := &nftablesFirewall{netNS: fd}
+		conn, err := fw.conn()
+		test.Nil(err)
+
+		countRules := func(chain *nftables.Chain) int {
+			rules, err := conn.GetRules(fw.table(), chain)
+			test.Nil(err)
+			return len(rules)
+		}
+
+		// 重复添加不能有重复的规则
+		test.Nil(fw.AddForwardAccept("cni-demo0"))
+		test.Nil(fw.AddForwardAccept("cni-demo0"))
+		test.Equal(1, countRules(fw.forwardChain()))
+
+		test.Nil(fw.SyncForwardAccept([]string{"veth1", "veth2", "veth3"}))
+		test.Equal(3, countRules(fw.forwardChain()))
+		test.Nil(fw.DelForwardAccept("veth2"))
+		test.Nil(fw.DelForwardAccept("veth2"))
+		test.Equal(2, countRules(fw.forwardChain()))
+
+		podIP := net.ParseIP("10.244.1.2")
+		for i := 0; i < 2; i++ {
+			err = fw.SetupIPMasq(podIP, "10.244.0.0/16", []string{"192.168.0.0/16"}, "ding-test-container")
+			test.Nil(err)
+		}
+		test.Equal(1, countRules(fw.postroutingChain()))
+		test.Equal(3, countRules(fw.masqChain("ding-test-container")))
+		test.NotNil(fw.SetupIPMasq(podIP, "10.244.0.0/16", []string{"not-a-cidr"}, "ding-test-container"))
+
+		test.Nil(fw.TeardownIPMasq("ding-test-container"))
+		test.Nil(fw.TeardownIPMasq("ding-test-container"))
+		test.Equal(0, countRules(fw.postroutingChain()))
+		exist, err := fw.chainExists(conn, GetMasqChainName("ding-test-container"))
+		test.Nil(err)
+		test.False(exist)
+
+		test.Nil(fw.Cleanup())
+		test.Nil(fw.Cleanup())
+		exist, err = fw.chainExists(conn, nftForwardChain)
+		test.Nil(err)
+		test.False(exist)
+	})
+}
+
+func TestIptablesFirewall(t *testing.T) {
+	if _, err := exec.LookPath("iptables"); err != nil {
+		t.Skip("没有 iptables 命令")
+	}
+	withTestNetNS(t, func(netns ns.NetNS) {
+		// iptables 命令是从当前线程 fork 出去的, 在 netns.Do 里执行才会落到测试的 netns 里
+		err := netns.Do(func(ns.NetNS) error {
+			test := assert.New(t)
+			fw := &iptablesFirewall{}
+			ipt, err := newIPTables()
+			if err != nil {
+				return err
+			}
+
+			test.Nil(fw.AddForwardAccept("cni-demo0"))
+			test.Nil(fw.AddForwardAccept("cni-demo0"))
+			rules, err := ipt.List("filter", FORWARD_CHAIN)
+			test.Nil(err)
+			// 第一条是 "-N CNI-DEMO-FORWARD"
+			test.Len(rules, 2)
+
+			test.Nil(fw.SetupIPMasq(net.ParseIP("10.244.1.2"), "10.244.0.0/16", nil, "ding-test-container"))
+			test.Nil(fw.TeardownIPMasq("ding-test-container"))
+			exist, err := ipt.ChainExists("nat", GetMasqChainName("ding-test-container"))
+			test.Nil(err)
+			test.False(exist)
+
+			test.Nil(fw.Cleanup())
+			exist, err = ipt.ChainExists("filter", FORWARD_CHAIN)
+			test.Nil(err)
+			test.False(exist)
+			return nil
+		})
+		assert.Nil(t, err)
+	})
+}
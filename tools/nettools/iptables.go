@@ -0,0 +1,328 @@
+package nettools
+
+import (
+	"cni-demo/consts"
+	"cni-demo/tools/logger"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+const (
+	// FORWARD_CHAIN 是 cni-demo 自己在 filter 表里管理的链
+	// 所有放行转发的规则都写在这条链里, FORWARD 上只挂一条跳过来的规则
+	// 这样不管 ADD 被调用多少次, FORWARD 都不会越来越长
+	FORWARD_CHAIN = "CNI-DEMO-FORWARD"
+	// forwardJumpComment 是 FORWARD 上那条跳转规则的注释
+	forwardJumpComment = "cni-demo:forward"
+)
+
+// iptablesFirewall 是用 go-iptables 实现的 Firewall
+type iptablesFirewall struct{}
+
+func (fw *iptablesFirewall) Backend() string {
+	return consts.FIREWALL_IPTABLES
+}
+
+// newIPTables 创建一个 ipv4 的 iptables 客户端
+func newIPTables() (*iptables.IPTables, error) {
+	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		logger.Error("iptables NewWithProtocol 失败", "err", err)
+		return nil, err
+	}
+	return ipt, nil
+}
+
+// getForwardJumpRule 返回 FORWARD 跳到 FORWARD_CHAIN 的规则
+func getForwardJumpRule() []string {
+	return []string{"-m", "comment", "--comment", forwardJumpComment, "-j", FORWARD_CHAIN}
+}
+
+// ensureForwardChain 保证 FORWARD_CHAIN 已经创建, 并且 FORWARD 上有且只有一条跳过来的规则
+// 跳转规则是插在 FORWARD 的最前头的, 因为 docker 之类的可能会在 FORWARD 上加 DROP
+func ensureForwardChain(ipt *iptables.IPTables) error {
+	exist, err := ipt.ChainExists("filter", FORWARD_CHAIN)
+	if err != nil {
+		return err
+	}
+	if !exist {
+		err = ipt.NewChain("filter", FORWARD_CHAIN)
+		if err != nil {
+			logger.Error("创建 iptables 链失败", "chain", FORWARD_CHAIN, "err", err)
+			return err
+		}
+	}
+
+	jump := getForwardJumpRule()
+	exist, err = ipt.Exists("filter", "FORWARD", jump...)
+	if err != nil {
+		return err
+	}
+	if exist {
+		return nil
+	}
+	err = ipt.Insert("filter", "FORWARD", 1, jump...)
+	if err != nil {
+		logger.Error("在 FORWARD 上添加跳转规则失败", "err", err)
+		return err
+	}
+	return nil
+}
+
+// getForwardAcceptRule 返回允许某块网卡做转发的规则
+func getForwardAcceptRule(name string) []string {
+	return []string{"-i", name, "-j", "ACCEPT"}
+}
+
+// AddForwardAccept 在 FORWARD_CHAIN 里允许某块网卡做转发, 已经存在的话不会重复添加
+func (fw *iptablesFirewall) AddForwardAccept(name string) error {
+	ipt, err := newIPTables()
+	if err != nil {
+		return err
+	}
+	err = ensureForwardChain(ipt)
+	if err != nil {
+		return err
+	}
+	err = ipt.AppendUnique("filter", FORWARD_CHAIN, getForwardAcceptRule(name)...)
+	if err != nil {
+		logger.Error("iptables AppendUnique 失败", "err", err)
+		return err
+	}
+	return nil
+}
+
+// DelForwardAccept 从 FORWARD_CHAIN 里删掉某块网卡的放行规则
+func (fw *iptablesFirewall) DelForwardAccept(name string) error {
+	ipt, err := newIPTables()
+	if err != nil {
+		return err
+	}
+	exist, err := ipt.ChainExists("filter", FORWARD_CHAIN)
+	if err != nil || !exist {
+		return err
+	}
+	return ipt.DeleteIfExists("filter", FORWARD_CHAIN, getForwardAcceptRule(name)...)
+}
+
+// diffForwardAcceptRules 比较 FORWARD_CHAIN 里现有的规则和要放行的网卡, 返回要加的网卡和要删的规则
+// rules 是 ipt.List 的输出, 格式是 "-A CNI-DEMO-FORWARD -i xxx -j ACCEPT", 第一行是 "-N CNI-DEMO-FORWARD"
+// 不是放行 names 里的网卡的规则都要删掉, 包括手动加进来的
+func diffForwardAcceptRules(rules []string, names []string) ([]string, [][]string) {
+	want := map[string]bool{}
+	for _, name := range names {
+		want[name] = true
+	}
+	existing := map[string]bool{}
+	del := [][]string{}
+	for _, rule := range rules {
+		spec := strings.Fields(rule)
+		if len(spec) < 2 || spec[0] != "-A" {
+			continue
+		}
+		spec = spec[2:]
+		if len(spec) == 4 && spec[0] == "-i" && spec[2] == "-j" && spec[3] == "ACCEPT" && want[spec[1]] && !existing[spec[1]] {
+			existing[spec[1]] = true
+			continue
+		}
+		del = append(del, spec)
+	}
+	add := []string{}
+	for _, name := range names {
+		if !existing[name] {
+			existing[name] = true
+			add = append(add, name)
+		}
+	}
+	return add, del
+}
+
+// SyncForwardAccept 把 FORWARD_CHAIN 整条链同步成只放行 names 这些网卡
+// 不能先清空再加, 中间会有一段链是空的, 正在转发的 pod 的流量会被 FORWARD 上别的规则丢掉
+// 所以这里只加缺的、删多的, 并且先加后删
+func (fw *iptablesFirewall) SyncForwardAccept(names []string) error {
+	ipt, err := newIPTables()
+	if err != nil {
+		return err
+	}
+	err = ensureForwardChain(ipt)
+	if err != nil {
+		return err
+	}
+	rules, err := ipt.List("filter", FORWARD_CHAIN)
+	if err != nil {
+		return err
+	}
+	add, del := diffForwardAcceptRules(rules, names)
+	for _, name := range add {
+		err = ipt.Append("filter", FORWARD_CHAIN, getForwardAcceptRule(name)...)
+		if err != nil {
+			logger.Error("iptables Append 失败", "err", err)
+			return err
+		}
+	}
+	for _, spec := range del {
+		err = ipt.Delete("filter", FORWARD_CHAIN, spec...)
+		if err != nil {
+			logger.Error("iptables Delete 失败", "err", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// SetupIPMasq 流程和官方插件的 ip.SetupIPMasq 差不多:
+//  1. 在 nat 表中创建一条这个 pod 专属的链
+//  2. 链里对目标是集群网段(也就是其他节点上的 pod 的 cidr)以及用户配置的不需要 snat 的网段直接 ACCEPT
+//  3. 剩下的除了组播以外全部 MASQUERADE
+//  4. 最后在 POSTROUTING 上挂一条规则, 源地址是这个 pod 的流量都跳到这条链上
+func (fw *iptablesFirewall) SetupIPMasq(podIP net.IP, clusterCIDR string, nonMasqCIDRs []string, containerID string) error {
+	ipt, err := newIPTables()
+	if err != nil {
+		return err
+	}
+
+	chain := GetMasqChainName(containerID)
+	comment := getMasqComment(containerID)
+
+	exist, err := ipt.ChainExists("nat", chain)
+	if err != nil {
+		return err
+	}
+	if !exist {
+		if err = ipt.NewChain("nat", chain); err != nil {
+			logger.Error("创建 snat 链失败", "chain", chain, "err", err)
+			return err
+		}
+	}
+
+	// 集群内部 pod 之间的通信以及用户指定的网段不做 snat
+	skipCIDRs := append([]string{clusterCIDR}, nonMasqCIDRs...)
+	for _, cidr := range skipCIDRs {
+		if cidr == "" {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid non-masquerade cidr %q: %v", cidr, err)
+		}
+		err = ipt.AppendUnique("nat", chain, "-d", cidr, "-j", "ACCEPT", "-m", "comment", "--comment", comment)
+		if err != nil {
+			logger.Error("添加 snat 跳过规则失败", "cidr", cidr, "err", err)
+			return err
+		}
+	}
+
+	err = ipt.AppendUnique("nat", chain, "!", "-d", multicastCIDR, "-j", "MASQUERADE", "-m", "comment", "--comment", comment)
+	if err != nil {
+		logger.Error("添加 MASQUERADE 规则失败", "err", err)
+		return err
+	}
+
+	source := (&net.IPNet{IP: podIP, Mask: net.CIDRMask(32, 32)}).String()
+	err = ipt.AppendUnique("nat", "POSTROUTING", "-s", source, "-j", chain, "-m", "comment", "--comment", comment)
+	if err != nil {
+		logger.Error("添加 POSTROUTING 跳转规则失败", "err", err)
+		return err
+	}
+	return nil
+}
+
+// deletePostroutingJumps 删掉 POSTROUTING 里所有跳到 chains 里的链的规则
+// 输出的格式是 "-A POSTROUTING -s x.x.x.x/32 -m comment --comment xxx -j CNI-DEMO-xxx"
+func deletePostroutingJumps(ipt *iptables.IPTables, chains map[string]bool) error {
+	rules, err := ipt.List("nat", "POSTROUTING")
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		spec := strings.Fields(rule)
+		if len(spec) < 2 || spec[0] != "-A" || !chains[spec[len(spec)-1]] {
+			continue
+		}
+		err = ipt.Delete("nat", "POSTROUTING", spec[2:]...)
+		if err != nil {
+			logger.Error("删除 POSTROUTING 跳转规则失败", "err", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// TeardownIPMasq 在 DEL 的时候删掉 SetupIPMasq 创建的链和跳转规则
+// DEL 的时候不一定能拿到 pod 的 ip, 所以这里是从 POSTROUTING 里找到所有跳到这条链上的规则挨个删掉
+func (fw *iptablesFirewall) TeardownIPMasq(containerID string) error {
+	ipt, err := newIPTables()
+	if err != nil {
+		return err
+	}
+
+	chain := GetMasqChainName(containerID)
+	err = deletePostroutingJumps(ipt, map[string]bool{chain: true})
+	if err != nil {
+		return err
+	}
+
+	exist, err := ipt.ChainExists("nat", chain)
+	if err != nil {
+		return err
+	}
+	if !exist {
+		return nil
+	}
+	return ipt.ClearAndDeleteChain("nat", chain)
+}
+
+// Cleanup 删掉 cni-demo 创建的所有 iptables 规则和链
+// 包括:
+//  1. FORWARD 上的跳转规则以及 FORWARD_CHAIN 本身
+//  2. nat 表里所有以 MASQ_CHAIN_PREFIX 开头的 snat 链以及 POSTROUTING 上跳过去的规则
+func (fw *iptablesFirewall) Cleanup() error {
+	ipt, err := newIPTables()
+	if err != nil {
+		return err
+	}
+
+	err = ipt.DeleteIfExists("filter", "FORWARD", getForwardJumpRule()...)
+	if err != nil {
+		return err
+	}
+	exist, err := ipt.ChainExists("filter", FORWARD_CHAIN)
+	if err != nil {
+		return err
+	}
+	if exist {
+		err = ipt.ClearAndDeleteChain("filter", FORWARD_CHAIN)
+		if err != nil {
+			return err
+		}
+	}
+
+	chains, err := ipt.ListChains("nat")
+	if err != nil {
+		return err
+	}
+	owned := map[string]bool{}
+	for _, chain := range chains {
+		if strings.HasPrefix(chain, MASQ_CHAIN_PREFIX) {
+			owned[chain] = true
+		}
+	}
+	if len(owned) == 0 {
+		return nil
+	}
+
+	err = deletePostroutingJumps(ipt, owned)
+	if err != nil {
+		return err
+	}
+	for chain := range owned {
+		err = ipt.ClearAndDeleteChain("nat", chain)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
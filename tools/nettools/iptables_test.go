@@ -0,0 +1,50 @@
+package nettools
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForwardChainRules(t *testing.T) {
+	test := assert.New(t)
+
+	// FORWARD_CHAIN 也是 MASQ_CHAIN_PREFIX 开头的, 但 snat 链名后半截是 hash 出来的十六进制,
+	// 所以 GetMasqChainName 不会生成和 FORWARD_CHAIN 一样的名字
+	test.True(strings.HasPrefix(FORWARD_CHAIN, MASQ_CHAIN_PREFIX))
+	_, err := hex.DecodeString(strings.TrimPrefix(FORWARD_CHAIN, MASQ_CHAIN_PREFIX))
+	test.NotNil(err)
+	test.NotEqual(FORWARD_CHAIN, GetMasqChainName(""))
+	test.LessOrEqual(len(FORWARD_CHAIN), maxChainLength)
+
+	jump := getForwardJumpRule()
+	test.Equal(FORWARD_CHAIN, jump[len(jump)-1])
+	test.Equal([]string{"-i", "cni-demo0", "-j", "ACCEPT"}, getForwardAcceptRule("cni-demo0"))
+}
+
+func TestDiffForwardAcceptRules(t *testing.T) {
+	test := assert.New(t)
+
+	rules := []string{
+		"-N CNI-DEMO-FORWARD",
+		"-A CNI-DEMO-FORWARD -i veth1 -j ACCEPT",
+		"-A CNI-DEMO-FORWARD -i veth2 -j ACCEPT",
+		// 重复的
+		"-A CNI-DEMO-FORWARD -i veth1 -j ACCEPT",
+		// 手动加进来的
+		"-A CNI-DEMO-FORWARD -s 10.0.0.0/8 -j ACCEPT",
+	}
+	add, del := diffForwardAcceptRules(rules, []string{"veth1", "veth3", "veth3"})
+	test.Equal([]string{"veth3"}, add)
+	test.Equal([][]string{
+		{"-i", "veth2", "-j", "ACCEPT"},
+		{"-i", "veth1", "-j", "ACCEPT"},
+		{"-s", "10.0.0.0/8", "-j", "ACCEPT"},
+	}, del)
+
+	add, del = diffForwardAcceptRules(rules[:2], []string{"veth1"})
+	test.Empty(add)
+	test.Empty(del)
+}
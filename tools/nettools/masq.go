@@ -0,0 +1,28 @@
+package nettools
+
+import (
+	"crypto/sha512"
+	"fmt"
+)
+
+const (
+	// MASQ_CHAIN_PREFIX 是 cni-demo 在 nat 表里创建的 snat 链的前缀, 风格上参照官方插件的 CNI-xxx
+	MASQ_CHAIN_PREFIX = "CNI-DEMO-"
+	// iptables 的链名最长只能有 28 个字符
+	maxChainLength = 28
+	// 组播地址不做 snat
+	multicastCIDR = "224.0.0.0/4"
+)
+
+// GetMasqChainName 根据 containerID 生成这个 pod 专属的 snat 链的名字
+// 和官方插件一样用 hash 来截断, 保证同一个容器每次算出来的都一样
+func GetMasqChainName(containerID string) string {
+	hash := sha512.Sum512([]byte(containerID))
+	return fmt.Sprintf("%s%x", MASQ_CHAIN_PREFIX, hash)[:maxChainLength]
+}
+
+// getMasqComment 生成挂在 POSTROUTING 上的那条跳转规则的注释, nftables 里是放在 rule 的 UserData 里
+// 注释里不能带空格, 否则在 DEL 的时候从 iptables -S 的输出里反解析规则会很麻烦
+func getMasqComment(containerID string) string {
+	return "cni-demo:masq:" + containerID
+}
@@ -0,0 +1,21 @@
+package nettools
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMasqChainName(t *testing.T) {
+	test := assert.New(t)
+
+	name := GetMasqChainName("ding-test-container")
+	test.True(strings.HasPrefix(name, MASQ_CHAIN_PREFIX))
+	test.Len(name, maxChainLength)
+	// 同一个容器每次算出来的链名都要一样, DEL 的时候才能找回来
+	test.Equal(name, GetMasqChainName("ding-test-container"))
+	test.NotEqual(name, GetMasqChainName("ding-test-container-2"))
+
+	test.NotContains(getMasqComment("ding-test-container"), " ")
+}
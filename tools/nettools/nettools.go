@@ -2,12 +2,12 @@ package nettools
 
 import (
 	"cni-demo/ipam"
+	"cni-demo/tools/logger"
 	utils2 "cni-demo/tools/utils"
 	"crypto/rand"
 	"errors"
 	"fmt"
 	"github.com/containernetworking/plugins/pkg/ns"
-	"github.com/coreos/go-iptables/iptables"
 	"github.com/vishvananda/netlink"
 	"net"
 	"os"
@@ -96,25 +96,72 @@ func SetIpForIPIPDeivce(name string, ip string) error {
 	return setIpForDevice(name, ip, "ipip")
 }
 
-// CreateArpEntry 为指定设备创建 ARP 表项。
-// TODO: trick now!
+// CreateArpEntry 为指定设备创建一条永久的 ARP 表项, 已经有了的话会覆盖掉。
 func CreateArpEntry(ip, mac, dev string) error {
-	processInfo := exec.Command(
-		"/bin/sh", "-c",
-		fmt.Sprintf("arp -s %s %s -i %s", ip, mac, dev),
-	)
-	_, err := processInfo.Output()
-	return err
+	neigh, err := newNeigh(ip, mac, dev)
+	if err != nil {
+		return err
+	}
+	neigh.Family = netlink.FAMILY_V4
+	return netlink.NeighSet(neigh)
 }
 
 // DeleteArpEntry 删除指定设备的 ARP 表项。
 func DeleteArpEntry(ip, dev string) error {
-	processInfo := exec.Command(
-		"/bin/sh", "-c",
-		fmt.Sprintf("arp -d %s -i %s", ip, dev),
-	)
-	_, err := processInfo.Output()
-	return err
+	link, err := netlink.LinkByName(dev)
+	if err != nil {
+		return err
+	}
+	return netlink.NeighDel(&netlink.Neigh{
+		LinkIndex: link.Attrs().Index,
+		Family:    netlink.FAMILY_V4,
+		IP:        net.ParseIP(ip),
+	})
+}
+
+// CreateFdbEntry 在指定的 vxlan 设备上创建一条永久的 fdb 表项, 目标 mac 是 mac 的帧封装之后发到 dst。
+// 等价于 bridge fdb replace ${mac} dev ${dev} dst ${dst} self permanent
+func CreateFdbEntry(mac, dst, dev string) error {
+	neigh, err := newNeigh(dst, mac, dev)
+	if err != nil {
+		return err
+	}
+	neigh.Family = syscall.AF_BRIDGE
+	neigh.Flags = netlink.NTF_SELF
+	return netlink.NeighSet(neigh)
+}
+
+// DeleteFdbEntry 删除指定 vxlan 设备上的 fdb 表项。
+func DeleteFdbEntry(mac, dst, dev string) error {
+	neigh, err := newNeigh(dst, mac, dev)
+	if err != nil {
+		return err
+	}
+	neigh.Family = syscall.AF_BRIDGE
+	neigh.Flags = netlink.NTF_SELF
+	return netlink.NeighDel(neigh)
+}
+
+// newNeigh 把字符串的 ip 和 mac 转成一条永久的邻居表项, Family 由调用的地方填
+func newNeigh(ip, mac, dev string) (*netlink.Neigh, error) {
+	link, err := netlink.LinkByName(dev)
+	if err != nil {
+		return nil, err
+	}
+	_ip := net.ParseIP(ip)
+	if _ip == nil {
+		return nil, fmt.Errorf("invalid ip %q", ip)
+	}
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return nil, err
+	}
+	return &netlink.Neigh{
+		LinkIndex:    link.Attrs().Index,
+		State:        netlink.NUD_PERMANENT,
+		IP:           _ip,
+		HardwareAddr: hw,
+	}, nil
 }
 
 // CreateVxlanAndUp 创建并启动指定名称的 VXLAN 设备。可以设置 MTU，如果没有设置则使用默认值。
@@ -138,24 +185,24 @@ func CreateVxlanAndUp(name string, mtu int) (*netlink.Vxlan, error) {
 	}
 	err := netlink.LinkAdd(vxlan)
 	if err != nil {
-		utils2.WriteLog("无法创建 vxlan 设备: ", name, "err: ", err.Error())
+		logger.Error("无法创建 vxlan 设备", "name", name, "err", err)
 		return nil, err
 	}
 
 	l, err = netlink.LinkByName(name)
 	if err != nil {
-		utils2.WriteLog("获取 vxlan 失败")
+		logger.Error("获取 vxlan 失败")
 		return nil, err
 	}
 
 	vxlan, ok = l.(*netlink.Vxlan)
 	if !ok {
-		utils2.WriteLog("找到了设备, 但是该设备不是 vxlan")
+		logger.Error("找到了设备, 但是该设备不是 vxlan")
 		return nil, fmt.Errorf("found the device %q but it's not a vxlan", name)
 	}
 	// 然后还要把这个 vxlan 给 up 起来
 	if err = netlink.LinkSetUp(vxlan); err != nil {
-		utils2.WriteLog("启动 vxlan 失败, err: ", err.Error())
+		logger.Error("启动 vxlan 失败", "err", err)
 		return nil, fmt.Errorf("setup vxlan %q error, err: %v", name, err)
 	}
 	return vxlan, nil
@@ -166,13 +213,21 @@ func SetIpForVxlan(name string, ip string) error {
 	return setIpForDevice(name, ip, "vxlan")
 }
 
-// CreateVxlanAndUp2 使用外部模式创建并启动指定名称的 VXLAN 设备。需要手动设置 MTU。
+// CreateVxlanAndUp2 使用外部模式创建并启动指定名称的 VXLAN 设备, 隧道的 udp 目标端口是 port。需要手动设置 MTU。
+// 已经有了同名的设备但是端口不一样的话报错, 要手动删掉, 不然已经在用的隧道会断掉
 // TODO: golang 的 netlink 包在创建 vxlan 设备时不支持传入 external 模式
-func CreateVxlanAndUp2(name string, mtu int) (*netlink.Vxlan, error) {
+func CreateVxlanAndUp2(name string, mtu int, port int) (*netlink.Vxlan, error) {
 	l, _ := netlink.LinkByName(name)
 
 	vxlan, ok := l.(*netlink.Vxlan)
 	if ok && vxlan != nil {
+		// kernel 数据面建出来的不是 external 的, 切换数据面之前要先把设备删掉
+		if !vxlan.FlowBased {
+			return nil, fmt.Errorf("vxlan %q already exists but it's not external", name)
+		}
+		if vxlan.Port != port {
+			return nil, fmt.Errorf("vxlan %q already exists with port %d, want %d", name, vxlan.Port, port)
+		}
 		return vxlan, nil
 	}
 	// if mtu == 0 {
@@ -181,7 +236,7 @@ func CreateVxlanAndUp2(name string, mtu int) (*netlink.Vxlan, error) {
 
 	processInfo := exec.Command(
 		"/bin/sh", "-c",
-		fmt.Sprintf("ip link add name %s type vxlan external", name),
+		fmt.Sprintf("ip link add name %s type vxlan external dstport %d", name, port),
 	)
 	_, err := processInfo.Output()
 	if err != nil {
@@ -190,18 +245,18 @@ func CreateVxlanAndUp2(name string, mtu int) (*netlink.Vxlan, error) {
 
 	l, err = netlink.LinkByName(name)
 	if err != nil {
-		utils2.WriteLog("获取 vxlan 失败")
+		logger.Error("获取 vxlan 失败")
 		return nil, err
 	}
 
 	vxlan, ok = l.(*netlink.Vxlan)
 	if !ok {
-		utils2.WriteLog("找到了设备, 但是该设备不是 vxlan")
+		logger.Error("找到了设备, 但是该设备不是 vxlan")
 		return nil, fmt.Errorf("found the device %q but it's not a vxlan", name)
 	}
 	// 然后还要把这个 vxlan 给 up 起来
 	if err = netlink.LinkSetUp(vxlan); err != nil {
-		utils2.WriteLog("启动 vxlan 失败, err: ", err.Error())
+		logger.Error("启动 vxlan 失败", "err", err)
 		return nil, fmt.Errorf("set up vxlan %q error, err: %v", name, err)
 	}
 	return vxlan, nil
@@ -348,7 +403,7 @@ func CreateBridge(brName, gw string, mtu int) (*netlink.Bridge, error) {
 
 	err = netlink.LinkAdd(br)
 	if err != nil {
-		utils2.WriteLog("无法创建网桥: ", brName, "err: ", err.Error())
+		logger.Error("无法创建网桥", "name", brName, "err", err)
 		return nil, err
 	}
 
@@ -361,26 +416,26 @@ func CreateBridge(brName, gw string, mtu int) (*netlink.Bridge, error) {
 
 	br, ok = l.(*netlink.Bridge)
 	if !ok {
-		utils2.WriteLog("找到了设备, 但是该设备不是网桥")
+		logger.Error("找到了设备, 但是该设备不是网桥")
 		return nil, fmt.Errorf("found the device %q but it's not a bridge device", brName)
 	}
 
 	// 给网桥绑定 ip 地址, 让网桥作为网关
 	ipaddr, ipnet, err := net.ParseCIDR(gw)
 	if err != nil {
-		utils2.WriteLog("无法 parse gw 为 ipnet, err: ", err.Error())
+		logger.Error("无法 parse gw 为 ipnet", "err", err)
 		return nil, fmt.Errorf("transform the gatewayIP error %q: %v", gw, err)
 	}
 	ipnet.IP = ipaddr
 	addr := &netlink.Addr{IPNet: ipnet}
 	if err = netlink.AddrAdd(br, addr); err != nil {
-		utils2.WriteLog("将 gw 添加到 bridge 失败, err: ", err.Error())
+		logger.Error("将 gw 添加到 bridge 失败", "err", err)
 		return nil, fmt.Errorf("can not add the gw %q to bridge %q, err: %v", addr, brName, err)
 	}
 
 	// 然后还要把这个网桥给 up 起来
 	if err = netlink.LinkSetUp(br); err != nil {
-		utils2.WriteLog("启动网桥失败, err: ", err.Error())
+		logger.Error("启动网桥失败", "err", err)
 		return nil, fmt.Errorf("set up bridge %q error, err: %v", brName, err)
 	}
 	return br, nil
@@ -392,7 +447,7 @@ func SetUpVeth(veth ...*netlink.Veth) error {
 		// 启动 veth 设备
 		err := netlink.LinkSetUp(v)
 		if err != nil {
-			utils2.WriteLog("启动 veth1 失败, err: ", err.Error())
+			logger.Error("启动 veth1 失败", "err", err)
 			return err
 		}
 	}
@@ -410,7 +465,7 @@ func CreateVethPair(ifName string, mtu int, hostName ...string) (*netlink.Veth,
 			_vname, err := RandomVethName()
 			vethPairName = _vname
 			if err != nil {
-				utils2.WriteLog("生成随机 veth pair 名字失败, err: ", err.Error())
+				logger.Error("生成随机 veth pair 名字失败", "err", err)
 				return nil, nil, err
 			}
 
@@ -442,7 +497,7 @@ func CreateVethPair(ifName string, mtu int, hostName ...string) (*netlink.Veth,
 	err := netlink.LinkAdd(veth)
 
 	if err != nil {
-		utils2.WriteLog("创建 veth 设备失败, err: ", err.Error())
+		logger.Error("创建 veth 设备失败", "err", err)
 		return nil, nil, err
 	}
 
@@ -451,7 +506,7 @@ func CreateVethPair(ifName string, mtu int, hostName ...string) (*netlink.Veth,
 	if err != nil {
 		// 如果获取失败就尝试删掉
 		netlink.LinkDel(veth1)
-		utils2.WriteLog("创建完 veth 但是获取失败, err: ", err.Error())
+		logger.Error("创建完 veth 但是获取失败", "err", err)
 		return nil, nil, err
 	}
 
@@ -460,7 +515,7 @@ func CreateVethPair(ifName string, mtu int, hostName ...string) (*netlink.Veth,
 	if err != nil {
 		// 如果获取失败就尝试删掉
 		netlink.LinkDel(veth2)
-		utils2.WriteLog("创建完 veth 但是获取失败, err: ", err.Error())
+		logger.Error("创建完 veth 但是获取失败", "err", err)
 		return nil, nil, err
 	}
 
@@ -558,7 +613,7 @@ func SetVethToBridge(veth *netlink.Veth, br *netlink.Bridge) error {
 	// 把 veth2 干到 br 上, veth1 不用, 因为在创建的时候已经被干到 ns 里头了
 	err := netlink.LinkSetMaster(veth, br)
 	if err != nil {
-		utils2.WriteLog("把 veth 插到网桥上失败, err: ", err.Error())
+		logger.Error("把 veth 插到网桥上失败", "err", err)
 		return fmt.Errorf("insert veth %q into bridge %v error, err: %v", veth.Attrs().Name, br.Attrs().Name, err)
 	}
 	return nil
@@ -582,7 +637,7 @@ func SetVethNsFd(veth *netlink.Veth, ns ns.NetNS) error {
 func SetVethMaster(veth *netlink.Veth, br *netlink.Bridge) error {
 	err := netlink.LinkSetMaster(veth, br)
 	if err != nil {
-		utils2.WriteLog(fmt.Sprintf("把 veth %q 干到 master 上失败: %v", veth.Attrs().Name, err))
+		logger.Error("把 veth 干到 master 上失败", "veth", veth.Attrs().Name, "err", err)
 		return fmt.Errorf("add veth %q to master error: %v", veth.Attrs().Name, err)
 	}
 	return nil
@@ -610,7 +665,7 @@ func SetDeviceMaster(device *netlink.Device, br *netlink.Bridge) error {
 
 	err := netlink.LinkSetMaster(device, br)
 	if err != nil {
-		utils2.WriteLog(fmt.Sprintf("把 veth %q 干到网桥上失败: %v", device.Attrs().Name, err))
+		logger.Error("把 veth 干到网桥上失败", "veth", device.Attrs().Name, "err", err)
 		return fmt.Errorf("add veth %q to bridge error: %v", device.Attrs().Name, err)
 	}
 	return nil
@@ -743,34 +798,15 @@ func RandomVethName() (string, error) {
 
 // SetIptablesForToForwardAccept 为指定的网络设备添加 iptables 规则以允许转发
 // link 参数是需要添加规则的网络设备
+// 规则具体是用 iptables 还是 nftables 下发的取决于 GetFirewall, 重复调用不会重复添加
 func SetIptablesForToForwardAccept(link netlink.Link) error {
-	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
-	if err != nil {
-		utils2.WriteLog("这里 NewWithProtocol 失败, err: ", err.Error())
-		return err
-	}
-	err = ipt.Append("filter", "FORWARD", "-i", link.Attrs().Name, "-j", "ACCEPT")
-	if err != nil {
-		utils2.WriteLog("这里 ipt.Append 失败, err: ", err.Error())
-		return err
-	}
-	return nil
+	return addForwardAccept(link.Attrs().Name)
 }
 
 // SetIptablesForDeviceToFarwordAccept 为指定的网络设备添加 iptables 规则以允许转发
 // device 参数是需要添加规则的网络设备
 func SetIptablesForDeviceToFarwordAccept(device *netlink.Device) error {
-	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
-	if err != nil {
-		utils2.WriteLog("这里 NewWithProtocol 失败, err: ", err.Error())
-		return err
-	}
-	err = ipt.Append("filter", "FORWARD", "-i", device.Attrs().Name, "-j", "ACCEPT")
-	if err != nil {
-		utils2.WriteLog("这里 ipt.Append 失败, err: ", err.Error())
-		return err
-	}
-	return nil
+	return addForwardAccept(device.Attrs().Name)
 }
 
 // CreateBridgeAndCreateVethAndSetNetworkDeviceStatusAndSetVethMaster 创建一个网桥，
@@ -787,7 +823,7 @@ func CreateBridgeAndCreateVethAndSetNetworkDeviceStatusAndSetVethMaster(
 	// 先创建网桥
 	br, err := CreateBridge(brName, gw, mtu)
 	if err != nil {
-		utils2.WriteLog("创建网卡失败, err: ", err.Error())
+		logger.Error("创建网卡失败", "err", err)
 		return err
 	}
 
@@ -795,42 +831,42 @@ func CreateBridgeAndCreateVethAndSetNetworkDeviceStatusAndSetVethMaster(
 		// 创建一对儿 veth 设备
 		containerVeth, hostVeth, err := CreateVethPair(ifName, mtu)
 		if err != nil {
-			utils2.WriteLog("创建 veth 失败, err: ", err.Error())
+			logger.Error("创建 veth 失败", "err", err)
 			return err
 		}
 
 		// 把随机起名的 veth 那头放在主机上
 		err = SetVethNsFd(hostVeth, hostNs)
 		if err != nil {
-			utils2.WriteLog("把 veth 设置到 ns 下失败: ", err.Error())
+			logger.Error("把 veth 设置到 ns 下失败", "err", err)
 			return err
 		}
 
 		// 然后把要被放到 pod 中的那头 veth 塞上 podIP
 		err = SetIpForVeth(containerVeth.Name, podIP)
 		if err != nil {
-			utils2.WriteLog("给 veth 设置 ip 失败, err: ", err.Error())
+			logger.Error("给 veth 设置 ip 失败", "err", err)
 			return err
 		}
 
 		// 然后启动它
 		err = SetUpVeth(containerVeth)
 		if err != nil {
-			utils2.WriteLog("启动 veth pair 失败, err: ", err.Error())
+			logger.Error("启动 veth pair 失败", "err", err)
 			return err
 		}
 
 		// 启动之后给这个 netns 设置默认路由 以便让其他网段的包也能从 veth 走到网桥
 		gwNetIP, _, err := net.ParseCIDR(gw)
 		if err != nil {
-			utils2.WriteLog("转换 gwip 失败, err:", err.Error())
+			logger.Error("转换 gwip 失败", "err", err)
 			return err
 		}
 
 		// 给 pod(net ns) 中加一个默认路由规则, 该规则让匹配了 0.0.0.0 的都走上边创建的那个 container veth
 		err = SetDefaultRouteToVeth(gwNetIP, containerVeth)
 		if err != nil {
-			utils2.WriteLog("SetDefaultRouteToVeth 时出错, err: ", err.Error())
+			logger.Error("SetDefaultRouteToVeth 时出错", "err", err)
 			return err
 		}
 
@@ -839,20 +875,20 @@ func CreateBridgeAndCreateVethAndSetNetworkDeviceStatusAndSetVethMaster(
 			_hostVeth, err := netlink.LinkByName(hostVeth.Attrs().Name)
 			hostVeth = _hostVeth.(*netlink.Veth)
 			if err != nil {
-				utils2.WriteLog("重新获取 hostVeth 失败, err: ", err.Error())
+				logger.Error("重新获取 hostVeth 失败", "err", err)
 				return err
 			}
 			// 启动它
 			err = SetUpVeth(hostVeth)
 			if err != nil {
-				utils2.WriteLog("启动 veth pair 失败, err: ", err.Error())
+				logger.Error("启动 veth pair 失败", "err", err)
 				return err
 			}
 
 			// 把它塞到网桥上
 			err = SetVethMaster(hostVeth, br)
 			if err != nil {
-				utils2.WriteLog("挂载 veth 到网桥失败, err: ", err.Error())
+				logger.Error("挂载 veth 到网桥失败", "err", err)
 				return err
 			}
 
@@ -0,0 +1,333 @@
+package nettools
+
+import (
+	"bytes"
+	"cni-demo/consts"
+	"cni-demo/tools/logger"
+	"fmt"
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// NFT_TABLE 是 cni-demo 在 nftables 里自己的表, 所有规则都放在这张表里
+	// 和 iptables 不一样, nftables 里每个表的 base chain 是各自独立挂在 hook 上的
+	// 所以不需要往别人的链里插跳转规则, Cleanup 的时候直接把整张表删掉就行
+	NFT_TABLE = "cni-demo"
+	// nftForwardChain 挂在 forward hook 上, 作用等同于 iptables 里的 FORWARD_CHAIN
+	nftForwardChain = "forward"
+	// nftPostroutingChain 挂在 postrouting hook 上, 作用等同于 iptables nat 表的 POSTROUTING
+	nftPostroutingChain = "postrouting"
+	// forwardAcceptComment 是转发放行规则的 UserData 前缀, 用来在删除的时候找到对应的规则
+	forwardAcceptComment = "cni-demo:forward:"
+)
+
+// nftablesFirewall 是直接通过 netlink 和内核里的 nftables 打交道的 Firewall, 不依赖 nft 命令
+type nftablesFirewall struct {
+	// netNS 不为 0 的话就是在这个 netns 里操作规则, 主要是给测试用的
+	netNS int
+}
+
+func (fw *nftablesFirewall) Backend() string {
+	return consts.FIREWALL_NFTABLES
+}
+
+func (fw *nftablesFirewall) conn() (*nftables.Conn, error) {
+	if fw.netNS != 0 {
+		return nftables.New(nftables.WithNetNSFd(fw.netNS))
+	}
+	return nftables.New()
+}
+
+// nftablesAvailable 看一下内核支不支持 nftables
+func nftablesAvailable(netNS int) bool {
+	conn, err := (&nftablesFirewall{netNS: netNS}).conn()
+	if err != nil {
+		return false
+	}
+	_, err = conn.ListTables()
+	return err == nil
+}
+
+func (fw *nftablesFirewall) table() *nftables.Table {
+	return &nftables.Table{Name: NFT_TABLE, Family: nftables.TableFamilyIPv4}
+}
+
+func (fw *nftablesFirewall) forwardChain() *nftables.Chain {
+	return &nftables.Chain{
+		Name:     nftForwardChain,
+		Table:    fw.table(),
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookForward,
+		Priority: nftables.ChainPriorityFilter,
+	}
+}
+
+func (fw *nftablesFirewall) postroutingChain() *nftables.Chain {
+	return &nftables.Chain{
+		Name:     nftPostroutingChain,
+		Table:    fw.table(),
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+	}
+}
+
+func (fw *nftablesFirewall) masqChain(containerID string) *nftables.Chain {
+	return &nftables.Chain{Name: GetMasqChainName(containerID), Table: fw.table()}
+}
+
+// ensureTable 保证表和两条 base chain 都已经创建, 已经存在的话内核不会报错
+func (fw *nftablesFirewall) ensureTable(conn *nftables.Conn) {
+	conn.AddTable(fw.table())
+	conn.AddChain(fw.forwardChain())
+	conn.AddChain(fw.postroutingChain())
+}
+
+// chainExists 看一下 cni-demo 表里有没有这条链, 表不存在的话也是返回 false
+func (fw *nftablesFirewall) chainExists(conn *nftables.Conn, name string) (bool, error) {
+	chains, err := conn.ListChainsOfTableFamily(nftables.TableFamilyIPv4)
+	if err != nil {
+		return false, err
+	}
+	for _, chain := range chains {
+		if chain.Table.Name == NFT_TABLE && chain.Name == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// findRules 找到某条链里 UserData 是 comment 的所有规则
+func (fw *nftablesFirewall) findRules(conn *nftables.Conn, chain *nftables.Chain, comment string) ([]*nftables.Rule, error) {
+	rules, err := conn.GetRules(fw.table(), chain)
+	if err != nil {
+		return nil, err
+	}
+	var res []*nftables.Rule
+	for _, rule := range rules {
+		if bytes.Equal(rule.UserData, []byte(comment)) {
+			res = append(res, rule)
+		}
+	}
+	return res, nil
+}
+
+// ifname 把网卡名转成内核里 IFNAMSIZ 长度的格式
+func ifname(name string) []byte {
+	b := make([]byte, unix.IFNAMSIZ)
+	copy(b, name+"\x00")
+	return b
+}
+
+// matchIIFName 匹配入口网卡是 name 的包
+func matchIIFName(name string) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname(name)},
+	}
+}
+
+// matchIPv4 匹配源地址(offset 12)或者目的地址(offset 16)在 ipNet 里的包
+func matchIPv4(offset uint32, ipNet *net.IPNet, op expr.CmpOp) []expr.Any {
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: net.IPv4len},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: net.IPv4len, Mask: ipNet.Mask, Xor: make([]byte, net.IPv4len)},
+		&expr.Cmp{Op: op, Register: 1, Data: ipNet.IP.To4()},
+	}
+}
+
+func (fw *nftablesFirewall) forwardAcceptRule(name string) *nftables.Rule {
+	return &nftables.Rule{
+		Table:    fw.table(),
+		Chain:    fw.forwardChain(),
+		Exprs:    append(matchIIFName(name), &expr.Verdict{Kind: expr.VerdictAccept}),
+		UserData: []byte(forwardAcceptComment + name),
+	}
+}
+
+// AddForwardAccept 在 forward 链里允许某块网卡做转发, 已经存在的话不会重复添加
+func (fw *nftablesFirewall) AddForwardAccept(name string) error {
+	conn, err := fw.conn()
+	if err != nil {
+		return err
+	}
+	fw.ensureTable(conn)
+	err = conn.Flush()
+	if err != nil {
+		logger.Error("创建 nftables 表失败", "table", NFT_TABLE, "err", err)
+		return err
+	}
+
+	rules, err := fw.findRules(conn, fw.forwardChain(), forwardAcceptComment+name)
+	if err != nil {
+		return err
+	}
+	if len(rules) > 0 {
+		return nil
+	}
+	conn.AddRule(fw.forwardAcceptRule(name))
+	err = conn.Flush()
+	if err != nil {
+		logger.Error("添加 nftables 转发规则失败", "err", err)
+		return err
+	}
+	return nil
+}
+
+// DelForwardAccept 从 forward 链里删掉某块网卡的放行规则
+func (fw *nftablesFirewall) DelForwardAccept(name string) error {
+	conn, err := fw.conn()
+	if err != nil {
+		return err
+	}
+	exist, err := fw.chainExists(conn, nftForwardChain)
+	if err != nil || !exist {
+		return err
+	}
+	rules, err := fw.findRules(conn, fw.forwardChain(), forwardAcceptComment+name)
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		err = conn.DelRule(rule)
+		if err != nil {
+			return err
+		}
+	}
+	return conn.Flush()
+}
+
+// SyncForwardAccept 把 forward 链整条同步成只放行 names 这些网卡
+// flush 和 add 是在同一个 batch 里提交的, 中间不会有规则全空的窗口
+func (fw *nftablesFirewall) SyncForwardAccept(names []string) error {
+	conn, err := fw.conn()
+	if err != nil {
+		return err
+	}
+	fw.ensureTable(conn)
+	conn.FlushChain(fw.forwardChain())
+	for _, name := range names {
+		conn.AddRule(fw.forwardAcceptRule(name))
+	}
+	return conn.Flush()
+}
+
+// SetupIPMasq 和 iptables 的实现一样, 每个 pod 一条自己的链:
+//  1. 目标是集群网段以及用户配置的不需要 snat 的网段直接 accept
+//  2. 剩下的除了组播以外全部 masquerade
+//  3. postrouting 上挂一条规则, 源地址是这个 pod 的流量都跳到这条链上
+func (fw *nftablesFirewall) SetupIPMasq(podIP net.IP, clusterCIDR string, nonMasqCIDRs []string, containerID string) error {
+	var skipNets []*net.IPNet
+	for _, cidr := range append([]string{clusterCIDR}, nonMasqCIDRs...) {
+		if cidr == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid non-masquerade cidr %q: %v", cidr, err)
+		}
+		skipNets = append(skipNets, ipNet)
+	}
+	_, multicast, _ := net.ParseCIDR(multicastCIDR)
+
+	conn, err := fw.conn()
+	if err != nil {
+		return err
+	}
+	fw.ensureTable(conn)
+
+	// pod 自己的链每次都整条重建, 这样重复调用也不会有重复的规则
+	chain := conn.AddChain(fw.masqChain(containerID))
+	conn.FlushChain(chain)
+	comment := []byte(getMasqComment(containerID))
+	for _, ipNet := range skipNets {
+		conn.AddRule(&nftables.Rule{
+			Table:    fw.table(),
+			Chain:    chain,
+			Exprs:    append(matchIPv4(16, ipNet, expr.CmpOpEq), &expr.Verdict{Kind: expr.VerdictAccept}),
+			UserData: comment,
+		})
+	}
+	conn.AddRule(&nftables.Rule{
+		Table:    fw.table(),
+		Chain:    chain,
+		Exprs:    append(matchIPv4(16, multicast, expr.CmpOpNeq), &expr.Masq{}),
+		UserData: comment,
+	})
+	err = conn.Flush()
+	if err != nil {
+		logger.Error("创建 nftables snat 链失败", "chain", chain.Name, "err", err)
+		return err
+	}
+
+	rules, err := fw.findRules(conn, fw.postroutingChain(), string(comment))
+	if err != nil {
+		return err
+	}
+	if len(rules) > 0 {
+		return nil
+	}
+	source := &net.IPNet{IP: podIP, Mask: net.CIDRMask(32, 32)}
+	conn.AddRule(&nftables.Rule{
+		Table:    fw.table(),
+		Chain:    fw.postroutingChain(),
+		Exprs:    append(matchIPv4(12, source, expr.CmpOpEq), &expr.Verdict{Kind: expr.VerdictJump, Chain: chain.Name}),
+		UserData: comment,
+	})
+	err = conn.Flush()
+	if err != nil {
+		logger.Error("添加 nftables postrouting 跳转规则失败", "err", err)
+		return err
+	}
+	return nil
+}
+
+// TeardownIPMasq 删掉 postrouting 上跳到这个 pod 的链的规则, 然后再把链删掉
+func (fw *nftablesFirewall) TeardownIPMasq(containerID string) error {
+	conn, err := fw.conn()
+	if err != nil {
+		return err
+	}
+	chain := fw.masqChain(containerID)
+	exist, err := fw.chainExists(conn, chain.Name)
+	if err != nil || !exist {
+		return err
+	}
+
+	rules, err := fw.findRules(conn, fw.postroutingChain(), getMasqComment(containerID))
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		err = conn.DelRule(rule)
+		if err != nil {
+			return err
+		}
+	}
+	conn.FlushChain(chain)
+	conn.DelChain(chain)
+	return conn.Flush()
+}
+
+// Cleanup 直接把 cni-demo 的表删掉, 里面的链和规则都会跟着一起删掉
+func (fw *nftablesFirewall) Cleanup() error {
+	conn, err := fw.conn()
+	if err != nil {
+		return err
+	}
+	tables, err := conn.ListTablesOfFamily(nftables.TableFamilyIPv4)
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		if table.Name == NFT_TABLE {
+			conn.DelTable(fw.table())
+			return conn.Flush()
+		}
+	}
+	return nil
+}
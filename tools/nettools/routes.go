@@ -0,0 +1,84 @@
+package nettools
+
+import (
+	"cni-demo/ipam"
+	"cni-demo/tools/logger"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+// diffHostRoutes 比较应该有的路由和网卡上现有的路由, 返回需要添加和需要删除的
+// 只会删除目的地址在集群网段里并且带网关的, 别的路由都不是我们加的, 不能动
+func diffHostRoutes(want map[string]net.IP, existing []netlink.Route, clusterCIDR *net.IPNet) (add map[string]net.IP, del []netlink.Route) {
+	add = map[string]net.IP{}
+	found := map[string]bool{}
+	for _, route := range existing {
+		if route.Dst == nil || route.Gw == nil || !clusterCIDR.Contains(route.Dst.IP) {
+			continue
+		}
+		dst := route.Dst.String()
+		gw, ok := want[dst]
+		if !ok || !gw.Equal(route.Gw) {
+			del = append(del, route)
+			continue
+		}
+		found[dst] = true
+	}
+	for dst, gw := range want {
+		if !found[dst] {
+			add[dst] = gw
+		}
+	}
+	return add, del
+}
+
+// ReconcileHostRoutes 让本机上去往其他节点 pod 网段的路由和 ipam 里记录的一致
+// 缺了的补上, 网关变了的换掉, 已经离开集群的节点的路由删掉
+// 和 SetOtherHostRouteToCurrentHost 不一样的是它可以反复调用, 由 cni-demo-agent 定时执行
+func ReconcileHostRoutes(networks []*ipam.Network, currentNetwork *ipam.Network, clusterCIDR string) error {
+	_, cluster, err := net.ParseCIDR(clusterCIDR)
+	if err != nil {
+		return err
+	}
+	link, err := netlink.LinkByName(currentNetwork.Name)
+	if err != nil {
+		return err
+	}
+	existing, err := netlink.RouteList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+
+	want := map[string]net.IP{}
+	for _, network := range networks {
+		if network.IsCurrentHost {
+			continue
+		}
+		_, cidr, err := net.ParseCIDR(network.CIDR)
+		if err != nil {
+			return err
+		}
+		ip := net.ParseIP(network.IP)
+		if ip == nil {
+			continue
+		}
+		want[cidr.String()] = ip
+	}
+
+	add, del := diffHostRoutes(want, existing, cluster)
+	for i := range del {
+		err = netlink.RouteDel(&del[i])
+		if err != nil {
+			logger.Error("删除过期的路由失败", "dst", del[i].Dst, "err", err)
+		}
+	}
+	for dst, gw := range add {
+		_, cidr, _ := net.ParseCIDR(dst)
+		err = AddHostRoute(cidr, gw, link)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package nettools
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+)
+
+func TestDiffHostRoutes(t *testing.T) {
+	test := assert.New(t)
+	_, cluster, _ := net.ParseCIDR("10.244.0.0/16")
+	route := func(dst, gw string) netlink.Route {
+		_, ipn, _ := net.ParseCIDR(dst)
+		return netlink.Route{Dst: ipn, Gw: net.ParseIP(gw)}
+	}
+
+	want := map[string]net.IP{
+		"10.244.1.0/24": net.ParseIP("192.168.1.1"),
+		"10.244.2.0/24": net.ParseIP("192.168.1.2"),
+		"10.244.3.0/24": net.ParseIP("192.168.1.3"),
+	}
+	existing := []netlink.Route{
+		// 已经是对的, 不用动
+		route("10.244.1.0/24", "192.168.1.1"),
+		// 节点 ip 变了, 要换掉
+		route("10.244.2.0/24", "192.168.1.20"),
+		// 节点已经不在了
+		route("10.244.9.0/24", "192.168.1.9"),
+		// 不是集群网段里的, 不能删
+		route("172.16.0.0/16", "192.168.1.254"),
+		// 没有网关的是本机的直连路由
+		{Dst: &net.IPNet{IP: net.ParseIP("10.244.0.0").To4(), Mask: net.CIDRMask(24, 32)}},
+	}
+
+	add, del := diffHostRoutes(want, existing, cluster)
+	test.Equal(map[string]net.IP{
+		"10.244.2.0/24": net.ParseIP("192.168.1.2"),
+		"10.244.3.0/24": net.ParseIP("192.168.1.3"),
+	}, add)
+	test.Len(del, 2)
+	test.Equal("10.244.2.0/24", del[0].Dst.String())
+	test.Equal("10.244.9.0/24", del[1].Dst.String())
+}
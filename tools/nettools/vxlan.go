@@ -0,0 +1,268 @@
+package nettools
+
+import (
+	"cni-demo/ipam"
+	"cni-demo/tools/logger"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// VxlanVtepIP 返回 pod 网段 cidr 对应的 vtep 地址, 也就是网段的网络地址 x.x.x.0, ipam 不会把它分给 pod
+func VxlanVtepIP(cidr string) (net.IP, error) {
+	_, ipn, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ip := ipn.IP.To4()
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not an ipv4 cidr", cidr)
+	}
+	return ip, nil
+}
+
+// VxlanVtepMAC 返回 vtep 地址为 ip 的 vxlan 设备的 mac, 是 0a:58 加上地址的 4 个字节
+// 这样其他节点只看 ipam 里的网段就能算出来, 不用再另外存一份
+func VxlanVtepMAC(ip net.IP) net.HardwareAddr {
+	mac := net.HardwareAddr{0x0a, 0x58, 0, 0, 0, 0}
+	copy(mac[2:], ip.To4())
+	return mac
+}
+
+// CreateKernelVxlanAndUp 创建并启动 kernel 数据面用的 vxlan 设备
+// 和 CreateVxlanAndUp2 建的 external 设备不一样, 这块设备带着 VNI, 关掉了 learning, 只按 fdb 封装,
+// mac 由 vtep 地址算出来, 见 VxlanVtepMAC。已经有了并且配置一样的话直接返回, 不一样的话报错
+func CreateKernelVxlanAndUp(name string, mtu int, vni uint32, port int, src, vtep net.IP) (*netlink.Vxlan, error) {
+	mac := VxlanVtepMAC(vtep)
+	l, _ := netlink.LinkByName(name)
+	if l != nil {
+		vxlan, ok := l.(*netlink.Vxlan)
+		if !ok {
+			return nil, fmt.Errorf("found the device %q but it's not a vxlan", name)
+		}
+		if vxlan.FlowBased {
+			return nil, fmt.Errorf("vxlan %q already exists but it's external", name)
+		}
+		if vxlan.VxlanId != int(vni) || vxlan.Port != port {
+			return nil, fmt.Errorf(
+				"vxlan %q already exists with vni %d port %d, want vni %d port %d",
+				name, vxlan.VxlanId, vxlan.Port, vni, port,
+			)
+		}
+		if vxlan.Attrs().HardwareAddr.String() != mac.String() {
+			err := netlink.LinkSetHardwareAddr(vxlan, mac)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return vxlan, netlink.LinkSetUp(vxlan)
+	}
+
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = name
+	attrs.MTU = mtu
+	attrs.HardwareAddr = mac
+	vxlan := &netlink.Vxlan{
+		LinkAttrs: attrs,
+		VxlanId:   int(vni),
+		SrcAddr:   src,
+		Port:      port,
+		Learning:  false,
+	}
+	err := netlink.LinkAdd(vxlan)
+	if err != nil {
+		return nil, fmt.Errorf("create vxlan %q error, err: %v", name, err)
+	}
+	l, err = netlink.LinkByName(name)
+	if err != nil {
+		return nil, err
+	}
+	vxlan, ok := l.(*netlink.Vxlan)
+	if !ok {
+		return nil, fmt.Errorf("found the device %q but it's not a vxlan", name)
+	}
+	if err = netlink.LinkSetUp(vxlan); err != nil {
+		logger.Error("启动 vxlan 失败", "err", err)
+		return nil, fmt.Errorf("set up vxlan %q error, err: %v", name, err)
+	}
+	return vxlan, nil
+}
+
+// vxlanPeer 是另一个节点在本机 vxlan 设备上要有的东西:
+// 去往它的 pod 网段的 onlink 路由, 它的 vtep 地址的邻居表项, 以及把它的 vtep mac 封装到它的节点 ip 上的 fdb 表项
+type vxlanPeer struct {
+	CIDR   *net.IPNet
+	VTEP   net.IP
+	MAC    net.HardwareAddr
+	NodeIP net.IP
+}
+
+// getVxlanPeers 从 ipam 里记的各个节点的网段算出其他节点的 vxlanPeer, 还没分到网段的节点跳过
+func getVxlanPeers(networks []*ipam.Network) (map[string]vxlanPeer, error) {
+	res := map[string]vxlanPeer{}
+	for _, network := range networks {
+		if network.IsCurrentHost || network.CIDR == "" {
+			continue
+		}
+		nodeIP := net.ParseIP(network.IP).To4()
+		if nodeIP == nil {
+			continue
+		}
+		_, cidr, err := net.ParseCIDR(network.CIDR)
+		if err != nil {
+			return nil, err
+		}
+		vtep, err := VxlanVtepIP(network.CIDR)
+		if err != nil {
+			return nil, err
+		}
+		res[cidr.String()] = vxlanPeer{
+			CIDR:   cidr,
+			VTEP:   vtep,
+			MAC:    VxlanVtepMAC(vtep),
+			NodeIP: nodeIP,
+		}
+	}
+	return res, nil
+}
+
+// diffVxlanPeers 比较应该有的 peers 和 vxlan 设备上现有的路由、邻居以及 fdb 表项,
+// 返回缺东西或者东西不对的 peer, 以及要删掉的路由、邻居和 fdb 表项
+// 设备上带网关的路由都是我们加的; 邻居和 fdb 只看永久的, 别的是内核自己学的
+func diffVxlanPeers(
+	peers map[string]vxlanPeer,
+	routes []netlink.Route,
+	neighs, fdbs []netlink.Neigh,
+) (add []vxlanPeer, delRoutes []netlink.Route, delNeighs, delFdbs []netlink.Neigh) {
+	vteps := map[string]vxlanPeer{}
+	macs := map[string]vxlanPeer{}
+	for _, peer := range peers {
+		vteps[peer.VTEP.String()] = peer
+		macs[peer.MAC.String()] = peer
+	}
+
+	okRoutes := map[string]bool{}
+	for _, route := range routes {
+		if route.Dst == nil || route.Gw == nil {
+			continue
+		}
+		peer, ok := peers[route.Dst.String()]
+		if !ok || !peer.VTEP.Equal(route.Gw) {
+			delRoutes = append(delRoutes, route)
+			continue
+		}
+		okRoutes[route.Dst.String()] = true
+	}
+	okNeighs := map[string]bool{}
+	for _, neigh := range neighs {
+		if neigh.State&netlink.NUD_PERMANENT == 0 || neigh.IP == nil {
+			continue
+		}
+		peer, ok := vteps[neigh.IP.String()]
+		if !ok {
+			delNeighs = append(delNeighs, neigh)
+			continue
+		}
+		// mac 不对的不用删, 加的时候会覆盖掉
+		if peer.MAC.String() == neigh.HardwareAddr.String() {
+			okNeighs[neigh.IP.String()] = true
+		}
+	}
+	okFdbs := map[string]bool{}
+	for _, fdb := range fdbs {
+		if fdb.State&netlink.NUD_PERMANENT == 0 || fdb.IP == nil {
+			continue
+		}
+		peer, ok := macs[fdb.HardwareAddr.String()]
+		if !ok || !peer.NodeIP.Equal(fdb.IP) {
+			delFdbs = append(delFdbs, fdb)
+			continue
+		}
+		okFdbs[fdb.HardwareAddr.String()] = true
+	}
+
+	for dst, peer := range peers {
+		if okRoutes[dst] && okNeighs[peer.VTEP.String()] && okFdbs[peer.MAC.String()] {
+			continue
+		}
+		add = append(add, peer)
+	}
+	return add, delRoutes, delNeighs, delFdbs
+}
+
+// ReconcileVxlanPeers 让 kernel 数据面的 vxlan 设备上去往其他节点的 fdb、邻居和路由和 ipam 里记录的一致
+// 和 ReconcileHostRoutes 一样可以反复调用, CNI 插件建好设备之后调一次, 之后由 cni-demo-agent 定时执行
+// 设备还没建的话 (本机还没起过 pod) 什么都不做
+func ReconcileVxlanPeers(networks []*ipam.Network, device string) error {
+	link, err := netlink.LinkByName(device)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			logger.Debug("vxlan 设备还没有创建, 先不同步", "device", device)
+			return nil
+		}
+		return err
+	}
+	index := link.Attrs().Index
+	peers, err := getVxlanPeers(networks)
+	if err != nil {
+		return err
+	}
+	routes, err := netlink.RouteList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	neighs, err := netlink.NeighList(index, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	fdbs, err := netlink.NeighList(index, syscall.AF_BRIDGE)
+	if err != nil {
+		return err
+	}
+
+	add, delRoutes, delNeighs, delFdbs := diffVxlanPeers(peers, routes, neighs, fdbs)
+	// 删的时候先删路由, 加的时候最后加路由, 这样路由在的时候邻居和 fdb 一定都在
+	for i := range delRoutes {
+		err = netlink.RouteDel(&delRoutes[i])
+		if err != nil {
+			logger.Error("删除过期的路由失败", "dst", delRoutes[i].Dst, "err", err)
+		}
+	}
+	for i := range delNeighs {
+		err = netlink.NeighDel(&delNeighs[i])
+		if err != nil {
+			logger.Error("删除过期的邻居失败", "ip", delNeighs[i].IP, "err", err)
+		}
+	}
+	for i := range delFdbs {
+		err = netlink.NeighDel(&delFdbs[i])
+		if err != nil {
+			logger.Error("删除过期的 fdb 失败", "mac", delFdbs[i].HardwareAddr, "err", err)
+		}
+	}
+	for _, peer := range add {
+		err = CreateFdbEntry(peer.MAC.String(), peer.NodeIP.String(), device)
+		if err != nil {
+			return err
+		}
+		err = CreateArpEntry(peer.VTEP.String(), peer.MAC.String(), device)
+		if err != nil {
+			return err
+		}
+		err = netlink.RouteReplace(&netlink.Route{
+			LinkIndex: index,
+			Dst:       peer.CIDR,
+			Gw:        peer.VTEP,
+			Flags:     int(netlink.FLAG_ONLINK),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(add) > 0 || len(delRoutes) > 0 {
+		logger.Info("同步 vxlan 的 fdb 和路由成功", "total", len(peers), "updated", len(add), "deleted", len(delRoutes))
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package nettools
+
+import (
+	"cni-demo/ipam"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+)
+
+func TestVxlanVtep(t *testing.T) {
+	test := assert.New(t)
+
+	vtep, err := VxlanVtepIP("10.244.3.0/24")
+	test.Nil(err)
+	test.Equal("10.244.3.0", vtep.String())
+	test.Equal("0a:58:0a:f4:03:00", VxlanVtepMAC(vtep).String())
+
+	_, err = VxlanVtepIP("fd00::/64")
+	test.NotNil(err)
+}
+
+func TestDiffVxlanPeers(t *testing.T) {
+	test := assert.New(t)
+
+	peers, err := getVxlanPeers([]*ipam.Network{
+		{Hostname: "node1", IP: "192.168.64.11", CIDR: "10.244.1.0/24", IsCurrentHost: true},
+		{Hostname: "node2", IP: "192.168.64.12", CIDR: "10.244.2.0/24"},
+		{Hostname: "node3", IP: "192.168.64.13", CIDR: "10.244.3.0/24"},
+		// 还没分到网段的
+		{Hostname: "node4", IP: "192.168.64.14"},
+	})
+	test.Nil(err)
+	test.Len(peers, 2)
+	node2, node3 := peers["10.244.2.0/24"], peers["10.244.3.0/24"]
+	test.Equal("10.244.2.0", node2.VTEP.String())
+	test.Equal("192.168.64.12", node2.NodeIP.String())
+
+	route := func(dst, gw string) netlink.Route {
+		_, ipn, _ := net.ParseCIDR(dst)
+		return netlink.Route{Dst: ipn, Gw: net.ParseIP(gw)}
+	}
+	neigh := func(ip, mac string, state int) netlink.Neigh {
+		hw, _ := net.ParseMAC(mac)
+		return netlink.Neigh{IP: net.ParseIP(ip), HardwareAddr: hw, State: state}
+	}
+	routes := []netlink.Route{
+		route("10.244.2.0/24", "10.244.2.0"),
+		route("10.244.3.0/24", "10.244.3.0"),
+		// 节点已经不在了
+		route("10.244.9.0/24", "10.244.9.0"),
+	}
+	neighs := []netlink.Neigh{
+		neigh("10.244.2.0", "0a:58:0a:f4:02:00", netlink.NUD_PERMANENT),
+		neigh("10.244.3.0", "0a:58:0a:f4:03:00", netlink.NUD_PERMANENT),
+		neigh("10.244.9.0", "0a:58:0a:f4:09:00", netlink.NUD_PERMANENT),
+		// 不是永久的不是我们加的
+		neigh("10.244.8.0", "0a:58:0a:f4:08:00", netlink.NUD_REACHABLE),
+	}
+	fdbs := []netlink.Neigh{
+		neigh("192.168.64.12", "0a:58:0a:f4:02:00", netlink.NUD_PERMANENT),
+		// node3 的节点 ip 换了
+		neigh("192.168.64.30", "0a:58:0a:f4:03:00", netlink.NUD_PERMANENT),
+		neigh("192.168.64.19", "0a:58:0a:f4:09:00", netlink.NUD_PERMANENT),
+	}
+
+	add, delRoutes, delNeighs, delFdbs := diffVxlanPeers(peers, routes, neighs, fdbs)
+	test.Equal([]vxlanPeer{node3}, add)
+	test.Equal([]netlink.Route{routes[2]}, delRoutes)
+	test.Equal([]netlink.Neigh{neighs[2]}, delNeighs)
+	test.Equal([]netlink.Neigh{fdbs[1], fdbs[2]}, delFdbs)
+
+	// 什么都没有的时候全都要加
+	add, delRoutes, delNeighs, delFdbs = diffVxlanPeers(peers, nil, nil, nil)
+	test.ElementsMatch([]vxlanPeer{node2, node3}, add)
+	test.Empty(delRoutes)
+	test.Empty(delNeighs)
+	test.Empty(delFdbs)
+}
@@ -18,7 +18,7 @@ package skel
 
 import (
 	"bytes"
-	testutils "cni-demo/tools/utils"
+	"cni-demo/tools/logger"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -44,6 +44,27 @@ type CmdArgs struct {
 	StdinData   []byte
 }
 
+// PodName 从 CNI_ARGS 里的 K8S_POD_NAMESPACE 和 K8S_POD_NAME 拼出 <namespace>/<pod>, 不是 kubelet 调的话返回空字符串
+func (args *CmdArgs) PodName() string {
+	var namespace, name string
+	for _, kv := range strings.Split(args.Args, ";") {
+		pair := strings.SplitN(kv, "=", 2)
+		if len(pair) != 2 {
+			continue
+		}
+		switch pair[0] {
+		case "K8S_POD_NAMESPACE":
+			namespace = pair[1]
+		case "K8S_POD_NAME":
+			name = pair[1]
+		}
+	}
+	if namespace == "" || name == "" {
+		return ""
+	}
+	return namespace + "/" + name
+}
+
 // dispatcher 结构体：包含用于调用插件的环境变量、标准输入、标准输出、标准错误，以及 CNI 版本解码器和版本协调器。
 type dispatcher struct {
 	Getenv func(string) string
@@ -199,10 +220,10 @@ func validateConfig(jsonBytes []byte) *types.Error {
 
 // (t *dispatcher) pluginMain() 方法：插件的主要入口，根据不同的命令调用不同的处理函数，同时负责验证配置文件和处理版本兼容性问题。
 func (t *dispatcher) pluginMain(cmdAdd, cmdCheck, cmdDel func(_ *CmdArgs) error, versionInfo version.PluginInfo, about string) *types.Error {
-	// testutils.WriteLog("进入到了 pluginMain")
+	// logger.Debug("进入到了 pluginMain")
 	cmd, cmdArgs, err := t.getCmdArgsFromEnv()
 	if err != nil {
-		// testutils.WriteLog("进入到了 pluginMain 的 err != nil: ", err.Error())
+		// logger.Debug("进入到了 pluginMain 的 err != nil", "err", err)
 		// Print the about string to stderr when no command is set
 		if err.Code == types.ErrInvalidEnvironmentVariables && t.Getenv("CNI_COMMAND") == "" && about != "" {
 			_, _ = fmt.Fprintln(t.Stderr, about)
@@ -210,7 +231,7 @@ func (t *dispatcher) pluginMain(cmdAdd, cmdCheck, cmdDel func(_ *CmdArgs) error,
 		}
 		return err
 	}
-	testutils.WriteLog("进入到了 pluginMain 并且没有 err, cmd 是: ", cmd)
+	logger.Debug("进入到了 pluginMain 并且没有 err", "cmd", cmd)
 	if cmd != "VERSION" {
 		if err = validateConfig(cmdArgs.StdinData); err != nil {
 			return err
@@ -225,7 +246,7 @@ func (t *dispatcher) pluginMain(cmdAdd, cmdCheck, cmdDel func(_ *CmdArgs) error,
 
 	switch cmd {
 	case "ADD":
-		// testutils.WriteLog("进入到了 pluginMain 执行了 ADD ")
+		// logger.Debug("进入到了 pluginMain 执行了 ADD")
 		err = t.checkVersionAndCall(cmdArgs, versionInfo, cmdAdd)
 	case "CHECK":
 		configVersion, err := t.ConfVersionDecoder.Decode(cmdArgs.StdinData)
@@ -252,12 +273,12 @@ func (t *dispatcher) pluginMain(cmdAdd, cmdCheck, cmdDel func(_ *CmdArgs) error,
 	case "DEL":
 		err = t.checkVersionAndCall(cmdArgs, versionInfo, cmdDel)
 	case "VERSION":
-		// testutils.WriteLog("进入到了 pluginMain 并且是 VERSION")
+		// logger.Debug("进入到了 pluginMain 并且是 VERSION")
 		if err := versionInfo.Encode(t.Stdout); err != nil {
-			// testutils.WriteLog("versionInfo.Encode(t.Stdout), 并且有 error: ", err.Error())
+			// logger.Debug("versionInfo.Encode(t.Stdout), 并且有 error", "err", err)
 			return types.NewError(types.ErrIOFailure, err.Error(), "")
 		}
-		// testutils.WriteLog("进入到了 pluginMain 并且是 VERSION, 并且没有 error")
+		// logger.Debug("进入到了 pluginMain 并且是 VERSION, 并且没有 error")
 	default:
 		return types.NewError(types.ErrInvalidEnvironmentVariables, fmt.Sprintf("unknown CNI_COMMAND: %v", cmd), "")
 	}
@@ -265,7 +286,7 @@ func (t *dispatcher) pluginMain(cmdAdd, cmdCheck, cmdDel func(_ *CmdArgs) error,
 	if err != nil {
 		return err
 	}
-	// testutils.WriteLog("执行完了 pluginMain, 并且没有出错")
+	// logger.Debug("执行完了 pluginMain, 并且没有出错")
 	return nil
 }
 
@@ -273,7 +294,7 @@ func (t *dispatcher) pluginMain(cmdAdd, cmdCheck, cmdDel func(_ *CmdArgs) error,
 // 接受 CNI 命令的处理函数（如 cmdAdd、cmdCheck、cmdDel）和插件支持的 CNI 规范版本信息，
 // 并返回错误（如果有）。调用者需要自行处理非空错误返回。
 func PluginMainWithError(cmdAdd, cmdCheck, cmdDel func(_ *CmdArgs) error, versionInfo version.PluginInfo, about string) *types.Error {
-	// testutils.WriteLog("进入到了 PluginMainWithError")
+	// logger.Debug("进入到了 PluginMainWithError")
 	return (&dispatcher{
 		Getenv: os.Getenv,
 		Stdin:  os.Stdin,
@@ -285,9 +306,9 @@ func PluginMainWithError(cmdAdd, cmdCheck, cmdDel func(_ *CmdArgs) error, versio
 // PluginMain() 函数：插件的核心 "main" 函数，自动处理错误。当 cmdAdd、cmdCheck 或 cmdDel 中出现错误时，
 // PluginMain 会将错误以 JSON 格式打印到标准输出，并调用 os.Exit(1)。 若要对错误处理有更多控制，请使用 PluginMainWithError()。
 func PluginMain(cmdAdd, cmdCheck, cmdDel func(_ *CmdArgs) error, versionInfo version.PluginInfo, about string) {
-	// testutils.WriteLog("进入到了 PluginMain")
+	// logger.Debug("进入到了 PluginMain")
 	if e := PluginMainWithError(cmdAdd, cmdCheck, cmdDel, versionInfo, about); e != nil {
-		// testutils.WriteLog("进入到了 PluginMainWithError 的 error 部分, error: ", e.Error())
+		// logger.Debug("进入到了 PluginMainWithError 的 error 部分", "err", e)
 		if err := e.Print(); err != nil {
 			log.Print("Error writing error JSON to stdout: ", err)
 		}